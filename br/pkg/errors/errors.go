@@ -50,6 +50,9 @@ var (
 	ErrRestoreSchemaNotExists  = errors.Normalize("schema not exists", errors.RFCCodeText("BR:Restore:ErrRestoreSchemaNotExists"))
 	ErrUnsupportedSystemTable  = errors.Normalize("the system table isn't supported for restoring yet", errors.RFCCodeText("BR:Restore:ErrUnsupportedSysTable"))
 
+	// ErrRestoreInsufficientCapacity is raised when the restore would fill the disks of the cluster up.
+	ErrRestoreInsufficientCapacity = errors.Normalize("insufficient capacity of cluster for restore", errors.RFCCodeText("BR:Restore:ErrRestoreInsufficientCapacity"))
+
 	// TODO maybe it belongs to PiTR.
 	ErrRestoreRTsConstrain = errors.Normalize("resolved ts constrain violation", errors.RFCCodeText("BR:Restore:ErrRestoreResolvedTsConstrain"))
 
@@ -36,6 +36,7 @@ import (
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/codec"
 	"github.com/tikv/pd/server/core"
+	"github.com/tikv/pd/server/schedule/labeler"
 	"github.com/tikv/pd/server/schedule/placement"
 	"go.uber.org/atomic"
 )
@@ -272,6 +273,10 @@ func (c *testClient) DeletePlacementRule(ctx context.Context, groupID, ruleID st
 	return nil
 }
 
+func (c *testClient) SetRegionLabelRule(ctx context.Context, rule *labeler.LabelRule) error {
+	return nil
+}
+
 func (c *testClient) SetStoresLabel(ctx context.Context, stores []uint64, labelKey, labelValue string) error {
 	return nil
 }
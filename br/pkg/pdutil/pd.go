@@ -27,6 +27,7 @@ import (
 	"github.com/pingcap/tidb/util/codec"
 	pd "github.com/tikv/pd/client"
 	pdapi "github.com/tikv/pd/server/api"
+	"github.com/tikv/pd/server/config"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
@@ -38,6 +39,7 @@ const (
 	schedulerPrefix      = "pd/api/v1/schedulers"
 	maxMsgSize           = int(128 * units.MiB) // pd.ScanRegion may return a large response
 	scheduleConfigPrefix = "pd/api/v1/config/schedule"
+	replicaConfigPrefix  = "pd/api/v1/config/replicate"
 	pauseTimeout         = 5 * time.Minute
 
 	// pd request retry time when connection fail
@@ -376,6 +378,29 @@ func (p *PdController) getStoreInfoWith(
 	return nil, errors.Trace(err)
 }
 
+// GetMaxReplicas returns the max replicas of the regions, i.e. the max-replicas of the replication config.
+func (p *PdController) GetMaxReplicas(ctx context.Context) (int, error) {
+	return p.getMaxReplicasWith(ctx, pdRequest)
+}
+
+func (p *PdController) getMaxReplicasWith(ctx context.Context, get pdHTTPRequest) (int, error) {
+	var err error
+	for _, addr := range p.addrs {
+		v, e := get(ctx, addr, replicaConfigPrefix, p.cli, http.MethodGet, nil)
+		if e != nil {
+			err = e
+			continue
+		}
+		replication := config.ReplicationConfig{}
+		err = json.Unmarshal(v, &replication)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		return int(replication.MaxReplicas), nil
+	}
+	return 0, errors.Trace(err)
+}
+
 func (p *PdController) doPauseSchedulers(ctx context.Context, schedulers []string, post pdHTTPRequest) ([]string, error) {
 	// pause this scheduler with 300 seconds
 	body, err := json.Marshal(pauseSchedulerBody{Delay: int64(pauseTimeout)})
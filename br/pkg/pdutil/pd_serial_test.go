@@ -21,6 +21,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/tikv/pd/pkg/typeutil"
 	"github.com/tikv/pd/server/api"
+	"github.com/tikv/pd/server/config"
 	"github.com/tikv/pd/server/core"
 	"github.com/tikv/pd/server/statistics"
 )
@@ -234,3 +235,20 @@ func TestStoreInfo(t *testing.T) {
 	require.Equal(t, "Tombstone", resp.Store.StateName)
 	require.Equal(t, uint64(1024), uint64(resp.Status.Available))
 }
+
+func TestMaxReplicas(t *testing.T) {
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		query := fmt.Sprintf("%s/%s", addr, prefix)
+		require.Equal(t, "http://mock/pd/api/v1/config/replicate", query)
+		ret, err := json.Marshal(config.ReplicationConfig{MaxReplicas: 5})
+		require.NoError(t, err)
+		return ret, nil
+	}
+
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	replicas, err := pdController.getMaxReplicasWith(context.Background(), mock)
+	require.NoError(t, err)
+	require.Equal(t, 5, replicas)
+}
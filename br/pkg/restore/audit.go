@@ -0,0 +1,227 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/tablecodec"
+)
+
+// RangeAudit is a merged range and the backup files restored into it.
+type RangeAudit struct {
+	// StartKey and EndKey are the hex encoded raw keys in the keyspace of the restored table,
+	// the end key is the split key between the range and the next one.
+	StartKey string   `json:"start-key"`
+	EndKey   string   `json:"end-key"`
+	Files    []string `json:"files"`
+}
+
+// PhysicalTableAudit is the ranges restored into a physical table, i.e. a partition or
+// a non-partitioned table.
+type PhysicalTableAudit struct {
+	Database      string       `json:"database"`
+	Table         string       `json:"table"`
+	OldPhysicalID int64        `json:"old-physical-id"`
+	NewPhysicalID int64        `json:"new-physical-id"`
+	Ranges        []RangeAudit `json:"ranges"`
+}
+
+// RestoreAudit records which backup files are restored into which ranges, by the physical tables.
+// It only records the merged ranges and never changes them.
+type RestoreAudit struct {
+	mu     sync.Mutex
+	tables []PhysicalTableAudit
+	// backupRanges are the merged ranges in the keyspace of the backup, by the old physical IDs.
+	backupRanges map[int64][]rtree.Range
+	// splitKeys are the split keys planned, in the keyspace of the restored tables.
+	splitKeys [][]byte
+}
+
+// NewRestoreAudit returns an empty audit.
+func NewRestoreAudit() *RestoreAudit {
+	return &RestoreAudit{backupRanges: make(map[int64][]rtree.Range)}
+}
+
+// Record records the merged ranges of the table, it's safe to be called concurrently.
+func (a *RestoreAudit) Record(t TableWithRange) error {
+	ranges, err := SortRanges(t.Range, t.RewriteRule)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tables := make([]PhysicalTableAudit, 0)
+	for _, rg := range ranges {
+		newID := tablecodec.DecodeTableID(rg.StartKey)
+		if len(tables) == 0 || tables[len(tables)-1].NewPhysicalID != newID {
+			table := PhysicalTableAudit{
+				Database:      t.OldTable.DB.Name.O,
+				Table:         t.Table.Name.O,
+				NewPhysicalID: newID,
+			}
+			if len(rg.Files) > 0 {
+				table.OldPhysicalID = tablecodec.DecodeTableID(rg.Files[0].GetStartKey())
+			}
+			tables = append(tables, table)
+		}
+		files := make([]string, 0, len(rg.Files))
+		for _, file := range rg.Files {
+			files = append(files, file.GetName())
+		}
+		table := &tables[len(tables)-1]
+		table.Ranges = append(table.Ranges, RangeAudit{
+			StartKey: hex.EncodeToString(rg.StartKey),
+			EndKey:   hex.EncodeToString(rg.EndKey),
+			Files:    files,
+		})
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tables = append(a.tables, tables...)
+	for _, rg := range t.Range {
+		oldID := tablecodec.DecodeTableID(rg.StartKey)
+		a.backupRanges[oldID] = append(a.backupRanges[oldID], rg)
+	}
+	return nil
+}
+
+// RecordSplitKeys records the split keys planned in the keyspace of the restored tables,
+// e.g. by Client.SetSplitKeysCallback, it's safe to be called concurrently.
+func (a *RestoreAudit) RecordSplitKeys(keys [][]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		a.splitKeys = append(a.splitKeys, append([]byte{}, key...))
+	}
+}
+
+// Tables returns the recorded physical tables sorted by the new physical IDs.
+func (a *RestoreAudit) Tables() []PhysicalTableAudit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tables := append([]PhysicalTableAudit{}, a.tables...)
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i].NewPhysicalID < tables[j].NewPhysicalID
+	})
+	return tables
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a *RestoreAudit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Tables []PhysicalTableAudit `json:"tables"`
+	}{Tables: a.Tables()})
+}
+
+// Hash returns the SHA-256 of the recorded ranges and files, and the split keys in hex, so two
+// restores can be proven to have restored the same files into the same ranges. It's computed in
+// the keyspace of the backup, i.e. by the old physical IDs and the keys of the backup, with the
+// split keys rewritten back by the recorded tables, so it's independent of the IDs the tables are
+// created with, and of the order of recording. The split keys outside the recorded tables, e.g. the
+// prefix of a table not restored, are hashed as they are.
+func (a *RestoreAudit) Hash() string {
+	oldIDs := make(map[int64]int64)
+	for _, table := range a.Tables() {
+		oldIDs[table.NewPhysicalID] = table.OldPhysicalID
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h := newPlanHasher()
+	tableIDs := make([]int64, 0, len(a.backupRanges))
+	for id := range a.backupRanges {
+		tableIDs = append(tableIDs, id)
+	}
+	sort.Slice(tableIDs, func(i, j int) bool { return tableIDs[i] < tableIDs[j] })
+	h.writeInt(int64(len(tableIDs)))
+	for _, id := range tableIDs {
+		ranges := append([]rtree.Range{}, a.backupRanges[id]...)
+		sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0 })
+		h.writeInt(id)
+		h.writeRanges(ranges)
+	}
+	h.writeSplitKeys(a.splitKeys, oldIDs)
+	return h.sum()
+}
+
+// backupKeyOf rewrites the key back into the keyspace of the backup, by the old physical IDs of
+// the new ones. The key of other tables is returned as it is.
+func backupKeyOf(key []byte, oldIDs map[int64]int64) []byte {
+	newID := tablecodec.DecodeTableID(key)
+	prefix := tablecodec.EncodeTablePrefix(newID)
+	oldID, ok := oldIDs[newID]
+	if !ok || !bytes.HasPrefix(key, prefix) {
+		return key
+	}
+	return append(tablecodec.EncodeTablePrefix(oldID), key[len(prefix):]...)
+}
+
+// planHasher writes the fields of a plan into a SHA-256 digest. Every field is
+// length prefixed, so different plans never collide by concatenating the fields.
+type planHasher struct {
+	h hash.Hash
+}
+
+func newPlanHasher() planHasher {
+	return planHasher{h: sha256.New()}
+}
+
+func (p planHasher) writeInt(v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	_, _ = p.h.Write(buf[:])
+}
+
+func (p planHasher) writeBytes(b []byte) {
+	p.writeInt(int64(len(b)))
+	_, _ = p.h.Write(b)
+}
+
+func (p planHasher) writeString(s string) {
+	p.writeBytes([]byte(s))
+}
+
+// writeRanges writes the keys and the names of the files of the ranges.
+func (p planHasher) writeRanges(ranges []rtree.Range) {
+	p.writeInt(int64(len(ranges)))
+	for _, rg := range ranges {
+		p.writeBytes(rg.StartKey)
+		p.writeBytes(rg.EndKey)
+		p.writeInt(int64(len(rg.Files)))
+		for _, file := range rg.Files {
+			p.writeString(file.GetName())
+		}
+	}
+}
+
+// writeSplitKeys writes the split keys rewritten back into the keyspace of the backup, sorted
+// and deduplicated, as the split keys of different batches may meet at the same key.
+func (p planHasher) writeSplitKeys(keys [][]byte, oldIDs map[int64]int64) {
+	backupKeys := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		backupKeys = append(backupKeys, backupKeyOf(key, oldIDs))
+	}
+	sort.Slice(backupKeys, func(i, j int) bool { return bytes.Compare(backupKeys[i], backupKeys[j]) < 0 })
+	deduped := backupKeys[:0]
+	for _, key := range backupKeys {
+		if len(deduped) == 0 || !bytes.Equal(key, deduped[len(deduped)-1]) {
+			deduped = append(deduped, key)
+		}
+	}
+	p.writeInt(int64(len(deduped)))
+	for _, key := range deduped {
+		p.writeBytes(key)
+	}
+}
+
+func (p planHasher) sum() string {
+	return hex.EncodeToString(p.h.Sum(nil))
+}
@@ -3,7 +3,9 @@
 package restore
 
 import (
+	"bytes"
 	"context"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,6 +14,7 @@ import (
 	backuppb "github.com/pingcap/kvproto/pkg/brpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/tablecodec"
 	"go.uber.org/zap"
 )
 
@@ -54,6 +57,15 @@ type Batcher struct {
 	manager            ContextManager
 	batchSizeThreshold int
 	size               int32
+	// noCrossTableBatch makes a batch never contain the ranges of more than one table.
+	noCrossTableBatch bool
+	// reverseSubmission makes the ranges of every batch submitted in the descending order, for testing only.
+	reverseSubmission bool
+	// descendingTables are the physical IDs in the backup of the tables whose ranges are batched
+	// from the high end.
+	descendingTables map[int64]struct{}
+	// sink emits the tables without any range left on closing, which are never sent as a batch.
+	sink TableSink
 }
 
 // Len calculate the current size of this batcher.
@@ -121,6 +133,7 @@ func NewBatcher(
 	restoredTables := make(chan []CreatedTable, defaultChannelSize)
 	go b.contextCleaner(ctx, restoredTables)
 	sink := chanTableSink{restoredTables, errCh}
+	b.sink = sink
 	sender.PutSink(sink)
 	return b, output
 }
@@ -178,6 +191,7 @@ func (b *Batcher) sendWorker(ctx context.Context, send <-chan SendType) {
 			sendUntil(0)
 		case SendAllThenClose:
 			sendUntil(0)
+			b.sendBlankTables(ctx)
 			b.sender.Close()
 			b.everythingIsDone.Done()
 			return
@@ -268,6 +282,12 @@ func (b *Batcher) drainRanges() DrainResult {
 		thisTableLen := len(thisTable.Range)
 		collected := len(result.Ranges)
 
+		// tables without ranges can still be sent with the batch, they won't make it span tables.
+		if b.noCrossTableBatch && collected > 0 && thisTableLen > 0 {
+			b.cachedTables = b.cachedTables[offset:]
+			return result
+		}
+
 		result.RewriteRules.Append(*thisTable.RewriteRule)
 		result.TablesToSend = append(result.TablesToSend, thisTable.CreatedTable)
 
@@ -310,6 +330,29 @@ func (b *Batcher) drainRanges() DrainResult {
 	return result
 }
 
+// sendBlankTables emits the tables left after all ranges are sent, i.e. the tables without any range
+// added after the last batch, e.g. an empty table restored last. They are emitted directly instead of
+// as an empty batch, so there is no split key nor file group for them. They still enter and leave the
+// context of the manager like the other tables.
+func (b *Batcher) sendBlankTables(ctx context.Context) {
+	b.cachedTablesMu.Lock()
+	tables := make([]CreatedTable, 0, len(b.cachedTables))
+	for _, t := range b.cachedTables {
+		tables = append(tables, t.CreatedTable)
+	}
+	b.cachedTables = []TableWithRange{}
+	b.cachedTablesMu.Unlock()
+	if len(tables) == 0 {
+		return
+	}
+	log.Info("send the tables without ranges lastly", ZapTables(tables))
+	if err := b.manager.Enter(ctx, tables); err != nil {
+		b.sendErr <- err
+		return
+	}
+	b.sink.EmitTables(tables...)
+}
+
 // Send sends all pending requests in the batcher.
 // returns tables sent FULLY in the current batch.
 func (b *Batcher) Send(ctx context.Context) {
@@ -320,6 +363,9 @@ func (b *Batcher) Send(ctx context.Context) {
 	}
 
 	drainResult := b.drainRanges()
+	if b.reverseSubmission {
+		reverseRanges(drainResult.Ranges)
+	}
 	tbs := drainResult.TablesToSend
 	ranges := drainResult.Ranges
 	log.Info("restore batch start", rtree.ZapRanges(ranges), ZapTables(tbs))
@@ -349,6 +395,9 @@ func (b *Batcher) Add(tbs TableWithRange) {
 		zap.Int("table size", len(tbs.Range)),
 		zap.Int("batch size", b.Len()),
 	)
+	if len(b.descendingTables) > 0 {
+		tbs.Range = descendTableRanges(tbs.Range, b.descendingTables)
+	}
 	b.cachedTables = append(b.cachedTables, tbs)
 	b.rewriteRules.Append(*tbs.RewriteRule)
 	atomic.AddInt32(&b.size, int32(len(tbs.Range)))
@@ -366,6 +415,68 @@ func (b *Batcher) Close() {
 	close(b.sendCh)
 }
 
+// DisableCrossTableBatch makes every batch contain the ranges of one table at most.
+// note this function isn't goroutine safe yet, just call it before anything starts, please.
+func (b *Batcher) DisableCrossTableBatch() {
+	b.noCrossTableBatch = true
+}
+
+// EnableReverseSubmission makes the ranges of every batch, and so the files of them,
+// submitted to the sender in the descending order of keys. It's for testing only:
+// it helps to find out whether something depends on the order of tables, the keys
+// to split are still sorted by the sender.
+// note this function isn't goroutine safe yet, just call it before anything starts, please.
+func (b *Batcher) EnableReverseSubmission() {
+	b.reverseSubmission = true
+}
+
+// SetDescendingTables makes the ranges of the tables batched descending by their start keys, so the
+// batches of a table spanning several batches are sent from its high end. The tables are the physical
+// tables in the backup, i.e. the old IDs of the tables and the partitions.
+// note this function isn't goroutine safe yet, just call it before anything starts, please.
+func (b *Batcher) SetDescendingTables(tableIDs []int64) {
+	b.descendingTables = make(map[int64]struct{}, len(tableIDs))
+	for _, id := range tableIDs {
+		b.descendingTables[id] = struct{}{}
+	}
+}
+
+// descendTableRanges returns the ranges with the ranges of every table in tables reordered descending
+// by their start keys, in place of the ranges of the table, the ranges of other tables are left where
+// they are. The ranges passed in are never modified.
+func descendTableRanges(ranges []rtree.Range, tables map[int64]struct{}) []rtree.Range {
+	positions := make(map[int64][]int)
+	for i, rg := range ranges {
+		tableID := tablecodec.DecodeTableID(rg.StartKey)
+		if _, ok := tables[tableID]; ok {
+			positions[tableID] = append(positions[tableID], i)
+		}
+	}
+	if len(positions) == 0 {
+		return ranges
+	}
+	reordered := append([]rtree.Range(nil), ranges...)
+	for _, idx := range positions {
+		tableRanges := make([]rtree.Range, 0, len(idx))
+		for _, i := range idx {
+			tableRanges = append(tableRanges, ranges[i])
+		}
+		sort.SliceStable(tableRanges, func(i, j int) bool {
+			return bytes.Compare(tableRanges[i].StartKey, tableRanges[j].StartKey) > 0
+		})
+		for k, i := range idx {
+			reordered[i] = tableRanges[k]
+		}
+	}
+	return reordered
+}
+
+func reverseRanges(ranges []rtree.Range) {
+	for i, j := 0, len(ranges)-1; i < j; i, j = i+1, j-1 {
+		ranges[i], ranges[j] = ranges[j], ranges[i]
+	}
+}
+
 // SetThreshold sets the threshold that how big the batch size reaching need to send batch.
 // note this function isn't goroutine safe yet,
 // just set threshold before anything starts(e.g. EnableAutoCommit), please.
@@ -5,6 +5,7 @@ package restore_test
 import (
 	"bytes"
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,7 +16,9 @@ import (
 	"github.com/pingcap/tidb/br/pkg/metautil"
 	"github.com/pingcap/tidb/br/pkg/restore"
 	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/parser/model"
+	"github.com/pingcap/tidb/tablecodec"
 	"go.uber.org/zap"
 )
 
@@ -153,6 +156,123 @@ func (sender *drySender) BatchCount() int {
 
 var _ = Suite(&testBatcherSuite{})
 
+// blockingManager blocks entering until released, and records the entered tables.
+type blockingManager struct {
+	release chan struct{}
+	failOn  int64
+
+	mu      sync.Mutex
+	entered [][]int64
+	closed  int
+}
+
+func (manager *blockingManager) Enter(ctx context.Context, tables []restore.CreatedTable) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-manager.release:
+	}
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	ids := make([]int64, 0, len(tables))
+	for _, t := range tables {
+		if t.Table.ID == manager.failOn {
+			return errors.Errorf("failed to prepare table %d", t.Table.ID)
+		}
+		ids = append(ids, t.Table.ID)
+	}
+	manager.entered = append(manager.entered, ids)
+	return nil
+}
+
+func (manager *blockingManager) Leave(context.Context, []restore.CreatedTable) error {
+	return nil
+}
+
+func (manager *blockingManager) Close(context.Context) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.closed++
+}
+
+func (s *testBatcherSuite) TestPrepareAheadContextManager(c *C) {
+	ctx := context.Background()
+	inner := &blockingManager{release: make(chan struct{})}
+	manager := restore.NewPrepareAheadContextManager(inner)
+	tables := []restore.CreatedTable{
+		fakeTableWithRange(1, nil).CreatedTable,
+		fakeTableWithRange(2, nil).CreatedTable,
+		fakeTableWithRange(3, nil).CreatedTable,
+	}
+	inCh := make(chan restore.CreatedTable, len(tables))
+	inCh <- tables[0]
+	inCh <- tables[1]
+	close(inCh)
+
+	// the tables are passed through while preparing them is blocked.
+	outCh := manager.GoPrepare(ctx, inCh)
+	for i := 0; i < 2; i++ {
+		select {
+		case t := <-outCh:
+			c.Assert(t.Table.ID, Equals, tables[i].Table.ID)
+		case <-time.After(time.Second):
+			c.Fatal("the tables are blocked by preparing")
+		}
+	}
+
+	// entering joins the preparing.
+	entered := make(chan error, 1)
+	go func() {
+		entered <- manager.Enter(ctx, tables[:2])
+	}()
+	select {
+	case <-entered:
+		c.Fatal("entered before the tables are prepared")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(inner.release)
+	c.Assert(<-entered, IsNil)
+	c.Assert(inner.entered, DeepEquals, [][]int64{{1}, {2}})
+
+	// the tables not prepared ahead are prepared on entering.
+	c.Assert(manager.Enter(ctx, tables), IsNil)
+	c.Assert(inner.entered, DeepEquals, [][]int64{{1}, {2}, {3}})
+	c.Assert(manager.Leave(ctx, tables), IsNil)
+
+	manager.Close(ctx)
+	manager.Close(ctx)
+	c.Assert(inner.closed, Equals, 1)
+}
+
+func (s *testBatcherSuite) TestPrepareAheadContextManagerError(c *C) {
+	ctx := context.Background()
+	inner := &blockingManager{release: make(chan struct{}), failOn: 2}
+	close(inner.release)
+	manager := restore.NewPrepareAheadContextManager(inner)
+	tables := []restore.CreatedTable{
+		fakeTableWithRange(1, nil).CreatedTable,
+		fakeTableWithRange(2, nil).CreatedTable,
+	}
+	inCh := make(chan restore.CreatedTable, len(tables))
+	for _, t := range tables {
+		inCh <- t
+	}
+	close(inCh)
+	for range manager.GoPrepare(ctx, inCh) {
+	}
+	c.Assert(manager.Enter(ctx, tables), ErrorMatches, "failed to prepare table 2")
+
+	// closing stops the preparing blocked.
+	inner = &blockingManager{release: make(chan struct{})}
+	manager = restore.NewPrepareAheadContextManager(inner)
+	inCh = make(chan restore.CreatedTable, 1)
+	inCh <- tables[0]
+	<-manager.GoPrepare(ctx, inCh)
+	manager.Close(ctx)
+	c.Assert(inner.entered, HasLen, 0)
+	c.Assert(inner.closed, Equals, 1)
+}
+
 func fakeTableWithRange(id int64, rngs []rtree.Range) restore.TableWithRange {
 	tbl := &metautil.Table{
 		DB: &model.DBInfo{},
@@ -385,3 +505,294 @@ func (*testBatcherSuite) TestBatcherLen(c *C) {
 	default:
 	}
 }
+
+type recordDrainSender struct {
+	mu      sync.Mutex
+	results []restore.DrainResult
+	sink    restore.TableSink
+}
+
+func (sender *recordDrainSender) PutSink(sink restore.TableSink) {
+	sender.sink = sink
+}
+
+func (sender *recordDrainSender) RestoreBatch(result restore.DrainResult) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.results = append(sender.results, result)
+	sender.sink.EmitTables(result.BlankTablesAfterSend...)
+}
+
+func (sender *recordDrainSender) Close() {
+	sender.sink.Close()
+}
+
+// TestEmptyTablesBetweenTables tests the ranges are always sent with the table they belong to,
+// even if there are tables without any range between them.
+func (*testBatcherSuite) TestEmptyTablesBetweenTables(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := &recordDrainSender{}
+	manager := newMockManager()
+	batcher, _ := restore.NewBatcher(ctx, sender, manager, errCh)
+	batcher.SetThreshold(2)
+
+	tableRanges := [][]rtree.Range{
+		{fakeRange("t1a", "t1b"), fakeRange("t1c", "t1d")},
+		{},
+		{fakeRange("t3a", "t3b")},
+		{},
+		{},
+		{fakeRange("t6a", "t6b"), fakeRange("t6c", "t6d"), fakeRange("t6e", "t6f")},
+		{},
+	}
+	for i, ranges := range tableRanges {
+		batcher.Add(fakeTableWithRange(int64(i+1), ranges))
+	}
+	batcher.Close()
+
+	sent := make(map[int64]int)
+	done := make(map[int64]bool)
+	for _, result := range sender.results {
+		sending := make(map[int64]bool)
+		for _, t := range result.TablesToSend {
+			c.Assert(done[t.Table.ID], IsFalse, Commentf("table %d is sent after done", t.Table.ID))
+			sending[t.Table.ID] = true
+		}
+		for _, rg := range result.Ranges {
+			id := int64(rg.StartKey[1] - '0')
+			c.Assert(sending[id], IsTrue, Commentf("range %s is sent without its table", rg.StartKey))
+			sent[id]++
+		}
+		for _, t := range result.BlankTablesAfterSend {
+			c.Assert(sending[t.Table.ID], IsTrue)
+			c.Assert(sent[t.Table.ID], Equals, len(tableRanges[t.Table.ID-1]))
+			done[t.Table.ID] = true
+		}
+	}
+	c.Assert(done, HasLen, len(tableRanges))
+	select {
+	case err := <-errCh:
+		c.Fatal(errors.Trace(err))
+	default:
+	}
+}
+
+// recordSplitClient records all keys used to split regions.
+type recordSplitClient struct {
+	*TestClient
+	mu        sync.Mutex
+	splitKeys [][]byte
+}
+
+func (c *recordSplitClient) BatchSplitRegions(
+	ctx context.Context, regionInfo *restore.RegionInfo, keys [][]byte,
+) ([]*restore.RegionInfo, error) {
+	c.mu.Lock()
+	c.splitKeys = append(c.splitKeys, keys...)
+	c.mu.Unlock()
+	return c.TestClient.BatchSplitRegions(ctx, regionInfo, keys)
+}
+
+// splitSender splits the ranges of every batch, and records the tables having ranges in every batch.
+type splitSender struct {
+	splitter *restore.RegionSplitter
+	batches  [][]int64
+	errCh    chan<- error
+	sink     restore.TableSink
+}
+
+func (sender *splitSender) PutSink(sink restore.TableSink) {
+	sender.sink = sink
+}
+
+func (sender *splitSender) RestoreBatch(result restore.DrainResult) {
+	tables := []int64{}
+	for _, rg := range result.Ranges {
+		tableID := tablecodec.DecodeTableID(rg.StartKey)
+		if len(tables) == 0 || tables[len(tables)-1] != tableID {
+			tables = append(tables, tableID)
+		}
+	}
+	sender.batches = append(sender.batches, tables)
+	if err := sender.splitter.Split(context.Background(), result.Ranges, result.RewriteRules, func([][]byte) {}); err != nil {
+		sender.errCh <- err
+	}
+	sender.sink.EmitTables(result.BlankTablesAfterSend...)
+}
+
+func (sender *splitSender) Close() {
+	sender.sink.Close()
+}
+
+// TestCrossTableBatchAndTableBoundarySplit tests that disabling cross-table batch and
+// splitting on table boundary work independently.
+func (*testBatcherSuite) TestCrossTableBatchAndTableBoundarySplit(c *C) {
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	cases := []struct {
+		noCrossTableBatch    bool
+		splitOnTableBoundary bool
+		batches              [][]int64
+		boundaryKeys         [][]byte
+	}{
+		{false, false, [][]int64{{1, 2, 3}}, nil},
+		{false, true, [][]int64{{1, 2, 3}}, [][]byte{tablecodec.EncodeTablePrefix(2), tablecodec.EncodeTablePrefix(3)}},
+		{true, false, [][]int64{{1}, {2}, {3}}, nil},
+		{true, true, [][]int64{{1}, {2}, {3}}, nil},
+	}
+	for _, cs := range cases {
+		ctx := context.Background()
+		errCh := make(chan error, 8)
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		if cs.splitOnTableBoundary {
+			splitter.EnableSplitOnTableBoundary()
+		}
+		sender := &splitSender{splitter: splitter, errCh: errCh}
+		batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+		batcher.SetThreshold(10)
+		if cs.noCrossTableBatch {
+			batcher.DisableCrossTableBatch()
+		}
+
+		var rangeEnds [][]byte
+		for id := int64(1); id <= 3; id++ {
+			ranges := []rtree.Range{
+				{StartKey: rowKey(id, 0), EndKey: rowKey(id, 10)},
+				{StartKey: rowKey(id, 10), EndKey: rowKey(id, 20)},
+			}
+			rangeEnds = append(rangeEnds, ranges[0].EndKey, ranges[1].EndKey)
+			batcher.Add(fakeTableWithRange(id, ranges))
+			// an empty table never makes a batch span tables.
+			batcher.Add(fakeTableWithRange(id+100, []rtree.Range{}))
+		}
+		batcher.Close()
+
+		comment := Commentf("case %+v", cs)
+		c.Assert(errCh, HasLen, 0, comment)
+		c.Assert(sender.batches, DeepEquals, cs.batches, comment)
+		expected := append(append([][]byte{}, rangeEnds...), cs.boundaryKeys...)
+		c.Assert(client.splitKeys, HasLen, len(expected), comment)
+		for _, key := range expected {
+			found := false
+			for _, splitKey := range client.splitKeys {
+				found = found || bytes.Equal(splitKey, key)
+			}
+			c.Assert(found, IsTrue, comment)
+		}
+	}
+}
+
+// TestTrailingEmptyTable tests that an empty table added after the last batch is sent
+// finishes on closing, without an empty batch nor a spurious split key.
+func (*testBatcherSuite) TestTrailingEmptyTable(c *C) {
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.EnableSplitOnTableBoundary()
+	sender := &splitSender{splitter: splitter, errCh: errCh}
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(10)
+
+	for id := int64(1); id <= 2; id++ {
+		batcher.Add(fakeTableWithRange(id, []rtree.Range{{StartKey: rowKey(id, 0), EndKey: rowKey(id, 10)}}))
+	}
+	// flush the batch, like the auto commit, before the last table is added.
+	batcher.Send(ctx)
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{}))
+	c.Assert(batcher.Len(), Equals, 0)
+	batcher.Close()
+
+	select {
+	case err := <-errCh:
+		c.Fatal(errors.Trace(err))
+	default:
+	}
+	c.Assert(sender.batches, DeepEquals, [][]int64{{1, 2}})
+	sort.Slice(client.splitKeys, func(i, j int) bool {
+		return bytes.Compare(client.splitKeys[i], client.splitKeys[j]) < 0
+	})
+	c.Assert(client.splitKeys, DeepEquals, [][]byte{rowKey(1, 10), tablecodec.EncodeTablePrefix(2), rowKey(2, 10)})
+	done := make([]int64, 0)
+	for t := range outCh {
+		done = append(done, t.Table.ID)
+	}
+	c.Assert(done, DeepEquals, []int64{1, 2, 3})
+}
+
+// TestReverseSubmission tests that reversing the submission order doesn't change the split keys.
+func (*testBatcherSuite) TestReverseSubmission(c *C) {
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	restoreTables := func(reverse bool) ([][]int64, [][]byte) {
+		errCh := make(chan error, 8)
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		splitter.EnableSplitOnTableBoundary()
+		sender := &splitSender{splitter: splitter, errCh: errCh}
+		batcher, _ := restore.NewBatcher(context.Background(), sender, newMockManager(), errCh)
+		batcher.SetThreshold(10)
+		if reverse {
+			batcher.EnableReverseSubmission()
+		}
+		for id := int64(1); id <= 3; id++ {
+			batcher.Add(fakeTableWithRange(id, []rtree.Range{
+				{StartKey: rowKey(id, 0), EndKey: rowKey(id, 10)},
+				{StartKey: rowKey(id, 10), EndKey: rowKey(id, 20)},
+			}))
+		}
+		batcher.Close()
+		c.Assert(errCh, HasLen, 0)
+		// regions are split concurrently, so sort the keys.
+		sort.Slice(client.splitKeys, func(i, j int) bool {
+			return bytes.Compare(client.splitKeys[i], client.splitKeys[j]) < 0
+		})
+		return sender.batches, client.splitKeys
+	}
+
+	batches, splitKeys := restoreTables(false)
+	reversedBatches, reversedSplitKeys := restoreTables(true)
+	c.Assert(batches, DeepEquals, [][]int64{{1, 2, 3}})
+	c.Assert(reversedBatches, DeepEquals, [][]int64{{3, 2, 1}})
+	c.Assert(reversedSplitKeys, DeepEquals, splitKeys)
+}
+
+// TestDescendingTables tests the ranges of a descending table spanning several batches are batched
+// from its high end, and the ranges of other tables stay ascending.
+func (*testBatcherSuite) TestDescendingTables(c *C) {
+	rowRange := func(tableID, handle int64) rtree.Range {
+		return rtree.Range{
+			StartKey: tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle)),
+			EndKey:   tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle+1)),
+		}
+	}
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _ := restore.NewBatcher(context.Background(), sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+	batcher.SetDescendingTables([]int64{2})
+
+	ascending := fakeTableWithRange(1, []rtree.Range{rowRange(1, 0), rowRange(1, 1)})
+	descending := fakeTableWithRange(2, []rtree.Range{
+		rowRange(2, 0), rowRange(2, 1), rowRange(2, 2), rowRange(2, 3), rowRange(2, 4),
+	})
+	batcher.Add(ascending)
+	batcher.Add(descending)
+	batcher.Close()
+	c.Assert(errCh, HasLen, 0)
+
+	c.Assert(sender.BatchCount(), Equals, 4)
+	c.Assert(sender.Ranges(), DeepEquals, []rtree.Range{
+		rowRange(1, 0), rowRange(1, 1),
+		rowRange(2, 4), rowRange(2, 3), rowRange(2, 2), rowRange(2, 1), rowRange(2, 0),
+	})
+	// the ranges added are left as they are.
+	c.Assert(descending.Range[0], DeepEquals, rowRange(2, 0))
+}
@@ -41,18 +41,29 @@ import (
 	"github.com/tikv/client-go/v2/oracle"
 	pd "github.com/tikv/pd/client"
 	"github.com/tikv/pd/server/schedule/placement"
+	"go.uber.org/atomic"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 // defaultChecksumConcurrency is the default number of the concurrent
 // checksum tasks.
 const defaultChecksumConcurrency = 64
 
+// tiFlashReplicaCheckInterval is the interval of checking whether the
+// TiFlash replicas of the restored tables are available.
+const tiFlashReplicaCheckInterval = 3 * time.Second
+
+// restoreFilesRetryMaxInterval is the max backoff of retrying the unfinished files.
+const restoreFilesRetryMaxInterval = 30 * time.Second
+
 // Client sends requests to restore files.
 type Client struct {
 	pdClient      pd.Client
@@ -61,6 +72,8 @@ type Client struct {
 	workerPool    *utils.WorkerPool
 	tlsConf       *tls.Config
 	keepaliveConf keepalive.ClientParameters
+	// pdHTTPDisabled makes the split clients work in gRPC-only mode.
+	pdHTTPDisabled bool
 
 	databases  map[string]*utils.Database
 	ddlJobs    []*model.Job
@@ -81,12 +94,125 @@ type Client struct {
 	hasSpeedLimited bool
 
 	restoreStores []uint64
+	// keepPlacementRules makes the placement rules of restored tables kept after restore, for debugging only.
+	keepPlacementRules bool
+	// skipMatchedPlacementRules makes the tables whose placement rules already match skipped on setting up.
+	skipMatchedPlacementRules bool
+	// placementRuleResetErrs are the errors of resetting the placement rules, which don't fail the restore.
+	placementRuleResetMu   sync.Mutex
+	placementRuleResetErrs []error
 
 	cipher             *backuppb.CipherInfo
 	storage            storage.ExternalStorage
 	backend            *backuppb.StorageBackend
 	switchModeInterval time.Duration
 	switchCh           chan struct{}
+	scatterWaitTimeout time.Duration
+	validateSplitKeys  bool
+	splitOnTable       bool
+	skipTailSplitKey   bool
+	splitOnTableStart  bool
+	// splitBatchDelay and splitBatchJitter pace the split requests of the regions.
+	splitBatchDelay  time.Duration
+	splitBatchJitter time.Duration
+	// splitOrder is the order of submitting the batches of split keys.
+	splitOrder SplitOrder
+	// restoreJobID labels the regions created by splitting, empty means no labeling.
+	restoreJobID string
+	// labeledRanges are the key ranges of the regions labeled across the splits of the restore.
+	labeledRanges *labeledRanges
+	// splitPacer adapts the delay between the split requests to the latency of them, nil means disabled.
+	splitPacer *SplitPacer
+	// regionTemplate is the externally managed boundaries of the regions to split at, if set.
+	regionTemplate [][]byte
+	// keyComparator sorts and validates the split keys, nil means bytewise.
+	keyComparator KeyComparator
+	// ingestThrottle limits the in-flight ingests by the disk usage of stores, nil means unlimited.
+	ingestThrottle *IngestThrottle
+	// capacitySource and maxCapacityFill check the cluster has the capacity for the restore,
+	// nil capacitySource means unchecked.
+	capacitySource  ClusterCapacitySource
+	maxCapacityFill float64
+	// regionCountSource checks the regions split by the restore don't exceed the limit, nil means unchecked.
+	regionCountSource RegionCountSource
+	// compactionTrigger and compactionScope compact the restored tables after restore,
+	// nil compactionTrigger means no compaction.
+	compactionTrigger CompactionTrigger
+	compactionScope   CompactionScope
+	// rangeWarmer and preWarmCfg read the samples of the restored tables after restore,
+	// nil rangeWarmer means no pre-warming.
+	rangeWarmer RangeWarmer
+	preWarmCfg  PreWarmConfig
+	// tableLimiter limits the count of the tables restored concurrently, nil means unlimited.
+	tableLimiter *tableLimiter
+	// prevalidatePlan inspects the restore plan before executing it, nil means no inspection.
+	prevalidatePlan PrevalidatePlanFunc
+	// descendingTables are the physical IDs in the backup of the tables whose groups of files
+	// are submitted in descending key order.
+	descendingTables map[int64]struct{}
+	// cfGroupOrder is the order of the CFs in which RestoreFiles restores the files, empty means all at once.
+	cfGroupOrder []string
+	// bandwidthLimiter limits the total bytes of ingesting per second across all tables, nil means unlimited.
+	bandwidthLimiter *BandwidthLimiter
+	// bytesLimiter limits the total bytes of the groups of files in flight, nil means unlimited.
+	bytesLimiter *bytesLimiter
+	// splitKeys is the count of the keys used to split regions.
+	splitKeys atomic.Int64
+	// restoredFiles is the count of the files restored by RestoreFiles.
+	restoredFiles atomic.Int64
+	// fileVerifier verifies the sample of the rate of the files before importing, nil means no verifying.
+	fileVerifier     FileVerifier
+	verifySampleRate float64
+	// verifyTokens bounds the count of the files verified concurrently.
+	verifyTokens chan struct{}
+	// verifiedFileNames are the names of the sampled files verified, so a file is verified once on retrying.
+	verifiedFileNames sync.Map
+	// verifiedFiles and mismatchedFiles are the count of the sampled files verified and mismatched.
+	verifiedFiles   atomic.Int64
+	mismatchedFiles atomic.Int64
+	// minRegions is the count of regions every table must be split into at least, 0 means unlimited.
+	// tableSplitKeys counts the split keys of every table across the splits of the restore for it.
+	minRegions     int
+	tableSplitKeys *tableSplitKeyCounter
+	// regionMaxSize is the size of files above which a range is split inside, 0 means disabled.
+	regionMaxSize uint64
+	// minSplitKeyDistance is the distance to the previous split key below which a split key is skipped.
+	minSplitKeyDistance uint64
+	// keptSplitKeys are the split keys kept by minSplitKeyDistance across the splits of the restore.
+	keptSplitKeys *keptSplitKeys
+	// tailSplit splits the tails of the restored tables with sequential int handles finer, 0 keys means disabled.
+	tailSplit TailSplitConfig
+	// injectedSplitKeys is the count of the split keys injected for minRegions and regionMaxSize.
+	injectedSplitKeys atomic.Int64
+	// summaryPrefix is the namespace of the summary units collected by restore.
+	summaryPrefix string
+	// tableTimingCallback is called with the time span of each table after restoring files.
+	tableTimingCallback func(TableRestoreTiming)
+	// fileIngestCallback is called with every file once it is ingested by RestoreFiles.
+	fileIngestCallback func(FileIngestResult)
+	// splitKeysCallback is called with the split keys planned for every split.
+	splitKeysCallback func(keys [][]byte)
+	// dropLastTableFiles makes RestoreFiles skip the files of the last table and fail, for fault injection.
+	dropLastTableFiles bool
+	// downloadNameRewriter rewrites the names of the files to download.
+	downloadNameRewriter func(name string) string
+	// downloadRetry and ingestRetry are the retry budgets of the file importer.
+	downloadRetry ImportRetryConfig
+	ingestRetry   ImportRetryConfig
+	// cfIngestOrder is the order of ingesting the files of the CFs into a region, empty means at once.
+	cfIngestOrder []string
+	// cutFileRange makes the importer download only the keys of the files inside their keys.
+	cutFileRange bool
+	// pauser halts submitting files to restore while the restore is paused.
+	pauser pauser
+	// timeBudget stops submitting files to restore once the deadline passes.
+	timeBudget timeBudget
+	// restoreFilesRetryTimes is how many times RestoreFiles retries the unfinished files
+	// on a transient error, restoreFilesRetryInterval is the backoff of the first retry.
+	restoreFilesRetryTimes    int
+	restoreFilesRetryInterval time.Duration
+	// ingestETA estimates the time remaining of ingesting by the finished files, nil means disabled.
+	ingestETA *IngestETATracker
 
 	// statHandler and dom are used for analyze table after restore.
 	// it will backup stats with #dump.DumpStatsToJSON
@@ -119,14 +245,15 @@ func NewRestoreClient(
 	}
 
 	return &Client{
-		pdClient:      pdClient,
-		toolClient:    NewSplitClient(pdClient, tlsConf),
-		db:            db,
-		tlsConf:       tlsConf,
-		keepaliveConf: keepaliveConf,
-		switchCh:      make(chan struct{}),
-		dom:           dom,
-		statsHandler:  statsHandle,
+		pdClient:           pdClient,
+		toolClient:         NewSplitClient(pdClient, tlsConf),
+		db:                 db,
+		tlsConf:            tlsConf,
+		keepaliveConf:      keepaliveConf,
+		switchCh:           make(chan struct{}),
+		dom:                dom,
+		scatterWaitTimeout: ScatterWaitUpperInterval,
+		statsHandler:       statsHandle,
 	}, nil
 }
 
@@ -135,6 +262,105 @@ func (rc *Client) SetRateLimit(rateLimit uint64) {
 	rc.rateLimit = rateLimit
 }
 
+// SetSummaryPrefix sets the prefix of the summary units collected by restore,
+// e.g. "restore" makes the unit "files" be collected as "restore.files".
+// It's useful when the units of backup and restore are recorded in the same summary.
+// The units rendered by the summary by their exact names, i.e. the total KVs and bytes,
+// aren't prefixed.
+func (rc *Client) SetSummaryPrefix(prefix string) {
+	rc.summaryPrefix = prefix
+	rc.fileImporter.summaryPrefix = prefix
+}
+
+// SetRestoreFilesRetry makes RestoreFiles restore the unfinished files again at most
+// the times, once the files fail with a transient error, e.g. a store is unavailable
+// for a while. The backoff starts from the interval and doubles on every retry.
+// The finished files are never restored again. 0 times (the default) means no retry.
+func (rc *Client) SetRestoreFilesRetry(times int, interval time.Duration) {
+	rc.restoreFilesRetryTimes = times
+	rc.restoreFilesRetryInterval = interval
+}
+
+// SetIngestETATracker makes RestoreFiles report the bytes of every finished group of files to the tracker.
+func (rc *Client) SetIngestETATracker(tracker *IngestETATracker) {
+	rc.ingestETA = tracker
+}
+
+// SetTableTimingCallback sets the callback which is called with the time span
+// of each table after every call of RestoreFiles.
+// It may be called concurrently when files are restored concurrently.
+func (rc *Client) SetTableTimingCallback(callback func(TableRestoreTiming)) {
+	rc.tableTimingCallback = callback
+}
+
+// SetFileIngestCallback sets the callback which is called with every file once it is
+// ingested by RestoreFiles, e.g. to index the restored files externally. Unlike the
+// progress, it's called per file rather than per group of files of a range.
+// It may be called concurrently when files are restored concurrently.
+func (rc *Client) SetFileIngestCallback(callback func(FileIngestResult)) {
+	rc.fileIngestCallback = callback
+}
+
+// SetSplitKeysCallback sets the callback which is called with the split keys planned for every
+// split of the ranges, i.e. every restore batch, before splitting, e.g. to audit the split keys.
+// The keys are raw keys in the keyspace of the restored tables. Unlike the progress, it's called
+// with the keys planned, including the keys already splitting the regions of the cluster.
+// It may be called concurrently when batches are split concurrently.
+func (rc *Client) SetSplitKeysCallback(callback func(keys [][]byte)) {
+	rc.splitKeysCallback = callback
+}
+
+// EnableDropLastTableFiles makes every call of RestoreFiles skip the files of
+// the table with the largest new ID and then return an error, so the restore
+// fails with incomplete data. It's for fault injection in staging clusters
+// only, and refuses to be enabled unless unsafe is set.
+func (rc *Client) EnableDropLastTableFiles(unsafe bool) error {
+	if !unsafe {
+		return errors.Annotate(berrors.ErrInvalidArgument,
+			"dropping files of the last table makes the restored data incomplete, it must be enabled explicitly as unsafe")
+	}
+	log.Warn("files of the last table would be dropped on purpose, the restored data would be incomplete")
+	rc.dropLastTableFiles = true
+	return nil
+}
+
+// SetDownloadNameRewriter sets the function rewriting the name of every file before downloading it.
+// nil means downloading the files by the names recorded in the backup meta.
+func (rc *Client) SetDownloadNameRewriter(rewriter func(name string) string) {
+	rc.downloadNameRewriter = rewriter
+	rc.fileImporter.SetDownloadNameRewriter(rewriter)
+}
+
+// SetImportRetry sets the retry budgets of downloading and ingesting the files separately,
+// so the flakiness of the external storage and the cluster can be tuned independently.
+// The zero configs mean the default budgets.
+func (rc *Client) SetImportRetry(download, ingest ImportRetryConfig) {
+	rc.downloadRetry = download
+	rc.ingestRetry = ingest
+	rc.fileImporter.SetRetry(download, ingest)
+}
+
+// SetCFIngestOrder sets the order of ingesting the files of the CFs into every region,
+// see FileImporter.SetCFIngestOrder. Empty means ingesting them at once.
+func (rc *Client) SetCFIngestOrder(cfs []string) {
+	rc.cfIngestOrder = cfs
+	rc.fileImporter.SetCFIngestOrder(cfs)
+}
+
+// EnableFileRangeCut makes the files restored only inside their start and end keys,
+// see FileImporter.EnableFileRangeCut, for the files cut by MergeConfig.KeyRangeAllowlist.
+func (rc *Client) EnableFileRangeCut() {
+	rc.cutFileRange = true
+	rc.fileImporter.EnableFileRangeCut()
+}
+
+// SetFileImporter replaces the importer used to restore files.
+func (rc *Client) SetFileImporter(importer FileImporter) {
+	rc.fileImporter = importer
+	rc.fileImporter.summaryPrefix = rc.summaryPrefix
+	rc.fileImporter.SetDownloadNameRewriter(rc.downloadNameRewriter)
+}
+
 func (rc *Client) SetCrypter(crypter *backuppb.CipherInfo) {
 	rc.cipher = crypter
 }
@@ -205,9 +431,16 @@ func (rc *Client) InitBackupMeta(
 	rc.backupMeta = backupMeta
 	log.Info("load backupmeta", zap.Int("databases", len(rc.databases)), zap.Int("jobs", len(rc.ddlJobs)))
 
-	metaClient := NewSplitClient(rc.pdClient, rc.tlsConf)
+	metaClient := rc.newSplitClient()
 	importCli := NewImportClient(metaClient, rc.tlsConf, rc.keepaliveConf)
 	rc.fileImporter = NewFileImporter(metaClient, importCli, backend, rc.backupMeta.IsRawKv, rc.rateLimit)
+	rc.fileImporter.summaryPrefix = rc.summaryPrefix
+	rc.fileImporter.SetDownloadNameRewriter(rc.downloadNameRewriter)
+	rc.fileImporter.SetRetry(rc.downloadRetry, rc.ingestRetry)
+	rc.fileImporter.SetCFIngestOrder(rc.cfIngestOrder)
+	if rc.cutFileRange {
+		rc.fileImporter.EnableFileRangeCut()
+	}
 	return rc.fileImporter.CheckMultiIngestSupport(c, rc.pdClient)
 }
 
@@ -272,6 +505,292 @@ func (rc *Client) GetFilesInRawRange(startKey []byte, endKey []byte, cf string)
 	return nil, errors.Annotate(berrors.ErrRestoreRangeMismatch, "no backup data in the range")
 }
 
+// SetScatterWaitTimeout sets how long to wait for scattering the new regions at most after splitting.
+// 0 means don't wait.
+func (rc *Client) SetScatterWaitTimeout(timeout time.Duration) {
+	rc.scatterWaitTimeout = timeout
+}
+
+// SetIngestThrottle sets the throttle limiting the in-flight ingests of RestoreFiles
+// by the disk usage of stores. nil means only the concurrency of the client limits them.
+func (rc *Client) SetIngestThrottle(throttle *IngestThrottle) {
+	rc.ingestThrottle = throttle
+}
+
+// SetClusterCapacityCheck makes CheckClusterCapacity refuse the restores which would fill
+// the disks of the cluster over the ratio of the capacity reported by the source.
+// nil source (the default) means unchecked.
+func (rc *Client) SetClusterCapacityCheck(source ClusterCapacitySource, maxFill float64) {
+	rc.capacitySource = source
+	rc.maxCapacityFill = maxFill
+}
+
+// CheckClusterCapacity checks the cluster has enough free disk for the files, i.e. the
+// used disk plus the total bytes of the files times the max replicas doesn't exceed the
+// fill ratio of the capacity, so the restore won't fill the disks up and wedge the cluster.
+// It is a no-op unless SetClusterCapacityCheck is called.
+func (rc *Client) CheckClusterCapacity(ctx context.Context, allFiles []*backuppb.File) error {
+	if rc.capacitySource == nil {
+		return nil
+	}
+	capacity, available, err := rc.capacitySource.ClusterCapacity(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	replicas, err := rc.capacitySource.MaxReplicas(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if replicas <= 0 {
+		replicas = 1
+	}
+	// every replica of the restored regions takes the disk of a store.
+	needed := filesTotalBytes(allFiles) * uint64(replicas)
+	used := uint64(0)
+	if capacity > available {
+		used = capacity - available
+	}
+	limit := uint64(float64(capacity) * rc.maxCapacityFill)
+	log.Info("check the capacity of cluster for restore",
+		zap.Uint64("capacity", capacity),
+		zap.Uint64("available", available),
+		zap.Uint64("needed", needed),
+		zap.Int("replicas", replicas),
+		zap.Float64("max fill", rc.maxCapacityFill))
+	if used+needed > limit {
+		return errors.Annotatef(berrors.ErrRestoreInsufficientCapacity,
+			"the restore needs %d bytes of %d replicas, but the cluster has %d bytes used of %d bytes, "+
+				"which would exceed the fill ratio %.2f",
+			needed, replicas, used, capacity, rc.maxCapacityFill)
+	}
+	return nil
+}
+
+// SetRegionCountCheck makes CheckRegionCount refuse the restores which would split the regions
+// of the cluster over the max count reported by the source. nil source (the default) means unchecked.
+func (rc *Client) SetRegionCountCheck(source RegionCountSource) {
+	rc.regionCountSource = source
+}
+
+// CheckRegionCount checks the regions of the cluster plus the regions split by the split keys
+// don't exceed the max count of regions, so the restore fails early instead of overloading
+// PD and the stores. It is a no-op unless SetRegionCountCheck is called.
+func (rc *Client) CheckRegionCount(ctx context.Context, splitKeys int) error {
+	if rc.regionCountSource == nil {
+		return nil
+	}
+	maxCount, err := rc.regionCountSource.MaxRegionCount(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if maxCount <= 0 {
+		return nil
+	}
+	count, err := rc.regionCountSource.RegionCount(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("check the region count of cluster for restore",
+		zap.Int("regions", count),
+		zap.Int("split keys", splitKeys),
+		zap.Int("max regions", maxCount))
+	if count+splitKeys > maxCount {
+		return errors.Annotatef(berrors.ErrRestoreInsufficientCapacity,
+			"the restore splits %d more regions, but the cluster has %d regions, "+
+				"which would exceed the max count of regions %d",
+			splitKeys, count, maxCount)
+	}
+	return nil
+}
+
+// SetMaxConcurrentTables limits the count of the distinct tables whose files are restored
+// concurrently, regardless of the concurrency of files, e.g. to keep the regions of related
+// tables from scattering all at once. The groups of files are restored table by table then.
+// 0 (the default) means unlimited.
+func (rc *Client) SetMaxConcurrentTables(maxTables int) {
+	if maxTables <= 0 {
+		rc.tableLimiter = nil
+		return
+	}
+	rc.tableLimiter = newTableLimiter(maxTables)
+}
+
+// SetGlobalBandwidthLimit limits the total bytes of the files restored per second,
+// shared by all the groups of files in flight, unlike the rate limit which is per store.
+// 0 (the default) means unlimited.
+func (rc *Client) SetGlobalBandwidthLimit(bytesPerSecond uint64) {
+	if bytesPerSecond == 0 {
+		rc.bandwidthLimiter = nil
+		return
+	}
+	rc.bandwidthLimiter = NewBandwidthLimiter(bytesPerSecond)
+}
+
+// SetMaxInFlightBytes limits the total bytes of the groups of files being downloaded and ingested
+// at once, e.g. to bound the buffers of downloading of the stores. A new group isn't started if it
+// would exceed the limit, unless no group is in flight. 0 (the default) means unlimited.
+func (rc *Client) SetMaxInFlightBytes(maxBytes uint64) {
+	if maxBytes == 0 {
+		rc.bytesLimiter = nil
+		return
+	}
+	rc.bytesLimiter = newBytesLimiter(maxBytes)
+}
+
+// SetTimeBudget limits the time of the restore from now on. Once the budget is exhausted,
+// RestoreFiles stops submitting new files, waits for the files in flight and returns
+// without an error, leaving the rest of the files unrestored, so the restore stops
+// cleanly and the unrestored tables can be restored by the next run.
+// 0 (the default) means unlimited.
+func (rc *Client) SetTimeBudget(budget time.Duration) {
+	if budget <= 0 {
+		rc.timeBudget.deadline = time.Time{}
+		return
+	}
+	rc.timeBudget.deadline = time.Now().Add(budget)
+}
+
+// TimeBudgetExhausted checks whether any file is left unrestored by the time budget.
+func (rc *Client) TimeBudgetExhausted() bool {
+	return len(rc.timeBudget.unrestoredTables()) > 0
+}
+
+// UnrestoredTableIDs returns the IDs of the restored tables with files left
+// unrestored by the time budget, in ascending order.
+func (rc *Client) UnrestoredTableIDs() []int64 {
+	return rc.timeBudget.unrestoredTables()
+}
+
+// fullyRestoredTables filters out the tables with files left unrestored by the time budget,
+// so they aren't checksummed as if they were restored.
+func (rc *Client) fullyRestoredTables(tables []CreatedTable) []CreatedTable {
+	restored := make([]CreatedTable, 0, len(tables))
+	for _, t := range tables {
+		ok := rc.timeBudget.isRestored(t.Table.ID)
+		if t.Table.Partition != nil {
+			for _, def := range t.Table.Partition.Definitions {
+				ok = ok && rc.timeBudget.isRestored(def.ID)
+			}
+		}
+		if !ok {
+			log.Warn("table isn't fully restored by the time budget",
+				zap.Stringer("table", t.Table.Name), zap.Int64("table id", t.Table.ID))
+			continue
+		}
+		restored = append(restored, t)
+	}
+	return restored
+}
+
+// SplitKeyCount returns the count of the keys used to split regions by the client.
+func (rc *Client) SplitKeyCount() int64 {
+	return rc.splitKeys.Load()
+}
+
+// SetMinRegions makes every table restored by the client split into at least the count of regions,
+// counting the split keys of a table across all the restore batches, by injecting evenly spaced
+// split keys into the ranges, see RegionSplitter.SetMinRegions.
+func (rc *Client) SetMinRegions(minRegions int) {
+	rc.minRegions = minRegions
+	rc.tableSplitKeys = newTableSplitKeyCounter()
+}
+
+// SetRegionMaxSize makes every split of the client split the ranges of files larger than the size
+// inside, by injecting evenly spaced split keys into them, see RegionSplitter.SetRegionMaxSize.
+func (rc *Client) SetRegionMaxSize(size uint64) {
+	rc.regionMaxSize = size
+}
+
+// SetMinSplitKeyDistance makes every split of the client skip the split keys closer than
+// the distance to the ones kept, checking the split keys across all the restore batches,
+// see RegionSplitter.SetMinSplitKeyDistance.
+func (rc *Client) SetMinSplitKeyDistance(distance uint64) {
+	rc.minSplitKeyDistance = distance
+	rc.keptSplitKeys = newKeptSplitKeys()
+}
+
+// SetTailSplit makes the splits of the ranges of the restored tables split the keyspace beyond the
+// tails of the tables with sequential int handles ahead, see RegionSplitter.SetTailSplit. SplitRanges knows no table,
+// so it doesn't split the tails.
+func (rc *Client) SetTailSplit(cfg TailSplitConfig) {
+	rc.tailSplit = cfg
+}
+
+// RestoredFileCount returns the count of the files restored by the client, excluding
+// the files skipped before restoring, e.g. the empty files. 0 means the run
+// restored nothing new, so the steps after restore on the data may be skipped.
+func (rc *Client) RestoredFileCount() int64 {
+	return rc.restoredFiles.Load()
+}
+
+// InjectedSplitKeyCount returns the count of the split keys injected for the min regions and the oversized ranges.
+func (rc *Client) InjectedSplitKeyCount() int64 {
+	return rc.injectedSplitKeys.Load()
+}
+
+// EnableSplitKeyValidation makes the client check the split keys are in the
+// keyspace of the restored tables before splitting.
+func (rc *Client) EnableSplitKeyValidation() {
+	rc.validateSplitKeys = true
+}
+
+// EnableSplitOnTableBoundary makes the client split at the start of every table
+// following another table when splitting a batch of ranges.
+func (rc *Client) EnableSplitOnTableBoundary() {
+	rc.splitOnTable = true
+}
+
+// EnableSplitOnTableStart makes the client split at the start of the first range of
+// every table when splitting a batch of ranges, including the first table.
+func (rc *Client) EnableSplitOnTableStart() {
+	rc.splitOnTableStart = true
+}
+
+// SkipTailSplitKey makes the client not split at the end of the last range of every batch,
+// when it's the prefix of the next table.
+func (rc *Client) SkipTailSplitKey() {
+	rc.skipTailSplitKey = true
+}
+
+// SetRegionTemplate makes the client split the regions exactly at the sorted keys of the
+// template instead of the end keys of the ranges, the merged ranges should be aligned to
+// the template by MergeConfig.RegionTemplate too.
+func (rc *Client) SetRegionTemplate(keys [][]byte) {
+	rc.regionTemplate = keys
+}
+
+// SetKeyComparator makes the client sort and validate the split keys by the comparator,
+// for the experimental key encodings. MergeConfig.KeyComparator should be the same one.
+func (rc *Client) SetKeyComparator(cmp KeyComparator) {
+	rc.keyComparator = cmp
+}
+
+// SetSplitBatchDelay makes the client wait the delay plus a random jitter between
+// the split requests of the regions, both 0 (the default) means no waiting.
+func (rc *Client) SetSplitBatchDelay(delay, jitter time.Duration) {
+	rc.splitBatchDelay = delay
+	rc.splitBatchJitter = jitter
+}
+
+// SetSplitOrder sets the order of submitting the batches of split keys, see RegionSplitter.SetSplitOrder.
+func (rc *Client) SetSplitOrder(order SplitOrder) {
+	rc.splitOrder = order
+}
+
+// SetSplitPacer sets the pacer shared by the splitters of the client, see RegionSplitter.SetSplitPacer.
+// nil (the default) means the delay between the split requests is static.
+func (rc *Client) SetSplitPacer(pacer *SplitPacer) {
+	rc.splitPacer = pacer
+}
+
+// SetRestoreJobLabel makes the client label the regions created by splitting with
+// RestoreJobLabelKey and the ID of the restore job, see RegionSplitter.SetRegionLabel.
+// Empty ID (the default) means no labeling.
+func (rc *Client) SetRestoreJobLabel(jobID string) {
+	rc.restoreJobID = jobID
+	rc.labeledRanges = newLabeledRanges()
+}
+
 // SetConcurrency sets the concurrency of dbs tables files.
 func (rc *Client) SetConcurrency(c uint) {
 	rc.workerPool = utils.NewWorkerPool(c, "file")
@@ -282,6 +801,43 @@ func (rc *Client) EnableOnline() {
 	rc.isOnline = true
 }
 
+// EnableKeepPlacementRules makes the placement rules set for online restore
+// kept after restoring the tables, so the placement could be checked after restore.
+// It's unsafe and for debugging only: the tables stay on the restore stores
+// until the rules are removed manually. The rules of the tables failed to restore
+// are removed anyway, see DiscardPlacementRules.
+func (rc *Client) EnableKeepPlacementRules() {
+	rc.keepPlacementRules = true
+}
+
+// EnableSkipMatchedPlacementRules makes SetupPlacementRules skip the tables whose placement rules
+// already match the rules of online restore, e.g. set by a previous run interrupted, at the cost of
+// loading the rule of every table first.
+func (rc *Client) EnableSkipMatchedPlacementRules() {
+	rc.skipMatchedPlacementRules = true
+}
+
+// DisablePDHTTP makes the split clients of the client work in gRPC-only mode, for the deployments
+// where the PD HTTP API is unreachable, e.g. by TLS or ACL restrictions, see NewSplitClientWithHTTPClient.
+// It must be called before InitBackupMeta.
+func (rc *Client) DisablePDHTTP() {
+	rc.pdHTTPDisabled = true
+	rc.toolClient = rc.newSplitClient()
+}
+
+// newSplitClient returns a split client of the PD client, in gRPC-only mode if the PD HTTP API is disabled.
+func (rc *Client) newSplitClient() SplitClient {
+	if rc.pdHTTPDisabled {
+		return NewSplitClientWithHTTPClient(rc.pdClient, rc.tlsConf, nil)
+	}
+	return NewSplitClient(rc.pdClient, rc.tlsConf)
+}
+
+// SetSplitClient replaces the client used to operate regions, stores and placement rules.
+func (rc *Client) SetSplitClient(client SplitClient) {
+	rc.toolClient = client
+}
+
 // GetTLSConfig returns the tls config.
 func (rc *Client) GetTLSConfig() *tls.Config {
 	return rc.tlsConf
@@ -558,44 +1114,708 @@ func (rc *Client) setSpeedLimit(ctx context.Context) error {
 				return errors.Trace(err)
 			}
 		}
-		rc.hasSpeedLimited = true
+		rc.hasSpeedLimited = true
+	}
+	return nil
+}
+
+// isFilesBelongToSameRange check whether two files are belong to the same range with different cf.
+func isFilesBelongToSameRange(f1, f2 string) bool {
+	// the backup date file pattern is `{store_id}_{region_id}_{epoch_version}_{key}_{ts}_{cf}.sst`
+	// so we need to compare with out the `_{cf}.sst` suffix
+	idx1 := strings.LastIndex(f1, "_")
+	idx2 := strings.LastIndex(f2, "_")
+
+	if idx1 < 0 || idx2 < 0 {
+		panic(fmt.Sprintf("invalid backup data file name: '%s', '%s'", f1, f2))
+	}
+
+	return f1[:idx1] == f2[:idx2]
+}
+
+func drainFilesByRange(files []*backuppb.File, supportMulti bool) ([]*backuppb.File, []*backuppb.File) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if !supportMulti {
+		return files[:1], files[1:]
+	}
+	idx := 1
+	for idx < len(files) {
+		if !isFilesBelongToSameRange(files[idx-1].Name, files[idx].Name) {
+			break
+		}
+		idx++
+	}
+
+	return files[:idx], files[idx:]
+}
+
+// BuildFileGroups validates and merges the files of the tables, returns the
+// tables with the ranges that would be split and restored, in the order of
+// the tables. It does the same planning as the restore pipeline, but doesn't
+// touch the cluster, so it's useful for checking the restore plan.
+// The zero thresholds of mergeCfg fall back to the default values.
+// It fails once the ranges exceed mergeCfg.MemoryBudgetBytes, instead of
+// running out of memory on a backup with too many files.
+// With mergeCfg.CFGroupOrder, a table has a group for each CF, sharing the rewrite rules.
+// With mergeCfg.GroupSkewRatio, it warns once the sizes of the groups are skewed.
+// It fails if the rewrite rules of different tables rewrite into overlapping keyspaces.
+func (rc *Client) BuildFileGroups(
+	ctx context.Context,
+	tables []CreatedTable,
+	allFiles []*backuppb.File,
+	mergeCfg MergeConfig,
+) ([]TableWithRange, error) {
+	mergeCfg.adjustAndLog()
+	fileOfTable := MapTableToFiles(allFiles)
+	restored := make(map[int64]struct{}, len(fileOfTable))
+	for _, t := range tables {
+		for oldID := range newPhysicalIDsOf(t) {
+			restored[oldID] = struct{}{}
+		}
+	}
+	// the errors collected on CollectAllErrors.
+	var errs error
+	if err := checkOrphanFiles(fileOfTable, restored, mergeCfg.OrphanFilesPolicy); err != nil {
+		if !mergeCfg.CollectAllErrors {
+			return nil, errors.Trace(err)
+		}
+		errs = multierr.Append(errs, err)
+	}
+	result := make([]TableWithRange, 0, len(tables))
+	memSize := uint64(0)
+	small := &smallTablesMergeStat{}
+	defer small.log()
+	keyspaces := newRewriteKeyspaces()
+	for i, t := range tables {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		tableWithRange, err := validateAndMergeTableFiles(t, fileOfTable, mergeCfg, small)
+		if err == nil {
+			err = keyspaces.add(tableWithRange.CreatedTable)
+		}
+		if err != nil {
+			if !mergeCfg.CollectAllErrors {
+				return nil, errors.Trace(err)
+			}
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		memSize += rangesMemSize(tableWithRange.Range)
+		if mergeCfg.MemoryBudgetBytes > 0 && memSize > mergeCfg.MemoryBudgetBytes {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"ranges of the first %d tables take %d bytes, exceeding the memory budget %d bytes, "+
+					"please raise the budget or the merge thresholds",
+				i+1, memSize, mergeCfg.MemoryBudgetBytes)
+		}
+		if len(mergeCfg.CFGroupOrder) > 0 {
+			result = append(result, splitRangesByCF(tableWithRange, mergeCfg.CFGroupOrder)...)
+			continue
+		}
+		result = append(result, tableWithRange)
+	}
+	if errs != nil {
+		logCollectedErrors(errs, mergeCfg)
+		return nil, errs
+	}
+	if mergeCfg.GroupSkewRatio > 0 {
+		logSkewedFileGroups(GetFileGroupsSizeStat(result), mergeCfg.GroupSkewRatio)
+	}
+	return result, nil
+}
+
+// RestorePlan is what to split and restore, computed by PlanRestore without touching
+// the cluster and executed by ExecuteRestorePlan, e.g. by RestoreSingleTable.
+// The restore task doesn't execute a plan: a plan holds the files of all tables and
+// splits all regions ahead, so the task streams the tables through the batcher instead,
+// and only inspects the plan of them by GoPrevalidatePlan.
+type RestorePlan struct {
+	// Groups is the tables with the merged ranges to restore, in the order of restoring.
+	Groups []TableWithRange
+	// SplitKeys is the raw keys to split the regions at, sorted by the key comparator of the client.
+	SplitKeys [][]byte
+	// MergeConfig is the effective merge config, with the zero thresholds adjusted.
+	MergeConfig MergeConfig
+}
+
+// Files returns the files of all groups of the plan.
+func (p *RestorePlan) Files() []*backuppb.File {
+	files := make([]*backuppb.File, 0)
+	for _, group := range p.Groups {
+		files = append(files, group.Files()...)
+	}
+	return files
+}
+
+// Hash returns the SHA-256 of the split keys and the files of the groups of the plan in hex,
+// so two restores with identical inputs can be proven to have planned identically.
+func (p *RestorePlan) Hash() string {
+	h := newPlanHasher()
+	h.writeInt(int64(len(p.SplitKeys)))
+	for _, key := range p.SplitKeys {
+		h.writeBytes(key)
+	}
+	h.writeInt(int64(len(p.Groups)))
+	for _, group := range p.Groups {
+		h.writeInt(group.Table.ID)
+		h.writeRanges(group.Range)
+	}
+	return h.sum()
+}
+
+// PlanDiff is the changes from a plan to another, e.g. re-planning after the backup is appended to.
+type PlanDiff struct {
+	// AddedSplitKeys and RemovedSplitKeys are the split keys only in the new plan and only in the old plan.
+	AddedSplitKeys   [][]byte
+	RemovedSplitKeys [][]byte
+	// ChangedRanges are the ranges whose files differ between the plans. A range only in the new
+	// plan has no removed files, and a range only in the old plan has no added files.
+	ChangedRanges []PlanRangeDiff
+}
+
+// PlanRangeDiff is the changes of the files of a range from a plan to another.
+type PlanRangeDiff struct {
+	// TableID is the new ID of the table of the range in the new plan, or in the old plan
+	// if the range is only in the old plan.
+	TableID int64
+	// StartKey and EndKey are the range in the keyspace of the backup.
+	StartKey []byte
+	EndKey   []byte
+	// AddedFiles and RemovedFiles are the names of the files only in the new plan and only in the old plan.
+	AddedFiles   []string
+	RemovedFiles []string
+}
+
+// Empty checks whether the plans are the same, regardless of the order of the groups.
+func (d *PlanDiff) Empty() bool {
+	return len(d.AddedSplitKeys) == 0 && len(d.RemovedSplitKeys) == 0 && len(d.ChangedRanges) == 0
+}
+
+// DiffPlans returns the changes from the old plan to the new one, for reviewing a re-plan before
+// executing it. The plans are compared in the keyspace of the backup, i.e. a range is identified by
+// the old ID of its table and its keys in the backup, and the split keys are rewritten back by the
+// tables of their plan, so the plans of the tables created with different IDs, e.g. by another run,
+// are compared by what they restore. A range with its keys changed is reported as removed from the
+// old plan and added to the new one. The split keys are reported as they are in their plan. The changes
+// are in the order of the new plan, followed by the changes only in the old plan in its order.
+func DiffPlans(oldPlan, newPlan *RestorePlan) *PlanDiff {
+	diff := &PlanDiff{
+		AddedSplitKeys:   subtractBackupKeys(newPlan, oldPlan),
+		RemovedSplitKeys: subtractBackupKeys(oldPlan, newPlan),
+		ChangedRanges:    make([]PlanRangeDiff, 0),
+	}
+	type rangeKey struct {
+		oldTableID int64
+		startKey   string
+		endKey     string
+	}
+	planRanges := func(plan *RestorePlan) ([]rangeKey, map[rangeKey][]string, map[rangeKey]int64) {
+		keys := make([]rangeKey, 0)
+		files := make(map[rangeKey][]string)
+		tableIDs := make(map[rangeKey]int64)
+		for _, group := range plan.Groups {
+			for _, rg := range group.Range {
+				key := rangeKey{oldTableID: group.OldTable.Info.ID, startKey: string(rg.StartKey), endKey: string(rg.EndKey)}
+				if _, ok := files[key]; !ok {
+					keys = append(keys, key)
+					tableIDs[key] = group.Table.ID
+				}
+				// the groups split by CF share the ranges.
+				for _, file := range rg.Files {
+					files[key] = append(files[key], file.GetName())
+				}
+			}
+		}
+		return keys, files, tableIDs
+	}
+	oldKeys, oldFiles, oldTableIDs := planRanges(oldPlan)
+	newKeys, newFiles, newTableIDs := planRanges(newPlan)
+	addRange := func(key rangeKey) {
+		added, removed := subtractNames(newFiles[key], oldFiles[key]), subtractNames(oldFiles[key], newFiles[key])
+		if len(added) == 0 && len(removed) == 0 {
+			return
+		}
+		tableID, ok := newTableIDs[key]
+		if !ok {
+			tableID = oldTableIDs[key]
+		}
+		diff.ChangedRanges = append(diff.ChangedRanges, PlanRangeDiff{
+			TableID:      tableID,
+			StartKey:     []byte(key.startKey),
+			EndKey:       []byte(key.endKey),
+			AddedFiles:   added,
+			RemovedFiles: removed,
+		})
+	}
+	for _, key := range newKeys {
+		addRange(key)
+	}
+	for _, key := range oldKeys {
+		if _, ok := newFiles[key]; !ok {
+			addRange(key)
+		}
+	}
+	return diff
+}
+
+// subtractBackupKeys returns the split keys of the plan not in the other plan, in their order,
+// comparing the keys rewritten back into the keyspace of the backup by the tables of their plan.
+func subtractBackupKeys(plan, other *RestorePlan) [][]byte {
+	set := make(map[string]struct{}, len(other.SplitKeys))
+	otherOldIDs := other.oldPhysicalIDs()
+	for _, key := range other.SplitKeys {
+		set[string(backupKeyOf(key, otherOldIDs))] = struct{}{}
+	}
+	oldIDs := plan.oldPhysicalIDs()
+	result := make([][]byte, 0)
+	for _, key := range plan.SplitKeys {
+		if _, ok := set[string(backupKeyOf(key, oldIDs))]; !ok {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// oldPhysicalIDs returns the old physical IDs of the tables of the plan by the new ones.
+func (p *RestorePlan) oldPhysicalIDs() map[int64]int64 {
+	oldIDs := make(map[int64]int64)
+	for _, group := range p.Groups {
+		for oldID, newID := range newPhysicalIDsOf(group.CreatedTable) {
+			oldIDs[newID] = oldID
+		}
+	}
+	return oldIDs
+}
+
+// subtractNames returns the names not in others, in their order.
+func subtractNames(names, others []string) []string {
+	set := make(map[string]struct{}, len(others))
+	for _, name := range others {
+		set[name] = struct{}{}
+	}
+	result := make([]string, 0)
+	for _, name := range names {
+		if _, ok := set[name]; !ok {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// PlanRestore validates and merges the files of the tables like BuildFileGroups, and computes
+// the keys the regions would be split at like SplitRanges.
+func (rc *Client) PlanRestore(
+	ctx context.Context,
+	tables []CreatedTable,
+	allFiles []*backuppb.File,
+	mergeCfg MergeConfig,
+) (*RestorePlan, error) {
+	groups, err := rc.BuildFileGroups(ctx, tables, allFiles, mergeCfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	mergeCfg.adjust()
+	splitter, splitKeys, err := rc.planGroupsSplitKeys(groups)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rc.injectedSplitKeys.Add(splitter.InjectedSplitKeyCount())
+	plan := &RestorePlan{Groups: groups, SplitKeys: splitKeys, MergeConfig: mergeCfg}
+	log.Info("restore planned",
+		zap.Int("groups", len(plan.Groups)),
+		zap.Int("split keys", len(plan.SplitKeys)),
+		zap.String("hash", plan.Hash()))
+	return plan, nil
+}
+
+// planGroupsSplitKeys computes the keys the regions of the groups would be split at, sorted by
+// the key comparator and deduplicated, without splitting anything.
+func (rc *Client) planGroupsSplitKeys(groups []TableWithRange) (*RegionSplitter, [][]byte, error) {
+	splitter := rc.newRegionSplitter()
+	// the split keys of the tables are counted and kept within the plan, which splits nothing yet.
+	splitter.tableSplitKeys = newTableSplitKeyCounter()
+	splitter.keptSplitKeys = newKeptSplitKeys()
+	splitKeys := make([][]byte, 0)
+	for _, group := range groups {
+		if len(group.Range) == 0 {
+			continue
+		}
+		splitter.SetTailSplit(rc.tailSplit, []CreatedTable{group.CreatedTable})
+		_, keys, err := splitter.planSplitKeys(group.Range, group.RewriteRule)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		splitKeys = append(splitKeys, keys...)
+	}
+	sort.Slice(splitKeys, func(i, j int) bool {
+		return splitter.keyComparator(splitKeys[i], splitKeys[j]) < 0
+	})
+	// The groups of the CFs of a table may share the split keys.
+	splitKeys, err := ValidateSplitKeysOrderWithComparator(splitKeys, splitter.keyComparator)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return splitter, splitKeys, nil
+}
+
+// PrevalidatePlanFunc inspects the plan before it's executed, an error vetoes the execution.
+type PrevalidatePlanFunc func(ctx context.Context, plan *RestorePlan) error
+
+// SetPrevalidatePlan makes ExecuteRestorePlan and GoPrevalidatePlan call the callback with the plan
+// before splitting or ingesting anything, e.g. so a policy engine could reject a restore touching certain
+// tables. ExecuteRestorePlan calls it before touching the cluster at all, but GoPrevalidatePlan only after
+// the tables are created, see it. The plan must not be modified. nil (the default) means no inspection.
+func (rc *Client) SetPrevalidatePlan(fn PrevalidatePlanFunc) {
+	rc.prevalidatePlan = fn
+}
+
+// GoPrevalidatePlan inspects the plan of the restore streaming the tables with ranges, see
+// SetPrevalidatePlan, and checks the region count by the split keys of the plan, see
+// SetRegionCountCheck. It takes all tables merged, plans the split keys of them like PlanRestore,
+// and passes the tables through only if the callback accepts the plan and the check passes, so
+// nothing is split or ingested before that. It holds all tables until then, no matter
+// mergeCfg.MemoryBudgetBytes. Without the callback and the check, it returns the stream as is.
+//
+// The guarantee is partial: the plan needs the rewrite rules of the created tables, so the tables
+// of the stream are already created, and the cluster may be prepared for restoring concurrently,
+// e.g. switched to the import mode. The caller undoes the preparation on the error, but the created
+// tables are left behind.
+func (rc *Client) GoPrevalidatePlan(
+	ctx context.Context,
+	rangeStream <-chan TableWithRange,
+	mergeCfg MergeConfig,
+	errCh chan<- error,
+) <-chan TableWithRange {
+	if rc.prevalidatePlan == nil && rc.regionCountSource == nil {
+		return rangeStream
+	}
+	outCh := make(chan TableWithRange)
+	go func() {
+		defer close(outCh)
+		groups := make([]TableWithRange, 0)
+	collect:
+		for {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case t, ok := <-rangeStream:
+				if !ok {
+					break collect
+				}
+				groups = append(groups, t)
+			}
+		}
+		mergeCfg.adjust()
+		_, splitKeys, err := rc.planGroupsSplitKeys(groups)
+		if err != nil {
+			errCh <- errors.Trace(err)
+			return
+		}
+		plan := &RestorePlan{Groups: groups, SplitKeys: splitKeys, MergeConfig: mergeCfg}
+		if rc.prevalidatePlan != nil {
+			if err := rc.prevalidatePlan(ctx, plan); err != nil {
+				log.Warn("restore plan is vetoed",
+					zap.Int("groups", len(plan.Groups)),
+					zap.Int("split keys", len(plan.SplitKeys)),
+					zap.Error(err))
+				errCh <- errors.Annotate(err, "restore plan is vetoed")
+				return
+			}
+		}
+		if err := rc.CheckRegionCount(ctx, len(plan.SplitKeys)); err != nil {
+			errCh <- errors.Trace(err)
+			return
+		}
+		log.Info("restore plan is accepted",
+			zap.Int("groups", len(plan.Groups)),
+			zap.Int("split keys", len(plan.SplitKeys)))
+		for _, t := range groups {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case outCh <- t:
+			}
+		}
+	}()
+	return outCh
+}
+
+// ExecuteRestorePlan splits the regions at the keys of the plan, then restores the files
+// of the groups in order. The placement rules of online restore are set for the tables
+// of the plan, and reset on return. It fails before splitting if the split keys would
+// exceed the max count of regions, see SetRegionCountCheck, or the plan is vetoed,
+// see SetPrevalidatePlan.
+func (rc *Client) ExecuteRestorePlan(ctx context.Context, plan *RestorePlan, updateCh glue.Progress) error {
+	if rc.prevalidatePlan != nil {
+		if err := rc.prevalidatePlan(ctx, plan); err != nil {
+			log.Warn("restore plan is vetoed",
+				zap.Int("groups", len(plan.Groups)),
+				zap.Int("split keys", len(plan.SplitKeys)),
+				zap.Error(err))
+			return errors.Annotate(err, "restore plan is vetoed")
+		}
+	}
+	tables := make([]*model.TableInfo, 0, len(plan.Groups))
+	seen := make(map[int64]struct{}, len(plan.Groups))
+	for _, group := range plan.Groups {
+		if _, ok := seen[group.Table.ID]; ok {
+			continue
+		}
+		seen[group.Table.ID] = struct{}{}
+		tables = append(tables, group.Table)
+	}
+	if err := rc.CheckRegionCount(ctx, len(plan.SplitKeys)); err != nil {
+		return errors.Trace(err)
+	}
+	defer splitPostWork(ctx, rc, tables)
+	if err := splitPrepareWork(ctx, rc, tables); err != nil {
+		return errors.Trace(err)
+	}
+
+	splitter := rc.newRegionSplitter()
+	err := splitter.SplitKeys(ctx, plan.SplitKeys, func(keys [][]byte) {
+		rc.splitKeys.Add(int64(len(keys)))
+		for range keys {
+			updateCh.Inc()
+		}
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, group := range plan.Groups {
+		files := group.Files()
+		if len(files) == 0 {
+			continue
+		}
+		if err := rc.RestoreFiles(ctx, files, group.RewriteRule, updateCh); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// RestoreSingleTable restores the files of exactly one created table, for
+// re-restoring a table from the backup, e.g. the table is corrupted after restore.
+// The files of the other tables in allFiles are ignored. It plans and executes
+// the restore by PlanRestore and ExecuteRestorePlan, so the placement rules of
+// online restore are set only for the table, and are reset on return.
+func (rc *Client) RestoreSingleTable(
+	ctx context.Context,
+	table CreatedTable,
+	allFiles []*backuppb.File,
+	mergeCfg MergeConfig,
+	updateCh glue.Progress,
+) error {
+	mergeCfg.OrphanFilesPolicy = OrphanFilesIgnore
+	plan, err := rc.PlanRestore(ctx, []CreatedTable{table}, allFiles, mergeCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(plan.Files()) == 0 {
+		log.Info("no files of the table to restore", zap.Stringer("table", table.Table.Name))
+		return nil
+	}
+	return rc.ExecuteRestorePlan(ctx, plan, updateCh)
+}
+
+// TableRestoreTiming is the time span of restoring the files of a table.
+type TableRestoreTiming struct {
+	// TableID is the new physical ID of the table.
+	TableID int64
+	Files   int
+	Start   time.Time
+	End     time.Time
+}
+
+// Duration returns how long the files of the table take to restore.
+func (t TableRestoreTiming) Duration() time.Duration {
+	return t.End.Sub(t.Start)
+}
+
+// FileIngestResult is a file ingested by RestoreFiles.
+type FileIngestResult struct {
+	// TableID is the new physical ID of the table.
+	TableID int64
+	Name    string
+	CF      string
+	// StartKey and EndKey are the key range of the file in the backup, i.e. before rewriting.
+	StartKey   []byte
+	EndKey     []byte
+	TotalKvs   uint64
+	TotalBytes uint64
+	// IngestedAt is when the group of files of the range is ingested.
+	IngestedAt time.Time
+}
+
+// tableTimingRecorder records the time span of restoring the files of each table.
+type tableTimingRecorder struct {
+	mu      sync.Mutex
+	timings map[int64]*TableRestoreTiming
+}
+
+func newTableTimingRecorder() *tableTimingRecorder {
+	return &tableTimingRecorder{timings: make(map[int64]*TableRestoreTiming)}
+}
+
+func (r *tableTimingRecorder) record(tableID int64, files int, start, end time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	timing, ok := r.timings[tableID]
+	if !ok {
+		r.timings[tableID] = &TableRestoreTiming{TableID: tableID, Files: files, Start: start, End: end}
+		return
+	}
+	timing.Files += files
+	if start.Before(timing.Start) {
+		timing.Start = start
+	}
+	if end.After(timing.End) {
+		timing.End = end
+	}
+}
+
+// sortedTimings returns the timings ordered by table ID.
+func (r *tableTimingRecorder) sortedTimings() []TableRestoreTiming {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	timings := make([]TableRestoreTiming, 0, len(r.timings))
+	for _, timing := range r.timings {
+		timings = append(timings, *timing)
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		return timings[i].TableID < timings[j].TableID
+	})
+	return timings
+}
+
+// restoredTableID returns the new physical ID of the table which the file would be restored to.
+func restoredTableID(file *backuppb.File, rewriteRules *RewriteRules) int64 {
+	key := file.GetStartKey()
+	if rewriteRules != nil {
+		if rule := matchOldPrefix(key, rewriteRules); rule != nil {
+			key = bytes.Replace(key, rule.GetOldKeyPrefix(), rule.GetNewKeyPrefix(), 1)
+		}
 	}
-	return nil
+	return tablecodec.DecodeTableID(key)
 }
 
-// isFilesBelongToSameRange check whether two files are belong to the same range with different cf.
-func isFilesBelongToSameRange(f1, f2 string) bool {
-	// the backup date file pattern is `{store_id}_{region_id}_{epoch_version}_{key}_{ts}_{cf}.sst`
-	// so we need to compare with out the `_{cf}.sst` suffix
-	idx1 := strings.LastIndex(f1, "_")
-	idx2 := strings.LastIndex(f2, "_")
-
-	if idx1 < 0 || idx2 < 0 {
-		panic(fmt.Sprintf("invalid backup data file name: '%s', '%s'", f1, f2))
+// SetDescendingTables makes RestoreFiles submit the groups of files of the tables in descending key
+// order, so the high end of a table queried mostly by reverse scans is restored first. The tables are
+// the physical tables in the backup, i.e. the old IDs of the tables and the partitions. The split keys
+// and the files restored are the same whatever the order is. Empty (the default) means ascending.
+// It orders the files within a batch only, Batcher.SetDescendingTables orders the batches of a table.
+func (rc *Client) SetDescendingTables(tableIDs []int64) {
+	rc.descendingTables = make(map[int64]struct{}, len(tableIDs))
+	for _, id := range tableIDs {
+		rc.descendingTables[id] = struct{}{}
 	}
+}
 
-	return f1[:idx1] == f2[:idx2]
+// SetCFGroupOrder makes RestoreFiles restore the files of every batch CF by CF in the order of
+// the CF names, e.g. write CF first and then default CF, waiting for the files of a CF to finish
+// before the next. The files of the unlisted CFs are restored last. Empty (the default) means
+// restoring the files of all CFs at once. It's MergeConfig.CFGroupOrder of the restore streaming
+// the ranges table by table, whose ranges can't be grouped by CF.
+func (rc *Client) SetCFGroupOrder(cfs []string) {
+	rc.cfGroupOrder = cfs
 }
 
-func drainFilesByRange(files []*backuppb.File, supportMulti bool) ([]*backuppb.File, []*backuppb.File) {
-	if len(files) == 0 {
-		return nil, nil
-	}
-	if !supportMulti {
-		return files[:1], files[1:]
+// descendTableFileGroups reorders the groups of files of every table in tables descending by their
+// start keys, in place of the groups of the table, the groups of other tables are left where they are.
+func descendTableFileGroups(fileGroups [][]*backuppb.File, tables map[int64]struct{}) {
+	positions := make(map[int64][]int)
+	for i, files := range fileGroups {
+		tableID := tablecodec.DecodeTableID(files[0].GetStartKey())
+		if _, ok := tables[tableID]; ok {
+			positions[tableID] = append(positions[tableID], i)
+		}
 	}
-	idx := 1
-	for idx < len(files) {
-		if !isFilesBelongToSameRange(files[idx-1].Name, files[idx].Name) {
-			break
+	for _, idx := range positions {
+		groups := make([][]*backuppb.File, 0, len(idx))
+		for _, i := range idx {
+			groups = append(groups, fileGroups[i])
+		}
+		sort.SliceStable(groups, func(i, j int) bool {
+			return bytes.Compare(groups[i][0].GetStartKey(), groups[j][0].GetStartKey()) > 0
+		})
+		for k, i := range idx {
+			fileGroups[i] = groups[k]
 		}
-		idx++
 	}
+}
 
-	return files[:idx], files[idx:]
+// drainFileGroups drains the files into the groups of files sharing a range, in the order to submit.
+func (rc *Client) drainFileGroups(files []*backuppb.File, rewriteRules *RewriteRules) [][]*backuppb.File {
+	var fileGroups [][]*backuppb.File
+	var rangeFiles []*backuppb.File
+	var leftFiles []*backuppb.File
+	for rangeFiles, leftFiles = drainFilesByRange(files, rc.fileImporter.supportMultiIngest); len(rangeFiles) != 0; rangeFiles, leftFiles = drainFilesByRange(leftFiles, rc.fileImporter.supportMultiIngest) {
+		fileGroups = append(fileGroups, rangeFiles)
+	}
+	if rc.tableLimiter != nil {
+		// submit the groups table by table, so the groups of a table in flight go first.
+		sort.SliceStable(fileGroups, func(i, j int) bool {
+			return restoredTableID(fileGroups[i][0], rewriteRules) < restoredTableID(fileGroups[j][0], rewriteRules)
+		})
+	}
+	if len(rc.descendingTables) > 0 {
+		descendTableFileGroups(fileGroups, rc.descendingTables)
+	}
+	return fileGroups
+}
+
+// restoreFileGroupsWithRetry restores the groups of files, and retries the unfinished groups
+// on the transient errors.
+func (rc *Client) restoreFileGroupsWithRetry(
+	ctx context.Context,
+	fileGroups [][]*backuppb.File,
+	rewriteRules *RewriteRules,
+	updateCh glue.Progress,
+	timings *tableTimingRecorder,
+) error {
+	backoff := rc.restoreFilesRetryInterval
+	for retry := 0; ; retry++ {
+		unfinished, err := rc.restoreFileGroups(ctx, fileGroups, rewriteRules, updateCh, timings)
+		if err == nil {
+			if len(unfinished) > 0 {
+				rc.timeBudget.recordUnrestored(unfinished, rewriteRules)
+				log.Warn("time budget of restore exhausted, the files left are not restored",
+					zap.Int("unrestored ranges", len(unfinished)))
+			}
+			return nil
+		}
+		if retry >= rc.restoreFilesRetryTimes || len(unfinished) == 0 || !isRetryableRestoreFilesError(err) {
+			summary.CollectFailureUnit(summaryUnit(rc.summaryPrefix, "file"), err)
+			log.Error(
+				"restore files failed",
+				zap.Error(err),
+			)
+			return errors.Trace(err)
+		}
+		log.Warn("restore files failed by a transient error, retry the unfinished files",
+			zap.Int("retry", retry+1),
+			zap.Int("unfinished ranges", len(unfinished)),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		if err := sleepWithContext(ctx, backoff); err != nil {
+			return errors.Trace(err)
+		}
+		backoff *= 2
+		if backoff > restoreFilesRetryMaxInterval {
+			backoff = restoreFilesRetryMaxInterval
+		}
+		fileGroups = unfinished
+	}
 }
 
 // RestoreFiles tries to restore the files.
+// The files are downloaded by TiKV rather than BR, and the files of different ranges are
+// imported concurrently by the worker pool, so the download of some ranges always overlaps
+// the ingest of others, there is no need to prefetch the files here.
 func (rc *Client) RestoreFiles(
 	ctx context.Context,
 	files []*backuppb.File,
@@ -607,7 +1827,7 @@ func (rc *Client) RestoreFiles(
 		elapsed := time.Since(start)
 		if err == nil {
 			log.Info("Restore files", zap.Duration("take", elapsed), logutil.Files(files))
-			summary.CollectSuccessUnit("files", len(files), elapsed)
+			summary.CollectSuccessUnit(summaryUnit(rc.summaryPrefix, "files"), len(files), elapsed)
 		}
 	}()
 
@@ -619,37 +1839,305 @@ func (rc *Client) RestoreFiles(
 		ctx = opentracing.ContextWithSpan(ctx, span1)
 	}
 
-	eg, ectx := errgroup.WithContext(ctx)
 	err = rc.setSpeedLimit(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	var rangeFiles []*backuppb.File
-	var leftFiles []*backuppb.File
-	for rangeFiles, leftFiles = drainFilesByRange(files, rc.fileImporter.supportMultiIngest); len(rangeFiles) != 0; rangeFiles, leftFiles = drainFilesByRange(leftFiles, rc.fileImporter.supportMultiIngest) {
-		filesReplica := rangeFiles
+	var droppedFiles []*backuppb.File
+	if rc.dropLastTableFiles {
+		files, droppedFiles = splitLastTableFiles(files, rewriteRules)
+	}
+
+	phases := [][]*backuppb.File{files}
+	if len(rc.cfGroupOrder) > 0 {
+		phases = groupFilesByCF(files, rc.cfGroupOrder)
+	}
+	timings := newTableTimingRecorder()
+	for _, phaseFiles := range phases {
+		if err := rc.restoreFileGroupsWithRetry(ctx, rc.drainFileGroups(phaseFiles, rewriteRules), rewriteRules, updateCh, timings); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, timing := range timings.sortedTimings() {
+		log.Info("restore files of table done",
+			zap.Int64("table id", timing.TableID),
+			zap.Int("files", timing.Files),
+			zap.Duration("take", timing.Duration()))
+		if rc.tableTimingCallback != nil {
+			rc.tableTimingCallback(timing)
+		}
+	}
+	if len(droppedFiles) > 0 {
+		log.Error("files of the last table are dropped on purpose", logutil.Files(droppedFiles))
+		return errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+			"%d files of table %d are dropped on purpose",
+			len(droppedFiles), restoredTableID(droppedFiles[0], rewriteRules))
+	}
+	return nil
+}
+
+// Pause halts submitting new files to restore, the files in flight still
+// get restored. It is a no-op if the restore is already paused.
+func (rc *Client) Pause() {
+	if rc.pauser.pause() {
+		log.Info("restore paused, the files in flight are still being restored")
+	}
+}
+
+// Resume resumes the restore paused by Pause.
+func (rc *Client) Resume() {
+	if rc.pauser.resume() {
+		log.Info("restore resumed")
+	}
+}
+
+// IsPaused checks whether the restore is paused.
+func (rc *Client) IsPaused() bool {
+	return rc.pauser.isPaused()
+}
+
+// restoreFileGroups restores the groups of files by the worker pool, the groups
+// which aren't restored are returned on error, or without an error if the time
+// budget is exhausted.
+func (rc *Client) restoreFileGroups(
+	ctx context.Context,
+	fileGroups [][]*backuppb.File,
+	rewriteRules *RewriteRules,
+	updateCh glue.Progress,
+	timings *tableTimingRecorder,
+) ([][]*backuppb.File, error) {
+	eg, ectx := errgroup.WithContext(ctx)
+	// every group is marked by its own task only, and read after the tasks are done.
+	finished := make([]bool, len(fileGroups))
+	var pauseErr error
+	exhausted := false
+	for i := range fileGroups {
+		if pauseErr = rc.pauser.wait(ectx); pauseErr != nil {
+			break
+		}
+		if exhausted = rc.timeBudget.exceeded(); exhausted {
+			break
+		}
+		i, filesReplica := i, fileGroups[i]
+		groupBytes := filesTotalBytes(filesReplica)
+		if rc.bytesLimiter != nil {
+			// don't start the group until the groups in flight leave room for it.
+			if pauseErr = rc.bytesLimiter.acquire(ectx, groupBytes); pauseErr != nil {
+				break
+			}
+		}
 		rc.workerPool.ApplyOnErrorGroup(eg,
-			func() error {
+			func() (err error) {
+				if rc.bytesLimiter != nil {
+					defer rc.bytesLimiter.release(groupBytes)
+				}
 				fileStart := time.Now()
 				defer func() {
+					fileEnd := time.Now()
 					log.Info("import files done", logutil.Files(filesReplica),
-						zap.Duration("take", time.Since(fileStart)))
-					updateCh.Inc()
+						zap.Duration("take", fileEnd.Sub(fileStart)))
+					timings.record(restoredTableID(filesReplica[0], rewriteRules), len(filesReplica), fileStart, fileEnd)
+					if err == nil {
+						finished[i] = true
+						rc.restoredFiles.Add(int64(len(filesReplica)))
+						updateCh.Inc()
+						if rc.ingestETA != nil {
+							rc.ingestETA.Finish(groupBytes, fileEnd)
+						}
+						if rc.fileIngestCallback != nil {
+							tableID := restoredTableID(filesReplica[0], rewriteRules)
+							for _, file := range filesReplica {
+								rc.fileIngestCallback(FileIngestResult{
+									TableID:    tableID,
+									Name:       file.GetName(),
+									CF:         fileCF(file),
+									StartKey:   file.GetStartKey(),
+									EndKey:     file.GetEndKey(),
+									TotalKvs:   file.GetTotalKvs(),
+									TotalBytes: file.GetTotalBytes(),
+									IngestedAt: fileEnd,
+								})
+							}
+						}
+					}
 				}()
+				// verify the files before waiting for the ingest, so verifying doesn't hold the tokens.
+				if err := rc.verifySampledFiles(ectx, filesReplica); err != nil {
+					return errors.Trace(err)
+				}
+				if rc.tableLimiter != nil {
+					tableID := restoredTableID(filesReplica[0], rewriteRules)
+					if err := rc.tableLimiter.acquire(ectx, tableID); err != nil {
+						return errors.Trace(err)
+					}
+					defer rc.tableLimiter.release(tableID)
+				}
+				if rc.ingestThrottle != nil {
+					if err := rc.ingestThrottle.Acquire(ectx); err != nil {
+						return errors.Trace(err)
+					}
+					defer rc.ingestThrottle.Release()
+				}
+				if rc.bandwidthLimiter != nil {
+					if err := rc.bandwidthLimiter.Wait(ectx, groupBytes); err != nil {
+						return errors.Trace(err)
+					}
+				}
 				return rc.fileImporter.Import(ectx, filesReplica, rewriteRules, rc.cipher)
 			})
 	}
 
-	if err := eg.Wait(); err != nil {
-		summary.CollectFailureUnit("file", err)
-		log.Error(
-			"restore files failed",
-			zap.Error(err),
-		)
-		return errors.Trace(err)
+	err := eg.Wait()
+	if err == nil {
+		err = pauseErr
 	}
-	return nil
+	if err == nil && !exhausted {
+		return nil, nil
+	}
+	unfinished := make([][]*backuppb.File, 0)
+	for i, files := range fileGroups {
+		if !finished[i] {
+			unfinished = append(unfinished, files)
+		}
+	}
+	return unfinished, errors.Trace(err)
+}
+
+// isRetryableRestoreFilesError checks whether the error of restoring files is transient,
+// i.e. the files are likely to be restored by retrying after a while, even though
+// the importer has retried. The error is only retryable if all of its errors are.
+func isRetryableRestoreFilesError(err error) bool {
+	cause := errors.Cause(err)
+	if errs := multierr.Errors(cause); len(errs) > 1 {
+		for _, e := range errs {
+			if !isRetryableRestoreFilesError(e) {
+				return false
+			}
+		}
+		return true
+	}
+	switch cause { // nolint:errorlint
+	case berrors.ErrKVEpochNotMatch, berrors.ErrKVDownloadFailed, berrors.ErrKVIngestFailed:
+		return true
+	}
+	switch status.Code(cause) {
+	case codes.Unavailable, codes.Aborted, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// timeBudget tracks the deadline of the restore and the files left by it,
+// the zero value is unlimited.
+type timeBudget struct {
+	deadline time.Time
+
+	mu sync.Mutex
+	// unrestored is the count of the files left unrestored by the restored table.
+	unrestored map[int64]int
+}
+
+func (b *timeBudget) exceeded() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+func (b *timeBudget) recordUnrestored(fileGroups [][]*backuppb.File, rewriteRules *RewriteRules) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.unrestored == nil {
+		b.unrestored = make(map[int64]int)
+	}
+	for _, files := range fileGroups {
+		for _, file := range files {
+			b.unrestored[restoredTableID(file, rewriteRules)]++
+		}
+	}
+}
+
+func (b *timeBudget) unrestoredTables() []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tableIDs := make([]int64, 0, len(b.unrestored))
+	for tableID := range b.unrestored {
+		tableIDs = append(tableIDs, tableID)
+	}
+	sort.Slice(tableIDs, func(i, j int) bool { return tableIDs[i] < tableIDs[j] })
+	return tableIDs
+}
+
+func (b *timeBudget) isRestored(tableID int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.unrestored[tableID] == 0
+}
+
+// pauser blocks the waiters while paused, the zero value isn't paused.
+type pauser struct {
+	mu sync.Mutex
+	// resumed is closed on resuming, nil if not paused.
+	resumed chan struct{}
+}
+
+func (p *pauser) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+func (p *pauser) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		return false
+	}
+	close(p.resumed)
+	p.resumed = nil
+	return true
+}
+
+func (p *pauser) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// wait blocks until resumed or the context is done.
+func (p *pauser) wait(ctx context.Context) error {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// splitLastTableFiles splits the files of the table with the largest new ID from the other files.
+func splitLastTableFiles(files []*backuppb.File, rewriteRules *RewriteRules) (rest, last []*backuppb.File) {
+	lastTableID := int64(0)
+	for _, file := range files {
+		if tableID := restoredTableID(file, rewriteRules); tableID > lastTableID {
+			lastTableID = tableID
+		}
+	}
+	for _, file := range files {
+		if restoredTableID(file, rewriteRules) == lastTableID {
+			last = append(last, file)
+		} else {
+			rest = append(rest, file)
+		}
+	}
+	return rest, last
 }
 
 // RestoreRaw tries to restore raw keys in the specified range.
@@ -822,7 +2310,7 @@ func (rc *Client) GoValidateChecksum(
 					defer func() {
 						elapsed := time.Since(start)
 						summary.CollectDuration("restore checksum", elapsed)
-						summary.CollectSuccessUnit("table checksum", 1, elapsed)
+						summary.CollectSuccessUnit(summaryUnit(rc.summaryPrefix, "table checksum"), 1, elapsed)
 					}()
 					err := rc.execChecksum(ectx, tbl, kvClient, concurrency, loadStatCh)
 					if err != nil {
@@ -984,19 +2472,54 @@ func (rc *Client) SetupPlacementRules(ctx context.Context, tables []*model.Table
 		Op:     "in",
 		Values: []string{restoreLabelValue},
 	})
+	skipped := 0
 	for _, t := range tables {
 		rule.ID = rc.getRuleID(t.ID)
 		rule.StartKeyHex = hex.EncodeToString(codec.EncodeBytes([]byte{}, tablecodec.EncodeTablePrefix(t.ID)))
 		rule.EndKeyHex = hex.EncodeToString(codec.EncodeBytes([]byte{}, tablecodec.EncodeTablePrefix(t.ID+1)))
+		if rc.skipMatchedPlacementRules {
+			current, err := rc.toolClient.GetPlacementRule(ctx, rule.GroupID, rule.ID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if placementRuleMatches(current, rule) {
+				log.Debug("skip the matched placement rule", zap.String("rule-id", rule.ID))
+				skipped++
+				continue
+			}
+		}
 		err = rc.toolClient.SetPlacementRule(ctx, rule)
 		if err != nil {
 			return errors.Trace(err)
 		}
 	}
-	log.Info("finish setting placement rules")
+	log.Info("finish setting placement rules", zap.Int("tables", len(tables)), zap.Int("skipped", skipped))
 	return nil
 }
 
+// placementRuleMatches returns whether the current rule loaded from PD is the same as the desired one.
+// Only the fields BR sets are compared, the fields PD fills in at runtime, like the version, are ignored.
+func placementRuleMatches(current, desired placement.Rule) bool {
+	if current.GroupID != desired.GroupID || current.ID != desired.ID ||
+		current.StartKeyHex != desired.StartKeyHex || current.EndKeyHex != desired.EndKeyHex ||
+		current.Role != desired.Role || current.Count != desired.Count ||
+		len(current.LabelConstraints) != len(desired.LabelConstraints) {
+		return false
+	}
+	for i, constraint := range current.LabelConstraints {
+		other := desired.LabelConstraints[i]
+		if constraint.Key != other.Key || constraint.Op != other.Op || len(constraint.Values) != len(other.Values) {
+			return false
+		}
+		for j, value := range constraint.Values {
+			if value != other.Values[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // WaitPlacementSchedule waits PD to move tables to restore stores.
 func (rc *Client) WaitPlacementSchedule(ctx context.Context, tables []*model.TableInfo) error {
 	if !rc.isOnline || len(rc.restoreStores) == 0 {
@@ -1059,9 +2582,37 @@ func (rc *Client) checkRange(ctx context.Context, start, end []byte) (bool, stri
 
 // ResetPlacementRules removes placement rules for tables.
 func (rc *Client) ResetPlacementRules(ctx context.Context, tables []*model.TableInfo) error {
+	return rc.resetPlacementRules(ctx, tables, rc.keepPlacementRules)
+}
+
+// DiscardPlacementRules removes placement rules for the tables failed to restore,
+// even if the rules are kept on purpose, as the tables would stay on the restore stores
+// without anyone looking into them.
+func (rc *Client) DiscardPlacementRules(ctx context.Context, tables []*model.TableInfo) error {
+	if rc.keepPlacementRules && len(tables) > 0 {
+		ruleIDs := make([]string, 0, len(tables))
+		for _, t := range tables {
+			ruleIDs = append(ruleIDs, rc.getRuleID(t.ID))
+		}
+		log.Warn("restore failed, removing the placement rules kept on purpose",
+			zap.Strings("rule-ids", ruleIDs))
+	}
+	return rc.resetPlacementRules(ctx, tables, false)
+}
+
+func (rc *Client) resetPlacementRules(ctx context.Context, tables []*model.TableInfo, keep bool) error {
 	if !rc.isOnline || len(rc.restoreStores) == 0 {
 		return nil
 	}
+	if keep {
+		ruleIDs := make([]string, 0, len(tables))
+		for _, t := range tables {
+			ruleIDs = append(ruleIDs, rc.getRuleID(t.ID))
+		}
+		log.Warn("placement rules of restored tables are kept on purpose, please remove them manually",
+			zap.Strings("rule-ids", ruleIDs))
+		return nil
+	}
 	log.Info("start reseting placement rules")
 	var failedTables []int64
 	for _, t := range tables {
@@ -1072,11 +2623,23 @@ func (rc *Client) ResetPlacementRules(ctx context.Context, tables []*model.Table
 		}
 	}
 	if len(failedTables) > 0 {
-		return errors.Annotatef(berrors.ErrPDInvalidResponse, "failed to delete placement rules for tables %v", failedTables)
+		err := errors.Annotatef(berrors.ErrPDInvalidResponse, "failed to delete placement rules for tables %v", failedTables)
+		rc.placementRuleResetMu.Lock()
+		rc.placementRuleResetErrs = append(rc.placementRuleResetErrs, err)
+		rc.placementRuleResetMu.Unlock()
+		return err
 	}
 	return nil
 }
 
+// PlacementRuleResetErrors returns the errors of resetting the placement rules of online restore
+// so far. The restore goes on without them, so the rules left must be removed manually.
+func (rc *Client) PlacementRuleResetErrors() []error {
+	rc.placementRuleResetMu.Lock()
+	defer rc.placementRuleResetMu.Unlock()
+	return append([]error(nil), rc.placementRuleResetErrs...)
+}
+
 func (rc *Client) getRuleID(tableID int64) string {
 	return "restore-t" + strconv.FormatInt(tableID, 10)
 }
@@ -1136,6 +2699,124 @@ func (rc *Client) PreCheckTableTiFlashReplica(
 	return nil
 }
 
+// TiFlashReplicaStatus is the status of the TiFlash replica of a restored table.
+type TiFlashReplicaStatus struct {
+	DB    model.CIStr
+	Table model.CIStr
+	Count uint64
+	// Skipped is true when the restore cluster doesn't have enough TiFlash stores.
+	Skipped   bool
+	Available bool
+}
+
+// sourceTiFlashReplicaCount returns the TiFlash replica count of the table in the backup cluster.
+func sourceTiFlashReplicaCount(table *metautil.Table) uint64 {
+	if table.Info.TiFlashReplica != nil {
+		return table.Info.TiFlashReplica.Count
+	}
+	return uint64(table.TiFlashReplicas)
+}
+
+// RecoverTiFlashReplica sets the TiFlash replica count of the restored tables
+// which have TiFlash replicas in the backup cluster.
+// When waitTimeout is greater than zero, it waits until the replicas are available or the timeout is reached.
+func (rc *Client) RecoverTiFlashReplica(
+	ctx context.Context,
+	tables []CreatedTable,
+	waitTimeout time.Duration,
+) ([]TiFlashReplicaStatus, error) {
+	tiFlashStores, err := conn.GetAllTiKVStores(ctx, rc.pdClient, conn.TiFlashOnly)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	statuses := make([]TiFlashReplicaStatus, 0, len(tables))
+	for _, table := range tables {
+		count := sourceTiFlashReplicaCount(table.OldTable)
+		if count == 0 {
+			continue
+		}
+		status := TiFlashReplicaStatus{
+			DB:    table.OldTable.DB.Name,
+			Table: table.Table.Name,
+			Count: count,
+		}
+		if count > uint64(len(tiFlashStores)) {
+			log.Warn("skip recovering tiflash replica, tiflash stores are not enough",
+				zap.Stringer("db", status.DB),
+				zap.Stringer("table", status.Table),
+				zap.Uint64("replica count", count),
+				zap.Int("tiflash store count", len(tiFlashStores)))
+			status.Skipped = true
+			statuses = append(statuses, status)
+			continue
+		}
+		if err := rc.db.AlterTiFlashReplica(ctx, status.DB, status.Table, count); err != nil {
+			return statuses, errors.Trace(err)
+		}
+		statuses = append(statuses, status)
+	}
+
+	if waitTimeout > 0 {
+		if err := rc.waitTiFlashReplicaAvailable(ctx, statuses, waitTimeout); err != nil {
+			return statuses, errors.Trace(err)
+		}
+	}
+	for _, status := range statuses {
+		log.Info("tiflash replica recovered",
+			zap.Stringer("db", status.DB),
+			zap.Stringer("table", status.Table),
+			zap.Uint64("replica count", status.Count),
+			zap.Bool("skipped", status.Skipped),
+			zap.Bool("available", status.Available))
+	}
+	return statuses, nil
+}
+
+// waitTiFlashReplicaAvailable polls the schema until all the not skipped TiFlash replicas
+// are available, and updates the statuses in place. Reaching the timeout isn't an error.
+func (rc *Client) waitTiFlashReplicaAvailable(
+	ctx context.Context,
+	statuses []TiFlashReplicaStatus,
+	waitTimeout time.Duration,
+) error {
+	if rc.dom == nil {
+		return errors.Annotate(berrors.ErrUnsupportedOperation, "wait tiflash replica without domain")
+	}
+	ticker := time.NewTicker(tiFlashReplicaCheckInterval)
+	defer ticker.Stop()
+	timeout := time.After(waitTimeout)
+	for {
+		pending := 0
+		for i := range statuses {
+			if statuses[i].Skipped || statuses[i].Available {
+				continue
+			}
+			tableInfo, err := rc.GetTableSchema(rc.dom, statuses[i].DB, statuses[i].Table)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if tableInfo.TiFlashReplica != nil && tableInfo.TiFlashReplica.Available {
+				statuses[i].Available = true
+				continue
+			}
+			pending++
+		}
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			log.Warn("timeout when waiting tiflash replica available",
+				zap.Int("pending table count", pending),
+				zap.Duration("timeout", waitTimeout))
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
 // PreCheckTableClusterIndex checks whether backup tables and existed tables have different cluster index options。
 func (rc *Client) PreCheckTableClusterIndex(
 	tables []*metautil.Table,
@@ -1176,6 +2857,53 @@ func (rc *Client) PreCheckTableClusterIndex(
 	return nil
 }
 
+// PreCheckTablesEmpty checks whether the existed tables of the backup tables contain no keys.
+// The deletes of an incremental backup only matter to the existed rows, so they can be dropped,
+// see MergeConfig.DropTombstoneFiles, only when the tables are empty. The tables not existed yet
+// are created empty.
+func (rc *Client) PreCheckTablesEmpty(
+	ctx context.Context,
+	store kv.Storage,
+	tables []*metautil.Table,
+	dom *domain.Domain,
+) error {
+	ver, err := store.CurrentVersion(kv.GlobalTxnScope)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	snapshot := store.GetSnapshot(ver)
+	for _, table := range tables {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		oldTableInfo, err := rc.GetTableSchema(dom, table.DB.Name, table.Info.Name)
+		// table doesn't exist in database
+		if err != nil {
+			continue
+		}
+		physicalIDs := []int64{oldTableInfo.ID}
+		if partitions := oldTableInfo.GetPartitionInfo(); partitions != nil {
+			for _, def := range partitions.Definitions {
+				physicalIDs = append(physicalIDs, def.ID)
+			}
+		}
+		for _, id := range physicalIDs {
+			prefix := tablecodec.EncodeTablePrefix(id)
+			iter, err := snapshot.Iter(prefix, prefix.PrefixNext())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			empty := !iter.Valid()
+			iter.Close()
+			if !empty {
+				return errors.Annotatef(berrors.ErrInvalidArgument,
+					"table %s.%s isn't empty", table.DB.Name, table.Info.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func transferBoolToValue(enable bool) string {
 	if enable {
 		return "ON"
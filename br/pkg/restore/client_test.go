@@ -3,24 +3,51 @@
 package restore_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/kvproto/pkg/encryptionpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	berrors "github.com/pingcap/tidb/br/pkg/errors"
 	"github.com/pingcap/tidb/br/pkg/gluetidb"
 	"github.com/pingcap/tidb/br/pkg/metautil"
 	"github.com/pingcap/tidb/br/pkg/mock"
 	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/br/pkg/storage"
+	"github.com/pingcap/tidb/br/pkg/summary"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/parser/model"
 	"github.com/pingcap/tidb/parser/mysql"
 	"github.com/pingcap/tidb/parser/types"
 	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/encrypt"
 	"github.com/pingcap/tidb/util/testleak"
 	pd "github.com/tikv/pd/client"
+	"github.com/tikv/pd/server/schedule/placement"
+	"go.uber.org/atomic"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 var _ = Suite(&testRestoreClientSuite{})
@@ -175,6 +202,68 @@ func (s *testRestoreClientSuite) TestPreCheckTableClusterIndex(c *C) {
 	c.Assert(client.PreCheckTableClusterIndex(tables, jobs, s.mock.Domain), IsNil)
 }
 
+func (s *testRestoreClientSuite) TestPreCheckTablesEmpty(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	info, err := s.mock.Domain.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	dbSchema, isExist := info.SchemaByName(model.NewCIStr("test"))
+	c.Assert(isExist, IsTrue)
+	intField := types.NewFieldType(mysql.TypeLong)
+	intField.Charset = "binary"
+	newTable := func(name string) *metautil.Table {
+		return &metautil.Table{
+			DB: dbSchema,
+			Info: &model.TableInfo{
+				ID:   1,
+				Name: model.NewCIStr(name),
+				Columns: []*model.ColumnInfo{{
+					ID:        1,
+					Name:      model.NewCIStr("id"),
+					FieldType: *intField,
+					State:     model.StatePublic,
+				}},
+				Charset: "utf8mb4",
+				Collate: "utf8mb4_bin",
+			},
+		}
+	}
+	existed := newTable("existed")
+	_, _, err = client.CreateTables(s.mock.Domain, []*metautil.Table{existed}, 0)
+	c.Assert(err, IsNil)
+	// the tables not existed yet are created empty.
+	tables := []*metautil.Table{existed, newTable("not_existed")}
+	c.Assert(client.PreCheckTablesEmpty(context.Background(), s.mock.Storage, tables, s.mock.Domain), IsNil)
+
+	// the row deleted by the incremental backup is in the existed table.
+	se, err := gluetidb.New().CreateSession(s.mock.Storage)
+	c.Assert(err, IsNil)
+	defer se.Close()
+	c.Assert(se.Execute(context.Background(), "INSERT INTO test.existed VALUES (1)"), IsNil)
+	err = client.PreCheckTablesEmpty(context.Background(), s.mock.Storage, tables, s.mock.Domain)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+	c.Assert(err, ErrorMatches, ".*table test.existed isn't empty.*")
+	// the tombstone file of the delete would be dropped.
+	fb := fileBulder{}
+	files := fb.build(int(existed.Info.ID), 0, 1, 0, 0)
+	for _, f := range files {
+		f.StartVersion = 10
+		f.EndVersion = 20
+	}
+	rngs, stat, err := restore.MergeFileRangesWithConfig(files, restore.MergeConfig{
+		SplitSizeBytes:     1,
+		SplitKeyCount:      1,
+		DropTombstoneFiles: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 0)
+	c.Assert(stat.TombstoneFiles, Equals, 1)
+}
+
 type fakePDClient struct {
 	pd.Client
 	stores []*metapb.Store
@@ -245,3 +334,2592 @@ func (s *testRestoreClientSuite) TestPreCheckTableTiFlashReplicas(c *C) {
 		}
 	}
 }
+
+type recordUnitCollector struct {
+	summary.LogCollector
+	mu    sync.Mutex
+	units []string
+}
+
+func (rc *recordUnitCollector) CollectSuccessUnit(name string, unitCount int, arg interface{}) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.units = append(rc.units, name)
+}
+
+type nopProgress struct{}
+
+func (nopProgress) Inc()   {}
+func (nopProgress) Close() {}
+
+func (s *testRestoreClientSuite) TestSummaryPrefix(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	collector := &recordUnitCollector{LogCollector: summary.NewLogCollector(log.Info)}
+	summary.SetLogCollector(collector)
+	defer summary.SetLogCollector(summary.NewLogCollector(log.Info))
+
+	ctx := context.Background()
+	c.Assert(client.RestoreFiles(ctx, nil, restore.EmptyRewriteRule(), nopProgress{}), IsNil)
+	client.SetSummaryPrefix("restore")
+	c.Assert(client.RestoreFiles(ctx, nil, restore.EmptyRewriteRule(), nopProgress{}), IsNil)
+	c.Assert(collector.units, DeepEquals, []string{"files", "restore.files"})
+
+	// the total KVs and bytes are rendered by the exact names, so they aren't prefixed.
+	collector.units = nil
+	client.SetConcurrency(1)
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), &fakeImporterClient{}, nil, false, 0))
+	files := []*backuppb.File{newImportTestFile("1_write.sst", 1)}
+	c.Assert(client.RestoreFiles(ctx, files, newImportTestRewriteRules(1, 11), nopProgress{}), IsNil)
+	c.Assert(collector.units, DeepEquals, []string{summary.TotalKV, summary.TotalBytes, "restore.files"})
+}
+
+func (s *testRestoreClientSuite) TestSetFileImporterKeepsNameRewriter(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(1)
+	client.SetDownloadNameRewriter(func(name string) string { return "backup/" + name })
+	// the importer set later still rewrites the names.
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	files := []*backuppb.File{newImportTestFile("1_write.sst", 1)}
+	c.Assert(client.RestoreFiles(context.Background(), files, newImportTestRewriteRules(1, 11), nopProgress{}), IsNil)
+	c.Assert(importCli.downloaded, DeepEquals, []string{"backup/1_write.sst"})
+}
+
+func newTestCreatedTable(oldID, newID int64) restore.CreatedTable {
+	oldTable := &model.TableInfo{ID: oldID, Name: model.NewCIStr("t" + strconv.FormatInt(oldID, 10))}
+	newTable := &model.TableInfo{ID: newID, Name: oldTable.Name}
+	return restore.CreatedTable{
+		RewriteRule: restore.GetRewriteRules(newTable, oldTable, 0),
+		Table:       newTable,
+		OldTable: &metautil.Table{
+			DB:   &model.DBInfo{Name: model.NewCIStr("test")},
+			Info: oldTable,
+		},
+	}
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroups(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// table 1 contains 3 small ranges, table 2 contains 2 big ranges.
+	for i := 0; i < 3; i++ {
+		files = append(files, fb.build(1, 0, 2, 1, 1)...)
+	}
+	for i := 0; i < 2; i++ {
+		files = append(files, fb.build(2, 0, 2, int(restore.DefaultMergeRegionSizeBytes), 1)...)
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(2, 102), newTestCreatedTable(1, 101)}
+
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 2)
+	c.Assert(groups[0].Table.ID, Equals, int64(102))
+	c.Assert(groups[0].Range, HasLen, 2)
+	c.Assert(groups[0].Files(), HasLen, 4)
+	c.Assert(groups[1].Table.ID, Equals, int64(101))
+	c.Assert(groups[1].Range, HasLen, 1)
+	c.Assert(groups[1].Files(), HasLen, 6)
+
+	// the files must match the rewrite rules.
+	tables[0].RewriteRule = restore.EmptyRewriteRule()
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, ErrorMatches, ".*cannot find rewrite rule.*")
+
+	// a table with files must have the rewrite rules.
+	tables[0].RewriteRule = nil
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, ErrorMatches, ".*table .* has 4 files to restore but no rewrite rules.*")
+	// but a table without files needn't.
+	tables[0] = newTestCreatedTable(2, 102)
+	tables = append(tables, newTestCreatedTable(3, 103))
+	tables[2].RewriteRule = nil
+	groups, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 3)
+	c.Assert(groups[2].Files(), HasLen, 0)
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsCollectAllErrors(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for tableID := 1; tableID <= 3; tableID++ {
+		files = append(files, fb.build(tableID, 0, 2, 1, 1)...)
+	}
+	// table 1 is fine, table 2 has mismatched rewrite rules and table 3 has no rewrite rules.
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102), newTestCreatedTable(3, 103),
+	}
+	tables[1].RewriteRule = restore.EmptyRewriteRule()
+	tables[2].RewriteRule = nil
+
+	// fail fast by default.
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, ErrorMatches, ".*cannot find rewrite rule.*")
+	c.Assert(multierr.Errors(errors.Cause(err)), HasLen, 1)
+
+	checkErrors := func(err error) {
+		errs := multierr.Errors(errors.Cause(err))
+		c.Assert(errs, HasLen, 2)
+		c.Assert(errs[0], ErrorMatches, ".*cannot find rewrite rule.*")
+		c.Assert(errs[1], ErrorMatches, ".*table t3 has 2 files to restore but no rewrite rules.*")
+	}
+	mergeCfg := restore.MergeConfig{CollectAllErrors: true}
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, mergeCfg)
+	checkErrors(err)
+	c.Assert(groups, HasLen, 0)
+
+	// the pipeline yields no table on the errors, even the tables before them.
+	tableStream := make(chan restore.CreatedTable, len(tables))
+	for _, t := range tables {
+		tableStream <- t
+	}
+	close(tableStream)
+	errCh := make(chan error, 1)
+	yielded := 0
+	for range restore.GoValidateFileRanges(
+		context.Background(), tableStream, restore.MapTableToFiles(files), mergeCfg, errCh) {
+		yielded++
+	}
+	c.Assert(yielded, Equals, 0)
+	select {
+	case err := <-errCh:
+		checkErrors(err)
+	default:
+		c.Fatal("no error is reported")
+	}
+
+	// but yields all the tables at the end without errors.
+	tableStream = make(chan restore.CreatedTable, 1)
+	tableStream <- tables[0]
+	close(tableStream)
+	yielded = 0
+	for range restore.GoValidateFileRanges(context.Background(), tableStream,
+		restore.MapTableToFiles(files[:2]), mergeCfg, errCh) {
+		yielded++
+	}
+	c.Assert(yielded, Equals, 1)
+	c.Assert(errCh, HasLen, 0)
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsSplitAtIndexBoundaries(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	indexes := func(ids ...int64) []*model.IndexInfo {
+		infos := make([]*model.IndexInfo, 0, len(ids))
+		for _, id := range ids {
+			infos = append(infos, &model.IndexInfo{ID: id, Name: model.NewCIStr("i" + strconv.FormatInt(id, 10))})
+		}
+		return infos
+	}
+	// the indexes are renumbered in the restored table.
+	oldTable := &model.TableInfo{ID: 1, Name: model.NewCIStr("t1"), Indices: indexes(1, 2)}
+	newTable := &model.TableInfo{ID: 101, Name: oldTable.Name, Indices: indexes(3, 4)}
+	newTable.Indices[0].Name, newTable.Indices[1].Name = oldTable.Indices[0].Name, oldTable.Indices[1].Name
+	tables := []restore.CreatedTable{{
+		RewriteRule: restore.GetRewriteRules(newTable, oldTable, 0),
+		Table:       newTable,
+		OldTable: &metautil.Table{
+			DB:   &model.DBInfo{Name: model.NewCIStr("test")},
+			Info: oldTable,
+		},
+	}}
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// index 1 has 2 small ranges, index 2 has an empty range, and the records have 2 small ranges.
+	files = append(files, fb.build(1, 1, 1, 1, 1)...)
+	files = append(files, fb.build(1, 1, 1, 1, 1)...)
+	files = append(files, fb.build(1, 2, 1, 0, 0)...)
+	files = append(files, fb.build(1, 0, 1, 1, 1)...)
+	files = append(files, fb.build(1, 0, 1, 1, 1)...)
+	endKeys := func(mergeCfg restore.MergeConfig) [][]byte {
+		groups, err := client.BuildFileGroups(context.Background(), tables, files, mergeCfg)
+		c.Assert(err, IsNil)
+		c.Assert(groups, HasLen, 1)
+		keys := make([][]byte, 0, len(groups[0].Range))
+		for _, rg := range groups[0].Range {
+			keys = append(keys, rg.EndKey)
+		}
+		return keys
+	}
+
+	// the empty range of index 2 is merged into index 1 by default.
+	c.Assert(endKeys(restore.MergeConfig{}), DeepEquals, [][]byte{files[2].EndKey, files[4].EndKey})
+	// but split at the boundaries of the indexes and the records.
+	boundaryKeys := [][]byte{
+		tablecodec.EncodeTableIndexPrefix(1, 2),
+		tablecodec.GenTableRecordPrefix(1),
+		files[4].EndKey,
+	}
+	c.Assert(endKeys(restore.MergeConfig{SplitAtIndexBoundaries: true}), DeepEquals, boundaryKeys)
+	// deterministically.
+	c.Assert(endKeys(restore.MergeConfig{SplitAtIndexBoundaries: true}), DeepEquals, boundaryKeys)
+
+	// the split keys are rewritten to the boundaries of the restored table.
+	groups, err := client.BuildFileGroups(context.Background(), tables, files,
+		restore.MergeConfig{SplitAtIndexBoundaries: true})
+	c.Assert(err, IsNil)
+	rewritten, err := restore.SortRanges(groups[0].Range, tables[0].RewriteRule)
+	c.Assert(err, IsNil)
+	c.Assert(rewritten, HasLen, 3)
+	c.Assert(rewritten[0].EndKey, DeepEquals, []byte(tablecodec.EncodeTableIndexPrefix(101, 4)))
+	c.Assert(rewritten[1].EndKey, DeepEquals, []byte(tablecodec.GenTableRecordPrefix(101)))
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsByCF(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// table 1 contains ranges of both CFs, table 2 contains a range of write CF only.
+	for i := 0; i < 2; i++ {
+		files = append(files, fb.build(1, 0, 2, int(restore.DefaultMergeRegionSizeBytes), 1)...)
+	}
+	files = append(files, fb.build(2, 0, 1, 1, 1)...)
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+
+	checkGroup := func(group restore.TableWithRange, tableID int64, cf string, ranges int) {
+		c.Assert(group.Table.ID, Equals, tableID)
+		c.Assert(group.Range, HasLen, ranges)
+		for _, file := range group.Files() {
+			c.Assert(file.Cf, Equals, cf)
+		}
+	}
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{
+		CFGroupOrder: []string{"write", "default"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 3)
+	checkGroup(groups[0], 101, "write", 2)
+	checkGroup(groups[1], 101, "default", 2)
+	checkGroup(groups[2], 102, "write", 1)
+	c.Assert(groups[0].RewriteRule, Equals, tables[0].RewriteRule)
+	c.Assert(groups[1].RewriteRule, Equals, tables[0].RewriteRule)
+	for i := range groups[0].Range {
+		c.Assert(groups[0].Range[i].StartKey, DeepEquals, groups[1].Range[i].StartKey)
+		c.Assert(groups[0].Range[i].EndKey, DeepEquals, groups[1].Range[i].EndKey)
+	}
+
+	// the unlisted CFs are grouped last.
+	groups, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{
+		CFGroupOrder: []string{"default"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 3)
+	checkGroup(groups[0], 101, "default", 2)
+	checkGroup(groups[1], 101, "write", 2)
+	checkGroup(groups[2], 102, "write", 1)
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsValidateRewriteTableID(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 2; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+	cfg := restore.MergeConfig{ValidateRewriteTableID: true}
+
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 2)
+
+	// the rewrite rule of table 2 is built for the wrong table.
+	tables[1].RewriteRule = restore.GetRewriteRules(&model.TableInfo{ID: 103}, tables[1].OldTable.Info, 0)
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	_, err = client.BuildFileGroups(context.Background(), tables, files, cfg)
+	c.Assert(err, ErrorMatches, ".*file .*_write.sst is rewritten into table 103, but expected table 102.*")
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsRewriteCollision(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 2; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+
+	// both tables are rewritten into table 101.
+	tables[1].RewriteRule = restore.GetRewriteRules(&model.TableInfo{ID: 101}, tables[1].OldTable.Info, 0)
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInvalidRewrite)
+	c.Assert(err, ErrorMatches, ".*tables test.t1 and test.t2 are rewritten into the overlapping keyspaces.*")
+
+	// the keyspace of table 2 contains the one of table 1 though the prefixes differ.
+	tables[1].RewriteRule = &restore.RewriteRules{Data: []*import_sstpb.RewriteRule{{
+		OldKeyPrefix: tablecodec.EncodeTablePrefix(2),
+		NewKeyPrefix: tablecodec.EncodeTablePrefix(101),
+	}}}
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, ErrorMatches, ".*tables test.t1 and test.t2 are rewritten into the overlapping keyspaces.*")
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsReservedKeyRanges(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// the files of the handles [0, 10) of the tables 1 and 2.
+	for id := 1; id <= 2; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+	handleKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKey(tableID, codec.EncodeInt(nil, handle))
+	}
+	cfg := restore.MergeConfig{ReservedKeyRanges: []rtree.Range{
+		// the keyspaces of the old tables, and the one after the restored tables.
+		{StartKey: tablecodec.EncodeTablePrefix(1), EndKey: tablecodec.EncodeTablePrefix(3)},
+		{StartKey: tablecodec.EncodeTablePrefix(103)},
+	}}
+	_, err = client.BuildFileGroups(context.Background(), tables, files, cfg)
+	c.Assert(err, IsNil)
+
+	// the handles [5, 8) of table 102 are reserved.
+	cfg.ReservedKeyRanges = append(cfg.ReservedKeyRanges, rtree.Range{
+		StartKey: handleKey(102, 5),
+		EndKey:   handleKey(102, 8),
+	})
+	_, err = client.BuildFileGroups(context.Background(), tables, files, cfg)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInvalidRewrite)
+	c.Assert(err, ErrorMatches, ".*file .* of table t2 is rewritten into .*, which overlaps the reserved key range.*")
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsOrphanFiles(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 3; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+	// the files of the tables 2 and 3 are orphans.
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101)}
+
+	core, logs := observer.New(zap.WarnLevel)
+	defer log.ReplaceGlobals(zap.New(core), nil)()
+	// strict by default.
+	for _, policy := range []restore.OrphanFilesPolicy{"", restore.OrphanFilesStrict} {
+		_, err = client.BuildFileGroups(context.Background(), tables, files,
+			restore.MergeConfig{OrphanFilesPolicy: policy})
+		c.Assert(err, ErrorMatches, ".*4 files of the tables \\[2 3\\] are not in the tables to restore.*")
+	}
+
+	groups, err := client.BuildFileGroups(context.Background(), tables, files,
+		restore.MergeConfig{OrphanFilesPolicy: restore.OrphanFilesWarn})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups[0].Files(), HasLen, 2)
+	orphanLogs := logs.FilterMessageSnippet("tables not to restore").All()
+	c.Assert(orphanLogs, HasLen, 1)
+	c.Assert(orphanLogs[0].ContextMap()["files"], Equals, int64(4))
+
+	logs.TakeAll()
+	groups, err = client.BuildFileGroups(context.Background(), tables, files,
+		restore.MergeConfig{OrphanFilesPolicy: restore.OrphanFilesIgnore})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups[0].Files(), HasLen, 2)
+	c.Assert(logs.FilterMessageSnippet("tables not to restore").All(), HasLen, 0)
+
+	// the pipeline leaves the orphan files to the check ahead of creating the tables.
+	oldTables := []*metautil.Table{tables[0].OldTable}
+	err = restore.CheckOrphanFiles(oldTables, restore.MapTableToFiles(files), "")
+	c.Assert(err, ErrorMatches, ".*4 files of the tables \\[2 3\\] are not in the tables to restore.*")
+	c.Assert(restore.CheckOrphanFiles(oldTables, restore.MapTableToFiles(files), restore.OrphanFilesWarn), IsNil)
+	c.Assert(restore.CheckOrphanFiles(oldTables, restore.MapTableToFiles(files), restore.OrphanFilesIgnore), IsNil)
+	// the partitions of the tables in the backup aren't orphans.
+	partitioned := &metautil.Table{Info: &model.TableInfo{ID: 1, Partition: &model.PartitionInfo{
+		Definitions: []model.PartitionDefinition{{ID: 2}, {ID: 3}},
+	}}}
+	c.Assert(restore.CheckOrphanFiles([]*metautil.Table{partitioned}, restore.MapTableToFiles(files), ""), IsNil)
+
+	tableStream := make(chan restore.CreatedTable, len(tables))
+	for _, t := range tables {
+		tableStream <- t
+	}
+	close(tableStream)
+	errCh := make(chan error, 1)
+	ranges := 0
+	for range restore.GoValidateFileRanges(context.Background(), tableStream, restore.MapTableToFiles(files),
+		restore.MergeConfig{}, errCh) {
+		ranges++
+	}
+	c.Assert(errCh, HasLen, 0)
+	c.Assert(ranges, Equals, 1)
+
+	_, err = restore.ParseOrphanFilesPolicy("warn")
+	c.Assert(err, IsNil)
+	_, err = restore.ParseOrphanFilesPolicy("drop")
+	c.Assert(err, ErrorMatches, ".*unknown orphan files policy drop.*")
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsAlignedToRegionTemplate(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// 4 small ranges of 10 handles each: [0, 10), [10, 20), [20, 30), [30, 40).
+	for i := 0; i < 4; i++ {
+		files = append(files, fb.build(1, 0, 2, 1, 1)...)
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101)}
+
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups[0].Range, HasLen, 1)
+
+	// the template is in the keyspace of the restored tables, the key of table 102 isn't restored.
+	template := [][]byte{
+		tablecodec.EncodeRowKey(101, codec.EncodeInt(nil, 20)),
+		tablecodec.EncodeRowKey(102, codec.EncodeInt(nil, 10)),
+	}
+	groups, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{RegionTemplate: template})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups[0].Range, HasLen, 2)
+	boundary := []byte(tablecodec.EncodeRowKey(1, codec.EncodeInt(nil, 20)))
+	c.Assert(groups[0].Range[0].EndKey, DeepEquals, boundary)
+	c.Assert(groups[0].Range[1].StartKey, DeepEquals, boundary)
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsTransformPhysicalTables(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	partitions := func(ids ...int64) *model.PartitionInfo {
+		info := &model.PartitionInfo{}
+		for i, id := range ids {
+			info.Definitions = append(info.Definitions, model.PartitionDefinition{
+				ID: id, Name: model.NewCIStr("p" + strconv.Itoa(i)),
+			})
+		}
+		return info
+	}
+	oldTable := &model.TableInfo{ID: 1, Name: model.NewCIStr("t1"), Partition: partitions(2, 3)}
+	newTable := &model.TableInfo{ID: 101, Name: oldTable.Name, Partition: partitions(102, 103)}
+	table := restore.CreatedTable{
+		RewriteRule: restore.GetRewriteRules(newTable, oldTable, 0),
+		Table:       newTable,
+		OldTable: &metautil.Table{
+			DB:   &model.DBInfo{Name: model.NewCIStr("test")},
+			Info: oldTable,
+		},
+	}
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 2; id <= 3; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+
+	groups, err := client.BuildFileGroups(context.Background(), []restore.CreatedTable{table}, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(groups[0].Files(), HasLen, 4)
+
+	var physicalIDs []int64
+	dropPartition := func(_ restore.CreatedTable, tables []restore.PhysicalTable) ([]restore.PhysicalTable, error) {
+		physicalIDs = physicalIDs[:0]
+		result := make([]restore.PhysicalTable, 0, len(tables))
+		for _, t := range tables {
+			physicalIDs = append(physicalIDs, t.NewPhysicalID)
+			if t.NewPhysicalID != 103 {
+				result = append(result, t)
+			}
+		}
+		return result, nil
+	}
+	groups, err = client.BuildFileGroups(context.Background(), []restore.CreatedTable{table}, files,
+		restore.MergeConfig{PhysicalTablesTransformer: dropPartition})
+	c.Assert(err, IsNil)
+	c.Assert(physicalIDs, DeepEquals, []int64{101, 102, 103})
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups[0].Files(), HasLen, 2)
+	for _, file := range groups[0].Files() {
+		c.Assert(tablecodec.DecodeTableID(file.StartKey), Equals, int64(2))
+	}
+	for _, rule := range groups[0].RewriteRule.Data {
+		c.Assert(tablecodec.DecodeTableID(rule.GetNewKeyPrefix()), Not(Equals), int64(103))
+	}
+
+	reverse := func(_ restore.CreatedTable, tables []restore.PhysicalTable) ([]restore.PhysicalTable, error) {
+		result := make([]restore.PhysicalTable, 0, len(tables))
+		for i := len(tables) - 1; i >= 0; i-- {
+			result = append(result, tables[i])
+		}
+		return result, nil
+	}
+	_, err = client.BuildFileGroups(context.Background(), []restore.CreatedTable{table}, files,
+		restore.MergeConfig{PhysicalTablesTransformer: reverse})
+	c.Assert(err, ErrorMatches, ".*physical tables of table t1 aren't sorted by the new physical ID.*")
+
+	// the physical tables are sorted by the comparator of an experimental key encoding.
+	descending := func(a, b []byte) int { return bytes.Compare(b, a) }
+	groups, err = client.BuildFileGroups(context.Background(), []restore.CreatedTable{table}, files,
+		restore.MergeConfig{PhysicalTablesTransformer: dropPartition, KeyComparator: descending})
+	c.Assert(err, IsNil)
+	c.Assert(physicalIDs, DeepEquals, []int64{103, 102, 101})
+	c.Assert(groups[0].Files(), HasLen, 2)
+	_, err = client.BuildFileGroups(context.Background(), []restore.CreatedTable{table}, files,
+		restore.MergeConfig{PhysicalTablesTransformer: reverse, KeyComparator: descending})
+	c.Assert(err, ErrorMatches, ".*102 follows 101.*")
+
+	// the partitions are rewritten into the same physical table, the ties are broken by the old IDs.
+	collided := table
+	collided.Table = &model.TableInfo{ID: 101, Name: oldTable.Name, Partition: partitions(102, 102)}
+	collided.RewriteRule = restore.GetRewriteRules(collided.Table, oldTable, 0)
+	for i := 0; i < 10; i++ {
+		_, err = client.BuildFileGroups(context.Background(), []restore.CreatedTable{collided}, files,
+			restore.MergeConfig{})
+		c.Assert(err, ErrorMatches, ".*physical tables 2 and 3 of table t1 are both rewritten into 102.*")
+		_, err = client.BuildFileGroups(context.Background(), []restore.CreatedTable{collided}, files,
+			restore.MergeConfig{PhysicalTablesTransformer: dropPartition})
+		c.Assert(err, ErrorMatches, ".*physical tables 2 and 3 of table t1 are both rewritten into 102.*")
+	}
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsMemoryBudget(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 2; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 2)
+
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{MemoryBudgetBytes: 1})
+	c.Assert(err, ErrorMatches, ".*ranges of the first 1 tables take .* bytes, exceeding the memory budget 1 bytes.*")
+
+	groups, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{MemoryBudgetBytes: 1 << 20})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 2)
+}
+
+func (s *testRestoreClientSuite) TestGoValidateFileRangesMemoryBudget(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 3; id++ {
+		files = append(files, fb.build(id, 0, 2, 1, 1)...)
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102), newTestCreatedTable(3, 103),
+	}
+	validate := func(mergeCfg restore.MergeConfig) ([]restore.TableWithRange, chan error) {
+		tableStream := make(chan restore.CreatedTable, len(tables))
+		for _, t := range tables {
+			tableStream <- t
+		}
+		close(tableStream)
+		errCh := make(chan error, 1)
+		var yielded []restore.TableWithRange
+		for t := range restore.GoValidateFileRanges(
+			context.Background(), tableStream, restore.MapTableToFiles(files), mergeCfg, errCh) {
+			// the ranges of a table at most are merged ahead of the consumer within a tiny budget.
+			time.Sleep(10 * time.Millisecond)
+			yielded = append(yielded, t)
+		}
+		return yielded, errCh
+	}
+
+	// the tables wait for the consumer, but are all yielded in order.
+	yielded, errCh := validate(restore.MergeConfig{MemoryBudgetBytes: 1})
+	c.Assert(errCh, HasLen, 0)
+	c.Assert(yielded, HasLen, 3)
+	for i, t := range yielded {
+		c.Assert(t.Table.ID, Equals, tables[i].Table.ID)
+	}
+
+	// the tables held back on collecting all errors can't wait.
+	yielded, errCh = validate(restore.MergeConfig{MemoryBudgetBytes: 1, CollectAllErrors: true})
+	c.Assert(yielded, HasLen, 0)
+	c.Assert(errCh, HasLen, 1)
+	c.Assert(<-errCh, ErrorMatches, ".*ranges of the first 1 tables take .* bytes, exceeding the memory budget 1 bytes.*")
+
+	yielded, errCh = validate(restore.MergeConfig{MemoryBudgetBytes: 1 << 20, CollectAllErrors: true})
+	c.Assert(errCh, HasLen, 0)
+	c.Assert(yielded, HasLen, 3)
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsLogSmallTablesTogether(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// table 1 is big, the other tables are small.
+	files = append(files, fb.build(1, 0, 1, 1000, 10)...)
+	for id := 2; id <= 4; id++ {
+		files = append(files, fb.build(id, 0, 1, 10, 1)...)
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102),
+		newTestCreatedTable(3, 103), newTestCreatedTable(4, 104),
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer log.ReplaceGlobals(zap.New(core), nil)()
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{
+		LogMinTableSizeBytes: 100,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 4)
+
+	tableLogs := logs.FilterMessage("merge and validate file").All()
+	c.Assert(tableLogs, HasLen, 1)
+	c.Assert(tableLogs[0].ContextMap()["table"], Equals, "t1")
+	smallLogs := logs.FilterMessage("merge and validate file of small tables").All()
+	c.Assert(smallLogs, HasLen, 1)
+	c.Assert(smallLogs[0].ContextMap()["tables"], Equals, int64(3))
+	c.Assert(smallLogs[0].ContextMap()["Bytes(total)"], Equals, uint64(30))
+
+	// every table is logged by default.
+	logs.TakeAll()
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(logs.FilterMessage("merge and validate file").All(), HasLen, 4)
+	c.Assert(logs.FilterMessage("merge and validate file of small tables").All(), HasLen, 0)
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsSkewed(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// table 1 is 100 times larger than the other tables.
+	files = append(files, fb.build(1, 0, 1, 1000, 10)...)
+	for id := 2; id <= 4; id++ {
+		files = append(files, fb.build(id, 0, 1, 10, 1)...)
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102),
+		newTestCreatedTable(3, 103), newTestCreatedTable(4, 104),
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	defer log.ReplaceGlobals(zap.New(core), nil)()
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{GroupSkewRatio: 10})
+	c.Assert(err, IsNil)
+	c.Assert(restore.GetFileGroupsSizeStat(groups), DeepEquals, restore.FileGroupsSizeStat{
+		Groups:      4,
+		MinBytes:    10,
+		MaxBytes:    1000,
+		MedianBytes: 10,
+	})
+	skewLogs := logs.FilterMessageSnippet("skewed").All()
+	c.Assert(skewLogs, HasLen, 1)
+	c.Assert(skewLogs[0].ContextMap()["max bytes"], Equals, uint64(1000))
+
+	// the skew is below the ratio.
+	logs.TakeAll()
+	_, err = client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{GroupSkewRatio: 200})
+	c.Assert(err, IsNil)
+	c.Assert(logs.FilterMessageSnippet("skewed").All(), HasLen, 0)
+	c.Assert(restore.GetFileGroupsSizeStat(nil), DeepEquals, restore.FileGroupsSizeStat{})
+}
+
+func (s *testRestoreClientSuite) TestGoValidateFileRangesSkewed(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// table 1 is 100 times larger than the other tables.
+	files = append(files, fb.build(1, 0, 1, 1000, 10)...)
+	for id := 2; id <= 4; id++ {
+		files = append(files, fb.build(id, 0, 1, 10, 1)...)
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102),
+		newTestCreatedTable(3, 103), newTestCreatedTable(4, 104),
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	defer log.ReplaceGlobals(zap.New(core), nil)()
+	for _, ratio := range []float64{10, 200} {
+		tableStream := make(chan restore.CreatedTable, len(tables))
+		for _, t := range tables {
+			tableStream <- t
+		}
+		close(tableStream)
+		errCh := make(chan error, 1)
+		yielded := 0
+		for range restore.GoValidateFileRanges(context.Background(), tableStream,
+			restore.MapTableToFiles(files), restore.MergeConfig{GroupSkewRatio: ratio}, errCh) {
+			yielded++
+		}
+		c.Assert(errCh, HasLen, 0)
+		c.Assert(yielded, Equals, 4)
+	}
+	// warned once all tables are merged, and only above the ratio.
+	skewLogs := logs.FilterMessageSnippet("skewed").All()
+	c.Assert(skewLogs, HasLen, 1)
+	c.Assert(skewLogs[0].ContextMap()["groups"], Equals, int64(4))
+	c.Assert(skewLogs[0].ContextMap()["max bytes"], Equals, uint64(1000))
+	c.Assert(skewLogs[0].ContextMap()["skew ratio"], Equals, float64(10))
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsWithHugeTable(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// table 1 is huge, it contains 8 ranges of 10 bytes.
+	for i := 0; i < 8; i++ {
+		files = append(files, fb.build(1, 0, 1, 10, 10)...)
+	}
+	// the other tables contain 4 ranges of 10 bytes.
+	for id := 2; id <= 4; id++ {
+		for i := 0; i < 4; i++ {
+			files = append(files, fb.build(id, 0, 1, 10, 10)...)
+		}
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102),
+		newTestCreatedTable(3, 103), newTestCreatedTable(4, 104),
+	}
+	mergeCfg := restore.MergeConfig{
+		HugeTableSizeBytes:  50,
+		HugeTableThresholds: restore.TableMergeThresholds{SplitSizeBytes: 20},
+	}
+
+	for i := 0; i < 2; i++ {
+		groups, err := client.BuildFileGroups(context.Background(), tables, files, mergeCfg)
+		c.Assert(err, IsNil)
+		c.Assert(groups, HasLen, 4)
+		c.Assert(groups[0].Range, HasLen, 4)
+		for _, group := range groups[1:] {
+			c.Assert(group.Range, HasLen, 1)
+		}
+	}
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsWithThresholdsClassifier(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// every table contains 4 ranges of 10 bytes.
+	for id := 1; id <= 3; id++ {
+		for i := 0; i < 4; i++ {
+			files = append(files, fb.build(id, 0, 1, 10, 10)...)
+		}
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102), newTestCreatedTable(3, 103),
+	}
+	// the tables of odd IDs are a class merged less aggressively, the table 3 is overridden by ID.
+	mergeCfg := restore.MergeConfig{
+		ThresholdsClassifier: func(table restore.CreatedTable, _ []*backuppb.File) (restore.TableMergeThresholds, bool) {
+			if table.Table.ID%2 == 0 {
+				return restore.TableMergeThresholds{}, false
+			}
+			return restore.TableMergeThresholds{SplitSizeBytes: 20}, true
+		},
+		TableThresholds: map[int64]restore.TableMergeThresholds{103: {SplitSizeBytes: 10}},
+	}
+
+	for i := 0; i < 2; i++ {
+		groups, err := client.BuildFileGroups(context.Background(), tables, files, mergeCfg)
+		c.Assert(err, IsNil)
+		c.Assert(groups, HasLen, 3)
+		c.Assert(groups[0].Range, HasLen, 2)
+		c.Assert(groups[1].Range, HasLen, 1)
+		c.Assert(groups[2].Range, HasLen, 4)
+	}
+}
+
+func (s *testRestoreClientSuite) TestBuildFileGroupsWithTableThresholds(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// every table contains 4 small ranges of 10 keys.
+	for id := 1; id <= 3; id++ {
+		for i := 0; i < 4; i++ {
+			files = append(files, fb.build(id, 0, 1, 10, 10)...)
+		}
+	}
+	tables := []restore.CreatedTable{
+		newTestCreatedTable(1, 101), newTestCreatedTable(2, 102), newTestCreatedTable(3, 103),
+	}
+	mergeCfg := restore.MergeConfig{
+		TableThresholds: map[int64]restore.TableMergeThresholds{
+			// wide rows: never merge.
+			102: {SplitKeyCount: 10},
+			// only the size is overridden, the key count falls back to the global one.
+			103: {SplitSizeBytes: 20},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		groups, err := client.BuildFileGroups(context.Background(), tables, files, mergeCfg)
+		c.Assert(err, IsNil)
+		c.Assert(groups, HasLen, 3)
+		c.Assert(groups[0].Range, HasLen, 1)
+		c.Assert(groups[1].Range, HasLen, 4)
+		c.Assert(groups[2].Range, HasLen, 2)
+	}
+}
+
+func (s *testRestoreClientSuite) TestRecoverTiFlashReplicaWithoutTiFlashStore(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), fakePDClient{
+		stores: []*metapb.Store{{Id: 1}},
+	}, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	noReplica := newTestCreatedTable(1, 101)
+	withReplica := newTestCreatedTable(2, 102)
+	withReplica.OldTable.TiFlashReplicas = 1
+
+	statuses, err := client.RecoverTiFlashReplica(
+		context.Background(), []restore.CreatedTable{noReplica, withReplica}, time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 1)
+	c.Assert(statuses[0].Table.O, Equals, "t2")
+	c.Assert(statuses[0].Count, Equals, uint64(1))
+	c.Assert(statuses[0].Skipped, IsTrue)
+	c.Assert(statuses[0].Available, IsFalse)
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesTableTiming(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(2)
+	importCli := &fakeImporterClient{downloadDelays: map[string]time.Duration{"2_write.sst": 100 * time.Millisecond}}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	var timings []restore.TableRestoreTiming
+	client.SetTableTimingCallback(func(timing restore.TableRestoreTiming) {
+		timings = append(timings, timing)
+	})
+
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 2),
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(2, 12).Data...)
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+
+	c.Assert(timings, HasLen, 2)
+	c.Assert(timings[0].TableID, Equals, int64(11))
+	c.Assert(timings[0].Files, Equals, 1)
+	c.Assert(timings[1].TableID, Equals, int64(12))
+	c.Assert(timings[1].Files, Equals, 1)
+	c.Assert(timings[1].Duration() >= 100*time.Millisecond, IsTrue, Commentf("%s", timings[1].Duration()))
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesCFGroupOrder(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(4)
+	// the write CF files are slow, the default CF files would be downloaded first without the order.
+	importCli := &fakeImporterClient{downloadDelays: map[string]time.Duration{
+		"1_write.sst": 50 * time.Millisecond,
+		"2_write.sst": 50 * time.Millisecond,
+	}}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	client.SetCFGroupOrder([]string{"write", "default"})
+
+	var files []*backuppb.File
+	for id := int64(1); id <= 2; id++ {
+		file := newImportTestFile(fmt.Sprintf("%d_default.sst", id), id)
+		file.Cf = "default"
+		files = append(files, file, newImportTestFile(fmt.Sprintf("%d_write.sst", id), id))
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(2, 12).Data...)
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+
+	c.Assert(importCli.downloaded, HasLen, 4)
+	sort.Strings(importCli.downloaded[:2])
+	sort.Strings(importCli.downloaded[2:])
+	c.Assert(importCli.downloaded, DeepEquals, []string{"1_write.sst", "2_write.sst", "1_default.sst", "2_default.sst"})
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesIngestCallback(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(2)
+	importCli := &fakeImporterClient{ingestErrors: 1}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	var mu sync.Mutex
+	results := make(map[string]restore.FileIngestResult)
+	client.SetFileIngestCallback(func(result restore.FileIngestResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := results[result.Name]
+		c.Assert(ok, IsFalse, Commentf("%s is reported twice", result.Name))
+		results[result.Name] = result
+	})
+
+	// the CF of the files of the old backups is known by the name only.
+	legacyFile := newImportTestFile("3_default.sst", 3)
+	legacyFile.Cf = ""
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 2),
+		legacyFile,
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(2, 12).Data...)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(3, 13).Data...)
+	start := time.Now()
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+
+	c.Assert(results, HasLen, 3)
+	for i, file := range files {
+		result := results[file.GetName()]
+		c.Assert(result.TableID, Equals, int64(11+i))
+		c.Assert(result.CF, Equals, []string{"write", "write", "default"}[i])
+		c.Assert(result.StartKey, DeepEquals, file.GetStartKey())
+		c.Assert(result.EndKey, DeepEquals, file.GetEndKey())
+		c.Assert(result.TotalKvs, Equals, uint64(100))
+		c.Assert(result.TotalBytes, Equals, uint64(1000))
+		c.Assert(result.IngestedAt.Before(start), IsFalse)
+	}
+}
+
+// fakeFileVerifier records the verified files, and mismatches the files of the names.
+type fakeFileVerifier struct {
+	mu         sync.Mutex
+	verified   []string
+	mismatches map[string]struct{}
+	// running and maxRunning record the count of the files verified concurrently.
+	running    int
+	maxRunning int
+}
+
+func (v *fakeFileVerifier) Verify(_ context.Context, file *backuppb.File) error {
+	v.mu.Lock()
+	v.running++
+	if v.running > v.maxRunning {
+		v.maxRunning = v.running
+	}
+	v.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.running--
+	v.verified = append(v.verified, file.GetName())
+	if _, ok := v.mismatches[file.GetName()]; ok {
+		return errors.Annotatef(berrors.ErrRestoreChecksumMismatch, "file %s mismatches", file.GetName())
+	}
+	return nil
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesVerifySample(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	var files []*backuppb.File
+	rules := &restore.RewriteRules{}
+	for i := int64(1); i <= 100; i++ {
+		file := newImportTestFile(fmt.Sprintf("%d_write.sst", i), i)
+		file.Sha256 = []byte{1}
+		files = append(files, file)
+		rules.Data = append(rules.Data, newImportTestRewriteRules(i, 1000+i).Data...)
+	}
+	// the files without checksums are never verified.
+	noChecksum := newImportTestFile("101_write.sst", 101)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(101, 1101).Data...)
+	var verifyConcurrency uint
+	var maxVerifying int
+	restoreFiles := func(rate float64, mismatches ...string) ([]string, int64, int64, error) {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(4)
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), &fakeImporterClient{}, nil, false, 0))
+		verifier := &fakeFileVerifier{mismatches: make(map[string]struct{})}
+		for _, name := range mismatches {
+			verifier.mismatches[name] = struct{}{}
+		}
+		client.SetFileVerifier(verifier, rate)
+		if verifyConcurrency > 0 {
+			client.SetVerifyConcurrency(verifyConcurrency)
+		}
+		err = client.RestoreFiles(context.Background(), append(files, noChecksum), rules, nopProgress{})
+		maxVerifying = verifier.maxRunning
+		sort.Strings(verifier.verified)
+		verified, mismatched := client.VerifiedFileCount()
+		return verifier.verified, verified, mismatched, err
+	}
+
+	sample, verified, mismatched, err := restoreFiles(0.1)
+	c.Assert(err, IsNil)
+	c.Assert(len(sample) > 0 && len(sample) < 30, IsTrue, Commentf("%d files sampled", len(sample)))
+	c.Assert(verified, Equals, int64(len(sample)))
+	c.Assert(mismatched, Equals, int64(0))
+	// the same files are sampled by every run.
+	again, _, _, err := restoreFiles(0.1)
+	c.Assert(err, IsNil)
+	c.Assert(again, DeepEquals, sample)
+
+	all, _, _, err := restoreFiles(1)
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 100)
+	none, _, _, err := restoreFiles(0)
+	c.Assert(err, IsNil)
+	c.Assert(none, HasLen, 0)
+
+	// a mismatch fails the restore.
+	_, _, mismatched, err = restoreFiles(0.1, sample[0])
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreChecksumMismatch)
+	c.Assert(mismatched, Equals, int64(1))
+
+	// the verify concurrency is bounded apart from the restore concurrency.
+	verifyConcurrency = 1
+	all, _, _, err = restoreFiles(1)
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 100)
+	c.Assert(maxVerifying, Equals, 1)
+
+	// the files are verified by the checksums of the content in the storage.
+	store, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	c.Assert(store.WriteFile(context.Background(), "1_write.sst", []byte("content")), IsNil)
+	checksum := sha256.Sum256([]byte("content"))
+	verifier := restore.NewStorageFileVerifier(store, nil)
+	c.Assert(verifier.Verify(context.Background(), &backuppb.File{Name: "1_write.sst", Sha256: checksum[:]}), IsNil)
+	err = verifier.Verify(context.Background(), &backuppb.File{Name: "1_write.sst", Sha256: []byte{1}})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreChecksumMismatch)
+
+	// the encrypted files are decrypted while streamed, the checksums are of the plain content.
+	cipherInfo := &backuppb.CipherInfo{
+		CipherType: encryptionpb.EncryptionMethod_AES128_CTR,
+		CipherKey:  []byte("0123456789abcdef"),
+	}
+	iv := []byte("fedcba9876543210")
+	encrypted, err := encrypt.AESEncryptWithCTR([]byte("content"), cipherInfo.CipherKey, iv)
+	c.Assert(err, IsNil)
+	c.Assert(store.WriteFile(context.Background(), "2_write.sst", encrypted), IsNil)
+	verifier = restore.NewStorageFileVerifier(store, cipherInfo)
+	c.Assert(verifier.Verify(context.Background(),
+		&backuppb.File{Name: "2_write.sst", Sha256: checksum[:], CipherIv: iv}), IsNil)
+	err = verifier.Verify(context.Background(),
+		&backuppb.File{Name: "2_write.sst", Sha256: checksum[:], CipherIv: []byte("0000000000000000")})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreChecksumMismatch)
+}
+
+// ingestedProgress records the count of ingested files on every progress.
+type ingestedProgress struct {
+	importCli *fakeImporterClient
+	mu        sync.Mutex
+	ingested  []int
+}
+
+func (p *ingestedProgress) Inc() {
+	p.importCli.mu.Lock()
+	ingested := len(p.importCli.ingested)
+	p.importCli.mu.Unlock()
+	p.mu.Lock()
+	p.ingested = append(p.ingested, ingested)
+	p.mu.Unlock()
+}
+
+func (p *ingestedProgress) Close() {}
+
+func (s *testRestoreClientSuite) TestRestoreFilesProgressIncrementally(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(3)
+	// the groups are restored concurrently, and finished one by one.
+	importCli := &fakeImporterClient{downloadDelays: map[string]time.Duration{
+		"2_write.sst": 200 * time.Millisecond,
+		"3_write.sst": 400 * time.Millisecond,
+	}}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 2),
+		newImportTestFile("3_write.sst", 3),
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(2, 12).Data...)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(3, 13).Data...)
+	progress := &ingestedProgress{importCli: importCli}
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, progress), IsNil)
+	// the progress advances once a group is finished, instead of on waiting all groups.
+	c.Assert(progress.ingested, DeepEquals, []int{1, 2, 3})
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesGlobalBandwidthLimit(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(8)
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	// the budget is shared by all the tables restored concurrently.
+	const budget = 4000
+	client.SetGlobalBandwidthLimit(budget)
+
+	files := make([]*backuppb.File, 0, 8)
+	rules := &restore.RewriteRules{}
+	for id := int64(1); id <= 8; id++ {
+		files = append(files, newImportTestFile(strconv.FormatInt(id, 10)+"_write.sst", id))
+		rules.Data = append(rules.Data, newImportTestRewriteRules(id, id+10).Data...)
+	}
+	start := time.Now()
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+	elapsed := time.Since(start)
+	c.Assert(importCli.ingested, HasLen, 8)
+	// the first second of budget is allowed at once, the rest by the rate.
+	totalBytes := float64(8 * 1000)
+	c.Assert(totalBytes <= budget*(1+elapsed.Seconds()), IsTrue, Commentf("%s", elapsed))
+	c.Assert(elapsed >= 900*time.Millisecond, IsTrue, Commentf("%s", elapsed))
+}
+
+func (s *testRestoreClientSuite) TestRestoredFileCount(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(2)
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	rules := newImportTestRewriteRules(1, 11)
+
+	// all the files are skipped before restoring, nothing new is restored.
+	c.Assert(client.RestoreFiles(context.Background(), nil, rules, nopProgress{}), IsNil)
+	c.Assert(client.RestoredFileCount(), Equals, int64(0))
+
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 1),
+	}
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+	c.Assert(client.RestoredFileCount(), Equals, int64(2))
+}
+
+// tableTrackingImporterClient records the most distinct tables downloading concurrently,
+// the table of a file is the prefix of its name.
+type tableTrackingImporterClient struct {
+	*fakeImporterClient
+	mu        sync.Mutex
+	inFlight  map[string]int
+	maxTables int
+}
+
+func (f *tableTrackingImporterClient) DownloadSST(
+	ctx context.Context, storeID uint64, req *import_sstpb.DownloadRequest,
+) (*import_sstpb.DownloadResponse, error) {
+	table := strings.SplitN(req.Name, "_", 2)[0]
+	f.mu.Lock()
+	f.inFlight[table]++
+	if len(f.inFlight) > f.maxTables {
+		f.maxTables = len(f.inFlight)
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight[table]--
+		if f.inFlight[table] == 0 {
+			delete(f.inFlight, table)
+		}
+		f.mu.Unlock()
+	}()
+	return f.fakeImporterClient.DownloadSST(ctx, storeID, req)
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesMaxConcurrentTables(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	// 2 files of each table, interleaved.
+	files := make([]*backuppb.File, 0, 8)
+	rules := &restore.RewriteRules{}
+	delays := make(map[string]time.Duration)
+	for i := 0; i < 2; i++ {
+		for id := int64(1); id <= 4; id++ {
+			name := fmt.Sprintf("%d_%d_write.sst", id, i)
+			files = append(files, newImportTestFile(name, id))
+			delays[name] = 100 * time.Millisecond
+		}
+	}
+	for id := int64(1); id <= 4; id++ {
+		rules.Data = append(rules.Data, newImportTestRewriteRules(id, id+10).Data...)
+	}
+	restoreFiles := func(maxTables int) *tableTrackingImporterClient {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(8)
+		client.SetMaxConcurrentTables(maxTables)
+		importCli := &tableTrackingImporterClient{
+			fakeImporterClient: &fakeImporterClient{downloadDelays: delays},
+			inFlight:           make(map[string]int),
+		}
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+		c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+		c.Assert(importCli.ingested, HasLen, 8)
+		return importCli
+	}
+
+	// all tables are restored at once by default.
+	c.Assert(restoreFiles(0).maxTables, Equals, 4)
+	c.Assert(restoreFiles(2).maxTables <= 2, IsTrue)
+	c.Assert(restoreFiles(1).maxTables, Equals, 1)
+}
+
+// bytesTrackingImporterClient records the most total bytes of the files downloading concurrently.
+type bytesTrackingImporterClient struct {
+	*fakeImporterClient
+	fileBytes map[string]uint64
+	mu        sync.Mutex
+	inFlight  uint64
+	maxBytes  uint64
+}
+
+func (f *bytesTrackingImporterClient) DownloadSST(
+	ctx context.Context, storeID uint64, req *import_sstpb.DownloadRequest,
+) (*import_sstpb.DownloadResponse, error) {
+	bytes := f.fileBytes[req.Name]
+	f.mu.Lock()
+	f.inFlight += bytes
+	if f.inFlight > f.maxBytes {
+		f.maxBytes = f.inFlight
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight -= bytes
+		f.mu.Unlock()
+	}()
+	return f.fakeImporterClient.DownloadSST(ctx, storeID, req)
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesMaxInFlightBytes(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	// a file of 1000 bytes of each table, so every group is of 1000 bytes.
+	files := make([]*backuppb.File, 0, 8)
+	rules := &restore.RewriteRules{}
+	delays := make(map[string]time.Duration)
+	fileBytes := make(map[string]uint64)
+	for id := int64(1); id <= 8; id++ {
+		name := fmt.Sprintf("%d_write.sst", id)
+		file := newImportTestFile(name, id)
+		files = append(files, file)
+		rules.Data = append(rules.Data, newImportTestRewriteRules(id, id+10).Data...)
+		delays[name] = 50 * time.Millisecond
+		fileBytes[name] = file.GetTotalBytes()
+	}
+	restoreFiles := func(maxBytes uint64) *bytesTrackingImporterClient {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(8)
+		client.SetMaxInFlightBytes(maxBytes)
+		importCli := &bytesTrackingImporterClient{
+			fakeImporterClient: &fakeImporterClient{downloadDelays: delays},
+			fileBytes:          fileBytes,
+		}
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+		c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+		c.Assert(importCli.ingested, HasLen, 8)
+		return importCli
+	}
+
+	// the groups are restored by the concurrency of files by default.
+	c.Assert(restoreFiles(0).maxBytes > 2500, IsTrue)
+	c.Assert(restoreFiles(2500).maxBytes <= 2500, IsTrue)
+	// a group exceeding the limit alone is restored once no group is in flight.
+	c.Assert(restoreFiles(500).maxBytes, Equals, uint64(1000))
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesTimeBudget(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	files := make([]*backuppb.File, 0, 8)
+	rules := &restore.RewriteRules{}
+	delays := make(map[string]time.Duration)
+	for id := int64(1); id <= 8; id++ {
+		name := fmt.Sprintf("%d_write.sst", id)
+		files = append(files, newImportTestFile(name, id))
+		rules.Data = append(rules.Data, newImportTestRewriteRules(id, id+10).Data...)
+		delays[name] = 100 * time.Millisecond
+	}
+	newClient := func() (*restore.Client, *fakeImporterClient) {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(1)
+		importCli := &fakeImporterClient{downloadDelays: delays}
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+		return client, importCli
+	}
+
+	client, importCli := newClient()
+	client.SetTimeBudget(250 * time.Millisecond)
+	// the budget exhausted isn't an error.
+	c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+	c.Assert(client.TimeBudgetExhausted(), IsTrue)
+	// the files in flight are waited for, no file is left half restored.
+	restored := len(importCli.ingested)
+	c.Assert(restored > 0 && restored < len(files), IsTrue, Commentf("restored %d files", restored))
+	c.Assert(client.RestoredFileCount(), Equals, int64(restored))
+	c.Assert(importCli.downloaded, HasLen, restored)
+	unrestored := client.UnrestoredTableIDs()
+	c.Assert(unrestored, HasLen, len(files)-restored)
+	// the groups are submitted in order, so the tables left are the last ones.
+	for i, tableID := range unrestored {
+		c.Assert(tableID, Equals, int64(restored+i+1+10))
+	}
+
+	// the next run restores the tables left.
+	left := files[restored:]
+	client, importCli = newClient()
+	c.Assert(client.RestoreFiles(context.Background(), left, rules, nopProgress{}), IsNil)
+	c.Assert(client.TimeBudgetExhausted(), IsFalse)
+	c.Assert(client.UnrestoredTableIDs(), HasLen, 0)
+	c.Assert(importCli.ingested, HasLen, len(left))
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesDescendingTables(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	files := make([]*backuppb.File, 0, 6)
+	rules := &restore.RewriteRules{}
+	for id := int64(1); id <= 3; id++ {
+		rules.Data = append(rules.Data, newImportTestRewriteRules(id, id+10).Data...)
+		for i := int64(0); i < 2; i++ {
+			file := newImportTestFile(fmt.Sprintf("%d_%d_write.sst", id, i), id)
+			file.StartKey = tablecodec.EncodeRowKeyWithHandle(id, kv.IntHandle(i*100))
+			file.EndKey = tablecodec.EncodeRowKeyWithHandle(id, kv.IntHandle((i+1)*100))
+			files = append(files, file)
+		}
+	}
+	restoreInOrder := func(descending ...int64) []string {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(1)
+		importCli := &fakeImporterClient{}
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+		client.SetDescendingTables(descending)
+		c.Assert(client.RestoreFiles(context.Background(), files, rules, nopProgress{}), IsNil)
+		return importCli.downloaded
+	}
+
+	// ascending by default.
+	c.Assert(restoreInOrder(), DeepEquals, []string{
+		"1_0_write.sst", "1_1_write.sst", "2_0_write.sst", "2_1_write.sst", "3_0_write.sst", "3_1_write.sst",
+	})
+	// only the files of the flagged table are reversed, the other tables stay in place.
+	c.Assert(restoreInOrder(2), DeepEquals, []string{
+		"1_0_write.sst", "1_1_write.sst", "2_1_write.sst", "2_0_write.sst", "3_0_write.sst", "3_1_write.sst",
+	})
+}
+
+type fakeCompactionTrigger struct {
+	ranges [][2][]byte
+}
+
+func (t *fakeCompactionTrigger) Compact(ctx context.Context, startKey, endKey []byte) error {
+	t.ranges = append(t.ranges, [2][]byte{startKey, endKey})
+	return nil
+}
+
+type countProgress struct {
+	count int
+}
+
+func (p *countProgress) Inc() {
+	p.count++
+}
+
+func (p *countProgress) Close() {}
+
+func (s *testRestoreClientSuite) TestCompactRestoredTables(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	tables := []restore.CreatedTable{newTestCreatedTable(2, 105), newTestCreatedTable(1, 101)}
+	tableRange := func(start, end int64) [2][]byte {
+		return [2][]byte{
+			codec.EncodeBytes(nil, tablecodec.EncodeTablePrefix(start)),
+			codec.EncodeBytes(nil, tablecodec.EncodeTablePrefix(end)),
+		}
+	}
+
+	// no compaction by default.
+	progress := &countProgress{}
+	c.Assert(client.CompactRestoredTables(context.Background(), tables, progress), IsNil)
+	c.Assert(progress.count, Equals, 0)
+
+	trigger := &fakeCompactionTrigger{}
+	client.SetPostRestoreCompaction(trigger, restore.CompactionScopeTable)
+	c.Assert(client.CompactRestoredTables(context.Background(), tables, progress), IsNil)
+	c.Assert(trigger.ranges, DeepEquals, [][2][]byte{tableRange(101, 102), tableRange(105, 106)})
+	c.Assert(progress.count, Equals, 2)
+	c.Assert(restore.CompactionRanges(tables, restore.CompactionScopeTable), HasLen, 2)
+
+	trigger = &fakeCompactionTrigger{}
+	progress = &countProgress{}
+	client.SetPostRestoreCompaction(trigger, restore.CompactionScopeGlobal)
+	c.Assert(client.CompactRestoredTables(context.Background(), tables, progress), IsNil)
+	c.Assert(trigger.ranges, DeepEquals, [][2][]byte{tableRange(101, 106)})
+	c.Assert(progress.count, Equals, 1)
+
+	_, err = restore.ParseCompactionScope("region")
+	c.Assert(err, ErrorMatches, ".*unknown compaction scope region.*")
+}
+
+type fakeRangeWarmer struct {
+	ranges [][2][]byte
+	// emptyFrom is the key from which the ranges are empty except their start keys.
+	emptyFrom []byte
+}
+
+func (w *fakeRangeWarmer) Warm(ctx context.Context, startKey, endKey []byte, limit int) (int, error) {
+	w.ranges = append(w.ranges, [2][]byte{startKey, endKey})
+	if bytes.Compare(startKey, w.emptyFrom) > 0 {
+		return 0, nil
+	}
+	return limit, nil
+}
+
+func (s *testRestoreClientSuite) TestPreWarmRestoredTables(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	tables := []restore.CreatedTable{newTestCreatedTable(2, 105), newTestCreatedTable(1, 101)}
+	// table 1 has 6 ranges of files, and table 2 has 2, of the write and default CFs.
+	fileOfTable := make(map[int64][]*backuppb.File)
+	for oldID, count := range map[int64]int64{1: 6, 2: 2} {
+		for i := int64(0); i < count; i++ {
+			for _, cf := range []string{"write", "default"} {
+				file := newImportTestFile(fmt.Sprintf("%d_%d_%s.sst", oldID, i, cf), oldID)
+				file.StartKey = tablecodec.EncodeRowKeyWithHandle(oldID, kv.IntHandle(i*100))
+				file.EndKey = tablecodec.EncodeRowKeyWithHandle(oldID, kv.IntHandle((i+1)*100))
+				file.Cf = cf
+				fileOfTable[oldID] = append(fileOfTable[oldID], file)
+			}
+		}
+	}
+
+	// no pre-warming by default.
+	stat, err := client.PreWarmRestoredTables(context.Background(), tables, fileOfTable)
+	c.Assert(err, IsNil)
+	c.Assert(stat, DeepEquals, restore.PreWarmStat{})
+
+	warmer := &fakeRangeWarmer{emptyFrom: tablecodec.EncodeRowKeyWithHandle(105, kv.IntHandle(50))}
+	client.SetPreWarm(warmer, restore.PreWarmConfig{SamplesPerTable: 4, KeysPerSample: 10})
+	stat, err = client.PreWarmRestoredTables(context.Background(), tables, fileOfTable)
+	c.Assert(err, IsNil)
+	// the ranges of the files are picked evenly and rewritten, in the order of keys.
+	rowRange := func(tableID, handle int64) [2][]byte {
+		return [2][]byte{
+			tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle)),
+			tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle+100)),
+		}
+	}
+	c.Assert(warmer.ranges, DeepEquals, [][2][]byte{
+		rowRange(101, 0), rowRange(101, 100), rowRange(101, 300), rowRange(101, 400),
+		rowRange(105, 0), rowRange(105, 100),
+	})
+	// only the second range of table 105 is empty.
+	c.Assert(stat, DeepEquals, restore.PreWarmStat{Samples: 6, WarmedSamples: 5, Keys: 50})
+	c.Assert(stat.Coverage(), Equals, 5.0/6)
+}
+
+func (s *testRestoreClientSuite) TestCheckClusterCapacity(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	// 2000 bytes to restore.
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 2),
+	}
+	// unchecked by default.
+	c.Assert(client.CheckClusterCapacity(context.Background(), files), IsNil)
+
+	// 6000 of 10000 bytes used, 8000 after restore of a single replica.
+	client.SetClusterCapacityCheck(fakeClusterCapacitySource{capacity: 10000, available: 4000, replicas: 1}, 0.8)
+	c.Assert(client.CheckClusterCapacity(context.Background(), files), IsNil)
+	// 7000 of 10000 bytes used, 9000 after restore of a single replica.
+	client.SetClusterCapacityCheck(fakeClusterCapacitySource{capacity: 10000, available: 3000, replicas: 1}, 0.8)
+	err = client.CheckClusterCapacity(context.Background(), files)
+	c.Assert(err, ErrorMatches, ".*needs 2000 bytes of 1 replicas, but the cluster has 7000 bytes used of 10000 bytes.*")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInsufficientCapacity)
+
+	// 2000 of 30000 bytes used, 20000 after restore of 3 replicas.
+	client.SetClusterCapacityCheck(fakeClusterCapacitySource{capacity: 30000, available: 28000, replicas: 3}, 0.8)
+	c.Assert(client.CheckClusterCapacity(context.Background(), files), IsNil)
+	// 20000 of 30000 bytes used, 26000 after restore of 3 replicas, though 22000 of a single one.
+	client.SetClusterCapacityCheck(fakeClusterCapacitySource{capacity: 30000, available: 10000, replicas: 3}, 0.8)
+	err = client.CheckClusterCapacity(context.Background(), files)
+	c.Assert(err, ErrorMatches, ".*needs 6000 bytes of 3 replicas, but the cluster has 20000 bytes used of 30000 bytes.*")
+}
+
+func (s *testRestoreClientSuite) TestCheckRegionCount(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	// unchecked by default.
+	c.Assert(client.CheckRegionCount(context.Background(), 100), IsNil)
+	// 0 max count means unlimited.
+	client.SetRegionCountCheck(fakeRegionCountSource{count: 10, maxCount: 0})
+	c.Assert(client.CheckRegionCount(context.Background(), 100), IsNil)
+
+	client.SetRegionCountCheck(fakeRegionCountSource{count: 4, maxCount: 6})
+	c.Assert(client.CheckRegionCount(context.Background(), 2), IsNil)
+	err = client.CheckRegionCount(context.Background(), 3)
+	c.Assert(err, ErrorMatches, ".*splits 3 more regions, but the cluster has 4 regions, .* max count of regions 6.*")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInsufficientCapacity)
+
+	// the plan fails before splitting or restoring anything.
+	client.SetSplitClient(initTestClient())
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	fb := fileBulder{}
+	files := fb.build(1, 0, 2, 1, 1)
+	plan := &restore.RestorePlan{
+		Groups: []restore.TableWithRange{{
+			CreatedTable: newTestCreatedTable(1, 101),
+			Range:        []rtree.Range{{StartKey: files[0].StartKey, EndKey: files[1].EndKey, Files: files}},
+		}},
+		SplitKeys: [][]byte{[]byte("aaa"), []byte("aaz"), []byte("bbb")},
+	}
+	err = client.ExecuteRestorePlan(context.Background(), plan, nopProgress{})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInsufficientCapacity)
+	c.Assert(client.SplitKeyCount(), Equals, int64(0))
+	c.Assert(importCli.downloaded, HasLen, 0)
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesDropLastTableFiles(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 2),
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	rules.Data = append(rules.Data, newImportTestRewriteRules(2, 12).Data...)
+	restoreFiles := func(enable func(*restore.Client)) (*fakeImporterClient, error) {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(1)
+		importCli := &fakeImporterClient{}
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+		enable(client)
+		return importCli, client.RestoreFiles(context.Background(), files, rules, nopProgress{})
+	}
+
+	// disabled by default.
+	importCli, err := restoreFiles(func(*restore.Client) {})
+	c.Assert(err, IsNil)
+	c.Assert(importCli.ingested, HasLen, 2)
+
+	// refuses to be enabled without unsafe.
+	importCli, err = restoreFiles(func(client *restore.Client) {
+		c.Assert(client.EnableDropLastTableFiles(false), ErrorMatches, ".*must be enabled explicitly as unsafe.*")
+	})
+	c.Assert(err, IsNil)
+	c.Assert(importCli.ingested, HasLen, 2)
+
+	importCli, err = restoreFiles(func(client *restore.Client) {
+		c.Assert(client.EnableDropLastTableFiles(true), IsNil)
+	})
+	c.Assert(err, ErrorMatches, ".*1 files of table 12 are dropped on purpose.*")
+	c.Assert(importCli.ingested, HasLen, 1)
+}
+
+func (s *testRestoreClientSuite) TestPauseAndResumeRestoreFiles(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 1),
+		newImportTestFile("3_write.sst", 1),
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(1)
+	importCli := &fakeImporterClient{downloadDelays: map[string]time.Duration{
+		"1_write.sst": 200 * time.Millisecond,
+		"2_write.sst": 200 * time.Millisecond,
+		"3_write.sst": 200 * time.Millisecond,
+	}}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+	ingested := func() int {
+		importCli.mu.Lock()
+		defer importCli.mu.Unlock()
+		return len(importCli.ingested)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.RestoreFiles(context.Background(), files, rules, nopProgress{})
+	}()
+	// Pause while the first file is in flight.
+	time.Sleep(100 * time.Millisecond)
+	client.Pause()
+	c.Assert(client.IsPaused(), IsTrue)
+	time.Sleep(time.Second)
+	select {
+	case err := <-done:
+		c.Fatalf("restore finished while paused: %v", err)
+	default:
+	}
+	c.Assert(ingested() > 0 && ingested() < len(files), IsTrue, Commentf("%d files ingested", ingested()))
+
+	client.Resume()
+	c.Assert(client.IsPaused(), IsFalse)
+	c.Assert(<-done, IsNil)
+	c.Assert(ingested(), Equals, len(files))
+
+	// A paused restore stops on canceling.
+	client.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = client.RestoreFiles(ctx, files, rules, nopProgress{})
+	c.Assert(errors.Cause(err), Equals, context.DeadlineExceeded)
+}
+
+func (s *testRestoreClientSuite) TestRestoreSingleTable(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 3; id++ {
+		files = append(files, fb.build(id, 0, 1, 1, 1)...)
+		files = append(files, fb.build(id, 0, 1, 1, 1)...)
+	}
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(1)
+	client.SetSplitClient(initTestClient())
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+
+	table := newTestCreatedTable(2, 102)
+	c.Assert(client.RestoreSingleTable(context.Background(), table, files, restore.MergeConfig{
+		SplitSizeBytes: 1,
+	}, nopProgress{}), IsNil)
+	// only the files of table 2 are restored.
+	c.Assert(importCli.ingested, HasLen, 2)
+	c.Assert(importCli.downloaded, HasLen, 2)
+	for _, name := range importCli.downloaded {
+		c.Assert(name == files[2].Name || name == files[3].Name, IsTrue, Commentf("%s is downloaded", name))
+	}
+	c.Assert(client.SplitKeyCount(), Equals, int64(2))
+
+	// nothing to restore for a table without files.
+	importCli.ingested = nil
+	c.Assert(client.RestoreSingleTable(context.Background(), newTestCreatedTable(4, 104), files,
+		restore.MergeConfig{}, nopProgress{}), IsNil)
+	c.Assert(importCli.ingested, HasLen, 0)
+}
+
+func (s *testRestoreClientSuite) TestRestoreAudit(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for _, id := range []int{2, 1} {
+		for i := 0; i < 3; i++ {
+			files = append(files, fb.build(id, 0, 2, 1, 1)...)
+		}
+	}
+	tables := []restore.CreatedTable{newTestCreatedTable(2, 102), newTestCreatedTable(1, 101)}
+	groups, err := client.BuildFileGroups(context.Background(), tables, files, restore.MergeConfig{
+		SplitSizeBytes: 2,
+	})
+	c.Assert(err, IsNil)
+
+	audit := restore.NewRestoreAudit()
+	for _, group := range groups {
+		c.Assert(audit.Record(group), IsNil)
+	}
+	records := audit.Tables()
+	c.Assert(records, HasLen, 2)
+	for i, group := range []restore.TableWithRange{groups[1], groups[0]} {
+		record := records[i]
+		c.Assert(record.Database, Equals, "test")
+		c.Assert(record.Table, Equals, group.Table.Name.O)
+		c.Assert(record.NewPhysicalID, Equals, group.Table.ID)
+		c.Assert(record.OldPhysicalID, Equals, group.OldTable.Info.ID)
+		c.Assert(record.Ranges, HasLen, len(group.Range))
+		c.Assert(len(record.Ranges) > 1, IsTrue)
+		ranges, err := restore.SortRanges(group.Range, group.RewriteRule)
+		c.Assert(err, IsNil)
+		for j, rg := range ranges {
+			c.Assert(record.Ranges[j].StartKey, Equals, hex.EncodeToString(rg.StartKey))
+			c.Assert(record.Ranges[j].EndKey, Equals, hex.EncodeToString(rg.EndKey))
+			c.Assert(tablecodec.DecodeTableID(rg.EndKey), Equals, group.Table.ID)
+			c.Assert(record.Ranges[j].Files, HasLen, len(rg.Files))
+			for k, file := range rg.Files {
+				c.Assert(record.Ranges[j].Files[k], Equals, file.Name)
+			}
+		}
+	}
+
+	data, err := json.Marshal(audit)
+	c.Assert(err, IsNil)
+	var decoded struct {
+		Tables []restore.PhysicalTableAudit `json:"tables"`
+	}
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded.Tables, DeepEquals, records)
+
+	// the hash is independent of the order of recording, and changes with the files.
+	reversed := restore.NewRestoreAudit()
+	c.Assert(reversed.Record(groups[1]), IsNil)
+	c.Assert(reversed.Record(groups[0]), IsNil)
+	c.Assert(reversed.Hash(), Equals, audit.Hash())
+	partial := restore.NewRestoreAudit()
+	c.Assert(partial.Record(groups[0]), IsNil)
+	c.Assert(partial.Hash(), Not(Equals), audit.Hash())
+
+	// the hash is in the keyspace of the backup, independent of the IDs of the tables created,
+	// and covers the split keys.
+	splitKeysOf := func(groups []restore.TableWithRange) [][]byte {
+		var keys [][]byte
+		for _, group := range groups {
+			ranges, err := restore.SortRanges(group.Range, group.RewriteRule)
+			c.Assert(err, IsNil)
+			for _, rg := range ranges {
+				keys = append(keys, rg.EndKey)
+			}
+		}
+		return keys
+	}
+	audit.RecordSplitKeys(splitKeysOf(groups))
+	renamedGroups, err := client.BuildFileGroups(context.Background(),
+		[]restore.CreatedTable{newTestCreatedTable(2, 202), newTestCreatedTable(1, 201)}, files,
+		restore.MergeConfig{SplitSizeBytes: 2})
+	c.Assert(err, IsNil)
+	renamed := restore.NewRestoreAudit()
+	for _, group := range renamedGroups {
+		c.Assert(renamed.Record(group), IsNil)
+	}
+	c.Assert(renamed.Hash(), Not(Equals), audit.Hash())
+	renamed.RecordSplitKeys(splitKeysOf(renamedGroups))
+	c.Assert(renamed.Tables()[0].NewPhysicalID, Equals, int64(201))
+	c.Assert(renamed.Hash(), Equals, audit.Hash())
+	// the split keys of different batches meeting at the same key are counted once.
+	renamed.RecordSplitKeys(splitKeysOf(renamedGroups[:1]))
+	c.Assert(renamed.Hash(), Equals, audit.Hash())
+	renamed.RecordSplitKeys([][]byte{tablecodec.EncodeRowKey(201, codec.EncodeInt(nil, 5))})
+	c.Assert(renamed.Hash(), Not(Equals), audit.Hash())
+}
+
+func (s *testRestoreClientSuite) TestPlanRestore(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 2; id++ {
+		files = append(files, fb.build(id, 0, 1, 1, 1)...)
+		files = append(files, fb.build(id, 0, 1, 1, 1)...)
+	}
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetSplitClient(initTestClient())
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+	plan, err := client.PlanRestore(context.Background(), tables, files, restore.MergeConfig{SplitSizeBytes: 1})
+	c.Assert(err, IsNil)
+	c.Assert(plan.Groups, HasLen, 2)
+	c.Assert(plan.Files(), HasLen, 4)
+	// the zero thresholds are adjusted.
+	c.Assert(plan.MergeConfig.SplitSizeBytes, Equals, uint64(1))
+	c.Assert(plan.MergeConfig.SplitKeyCount, Greater, uint64(0))
+	// the split keys are sorted and rewritten into the new tables.
+	c.Assert(plan.SplitKeys, Not(HasLen), 0)
+	c.Assert(sort.SliceIsSorted(plan.SplitKeys, func(i, j int) bool {
+		return bytes.Compare(plan.SplitKeys[i], plan.SplitKeys[j]) < 0
+	}), IsTrue)
+	for _, key := range plan.SplitKeys {
+		id := tablecodec.DecodeTableID(key)
+		c.Assert(id == 101 || id == 102, IsTrue, Commentf("split key of table %d", id))
+	}
+	// neither split nor restored.
+	c.Assert(client.SplitKeyCount(), Equals, int64(0))
+	c.Assert(importCli.downloaded, HasLen, 0)
+
+	// the hash is stable for the same inputs.
+	hash := plan.Hash()
+	c.Assert(hash, HasLen, 64)
+	for i := 0; i < 3; i++ {
+		again, err := client.PlanRestore(context.Background(), tables, files, restore.MergeConfig{SplitSizeBytes: 1})
+		c.Assert(err, IsNil)
+		c.Assert(again.Hash(), Equals, hash)
+	}
+	// and changes with the merge config, the files or the tables.
+	merged, err := client.PlanRestore(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(merged.Hash(), Not(Equals), hash)
+	fewer, err := client.PlanRestore(context.Background(), tables, files[1:], restore.MergeConfig{SplitSizeBytes: 1})
+	c.Assert(err, IsNil)
+	c.Assert(fewer.Hash(), Not(Equals), hash)
+	renamed, err := client.PlanRestore(context.Background(),
+		[]restore.CreatedTable{newTestCreatedTable(1, 201), newTestCreatedTable(2, 202)},
+		files, restore.MergeConfig{SplitSizeBytes: 1})
+	c.Assert(err, IsNil)
+	c.Assert(renamed.Hash(), Not(Equals), hash)
+}
+
+// newTestIntPKCreatedTable is newTestCreatedTable with an int primary key as the handle,
+// with the flags of the column, e.g. auto-increment.
+func newTestIntPKCreatedTable(oldID, newID int64, flag uint) restore.CreatedTable {
+	t := newTestCreatedTable(oldID, newID)
+	for _, info := range []*model.TableInfo{t.OldTable.Info, t.Table} {
+		pk := &model.ColumnInfo{
+			ID:        1,
+			Name:      model.NewCIStr("id"),
+			FieldType: *types.NewFieldType(mysql.TypeLonglong),
+			State:     model.StatePublic,
+		}
+		pk.Flag = mysql.PriKeyFlag | flag
+		info.Columns = []*model.ColumnInfo{pk}
+		info.PKIsHandle = true
+	}
+	return t
+}
+
+func (s *testRestoreClientSuite) TestPlanRestoreTailSplit(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	// 2 record files of handles [0, 10) and [10, 20) of every table.
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for id := 1; id <= 3; id++ {
+		files = append(files, fb.build(id, 0, 1, 1, 1)...)
+		files = append(files, fb.build(id, 0, 1, 1, 1)...)
+	}
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetSplitClient(initTestClient())
+
+	// only the auto-increment int primary key is sequential, the sharded row IDs aren't.
+	sharded := newTestCreatedTable(3, 103)
+	sharded.Table.ShardRowIDBits = 4
+	tables := []restore.CreatedTable{
+		newTestIntPKCreatedTable(1, 101, mysql.AutoIncrementFlag),
+		newTestIntPKCreatedTable(2, 102, 0),
+		sharded,
+	}
+	mergeCfg := restore.MergeConfig{SplitSizeBytes: 1}
+	plain, err := client.PlanRestore(context.Background(), tables, files, mergeCfg)
+	c.Assert(err, IsNil)
+
+	client.SetTailSplit(restore.TailSplitConfig{Keys: 5, HandleStep: 3})
+	plan, err := client.PlanRestore(context.Background(), tables, files, mergeCfg)
+	c.Assert(err, IsNil)
+	// the keyspace beyond the last range of handles [10, 20) of the auto-increment table is split
+	// ahead, where the inserts after restore go.
+	diff := restore.DiffPlans(plain, plan)
+	c.Assert(diff.RemovedSplitKeys, HasLen, 0)
+	c.Assert(diff.AddedSplitKeys, DeepEquals, [][]byte{
+		tablecodec.EncodeRowKeyWithHandle(101, kv.IntHandle(23)),
+		tablecodec.EncodeRowKeyWithHandle(101, kv.IntHandle(26)),
+		tablecodec.EncodeRowKeyWithHandle(101, kv.IntHandle(29)),
+		tablecodec.EncodeRowKeyWithHandle(101, kv.IntHandle(32)),
+		tablecodec.EncodeRowKeyWithHandle(101, kv.IntHandle(35)),
+	})
+	c.Assert(client.InjectedSplitKeyCount(), Equals, int64(5))
+	// the keys are all beyond the data restored.
+	for _, file := range plan.Files() {
+		if tablecodec.DecodeTableID(file.GetEndKey()) != 1 {
+			continue
+		}
+		end, err := tablecodec.DecodeRowKey(file.GetEndKey())
+		c.Assert(err, IsNil)
+		for _, key := range diff.AddedSplitKeys {
+			handle, err := tablecodec.DecodeRowKey(key)
+			c.Assert(err, IsNil)
+			c.Assert(handle.IntValue() > end.IntValue(), IsTrue)
+		}
+	}
+
+	// the keys are the same for every run.
+	again, err := client.PlanRestore(context.Background(), tables, files, mergeCfg)
+	c.Assert(err, IsNil)
+	c.Assert(again.Hash(), Equals, plan.Hash())
+}
+
+func (s *testRestoreClientSuite) TestPlanRestoreInPlace(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	fb := fileBulder{}
+	var files []*backuppb.File
+	files = append(files, fb.build(5, 0, 1, 1, 1)...)
+	files = append(files, fb.build(5, 0, 1, 1, 1)...)
+	files = append(files, fb.build(1, 0, 1, 1, 1)...)
+	// table 5 is restored in place, with the identical IDs.
+	tables := []restore.CreatedTable{newTestCreatedTable(5, 5), newTestCreatedTable(1, 101)}
+	mergeCfg := restore.MergeConfig{SplitSizeBytes: 1, ValidateRewriteTableID: true}
+	plan, err := client.PlanRestore(context.Background(), tables, files, mergeCfg)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Files(), HasLen, 3)
+	// the split keys of table 5 are the keys in the backup as they are.
+	inPlaceKeys := make([][]byte, 0)
+	for _, key := range plan.SplitKeys {
+		if tablecodec.DecodeTableID(key) == 5 {
+			inPlaceKeys = append(inPlaceKeys, key)
+		} else {
+			c.Assert(tablecodec.DecodeTableID(key), Equals, int64(101))
+		}
+	}
+	c.Assert(inPlaceKeys, Not(HasLen), 0)
+	for _, key := range inPlaceKeys {
+		c.Assert(bytes.Equal(key, files[0].EndKey) || bytes.Equal(key, files[1].EndKey), IsTrue,
+			Commentf("unexpected split key %X", key))
+	}
+
+	// but a table restored in place must not be rewritten elsewhere.
+	tables[0].RewriteRule = newTestCreatedTable(5, 6).RewriteRule
+	_, err = client.PlanRestore(context.Background(), tables, files, restore.MergeConfig{})
+	c.Assert(err, ErrorMatches, ".*physical table 5 of table t5 is restored in place, but rewrite rule .* rewrites it into table 6.*")
+}
+
+func (s *testRestoreClientSuite) TestDiffPlans(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	fb := fileBulder{}
+	var files []*backuppb.File
+	files = append(files, fb.build(1, 0, 1, 1, 1)...)
+	files = append(files, fb.build(1, 0, 1, 1, 1)...)
+	files = append(files, fb.build(2, 0, 1, 1, 1)...)
+	// the backup is appended to with a range of table 2.
+	appended := append(append([]*backuppb.File{}, files...), fb.build(2, 0, 1, 1, 1)...)
+	tables := []restore.CreatedTable{newTestCreatedTable(1, 101), newTestCreatedTable(2, 102)}
+	mergeCfg := restore.MergeConfig{SplitSizeBytes: 1}
+	oldPlan, err := client.PlanRestore(context.Background(), tables, files, mergeCfg)
+	c.Assert(err, IsNil)
+	newPlan, err := client.PlanRestore(context.Background(), tables, appended, mergeCfg)
+	c.Assert(err, IsNil)
+
+	c.Assert(restore.DiffPlans(oldPlan, oldPlan).Empty(), IsTrue)
+	// the plans are compared in the keyspace of the backup, whatever the tables are created with.
+	recreated := []restore.CreatedTable{newTestCreatedTable(1, 201), newTestCreatedTable(2, 202)}
+	recreatedPlan, err := client.PlanRestore(context.Background(), recreated, files, mergeCfg)
+	c.Assert(err, IsNil)
+	c.Assert(restore.DiffPlans(oldPlan, recreatedPlan).Empty(), IsTrue)
+
+	diff := restore.DiffPlans(oldPlan, newPlan)
+	c.Assert(diff.Empty(), IsFalse)
+	c.Assert(diff.AddedSplitKeys, HasLen, 1)
+	c.Assert(tablecodec.DecodeTableID(diff.AddedSplitKeys[0]), Equals, int64(102))
+	c.Assert(diff.RemovedSplitKeys, HasLen, 0)
+	c.Assert(diff.ChangedRanges, DeepEquals, []restore.PlanRangeDiff{{
+		TableID:      102,
+		StartKey:     appended[3].StartKey,
+		EndKey:       appended[3].EndKey,
+		AddedFiles:   []string{appended[3].Name},
+		RemovedFiles: []string{},
+	}})
+
+	// the other way around.
+	diff = restore.DiffPlans(newPlan, oldPlan)
+	c.Assert(diff.AddedSplitKeys, HasLen, 0)
+	c.Assert(diff.RemovedSplitKeys, HasLen, 1)
+	c.Assert(diff.ChangedRanges, HasLen, 1)
+	c.Assert(diff.ChangedRanges[0].AddedFiles, HasLen, 0)
+	c.Assert(diff.ChangedRanges[0].RemovedFiles, DeepEquals, []string{appended[3].Name})
+
+	// a file replaced in a range.
+	replaced := append([]*backuppb.File{}, files...)
+	replacement := *files[0]
+	replacement.Name = "replaced_write.sst"
+	replaced[0] = &replacement
+	replacedPlan, err := client.PlanRestore(context.Background(), tables, replaced, mergeCfg)
+	c.Assert(err, IsNil)
+	diff = restore.DiffPlans(oldPlan, replacedPlan)
+	c.Assert(diff.AddedSplitKeys, HasLen, 0)
+	c.Assert(diff.RemovedSplitKeys, HasLen, 0)
+	c.Assert(diff.ChangedRanges, HasLen, 1)
+	c.Assert(diff.ChangedRanges[0].TableID, Equals, int64(101))
+	c.Assert(diff.ChangedRanges[0].AddedFiles, DeepEquals, []string{"replaced_write.sst"})
+	c.Assert(diff.ChangedRanges[0].RemovedFiles, DeepEquals, []string{files[0].Name})
+}
+
+func (s *testRestoreClientSuite) TestExecuteRestorePlan(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	fb := fileBulder{}
+	files := fb.build(1, 0, 2, 1, 1)
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(1)
+	client.SetSplitClient(initTestClient())
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+
+	var planned [][]byte
+	client.SetSplitKeysCallback(func(keys [][]byte) {
+		planned = append(planned, keys...)
+	})
+
+	table := newTestCreatedTable(1, 101)
+	rg := rtree.Range{StartKey: files[0].StartKey, EndKey: files[1].EndKey, Files: files}
+	// the plan is executed as is, so it splits at exactly the keys of the plan.
+	plan := &restore.RestorePlan{
+		Groups:    []restore.TableWithRange{{CreatedTable: table, Range: []rtree.Range{rg}}},
+		SplitKeys: [][]byte{[]byte("aaz"), []byte("bbb")},
+	}
+	c.Assert(client.ExecuteRestorePlan(context.Background(), plan, nopProgress{}), IsNil)
+	c.Assert(client.SplitKeyCount(), Equals, int64(2))
+	c.Assert(planned, DeepEquals, plan.SplitKeys)
+	c.Assert(importCli.downloaded, HasLen, 2)
+	c.Assert(importCli.ingested, HasLen, 2)
+
+	// nothing to split or restore for an empty plan.
+	importCli.downloaded = nil
+	c.Assert(client.ExecuteRestorePlan(context.Background(), &restore.RestorePlan{}, nopProgress{}), IsNil)
+	c.Assert(client.SplitKeyCount(), Equals, int64(2))
+	c.Assert(importCli.downloaded, HasLen, 0)
+
+	// the split keys planned from the ranges are reported too.
+	planned = nil
+	err = restore.SplitRanges(context.Background(), client,
+		[]rtree.Range{{StartKey: []byte("aaa"), EndKey: []byte("aae")}}, &restore.RewriteRules{}, nopProgress{})
+	c.Assert(err, IsNil)
+	c.Assert(planned, DeepEquals, [][]byte{[]byte("aae")})
+}
+
+func (s *testRestoreClientSuite) TestExecuteRestorePlanVetoed(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	fb := fileBulder{}
+	files := fb.build(1, 0, 2, 1, 1)
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(1)
+	splitClient := &recordSplitClient{TestClient: initTestClient()}
+	client.SetSplitClient(splitClient)
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+
+	table := newTestCreatedTable(1, 101)
+	rg := rtree.Range{StartKey: files[0].StartKey, EndKey: files[1].EndKey, Files: files}
+	plan := &restore.RestorePlan{
+		Groups:    []restore.TableWithRange{{CreatedTable: table, Range: []rtree.Range{rg}}},
+		SplitKeys: [][]byte{[]byte("aaz"), []byte("bbb")},
+	}
+	vetoed := errors.New("table test.t1 is protected")
+	var inspected *restore.RestorePlan
+	client.SetPrevalidatePlan(func(_ context.Context, p *restore.RestorePlan) error {
+		inspected = p
+		return vetoed
+	})
+	err = client.ExecuteRestorePlan(context.Background(), plan, nopProgress{})
+	c.Assert(errors.Cause(err), Equals, vetoed)
+	c.Assert(inspected, Equals, plan)
+	// nothing in the cluster is touched.
+	c.Assert(splitClient.splitKeys, HasLen, 0)
+	c.Assert(client.SplitKeyCount(), Equals, int64(0))
+	c.Assert(importCli.downloaded, HasLen, 0)
+	c.Assert(importCli.ingested, HasLen, 0)
+
+	// the plan passing the inspection is executed.
+	client.SetPrevalidatePlan(func(context.Context, *restore.RestorePlan) error { return nil })
+	c.Assert(client.ExecuteRestorePlan(context.Background(), plan, nopProgress{}), IsNil)
+	c.Assert(splitClient.splitKeys, HasLen, 2)
+	c.Assert(importCli.ingested, HasLen, 2)
+}
+
+func (s *testRestoreClientSuite) TestGoPrevalidatePlan(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	fb := fileBulder{}
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	tables := make([]restore.TableWithRange, 0, 2)
+	for id := int64(1); id <= 2; id++ {
+		files := fb.build(int(id), 0, 2, 1, 1)
+		rg := rtree.Range{StartKey: files[0].StartKey, EndKey: files[1].EndKey, Files: files}
+		tables = append(tables, restore.TableWithRange{CreatedTable: newTestCreatedTable(id, id+100), Range: []rtree.Range{rg}})
+	}
+	prevalidate := func() ([]restore.TableWithRange, error) {
+		rangeStream := make(chan restore.TableWithRange, len(tables))
+		for _, t := range tables {
+			rangeStream <- t
+		}
+		close(rangeStream)
+		errCh := make(chan error, 1)
+		passed := make([]restore.TableWithRange, 0)
+		for t := range client.GoPrevalidatePlan(context.Background(), rangeStream, restore.MergeConfig{}, errCh) {
+			passed = append(passed, t)
+		}
+		select {
+		case err := <-errCh:
+			return passed, err
+		default:
+			return passed, nil
+		}
+	}
+
+	// without the callback, the tables are passed through.
+	passed, err := prevalidate()
+	c.Assert(err, IsNil)
+	c.Assert(passed, HasLen, 2)
+
+	// the plan of all tables is inspected, and nothing is passed on vetoing.
+	vetoed := errors.New("table test.t2 is protected")
+	var inspected *restore.RestorePlan
+	client.SetPrevalidatePlan(func(_ context.Context, p *restore.RestorePlan) error {
+		inspected = p
+		return vetoed
+	})
+	passed, err = prevalidate()
+	c.Assert(errors.Cause(err), Equals, vetoed)
+	c.Assert(passed, HasLen, 0)
+	c.Assert(inspected.Groups, HasLen, 2)
+	c.Assert(inspected.SplitKeys, Not(HasLen), 0)
+	c.Assert(inspected.Files(), HasLen, 4)
+
+	// the tables are passed through once the plan is accepted.
+	client.SetPrevalidatePlan(func(context.Context, *restore.RestorePlan) error { return nil })
+	passed, err = prevalidate()
+	c.Assert(err, IsNil)
+	c.Assert(passed, DeepEquals, tables)
+
+	// the region count is checked by the split keys of the plan, even without the callback.
+	client.SetPrevalidatePlan(nil)
+	client.SetRegionCountCheck(fakeRegionCountSource{count: 4, maxCount: 5})
+	passed, err = prevalidate()
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInsufficientCapacity)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(".*splits %d more regions.*", len(inspected.SplitKeys)))
+	c.Assert(passed, HasLen, 0)
+	client.SetRegionCountCheck(fakeRegionCountSource{count: 4, maxCount: 4 + len(inspected.SplitKeys)})
+	passed, err = prevalidate()
+	c.Assert(err, IsNil)
+	c.Assert(passed, DeepEquals, tables)
+}
+
+// recordPlacementRuleClient records the deleted placement rules.
+type recordPlacementRuleClient struct {
+	*TestClient
+	deletedRules []string
+}
+
+func (c *recordPlacementRuleClient) DeletePlacementRule(_ context.Context, _, ruleID string) error {
+	c.deletedRules = append(c.deletedRules, ruleID)
+	return nil
+}
+
+func (s *testRestoreClientSuite) TestKeepPlacementRules(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	tables := []*model.TableInfo{{ID: 1}, {ID: 2}}
+	// the store labeled for online restore.
+	pdClient := fakePDClient{Client: s.mock.PDClient, stores: []*metapb.Store{{
+		Id:     1,
+		State:  metapb.StoreState_Up,
+		Labels: []*metapb.StoreLabel{{Key: "exclusive", Value: "restore"}},
+	}}}
+	resetPlacementRules := func(keep, failed bool) []string {
+		client, err := restore.NewRestoreClient(gluetidb.New(), pdClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.EnableOnline()
+		c.Assert(client.LoadRestoreStores(context.Background()), IsNil)
+		splitClient := &recordPlacementRuleClient{TestClient: initTestClient()}
+		client.SetSplitClient(splitClient)
+		if keep {
+			client.EnableKeepPlacementRules()
+		}
+		if failed {
+			c.Assert(client.DiscardPlacementRules(context.Background(), tables), IsNil)
+		} else {
+			c.Assert(client.ResetPlacementRules(context.Background(), tables), IsNil)
+		}
+		return splitClient.deletedRules
+	}
+
+	c.Assert(resetPlacementRules(false, false), DeepEquals, []string{"restore-t1", "restore-t2"})
+	c.Assert(resetPlacementRules(true, false), HasLen, 0)
+	// the rules are kept only when the tables are restored.
+	c.Assert(resetPlacementRules(false, true), DeepEquals, []string{"restore-t1", "restore-t2"})
+	c.Assert(resetPlacementRules(true, true), DeepEquals, []string{"restore-t1", "restore-t2"})
+}
+
+// failedPlacementRuleClient fails deleting the placement rules.
+type failedPlacementRuleClient struct {
+	*TestClient
+}
+
+func (c *failedPlacementRuleClient) DeletePlacementRule(_ context.Context, _, ruleID string) error {
+	return errors.Errorf("failed to delete %s", ruleID)
+}
+
+func (s *testRestoreClientSuite) TestPlacementRuleResetErrors(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	pdClient := fakePDClient{Client: s.mock.PDClient, stores: []*metapb.Store{{
+		Id:     1,
+		State:  metapb.StoreState_Up,
+		Labels: []*metapb.StoreLabel{{Key: "exclusive", Value: "restore"}},
+	}}}
+	client, err := restore.NewRestoreClient(gluetidb.New(), pdClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.EnableOnline()
+	c.Assert(client.LoadRestoreStores(context.Background()), IsNil)
+	client.SetSplitClient(&failedPlacementRuleClient{TestClient: initTestClient()})
+	c.Assert(client.PlacementRuleResetErrors(), HasLen, 0)
+
+	// leaving the tables doesn't fail on resetting the rules, but the errors are recorded.
+	manager := restore.NewBRContextManager(client)
+	c.Assert(manager.Leave(context.Background(), []restore.CreatedTable{newTestCreatedTable(1, 101)}), IsNil)
+	errs := client.PlacementRuleResetErrors()
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrPDInvalidResponse)
+	c.Assert(errs[0], ErrorMatches, ".*failed to delete placement rules for tables \\[101\\].*")
+}
+
+func (s *testRestoreClientSuite) TestDisablePDHTTP(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	pdClient := fakePDClient{Client: s.mock.PDClient, stores: []*metapb.Store{{
+		Id:     1,
+		State:  metapb.StoreState_Up,
+		Labels: []*metapb.StoreLabel{{Key: "exclusive", Value: "restore"}},
+	}}}
+	client, err := restore.NewRestoreClient(gluetidb.New(), pdClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.EnableOnline()
+	c.Assert(client.LoadRestoreStores(context.Background()), IsNil)
+	client.DisablePDHTTP()
+	// the placement rules depend on the PD HTTP API.
+	err = client.SetupPlacementRules(context.Background(), []*model.TableInfo{{ID: 1}})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrUnsupportedOperation)
+}
+
+// placementRuleStoreClient keeps the placement rules in memory, and records the rules set.
+type placementRuleStoreClient struct {
+	*TestClient
+	rules    map[string]placement.Rule
+	setRules []string
+}
+
+func (c *placementRuleStoreClient) GetPlacementRule(_ context.Context, groupID, ruleID string) (placement.Rule, error) {
+	if ruleID == "default" {
+		return placement.Rule{GroupID: groupID, ID: ruleID, Role: placement.Voter, Count: 3}, nil
+	}
+	return c.rules[ruleID], nil
+}
+
+func (c *placementRuleStoreClient) SetPlacementRule(_ context.Context, rule placement.Rule) error {
+	c.rules[rule.ID] = rule
+	c.setRules = append(c.setRules, rule.ID)
+	return nil
+}
+
+func (s *testRestoreClientSuite) TestSkipMatchedPlacementRules(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	tables := []*model.TableInfo{{ID: 1}, {ID: 2}, {ID: 3}}
+	pdClient := fakePDClient{Client: s.mock.PDClient, stores: []*metapb.Store{{
+		Id:     1,
+		State:  metapb.StoreState_Up,
+		Labels: []*metapb.StoreLabel{{Key: "exclusive", Value: "restore"}},
+	}}}
+	newClient := func(splitClient restore.SplitClient, skipMatched bool) *restore.Client {
+		client, err := restore.NewRestoreClient(gluetidb.New(), pdClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.EnableOnline()
+		c.Assert(client.LoadRestoreStores(context.Background()), IsNil)
+		client.SetSplitClient(splitClient)
+		if skipMatched {
+			client.EnableSkipMatchedPlacementRules()
+		}
+		return client
+	}
+
+	// a previous run interrupted has set the rules of table 1 and 2, and the rule of table 2 is changed since.
+	splitClient := &placementRuleStoreClient{TestClient: initTestClient(), rules: map[string]placement.Rule{}}
+	c.Assert(newClient(splitClient, false).SetupPlacementRules(context.Background(), tables[:2]), IsNil)
+	rule := splitClient.rules["restore-t2"]
+	rule.Count = 1
+	splitClient.rules["restore-t2"] = rule
+	// the fields filled in by PD don't make a rule changed.
+	rule = splitClient.rules["restore-t1"]
+	rule.Version, rule.CreateTimestamp = 2, 1634256000
+	splitClient.rules["restore-t1"] = rule
+	splitClient.setRules = nil
+
+	c.Assert(newClient(splitClient, true).SetupPlacementRules(context.Background(), tables), IsNil)
+	c.Assert(splitClient.setRules, DeepEquals, []string{"restore-t2", "restore-t3"})
+	c.Assert(splitClient.rules["restore-t2"].Count, Equals, 3)
+
+	// all the rules are set again without skipping.
+	splitClient.setRules = nil
+	c.Assert(newClient(splitClient, false).SetupPlacementRules(context.Background(), tables), IsNil)
+	c.Assert(splitClient.setRules, DeepEquals, []string{"restore-t1", "restore-t2", "restore-t3"})
+}
+
+func (s *testRestoreClientSuite) TestRestoreFilesRetryTransientErrors(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 1),
+		newImportTestFile("3_write.sst", 1),
+	}
+	for _, file := range files {
+		file.Sha256 = []byte{1}
+	}
+	rules := newImportTestRewriteRules(1, 11)
+	var verifier *fakeFileVerifier
+	restoreFiles := func(retryTimes int, downloadErrors map[string][]error) ([]string, error) {
+		client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+		c.Assert(err, IsNil)
+		client.SetConcurrency(1)
+		client.SetRestoreFilesRetry(retryTimes, 10*time.Millisecond)
+		verifier = &fakeFileVerifier{}
+		client.SetFileVerifier(verifier, 1)
+		importCli := &fakeImporterClient{downloadErrors: downloadErrors}
+		client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+		err = client.RestoreFiles(context.Background(), files, rules, nopProgress{})
+		importCli.mu.Lock()
+		defer importCli.mu.Unlock()
+		return importCli.downloaded, err
+	}
+	unavailable := func() map[string][]error {
+		// the store is too busy to download the second file once.
+		return map[string][]error{"2_write.sst": {status.Error(codes.ResourceExhausted, "store is busy")}}
+	}
+
+	_, err := restoreFiles(0, unavailable())
+	c.Assert(err, ErrorMatches, ".*store is busy.*")
+
+	downloaded, err := restoreFiles(2, unavailable())
+	c.Assert(err, IsNil)
+	// only the unfinished files are restored again.
+	sort.Strings(downloaded)
+	c.Assert(downloaded, DeepEquals, []string{"1_write.sst", "2_write.sst", "3_write.sst"})
+	// the files retried aren't verified again.
+	sort.Strings(verifier.verified)
+	c.Assert(verifier.verified, DeepEquals, []string{"1_write.sst", "2_write.sst", "3_write.sst"})
+
+	// a fatal error is never retried.
+	_, err = restoreFiles(2, map[string][]error{
+		"2_write.sst": {status.Error(codes.InvalidArgument, "bad request")},
+	})
+	c.Assert(err, ErrorMatches, ".*bad request.*")
+}
+
+// syncCountProgress is a countProgress safe to increase concurrently.
+type syncCountProgress struct {
+	count atomic.Int64
+}
+
+func (p *syncCountProgress) Inc() {
+	p.count.Inc()
+}
+
+func (p *syncCountProgress) Close() {}
+
+// recordTableSink records the emitted tables, and signals on close or error.
+type recordTableSink struct {
+	mu     sync.Mutex
+	tables []restore.CreatedTable
+	errs   chan error
+	closed chan struct{}
+}
+
+func (s *recordTableSink) EmitTables(tables ...restore.CreatedTable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables = append(s.tables, tables...)
+}
+
+func (s *recordTableSink) EmitError(err error) {
+	s.errs <- err
+}
+
+func (s *recordTableSink) Close() {
+	close(s.closed)
+}
+
+func (s *testRestoreClientSuite) TestTiKVSenderStageProgress(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	fb := fileBulder{}
+	files := append(fb.build(1, 0, 1, 1, 1), fb.build(1, 0, 1, 1, 1)...)
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetConcurrency(1)
+	client.SetSplitClient(initTestClient())
+	importCli := &fakeImporterClient{}
+	client.SetFileImporter(restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0))
+
+	split, ingest := &syncCountProgress{}, &syncCountProgress{}
+	ctx := context.Background()
+	sender, err := restore.NewTiKVSenderWithStageProgress(ctx, client,
+		restore.StageProgress{Split: split, Ingest: ingest}, 1)
+	c.Assert(err, IsNil)
+	sink := &recordTableSink{errs: make(chan error, 2), closed: make(chan struct{})}
+	sender.PutSink(sink)
+
+	table := newTestCreatedTable(1, 101)
+	sender.RestoreBatch(restore.DrainResult{
+		TablesToSend:         []restore.CreatedTable{table},
+		BlankTablesAfterSend: []restore.CreatedTable{table},
+		RewriteRules:         newImportTestRewriteRules(1, 101),
+		Ranges: []rtree.Range{
+			{StartKey: files[0].StartKey, EndKey: files[0].EndKey, Files: files[:1]},
+			{StartKey: files[1].StartKey, EndKey: files[1].EndKey, Files: files[1:]},
+		},
+	})
+	go sender.Close()
+	select {
+	case err := <-sink.errs:
+		c.Fatal(err)
+	case <-sink.closed:
+	}
+
+	c.Assert(sink.tables, HasLen, 1)
+	// the split progress is of the split keys, and the ingest progress is of the file groups.
+	c.Assert(split.count.Load(), Equals, client.SplitKeyCount())
+	c.Assert(split.count.Load() > 0, IsTrue)
+	c.Assert(ingest.count.Load(), Equals, int64(2))
+	c.Assert(importCli.ingested, HasLen, 2)
+
+	// both stages are reported to the same progress by the merged one.
+	merged := &syncCountProgress{}
+	progress := restore.MergedStageProgress(merged)
+	progress.Split.Inc()
+	progress.Ingest.Inc()
+	c.Assert(merged.count.Load(), Equals, int64(2))
+}
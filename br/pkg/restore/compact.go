@@ -0,0 +1,153 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/br/pkg/conn"
+	berrors "github.com/pingcap/tidb/br/pkg/errors"
+	"github.com/pingcap/tidb/br/pkg/glue"
+	"github.com/pingcap/tidb/br/pkg/logutil"
+	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	pd "github.com/tikv/pd/client"
+	"go.uber.org/zap"
+)
+
+// CompactionTrigger triggers the compaction of the key ranges on the stores.
+type CompactionTrigger interface {
+	// Compact compacts the range [startKey, endKey) of the encoded keys on all the stores.
+	Compact(ctx context.Context, startKey, endKey []byte) error
+}
+
+type storeCompactionTrigger struct {
+	pdClient     pd.Client
+	importClient ImporterClient
+}
+
+// NewStoreCompactionTrigger returns a CompactionTrigger sending the compact requests to every TiKV store.
+func NewStoreCompactionTrigger(pdClient pd.Client, importClient ImporterClient) CompactionTrigger {
+	return storeCompactionTrigger{pdClient: pdClient, importClient: importClient}
+}
+
+func (t storeCompactionTrigger) Compact(ctx context.Context, startKey, endKey []byte) error {
+	stores, err := conn.GetAllTiKVStores(ctx, t.pdClient, conn.SkipTiFlash)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, store := range stores {
+		client, err := t.importClient.GetImportClient(ctx, store.GetId())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// -1 means compacting to the bottommost level.
+		_, err = client.Compact(ctx, &import_sstpb.CompactRequest{
+			Range:       &import_sstpb.Range{Start: startKey, End: endKey},
+			OutputLevel: -1,
+		})
+		if err != nil {
+			return errors.Annotatef(err, "failed to compact on store %d", store.GetId())
+		}
+	}
+	return nil
+}
+
+// CompactionScope is how the keyspaces of the restored tables are compacted.
+type CompactionScope string
+
+const (
+	// CompactionScopeTable compacts the keyspace of every restored physical table separately.
+	CompactionScopeTable CompactionScope = "table"
+	// CompactionScopeGlobal compacts the span of all the restored tables at once.
+	CompactionScopeGlobal CompactionScope = "global"
+)
+
+// ParseCompactionScope parses the scope of compaction from its name.
+func ParseCompactionScope(name string) (CompactionScope, error) {
+	switch scope := CompactionScope(name); scope {
+	case CompactionScopeTable, CompactionScopeGlobal:
+		return scope, nil
+	}
+	return "", errors.Annotatef(berrors.ErrInvalidArgument,
+		"unknown compaction scope %s, should be one of %s and %s",
+		name, CompactionScopeTable, CompactionScopeGlobal)
+}
+
+// CompactionRanges returns the raw key ranges to compact for the restored tables by the scope, sorted by keys.
+// A physical table, i.e. a partition or a non-partitioned table, is compacted as a whole.
+func CompactionRanges(tables []CreatedTable, scope CompactionScope) []rtree.Range {
+	ids := make([]int64, 0, len(tables))
+	seen := make(map[int64]struct{}, len(tables))
+	for _, t := range tables {
+		for _, newID := range newPhysicalIDsOf(t) {
+			if _, ok := seen[newID]; !ok {
+				seen[newID] = struct{}{}
+				ids = append(ids, newID)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if scope == CompactionScopeGlobal {
+		return []rtree.Range{{
+			StartKey: tablecodec.EncodeTablePrefix(ids[0]),
+			EndKey:   tablecodec.EncodeTablePrefix(ids[len(ids)-1] + 1),
+		}}
+	}
+	ranges := make([]rtree.Range, 0, len(ids))
+	for _, id := range ids {
+		ranges = append(ranges, rtree.Range{
+			StartKey: tablecodec.EncodeTablePrefix(id),
+			EndKey:   tablecodec.EncodeTablePrefix(id + 1),
+		})
+	}
+	return ranges
+}
+
+// SetPostRestoreCompaction makes CompactRestoredTables compact the keyspaces of the restored tables
+// by the trigger and the scope. nil trigger (the default) means no compaction.
+func (rc *Client) SetPostRestoreCompaction(trigger CompactionTrigger, scope CompactionScope) {
+	rc.compactionTrigger = trigger
+	rc.compactionScope = scope
+}
+
+// CompactRestoredTables triggers the compaction of the keyspaces of the restored tables,
+// so the L0 files created by ingesting are compacted, and the tables are ready for
+// querying sooner. updateCh is increased once a range is compacted, there are
+// len(CompactionRanges(tables, scope)) ranges. It's a no-op unless SetPostRestoreCompaction.
+func (rc *Client) CompactRestoredTables(ctx context.Context, tables []CreatedTable, updateCh glue.Progress) error {
+	if rc.compactionTrigger == nil {
+		return nil
+	}
+	ranges := CompactionRanges(tables, rc.compactionScope)
+	start := time.Now()
+	for i, rg := range ranges {
+		rangeStart := time.Now()
+		startKey, endKey := codec.EncodeBytes(nil, rg.StartKey), codec.EncodeBytes(nil, rg.EndKey)
+		if err := rc.compactionTrigger.Compact(ctx, startKey, endKey); err != nil {
+			return errors.Trace(err)
+		}
+		updateCh.Inc()
+		log.Info("compact restored range done",
+			logutil.Key("startKey", rg.StartKey),
+			logutil.Key("endKey", rg.EndKey),
+			zap.Int("progress", i+1),
+			zap.Int("total", len(ranges)),
+			zap.Duration("take", time.Since(rangeStart)))
+	}
+	log.Info("compact restored tables done",
+		zap.String("scope", string(rc.compactionScope)),
+		zap.Int("tables", len(tables)),
+		zap.Int("ranges", len(ranges)),
+		zap.Duration("take", time.Since(start)))
+	return nil
+}
@@ -167,6 +167,10 @@ func (db *DB) CreateTable(ctx context.Context, table *metautil.Table, ddlTables
 				zap.Error(err))
 			return errors.Trace(err)
 		}
+		log.Info("restore sequence value",
+			zap.Stringer("db", table.DB.Name),
+			zap.Stringer("sequence", table.Info.Name),
+			zap.Int64("value", table.Info.AutoIncID))
 	// only table exists in ddlJobs during incremental restoration should do alter after creation.
 	case ddlTables[UniqueTableName{table.DB.Name.String(), table.Info.Name.String()}]:
 		if utils.NeedAutoID(table.Info) {
@@ -200,6 +204,23 @@ func (db *DB) CreateTable(ctx context.Context, table *metautil.Table, ddlTables
 	return errors.Trace(err)
 }
 
+// AlterTiFlashReplica executes an ALTER TABLE ... SET TIFLASH REPLICA SQL.
+func (db *DB) AlterTiFlashReplica(ctx context.Context, dbName, tableName model.CIStr, count uint64) error {
+	alterSQL := fmt.Sprintf("alter table %s.%s set tiflash replica %d;",
+		utils.EncloseName(dbName.O),
+		utils.EncloseName(tableName.O),
+		count)
+	err := db.se.Execute(ctx, alterSQL)
+	if err != nil {
+		log.Error("alter tiflash replica failed",
+			zap.String("query", alterSQL),
+			zap.Stringer("db", dbName),
+			zap.Stringer("table", tableName),
+			zap.Error(err))
+	}
+	return errors.Trace(err)
+}
+
 // Close closes the connection.
 func (db *DB) Close() {
 	db.se.Close()
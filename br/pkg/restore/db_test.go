@@ -127,6 +127,31 @@ func (s *testRestoreSchemaSuite) TestRestoreAutoIncID(c *C) {
 
 }
 
+func (s *testRestoreSchemaSuite) TestRestoreSequenceValue(c *C) {
+	tk := testkit.NewTestKit(c, s.mock.Storage)
+	tk.MustExec("create database if not exists test_seq")
+	tk.MustExec("use test_seq")
+	tk.MustExec("drop sequence if exists seq")
+	tk.MustExec("create sequence seq start with 1 increment by 1")
+	info, err := s.mock.Domain.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	dbInfo, exists := info.SchemaByName(model.NewCIStr("test_seq"))
+	c.Assert(exists, IsTrue)
+	seqInfo, err := info.TableByName(model.NewCIStr("test_seq"), model.NewCIStr("seq"))
+	c.Assert(err, IsNil)
+	// the backed up sequence has allocated values until 100.
+	table := metautil.Table{Info: seqInfo.Meta().Clone(), DB: dbInfo}
+	table.Info.AutoIncID = 100
+	tk.MustExec("drop sequence seq")
+
+	db, err := restore.NewDB(gluetidb.New(), s.mock.Storage)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	err = db.CreateTable(context.Background(), &table, map[restore.UniqueTableName]bool{})
+	c.Assert(err, IsNil)
+	tk.MustQuery("select nextval(seq)").Check(testkit.Rows("101"))
+}
+
 func (s *testRestoreSchemaSuite) TestFilterDDLJobs(c *C) {
 	tk := testkit.NewTestKit(c, s.mock.Storage)
 	tk.MustExec("CREATE DATABASE IF NOT EXISTS test_db;")
@@ -0,0 +1,112 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ParseFileEpoch parses the epoch version of the backed up region from the name of a file,
+// which is "{store}_{region}_{epoch version}_{cf}.sst", or with the hash of the range and
+// the timestamp before the CF by the newer TiKV. It returns false if the name isn't the format.
+func ParseFileEpoch(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".sst") {
+		return 0, false
+	}
+	fields := strings.Split(strings.TrimSuffix(name, ".sst"), "_")
+	if len(fields) < 4 {
+		return 0, false
+	}
+	epoch, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return epoch, true
+}
+
+// TableFileEpochs is the distribution of the region epochs of the files of a table.
+type TableFileEpochs struct {
+	// TableID is the ID of the table in the backup.
+	TableID int64
+	Files   int
+	// UnknownFiles is the count of the files whose epoch can't be parsed from the name.
+	UnknownFiles int
+	// Epochs is the count of files of each epoch version.
+	Epochs map[uint64]int
+}
+
+// EpochRange returns the min and max epoch versions of the files, zeros if there is no epoch.
+func (t TableFileEpochs) EpochRange() (minEpoch, maxEpoch uint64) {
+	first := true
+	for epoch := range t.Epochs {
+		if first || epoch < minEpoch {
+			minEpoch = epoch
+		}
+		if first || epoch > maxEpoch {
+			maxEpoch = epoch
+		}
+		first = false
+	}
+	return minEpoch, maxEpoch
+}
+
+// SpansManyEpochs checks whether the files span at least the count of epochs, which is
+// a sign of the regions of the table being split concurrently during the backup.
+func (t TableFileEpochs) SpansManyEpochs(count int) bool {
+	return count > 0 && len(t.Epochs) >= count
+}
+
+// AnalyzeFileEpochs groups the files by the table and the region epoch parsed from the names,
+// in the order of the table IDs. It's for diagnosing only and doesn't change the files.
+func AnalyzeFileEpochs(files []*backuppb.File) []TableFileEpochs {
+	fileOfTable := MapTableToFiles(files)
+	result := make([]TableFileEpochs, 0, len(fileOfTable))
+	for tableID, tableFiles := range fileOfTable {
+		stat := TableFileEpochs{TableID: tableID, Files: len(tableFiles), Epochs: make(map[uint64]int)}
+		for _, file := range tableFiles {
+			epoch, ok := ParseFileEpoch(file.GetName())
+			if !ok {
+				stat.UnknownFiles++
+				continue
+			}
+			stat.Epochs[epoch]++
+		}
+		result = append(result, stat)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].TableID < result[j].TableID
+	})
+	return result
+}
+
+// LogFileEpochs logs the epoch distribution of the tables, and warns for the tables whose
+// files span at least manyEpochs epochs.
+func LogFileEpochs(stats []TableFileEpochs, manyEpochs int) {
+	flagged := 0
+	for _, stat := range stats {
+		minEpoch, maxEpoch := stat.EpochRange()
+		fields := []zap.Field{
+			zap.Int64("table id", stat.TableID),
+			zap.Int("files", stat.Files),
+			zap.Int("unknown files", stat.UnknownFiles),
+			zap.Int("epochs", len(stat.Epochs)),
+			zap.Uint64("min epoch", minEpoch),
+			zap.Uint64("max epoch", maxEpoch),
+		}
+		if stat.SpansManyEpochs(manyEpochs) {
+			flagged++
+			log.Warn("the files of the table span many region epochs, "+
+				"the regions may be split concurrently during backup", fields...)
+			continue
+		}
+		log.Info("the region epochs of the files of the table", fields...)
+	}
+	log.Info("analyze the region epochs of files done",
+		zap.Int("tables", len(stats)), zap.Int("tables span many epochs", flagged))
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"testing"
+
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFileEpoch(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name  string
+		epoch uint64
+		ok    bool
+	}{
+		{"1_4_2_default.sst", 2, true},
+		{"1_2_29_6e97c3b17c657c4413724f614a619f5b665b990187b159e7d2b92552076144b6_1617351201040_write.sst", 29, true},
+		{"1_write.sst", 0, false},
+		{"1_4_x_default.sst", 0, false},
+		{"1_4_2_default", 0, false},
+	}
+	for _, ca := range cases {
+		epoch, ok := restore.ParseFileEpoch(ca.name)
+		require.Equal(t, ca.ok, ok, ca.name)
+		require.Equal(t, ca.epoch, epoch, ca.name)
+	}
+}
+
+func TestAnalyzeFileEpochs(t *testing.T) {
+	t.Parallel()
+	newFile := func(tableID int64, name string) *backuppb.File {
+		return &backuppb.File{
+			Name:     name,
+			StartKey: tablecodec.GenTableIndexPrefix(tableID),
+			EndKey:   tablecodec.GenTableRecordPrefix(tableID),
+		}
+	}
+	files := []*backuppb.File{
+		newFile(2, "1_10_5_default.sst"),
+		newFile(2, "1_11_6_default.sst"),
+		newFile(2, "1_12_7_write.sst"),
+		newFile(2, "1_13_7_write.sst"),
+		newFile(1, "1_2_3_default.sst"),
+		newFile(1, "2_2_3_write.sst"),
+		newFile(1, "broken.sst"),
+	}
+	stats := restore.AnalyzeFileEpochs(files)
+	require.Len(t, stats, 2)
+
+	require.Equal(t, int64(1), stats[0].TableID)
+	require.Equal(t, 3, stats[0].Files)
+	require.Equal(t, 1, stats[0].UnknownFiles)
+	require.Equal(t, map[uint64]int{3: 2}, stats[0].Epochs)
+	minEpoch, maxEpoch := stats[0].EpochRange()
+	require.Equal(t, uint64(3), minEpoch)
+	require.Equal(t, uint64(3), maxEpoch)
+	require.False(t, stats[0].SpansManyEpochs(3))
+
+	require.Equal(t, int64(2), stats[1].TableID)
+	require.Equal(t, 4, stats[1].Files)
+	require.Equal(t, map[uint64]int{5: 1, 6: 1, 7: 2}, stats[1].Epochs)
+	minEpoch, maxEpoch = stats[1].EpochRange()
+	require.Equal(t, uint64(5), minEpoch)
+	require.Equal(t, uint64(7), maxEpoch)
+	require.True(t, stats[1].SpansManyEpochs(3))
+	require.False(t, stats[1].SpansManyEpochs(4))
+	// 0 disables flagging.
+	require.False(t, stats[1].SpansManyEpochs(0))
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+	"time"
+)
+
+// IngestProgress is the progress of ingesting the files, with the estimated time remaining.
+type IngestProgress struct {
+	FinishedBytes uint64
+	TotalBytes    uint64
+	// BytesPerSecond is the ingest rate over the recent window.
+	BytesPerSecond float64
+	// Remaining is the estimated time to ingest the rest bytes, 0 if the rate is unknown yet.
+	Remaining time.Duration
+}
+
+type ingestEvent struct {
+	bytes uint64
+	at    time.Time
+}
+
+// IngestETATracker estimates the time remaining of ingesting by the rolling ingest rate
+// of the finished file groups.
+type IngestETATracker struct {
+	totalBytes uint64
+	window     time.Duration
+	callback   func(IngestProgress)
+
+	mu       sync.Mutex
+	start    time.Time
+	finished uint64
+	// events is the finished groups in the window, in the order of finishing.
+	events []ingestEvent
+}
+
+// NewIngestETATracker returns a tracker of ingesting the total bytes, starting from now.
+// The rate is computed from the groups finished in the last window, and the callback is
+// called with the progress once a group is finished.
+func NewIngestETATracker(totalBytes uint64, window time.Duration, callback func(IngestProgress)) *IngestETATracker {
+	return &IngestETATracker{
+		totalBytes: totalBytes,
+		window:     window,
+		callback:   callback,
+		start:      time.Now(),
+	}
+}
+
+// Finish records a group of files of the bytes is ingested at the time.
+func (tr *IngestETATracker) Finish(bytes uint64, at time.Time) {
+	tr.mu.Lock()
+	tr.finished += bytes
+	tr.events = append(tr.events, ingestEvent{bytes: bytes, at: at})
+	windowStart := at.Add(-tr.window)
+	i := 0
+	for i < len(tr.events) && !tr.events[i].at.After(windowStart) {
+		i++
+	}
+	tr.events = tr.events[i:]
+	progress := tr.progressLocked(at, windowStart)
+	tr.mu.Unlock()
+
+	if tr.callback != nil {
+		tr.callback(progress)
+	}
+}
+
+func (tr *IngestETATracker) progressLocked(now, windowStart time.Time) IngestProgress {
+	progress := IngestProgress{FinishedBytes: tr.finished, TotalBytes: tr.totalBytes}
+	if windowStart.Before(tr.start) {
+		windowStart = tr.start
+	}
+	elapsed := now.Sub(windowStart)
+	if elapsed <= 0 {
+		return progress
+	}
+	windowBytes := uint64(0)
+	for _, event := range tr.events {
+		windowBytes += event.bytes
+	}
+	progress.BytesPerSecond = float64(windowBytes) / elapsed.Seconds()
+	if progress.BytesPerSecond > 0 && tr.totalBytes > tr.finished {
+		progress.Remaining = time.Duration(float64(tr.totalBytes-tr.finished) / progress.BytesPerSecond * float64(time.Second))
+	}
+	return progress
+}
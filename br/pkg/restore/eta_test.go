@@ -0,0 +1,39 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestETATracker(t *testing.T) {
+	t.Parallel()
+	var progresses []restore.IngestProgress
+	tracker := restore.NewIngestETATracker(3000, 5*time.Second, func(p restore.IngestProgress) {
+		progresses = append(progresses, p)
+	})
+	start := time.Now()
+	// a group of 100 bytes is finished every second.
+	for i := 1; i <= 10; i++ {
+		tracker.Finish(100, start.Add(time.Duration(i)*time.Second))
+	}
+	require.Len(t, progresses, 10)
+	last := progresses[len(progresses)-1]
+	require.Equal(t, uint64(1000), last.FinishedBytes)
+	require.Equal(t, uint64(3000), last.TotalBytes)
+	require.InDelta(t, 100, last.BytesPerSecond, 1)
+	// the rest 2000 bytes take about 20 seconds.
+	require.InDelta(t, float64(20*time.Second), float64(last.Remaining), float64(100*time.Millisecond))
+
+	// the rate follows the recent groups only, which are getting faster.
+	for i := 1; i <= 5; i++ {
+		tracker.Finish(200, start.Add(10*time.Second+time.Duration(i)*time.Second))
+	}
+	last = progresses[len(progresses)-1]
+	require.InDelta(t, 200, last.BytesPerSecond, 1)
+	require.InDelta(t, float64(5*time.Second), float64(last.Remaining), float64(100*time.Millisecond))
+}
@@ -205,6 +205,26 @@ type FileImporter struct {
 	rawStartKey        []byte
 	rawEndKey          []byte
 	supportMultiIngest bool
+
+	summaryPrefix string
+	// downloadNameRewriter rewrites the names of the files to download, nil means identity.
+	downloadNameRewriter func(name string) string
+	// downloadRetry and ingestRetry are the retry budgets of downloading and ingesting.
+	downloadRetry ImportRetryConfig
+	ingestRetry   ImportRetryConfig
+	// cfIngestOrder ingests the files of every CF into a region separately in the order, empty means at once.
+	cfIngestOrder []string
+	// cutFileRange downloads only the keys of the files inside their start and end keys.
+	cutFileRange bool
+}
+
+// ImportRetryConfig is the retry budget of a step of importing files.
+// The zero value means the default budget of the step.
+type ImportRetryConfig struct {
+	// Attempts is how many times to try at most, 0 means the default.
+	Attempts int
+	// Interval is the backoff of the first retry, which doubles on every retry, 0 means the default.
+	Interval time.Duration
 }
 
 // NewFileImporter returns a new file importClient.
@@ -257,6 +277,73 @@ func (importer *FileImporter) SetRawRange(startKey, endKey []byte) error {
 	return nil
 }
 
+// SetDownloadNameRewriter sets the function rewriting the name of every file before
+// downloading it, so the files could be downloaded from a mirror of the backup storage
+// without rewriting the backup meta. nil means downloading the files by their names.
+func (importer *FileImporter) SetDownloadNameRewriter(rewriter func(name string) string) {
+	importer.downloadNameRewriter = rewriter
+}
+
+// SetRetry sets the retry budgets of downloading the files and ingesting them separately,
+// since downloading fails by the external storage while ingesting fails by the cluster.
+// The download budget applies to every region, and a failed download uses up one attempt
+// of the ingest budget, which covers scanning the regions and ingesting into them.
+func (importer *FileImporter) SetRetry(download, ingest ImportRetryConfig) {
+	importer.downloadRetry = download
+	importer.ingestRetry = ingest
+}
+
+// SetCFIngestOrder makes the files of the CFs downloaded into a region ingested by a request per CF,
+// in the order of the CF names, e.g. default CF first, so a write CF record never becomes visible
+// before the value it points to. The files of the unlisted CFs are ingested last together.
+// Empty (the default) means ingesting the files of all CFs at once, which is atomic.
+func (importer *FileImporter) SetCFIngestOrder(cfs []string) {
+	importer.cfIngestOrder = cfs
+}
+
+// EnableFileRangeCut makes the importer download only the keys of every file inside the start and
+// end keys of the file, rewritten by the rules, e.g. the files cut by MergeConfig.KeyRangeAllowlist.
+// By default, all the keys of a file inside a region are downloaded into the region. It doesn't work
+// in the raw kv mode, see SetRawRange.
+func (importer *FileImporter) EnableFileRangeCut() {
+	importer.cutFileRange = true
+}
+
+// ingestBatches splits the SSTs downloaded from the files into the batches to ingest in order,
+// by the CF ingest order. The SSTs are in the same order as the files.
+func (importer *FileImporter) ingestBatches(
+	files []*backuppb.File, metas []*import_sstpb.SSTMeta,
+) [][]*import_sstpb.SSTMeta {
+	if len(importer.cfIngestOrder) == 0 {
+		return [][]*import_sstpb.SSTMeta{metas}
+	}
+	batches := make([][]*import_sstpb.SSTMeta, len(importer.cfIngestOrder)+1)
+	for i, meta := range metas {
+		idx := len(importer.cfIngestOrder)
+		for j, cf := range importer.cfIngestOrder {
+			if fileCF(files[i]) == cf {
+				idx = j
+				break
+			}
+		}
+		batches[idx] = append(batches[idx], meta)
+	}
+	result := batches[:0]
+	for _, batch := range batches {
+		if len(batch) > 0 {
+			result = append(result, batch)
+		}
+	}
+	return result
+}
+
+func (importer *FileImporter) downloadName(file *backuppb.File) string {
+	if importer.downloadNameRewriter == nil {
+		return file.GetName()
+	}
+	return importer.downloadNameRewriter(file.GetName())
+}
+
 // Import tries to import a file.
 // All rules must contain encoded keys.
 func (importer *FileImporter) Import(
@@ -292,7 +379,13 @@ func (importer *FileImporter) Import(
 		logutil.Key("startKey", startKey),
 		logutil.Key("endKey", endKey))
 
+	attempt := 0
 	err := utils.WithRetry(ctx, func() error {
+		if attempt > 0 {
+			summary.CollectSuccessUnit(
+				summaryUnit(importer.summaryPrefix, summary.FileIngestRetries), 1, uint64(len(files)))
+		}
+		attempt++
 		tctx, cancel := context.WithTimeout(ctx, importScanRegionTime)
 		defer cancel()
 		// Scan regions covered by the file range
@@ -336,7 +429,7 @@ func (importer *FileImporter) Import(
 				}
 
 				return nil
-			}, utils.NewDownloadSSTBackoffer())
+			}, utils.NewDownloadSSTBackofferWithRetry(importer.downloadRetry.Attempts, importer.downloadRetry.Interval))
 			if errDownload != nil {
 				for _, e := range multierr.Errors(errDownload) {
 					switch errors.Cause(e) { // nolint:errorlint
@@ -365,79 +458,82 @@ func (importer *FileImporter) Import(
 				logutil.Key("start", files[0].StartKey),
 				logutil.Key("end", files[0].EndKey),
 			)
-			ingestResp, errIngest := importer.ingestSSTs(ctx, downloadMetas, info)
-		ingestRetry:
-			for errIngest == nil {
-				errPb := ingestResp.GetError()
-				if errPb == nil {
-					// Ingest success
-					break ingestRetry
-				}
-				switch {
-				case errPb.NotLeader != nil:
-					// If error is `NotLeader`, update the region info and retry
-					var newInfo *RegionInfo
-					if newLeader := errPb.GetNotLeader().GetLeader(); newLeader != nil {
-						newInfo = &RegionInfo{
-							Leader: newLeader,
-							Region: info.Region,
+			for _, metas := range importer.ingestBatches(files, downloadMetas) {
+				ingestResp, errIngest := importer.ingestSSTs(ctx, metas, info)
+			ingestRetry:
+				for errIngest == nil {
+					errPb := ingestResp.GetError()
+					if errPb == nil {
+						// Ingest success
+						break ingestRetry
+					}
+					switch {
+					case errPb.NotLeader != nil:
+						// If error is `NotLeader`, update the region info and retry
+						var newInfo *RegionInfo
+						if newLeader := errPb.GetNotLeader().GetLeader(); newLeader != nil {
+							newInfo = &RegionInfo{
+								Leader: newLeader,
+								Region: info.Region,
+							}
+						} else {
+							// Slow path, get region from PD
+							newInfo, errIngest = importer.metaClient.GetRegion(
+								ctx, info.Region.GetStartKey())
+							if errIngest != nil {
+								break ingestRetry
+							}
+							// do not get region info, wait a second and continue
+							if newInfo == nil {
+								log.Warn("get region by key return nil", logutil.Region(info.Region))
+								time.Sleep(time.Second)
+								continue
+							}
 						}
-					} else {
-						// Slow path, get region from PD
-						newInfo, errIngest = importer.metaClient.GetRegion(
-							ctx, info.Region.GetStartKey())
-						if errIngest != nil {
+						log.Debug("ingest sst returns not leader error, retry it",
+							logutil.Region(info.Region),
+							zap.Stringer("newLeader", newInfo.Leader))
+
+						if !checkRegionEpoch(newInfo, info) {
+							errIngest = errors.Trace(berrors.ErrKVEpochNotMatch)
 							break ingestRetry
 						}
-						// do not get region info, wait a second and continue
-						if newInfo == nil {
-							log.Warn("get region by key return nil", logutil.Region(info.Region))
-							time.Sleep(time.Second)
-							continue
-						}
-					}
-					log.Debug("ingest sst returns not leader error, retry it",
-						logutil.Region(info.Region),
-						zap.Stringer("newLeader", newInfo.Leader))
-
-					if !checkRegionEpoch(newInfo, info) {
+						ingestResp, errIngest = importer.ingestSSTs(ctx, metas, newInfo)
+					case errPb.EpochNotMatch != nil:
+						// TODO handle epoch not match error
+						//      1. retry download if needed
+						//      2. retry ingest
 						errIngest = errors.Trace(berrors.ErrKVEpochNotMatch)
 						break ingestRetry
+					case errPb.KeyNotInRegion != nil:
+						errIngest = errors.Trace(berrors.ErrKVKeyNotInRegion)
+						break ingestRetry
+					default:
+						// Other errors like `ServerIsBusy`, `RegionNotFound`, etc. should be retryable
+						errIngest = errors.Annotatef(berrors.ErrKVIngestFailed, "ingest error %s", errPb)
+						break ingestRetry
 					}
-					ingestResp, errIngest = importer.ingestSSTs(ctx, downloadMetas, newInfo)
-				case errPb.EpochNotMatch != nil:
-					// TODO handle epoch not match error
-					//      1. retry download if needed
-					//      2. retry ingest
-					errIngest = errors.Trace(berrors.ErrKVEpochNotMatch)
-					break ingestRetry
-				case errPb.KeyNotInRegion != nil:
-					errIngest = errors.Trace(berrors.ErrKVKeyNotInRegion)
-					break ingestRetry
-				default:
-					// Other errors like `ServerIsBusy`, `RegionNotFound`, etc. should be retryable
-					errIngest = errors.Annotatef(berrors.ErrKVIngestFailed, "ingest error %s", errPb)
-					break ingestRetry
 				}
-			}
 
-			if errIngest != nil {
-				log.Error("ingest file failed",
-					logutil.Files(files),
-					logutil.SSTMetas(downloadMetas),
-					logutil.Region(info.Region),
-					zap.Error(errIngest))
-				return errors.Trace(errIngest)
+				if errIngest != nil {
+					log.Error("ingest file failed",
+						logutil.Files(files),
+						logutil.SSTMetas(metas),
+						logutil.Region(info.Region),
+						zap.Error(errIngest))
+					return errors.Trace(errIngest)
+				}
 			}
 		}
 		log.Debug("ingest file done", zap.String("file-sample", files[0].Name), zap.Stringer("take", time.Since(start)))
+		// The summary renders the total KVs and bytes by the exact names, so they are never prefixed.
 		for _, f := range files {
 			summary.CollectSuccessUnit(summary.TotalKV, 1, f.TotalKvs)
 			summary.CollectSuccessUnit(summary.TotalBytes, 1, f.TotalBytes)
 		}
 
 		return nil
-	}, utils.NewImportSSTBackoffer())
+	}, utils.NewImportSSTBackofferWithRetry(importer.ingestRetry.Attempts, importer.ingestRetry.Interval))
 	return errors.Trace(err)
 }
 
@@ -468,11 +564,28 @@ func (importer *FileImporter) downloadSST(
 		NewKeyPrefix: encodeKeyPrefix(fileRule.GetNewKeyPrefix()),
 	}
 	sstMeta := GetSSTMetaFromFile(id, file, regionInfo.Region, &rule)
+	if importer.cutFileRange {
+		startKey, endKey, err := rewriteFileKeys(file, rewriteRules)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// Cut the SST file's range to fit in the keys of the file.
+		if bytes.Compare(startKey, sstMeta.Range.GetStart()) > 0 {
+			sstMeta.Range.Start = startKey
+		}
+		if len(endKey) > 0 && bytes.Compare(endKey, sstMeta.Range.GetEnd()) <= 0 {
+			sstMeta.Range.End = endKey
+			sstMeta.EndKeyExclusive = true
+		}
+		if bytes.Compare(sstMeta.Range.GetStart(), sstMeta.Range.GetEnd()) >= 0 {
+			return nil, errors.Trace(berrors.ErrKVRangeIsEmpty)
+		}
+	}
 
 	req := &import_sstpb.DownloadRequest{
 		Sst:            sstMeta,
 		StorageBackend: importer.backend,
-		Name:           file.GetName(),
+		Name:           importer.downloadName(file),
 		RewriteRule:    rule,
 		CipherInfo:     cipher,
 	}
@@ -549,7 +662,7 @@ func (importer *FileImporter) downloadRawKVSST(
 	req := &import_sstpb.DownloadRequest{
 		Sst:            sstMeta,
 		StorageBackend: importer.backend,
-		Name:           file.GetName(),
+		Name:           importer.downloadName(file),
 		RewriteRule:    rule,
 		IsRawKv:        true,
 		CipherInfo:     cipher,
@@ -0,0 +1,275 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/pingcap/tidb/br/pkg/summary"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeImporterClient struct {
+	mu sync.Mutex
+	// ingestErrors is the count of the ingest requests should be failed
+	// with a retryable error before success.
+	ingestErrors int
+	// downloadDelays is the time to take for downloading, by the file name.
+	downloadDelays map[string]time.Duration
+	// downloadErrors is the errors to fail the download requests by the file name,
+	// one error per request before success.
+	downloadErrors map[string][]error
+	downloaded     []string
+	ingested       []*import_sstpb.SSTMeta
+	// multiIngest supports the multi ingest requests, whose SSTs are recorded by request.
+	multiIngest   bool
+	multiIngested [][]*import_sstpb.SSTMeta
+}
+
+func (f *fakeImporterClient) DownloadSST(
+	_ context.Context, _ uint64, req *import_sstpb.DownloadRequest,
+) (*import_sstpb.DownloadResponse, error) {
+	time.Sleep(f.downloadDelays[req.Name])
+	f.mu.Lock()
+	if errs := f.downloadErrors[req.Name]; len(errs) > 0 {
+		f.downloadErrors[req.Name] = errs[1:]
+		f.mu.Unlock()
+		return nil, errs[0]
+	}
+	f.downloaded = append(f.downloaded, req.Name)
+	f.mu.Unlock()
+	return &import_sstpb.DownloadResponse{Range: import_sstpb.Range{
+		Start: append(append([]byte{}, req.Sst.Range.Start...), make([]byte, 8)...),
+		End:   append(append([]byte{}, req.Sst.Range.End...), make([]byte, 8)...),
+	}}, nil
+}
+
+func (f *fakeImporterClient) IngestSST(
+	_ context.Context, _ uint64, req *import_sstpb.IngestRequest,
+) (*import_sstpb.IngestResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ingestErrors > 0 {
+		f.ingestErrors--
+		return &import_sstpb.IngestResponse{Error: &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}}, nil
+	}
+	f.ingested = append(f.ingested, req.Sst)
+	return &import_sstpb.IngestResponse{}, nil
+}
+
+func (f *fakeImporterClient) MultiIngest(
+	_ context.Context, _ uint64, req *import_sstpb.MultiIngestRequest,
+) (*import_sstpb.IngestResponse, error) {
+	if !f.multiIngest {
+		return nil, errors.New("multi ingest is unsupported")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.multiIngested = append(f.multiIngested, req.Ssts)
+	return &import_sstpb.IngestResponse{}, nil
+}
+
+func (f *fakeImporterClient) SetDownloadSpeedLimit(
+	context.Context, uint64, *import_sstpb.SetDownloadSpeedLimitRequest,
+) (*import_sstpb.SetDownloadSpeedLimitResponse, error) {
+	return &import_sstpb.SetDownloadSpeedLimitResponse{}, nil
+}
+
+func (f *fakeImporterClient) GetImportClient(context.Context, uint64) (import_sstpb.ImportSSTClient, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (f *fakeImporterClient) SupportMultiIngest(context.Context, []uint64) (bool, error) {
+	return f.multiIngest, nil
+}
+
+// newSingleRegionTestClient makes a split client with only one region covers all keys.
+func newSingleRegionTestClient() *TestClient {
+	peers := []*metapb.Peer{{Id: 1, StoreId: 1}}
+	regions := map[uint64]*restore.RegionInfo{
+		1: {
+			Region: &metapb.Region{Id: 1, Peers: peers, RegionEpoch: &metapb.RegionEpoch{Version: 1, ConfVer: 1}},
+			Leader: peers[0],
+		},
+	}
+	stores := map[uint64]*metapb.Store{1: {Id: 1}}
+	return NewTestClient(stores, regions, 2)
+}
+
+func newImportTestFile(name string, tableID int64) *backuppb.File {
+	return &backuppb.File{
+		Name:       name,
+		StartKey:   tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(0)),
+		EndKey:     tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(100)),
+		TotalKvs:   100,
+		TotalBytes: 1000,
+		Cf:         "write",
+	}
+}
+
+func newImportTestRewriteRules(oldTableID, newTableID int64) *restore.RewriteRules {
+	return &restore.RewriteRules{
+		Data: []*import_sstpb.RewriteRule{{
+			OldKeyPrefix: tablecodec.GenTableRecordPrefix(oldTableID),
+			NewKeyPrefix: tablecodec.GenTableRecordPrefix(newTableID),
+		}},
+	}
+}
+
+func TestImportCollectFileRetries(t *testing.T) {
+	importCli := &fakeImporterClient{ingestErrors: 2}
+	importer := restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0)
+
+	collector := &recordUnitCollector{LogCollector: summary.NewLogCollector(log.Info)}
+	summary.SetLogCollector(collector)
+	defer summary.SetLogCollector(summary.NewLogCollector(log.Info))
+
+	files := []*backuppb.File{newImportTestFile("1_2_3_4_5_write.sst", 1)}
+	err := importer.Import(context.Background(), files, newImportTestRewriteRules(1, 2), nil)
+	require.NoError(t, err)
+	require.Len(t, importCli.ingested, 1)
+
+	retries := 0
+	for _, unit := range collector.units {
+		if unit == summary.FileIngestRetries {
+			retries++
+		}
+	}
+	require.Equal(t, 2, retries)
+}
+
+func TestImportRewriteDownloadName(t *testing.T) {
+	files := []*backuppb.File{
+		newImportTestFile("1_write.sst", 1),
+		newImportTestFile("2_write.sst", 1),
+	}
+	importFiles := func(rewriter func(string) string) []string {
+		importCli := &fakeImporterClient{}
+		importer := restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0)
+		importer.SetDownloadNameRewriter(rewriter)
+		for _, file := range files {
+			err := importer.Import(context.Background(), []*backuppb.File{file}, newImportTestRewriteRules(1, 2), nil)
+			require.NoError(t, err)
+		}
+		return importCli.downloaded
+	}
+
+	downloaded := importFiles(func(name string) string {
+		return "mirror/" + name
+	})
+	require.Equal(t, []string{"mirror/1_write.sst", "mirror/2_write.sst"}, downloaded)
+	// the names are kept by default.
+	require.Equal(t, []string{"1_write.sst", "2_write.sst"}, importFiles(nil))
+}
+
+func TestImportFileRangeCut(t *testing.T) {
+	// the file is cut to the handles [20, 50).
+	file := newImportTestFile("1_write.sst", 1)
+	file.StartKey = tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(20))
+	file.EndKey = tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(50))
+	importFile := func(cut bool) *import_sstpb.SSTMeta {
+		importCli := &fakeImporterClient{}
+		importer := restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0)
+		if cut {
+			importer.EnableFileRangeCut()
+		}
+		err := importer.Import(context.Background(), []*backuppb.File{file}, newImportTestRewriteRules(1, 2), nil)
+		require.NoError(t, err)
+		require.Len(t, importCli.ingested, 1)
+		return importCli.ingested[0]
+	}
+
+	// all the keys of the file in the region are downloaded by default.
+	whole := importFile(false)
+	require.False(t, whole.EndKeyExclusive)
+	// only the keys of the file are downloaded if cut, rewritten by the rules.
+	sst := importFile(true)
+	require.Equal(t, codec.EncodeBytes(nil, tablecodec.EncodeRowKeyWithHandle(2, kv.IntHandle(20))), sst.Range.Start)
+	require.Equal(t, codec.EncodeBytes(nil, tablecodec.EncodeRowKeyWithHandle(2, kv.IntHandle(50))), sst.Range.End)
+	require.True(t, sst.EndKeyExclusive)
+	require.Less(t, string(whole.Range.Start), string(sst.Range.Start))
+	require.Greater(t, string(whole.Range.End), string(sst.Range.End))
+}
+
+func TestImportRetryDownloadAndIngestSeparately(t *testing.T) {
+	files := []*backuppb.File{newImportTestFile("1_write.sst", 1)}
+	importFile := func(importCli *fakeImporterClient, download, ingest restore.ImportRetryConfig) error {
+		importer := restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0)
+		importer.SetRetry(download, ingest)
+		return importer.Import(context.Background(), files, newImportTestRewriteRules(1, 2), nil)
+	}
+	transientDownloadErrors := func(n int) map[string][]error {
+		errs := make([]error, 0, n)
+		for i := 0; i < n; i++ {
+			errs = append(errs, status.Error(codes.Unavailable, "object storage is flaky"))
+		}
+		return map[string][]error{"1_write.sst": errs}
+	}
+	noRetry := restore.ImportRetryConfig{Attempts: 1, Interval: time.Millisecond}
+
+	// the download failures are retried by the download budget, without the ingest budget.
+	importCli := &fakeImporterClient{downloadErrors: transientDownloadErrors(2)}
+	err := importFile(importCli, restore.ImportRetryConfig{Attempts: 3, Interval: time.Millisecond}, noRetry)
+	require.NoError(t, err)
+	require.Len(t, importCli.ingested, 1)
+	importCli = &fakeImporterClient{downloadErrors: transientDownloadErrors(2)}
+	err = importFile(importCli, restore.ImportRetryConfig{Attempts: 2, Interval: time.Millisecond}, noRetry)
+	require.Error(t, err)
+	require.Len(t, importCli.ingested, 0)
+
+	// the ingest failures are retried by the ingest budget, without the download budget.
+	importCli = &fakeImporterClient{ingestErrors: 2}
+	err = importFile(importCli, noRetry, restore.ImportRetryConfig{Attempts: 3, Interval: time.Millisecond})
+	require.NoError(t, err)
+	require.Len(t, importCli.ingested, 1)
+	importCli = &fakeImporterClient{ingestErrors: 2}
+	err = importFile(importCli, noRetry, restore.ImportRetryConfig{Attempts: 2, Interval: time.Millisecond})
+	require.Error(t, err)
+	require.Len(t, importCli.ingested, 0)
+}
+
+func TestImportCFIngestOrder(t *testing.T) {
+	writeFile := newImportTestFile("1_write.sst", 1)
+	defaultFile := newImportTestFile("1_default.sst", 1)
+	defaultFile.Cf = "default"
+	files := []*backuppb.File{writeFile, defaultFile}
+	pdClient := fakePDClient{stores: []*metapb.Store{{Id: 1, State: metapb.StoreState_Up}}}
+	ingestCFs := func(order []string) [][]string {
+		importCli := &fakeImporterClient{multiIngest: true}
+		importer := restore.NewFileImporter(newSingleRegionTestClient(), importCli, nil, false, 0)
+		require.NoError(t, importer.CheckMultiIngestSupport(context.Background(), pdClient))
+		importer.SetCFIngestOrder(order)
+		require.NoError(t, importer.Import(context.Background(), files, newImportTestRewriteRules(1, 2), nil))
+		cfs := make([][]string, 0, len(importCli.multiIngested))
+		for _, ssts := range importCli.multiIngested {
+			req := make([]string, 0, len(ssts))
+			for _, sst := range ssts {
+				req = append(req, sst.CfName)
+			}
+			cfs = append(cfs, req)
+		}
+		return cfs
+	}
+
+	// the files of all CFs are ingested at once by default.
+	require.Equal(t, [][]string{{"write", "default"}}, ingestCFs(nil))
+	require.Equal(t, [][]string{{"default"}, {"write"}}, ingestCFs([]string{"default", "write"}))
+	require.Equal(t, [][]string{{"write"}, {"default"}}, ingestCFs([]string{"write", "default"}))
+	// the files of the unlisted CFs are ingested last.
+	require.Equal(t, [][]string{{"default"}, {"write"}}, ingestCFs([]string{"default"}))
+}
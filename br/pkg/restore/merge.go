@@ -3,15 +3,21 @@
 package restore
 
 import (
+	"bytes"
+	"sort"
 	"strings"
 
 	"github.com/docker/go-units"
 	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/log"
 	berrors "github.com/pingcap/tidb/br/pkg/errors"
+	"github.com/pingcap/tidb/br/pkg/logutil"
+	"github.com/pingcap/tidb/br/pkg/redact"
 	"github.com/pingcap/tidb/br/pkg/rtree"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/tablecodec"
+	"go.uber.org/zap"
 )
 
 const (
@@ -28,15 +34,749 @@ const (
 
 // MergeRangesStat holds statistics for the MergeRanges.
 type MergeRangesStat struct {
-	TotalFiles           int
-	TotalWriteCFFile     int
-	TotalDefaultCFFile   int
-	TotalRegions         int
-	RegionKeysAvg        int
-	RegionBytesAvg       int
+	// TotalFiles, TotalWriteCFFile and TotalDefaultCFFile are the count of the files.
+	TotalFiles         int
+	TotalWriteCFFile   int
+	TotalDefaultCFFile int
+	// TotalRegions is the count of the ranges of the files before merging,
+	// RegionKeysAvg and RegionBytesAvg are the average of them.
+	TotalRegions   int
+	RegionKeysAvg  int
+	RegionBytesAvg int
+	// MergedRegions is the count of the merged ranges,
+	// MergedRegionKeysAvg and MergedRegionBytesAvg are the average of them.
 	MergedRegions        int
 	MergedRegionKeysAvg  int
 	MergedRegionBytesAvg int
+	// TombstoneFiles is the count of files dropped by MergeConfig.DropTombstoneFiles.
+	TombstoneFiles int
+	// EmptyFiles is the count of files skipped by MergeConfig.SkipEmptyFiles.
+	EmptyFiles int
+	// FilteredFiles is the count of files out of MergeConfig.KeyRangeAllowlist.
+	FilteredFiles int
+}
+
+// SumMergeRangesStats sums up the statistics, e.g. of the tables, the averages
+// are weighted by the count of the ranges. The nil statistics are skipped.
+func SumMergeRangesStats(stats []*MergeRangesStat) MergeRangesStat {
+	var sum MergeRangesStat
+	var keys, bytes, mergedKeys, mergedBytes int
+	for _, stat := range stats {
+		if stat == nil {
+			continue
+		}
+		sum.TotalFiles += stat.TotalFiles
+		sum.TotalWriteCFFile += stat.TotalWriteCFFile
+		sum.TotalDefaultCFFile += stat.TotalDefaultCFFile
+		sum.TotalRegions += stat.TotalRegions
+		sum.MergedRegions += stat.MergedRegions
+		sum.TombstoneFiles += stat.TombstoneFiles
+		sum.EmptyFiles += stat.EmptyFiles
+		sum.FilteredFiles += stat.FilteredFiles
+		keys += stat.RegionKeysAvg * stat.TotalRegions
+		bytes += stat.RegionBytesAvg * stat.TotalRegions
+		mergedKeys += stat.MergedRegionKeysAvg * stat.MergedRegions
+		mergedBytes += stat.MergedRegionBytesAvg * stat.MergedRegions
+	}
+	if sum.TotalRegions > 0 {
+		sum.RegionKeysAvg = keys / sum.TotalRegions
+		sum.RegionBytesAvg = bytes / sum.TotalRegions
+	}
+	if sum.MergedRegions > 0 {
+		sum.MergedRegionKeysAvg = mergedKeys / sum.MergedRegions
+		sum.MergedRegionBytesAvg = mergedBytes / sum.MergedRegions
+	}
+	return sum
+}
+
+// MergeConfig is the configuration of merging the ranges of files.
+type MergeConfig struct {
+	// SplitSizeBytes and SplitKeyCount are the thresholds of a merged range.
+	SplitSizeBytes uint64
+	SplitKeyCount  uint64
+	// MinFileSizeBytes is the size below which the range of files is always
+	// merged into its neighbour, regardless of the thresholds above.
+	// 0 means disabled.
+	MinFileSizeBytes uint64
+	// MaxFilesPerGroup is the count of the files of a merged range at most, which caps
+	// the ranges merged by MinFileSizeBytes too. 0 means unlimited.
+	MaxFilesPerGroup int
+	// TableThresholds overrides the thresholds above by the new ID of the table.
+	TableThresholds map[int64]TableMergeThresholds
+	// ThresholdsClassifier overrides the thresholds above by the class of the table,
+	// e.g. merging the small partitions more aggressively than the other tables.
+	// The overrides in TableThresholds take precedence. Nil means disabled.
+	ThresholdsClassifier TableThresholdsClassifier
+	// HugeTableThresholds overrides the thresholds above for the tables whose
+	// files take at least HugeTableSizeBytes, so a huge table is split into more,
+	// smaller regions. Note a range never gets smaller than the range of a file.
+	// The overrides in TableThresholds and ThresholdsClassifier take precedence. 0 means disabled.
+	HugeTableSizeBytes  uint64
+	HugeTableThresholds TableMergeThresholds
+	// MemoryBudgetBytes is the memory budget of the merged ranges accumulated
+	// by BuildFileGroups, or yielded by GoValidateFileRanges but not consumed yet,
+	// on which GoValidateFileRanges waits for the consumer. 0 means unlimited.
+	MemoryBudgetBytes uint64
+	// DropTombstoneFiles drops the ranges whose files contain nothing but tombstones,
+	// which is only safe when restoring into empty tables, as there is nothing to delete,
+	// see Client.PreCheckTablesEmpty.
+	DropTombstoneFiles bool
+	// SkipEmptyFiles skips the ranges of full backups whose files contain no kvs at all,
+	// e.g. the placeholders of empty ranges, which would waste an ingest request.
+	SkipEmptyFiles bool
+	// NoMerge keeps the range of every backed up file as a range of its own, i.e. one region
+	// per file, for diagnosing ingest issues and small restores only. The files of the CFs
+	// sharing the same range, e.g. the pair of write and default CF files, stay together.
+	NoMerge bool
+	// LogMinTableSizeBytes is the size of files below which a table doesn't get
+	// its own merge log, but is summed up into a log of all such small tables,
+	// 0 means logging every table.
+	LogMinTableSizeBytes uint64
+	// CFGroupOrder splits the files of a table into a group per CF by BuildFileGroups,
+	// in the order of the CF names, e.g. write CF first and then default CF.
+	// The files of the unlisted CFs are grouped last. Empty means not splitting.
+	// GoValidateFileRanges always yields a group per table, so the order is applied
+	// on restoring the files of every batch instead, see Client.SetCFGroupOrder.
+	CFGroupOrder []string
+	// MaxRangeGapHandles is the difference of the int handles between the end of
+	// a range and the start of the next range of a table, above which files are
+	// suspected to be missing from the backup. 0 means disabled.
+	MaxRangeGapHandles uint64
+	// StrictRangeGap fails merging on a gap above MaxRangeGapHandles, instead of warning.
+	StrictRangeGap bool
+	// ValidateRewriteTableID checks the start key of every file is rewritten into the
+	// new physical table matching its old one, against mis-built rewrite rules.
+	ValidateRewriteTableID bool
+	// RegionTemplate is the sorted boundaries of the regions managed externally,
+	// a merged range never crosses a boundary, unless the range of a single file does.
+	// MergeFileRangesWithConfig compares the keys of the files with the boundaries as they are,
+	// GoValidateFileRanges and BuildFileGroups rewrite the boundaries of the restored tables
+	// back into the keyspace of the backup by the rewrite rules of every table first.
+	RegionTemplate [][]byte
+	// SplitAtIndexBoundaries makes GoValidateFileRanges and BuildFileGroups split the ranges of a table
+	// exactly at the prefixes of its indexes and records, by the table info, so the regions of every
+	// index and the records are cleanly separated, even where the ranges leave gaps or are empty.
+	// MergeFileRangesWithConfig ignores it.
+	SplitAtIndexBoundaries bool
+	// ReservedKeyRanges are the raw key ranges [StartKey, EndKey) of the restored cluster reserved
+	// for others, e.g. the system tables or another tenant, an empty EndKey means unbounded.
+	// GoValidateFileRanges and BuildFileGroups refuse the files rewritten into them, and the
+	// split keys inside them. MergeFileRangesWithConfig ignores them.
+	ReservedKeyRanges []rtree.Range
+	// KeyRangeAllowlist are the raw key ranges [StartKey, EndKey) of the backup to restore selectively,
+	// an empty EndKey means unbounded. Only the files intersecting them are restored, and the ranges of
+	// the files are cut to the parts inside them, with the keys of the files copied and cut too, so the
+	// split keys are inside them, and the importer downloads only the parts of the files, see
+	// FileImporter.EnableFileRangeCut. Empty means restoring all the files.
+	KeyRangeAllowlist []rtree.Range
+	// GroupSkewRatio is the ratio of the largest file group to the median one, above which
+	// BuildFileGroups and GoValidateFileRanges warn about the skewed sizes of the groups,
+	// i.e. tables for the latter. 0 means disabled.
+	GroupSkewRatio float64
+	// PhysicalTablesTransformer inspects or adjusts the physical tables of every table before
+	// merging its files, e.g. drops a partition or overrides a rewrite rule. Nil means identity.
+	PhysicalTablesTransformer PhysicalTablesTransformer
+	// KeyComparator orders the prefixes of the physical tables for PhysicalTablesTransformer,
+	// for the experimental key encodings. Nil means bytewise.
+	KeyComparator KeyComparator
+	// OrphanFilesPolicy is how to handle the files of the tables not to restore, which usually
+	// means the backup files and the metadata mismatch. Empty means OrphanFilesStrict.
+	// BuildFileGroups checks it, GoValidateFileRanges leaves it to CheckOrphanFiles ahead.
+	OrphanFilesPolicy OrphanFilesPolicy
+	// RegionMaxSizeBytes is the max size of a region of the restored cluster, a range of files
+	// above it, i.e. a single file, or the files of the CFs sharing its range, is oversized
+	// and handled by OversizedFilesPolicy. 0 means disabled.
+	RegionMaxSizeBytes uint64
+	// OversizedFilesPolicy is how to handle the oversized ranges of files. Empty means OversizedFilesIgnore.
+	OversizedFilesPolicy OversizedFilesPolicy
+	// CollectAllErrors makes GoValidateFileRanges and BuildFileGroups continue past the errors of
+	// validating and merging the files of a table, and fail with all the errors combined at the end,
+	// e.g. for checking the restorability of a whole backup. No table is yielded on any error then,
+	// GoValidateFileRanges yields the tables at the end only. False means failing on the first error.
+	CollectAllErrors bool
+	// Trace is called with every decision of merging a range into the range before it,
+	// for debugging the split keys. It's expensive for large restores and never changes
+	// the decisions. Nil (the default) means no tracing.
+	Trace MergeTraceFunc
+}
+
+// MergeTraceFunc traces the decisions of merging ranges.
+type MergeTraceFunc func(MergeDecision)
+
+// MergeDecision is a decision of merging a range into the group of the ranges before it.
+type MergeDecision struct {
+	// GroupStartKey and GroupEndKey are the range of the group merged so far.
+	GroupStartKey []byte
+	GroupEndKey   []byte
+	// GroupBytes and GroupKeys are the size of the group merged so far.
+	GroupBytes uint64
+	GroupKeys  uint64
+	// RangeStartKey, RangeBytes and RangeKeys are the range to merge.
+	RangeStartKey []byte
+	RangeBytes    uint64
+	RangeKeys     uint64
+	// Merged is whether the range is merged into the group. If not, GroupEndKey is a split key.
+	Merged bool
+	Reason MergeReason
+}
+
+// MergeReason is why a range is merged into the group before it or not.
+type MergeReason string
+
+const (
+	// MergeReasonNoMerge is not merging by MergeConfig.NoMerge.
+	MergeReasonNoMerge MergeReason = "no-merge"
+	// MergeReasonRegionTemplate is not merging across a boundary of MergeConfig.RegionTemplate.
+	MergeReasonRegionTemplate MergeReason = "region-template"
+	// MergeReasonMaxFiles is not merging as the files exceed MergeConfig.MaxFilesPerGroup.
+	MergeReasonMaxFiles MergeReason = "max-files"
+	// MergeReasonEmptyRange is merging the range without data.
+	MergeReasonEmptyRange MergeReason = "empty-range"
+	// MergeReasonSplitSize is not merging as the size exceeds MergeConfig.SplitSizeBytes.
+	MergeReasonSplitSize MergeReason = "split-size"
+	// MergeReasonSplitKeyCount is not merging as the keys exceed MergeConfig.SplitKeyCount.
+	MergeReasonSplitKeyCount MergeReason = "split-key-count"
+	// MergeReasonCrossTable is not merging the ranges of different tables.
+	MergeReasonCrossTable MergeReason = "cross-table"
+	// MergeReasonCrossIndex is not merging the ranges of different indexes, or an index and the records.
+	MergeReasonCrossIndex MergeReason = "cross-index"
+	// MergeReasonSameIndex is merging the ranges of the same index, or the records of the same table.
+	MergeReasonSameIndex MergeReason = "same-index"
+)
+
+// OrphanFilesPolicy is the policy on the files whose tables aren't restored.
+type OrphanFilesPolicy string
+
+const (
+	// OrphanFilesStrict fails with the IDs of the tables of the orphan files.
+	OrphanFilesStrict OrphanFilesPolicy = "strict"
+	// OrphanFilesWarn logs the orphan files and skips them.
+	OrphanFilesWarn OrphanFilesPolicy = "warn"
+	// OrphanFilesIgnore skips the orphan files silently.
+	OrphanFilesIgnore OrphanFilesPolicy = "ignore"
+)
+
+// ParseOrphanFilesPolicy parses the policy from its name.
+func ParseOrphanFilesPolicy(name string) (OrphanFilesPolicy, error) {
+	switch policy := OrphanFilesPolicy(name); policy {
+	case OrphanFilesStrict, OrphanFilesWarn, OrphanFilesIgnore:
+		return policy, nil
+	}
+	return "", errors.Annotatef(berrors.ErrInvalidArgument,
+		"unknown orphan files policy %s, should be one of %s, %s and %s",
+		name, OrphanFilesStrict, OrphanFilesWarn, OrphanFilesIgnore)
+}
+
+// OversizedFilesPolicy is the policy on the ranges of files larger than the max size of a region.
+type OversizedFilesPolicy string
+
+const (
+	// OversizedFilesIgnore restores the oversized files as they are, TiKV splits the regions after ingesting.
+	OversizedFilesIgnore OversizedFilesPolicy = "ignore"
+	// OversizedFilesSplit logs the oversized files, the regions of them are split before ingesting
+	// by RegionSplitter.SetRegionMaxSize.
+	OversizedFilesSplit OversizedFilesPolicy = "split"
+	// OversizedFilesFail fails with the first oversized range of files.
+	OversizedFilesFail OversizedFilesPolicy = "fail"
+)
+
+// ParseOversizedFilesPolicy parses the policy from its name.
+func ParseOversizedFilesPolicy(name string) (OversizedFilesPolicy, error) {
+	switch policy := OversizedFilesPolicy(name); policy {
+	case OversizedFilesIgnore, OversizedFilesSplit, OversizedFilesFail:
+		return policy, nil
+	}
+	return "", errors.Annotatef(berrors.ErrInvalidArgument,
+		"unknown oversized files policy %s, should be one of %s, %s and %s",
+		name, OversizedFilesIgnore, OversizedFilesSplit, OversizedFilesFail)
+}
+
+// keyComparator returns the comparator of keys, bytewise by default.
+func (cfg MergeConfig) keyComparator() KeyComparator {
+	if cfg.KeyComparator == nil {
+		return bytes.Compare
+	}
+	return cfg.KeyComparator
+}
+
+// TableMergeThresholds is the thresholds of merging the ranges of a table.
+// The zero thresholds fall back to the thresholds of the MergeConfig.
+type TableMergeThresholds struct {
+	SplitSizeBytes uint64
+	SplitKeyCount  uint64
+}
+
+// TableThresholdsClassifier classifies the table by e.g. whether it's partitioned or the
+// size of its files, and returns the thresholds of merging the ranges of the class.
+// false means the table isn't classified and gets the other thresholds of the MergeConfig.
+// It must return the same thresholds for the same table and files, to keep the merge deterministic.
+type TableThresholdsClassifier func(table CreatedTable, files []*backuppb.File) (TableMergeThresholds, bool)
+
+// FileGroupsSizeStat is the distribution of the total bytes of the files among the file groups.
+type FileGroupsSizeStat struct {
+	Groups      int
+	MinBytes    uint64
+	MaxBytes    uint64
+	MedianBytes uint64
+}
+
+// GetFileGroupsSizeStat returns the distribution of the sizes of the file groups,
+// e.g. built by BuildFileGroups.
+func GetFileGroupsSizeStat(groups []TableWithRange) FileGroupsSizeStat {
+	sizes := make([]uint64, 0, len(groups))
+	for _, group := range groups {
+		sizes = append(sizes, filesTotalBytes(group.Files()))
+	}
+	return fileGroupsSizeStatOf(sizes)
+}
+
+// fileGroupsSizeStatOf returns the distribution of the sizes, it sorts the sizes.
+func fileGroupsSizeStatOf(sizes []uint64) FileGroupsSizeStat {
+	if len(sizes) == 0 {
+		return FileGroupsSizeStat{}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return FileGroupsSizeStat{
+		Groups:      len(sizes),
+		MinBytes:    sizes[0],
+		MaxBytes:    sizes[len(sizes)-1],
+		MedianBytes: sizes[len(sizes)/2],
+	}
+}
+
+// Skewed checks whether the largest group is more than ratio times the median one,
+// which makes some stores much hotter than others on ingesting. A zero median is
+// skewed by any non-empty group.
+func (stat FileGroupsSizeStat) Skewed(ratio float64) bool {
+	if stat.MedianBytes == 0 {
+		return stat.MaxBytes > 0
+	}
+	return float64(stat.MaxBytes) > ratio*float64(stat.MedianBytes)
+}
+
+// logSkewedFileGroups warns if the sizes of the file groups are skewed.
+func logSkewedFileGroups(stat FileGroupsSizeStat, ratio float64) {
+	if !stat.Skewed(ratio) {
+		return
+	}
+	log.Warn("the sizes of file groups are skewed, some stores may be hot on restoring, "+
+		"consider adjusting the merge thresholds",
+		zap.Int("groups", stat.Groups),
+		zap.Uint64("min bytes", stat.MinBytes),
+		zap.Uint64("max bytes", stat.MaxBytes),
+		zap.Uint64("median bytes", stat.MedianBytes),
+		zap.Float64("skew ratio", ratio))
+}
+
+// forTable returns the config with the thresholds for the table applied.
+func (cfg MergeConfig) forTable(table CreatedTable, files []*backuppb.File) MergeConfig {
+	thresholds, ok := cfg.TableThresholds[table.Table.ID]
+	if !ok && cfg.ThresholdsClassifier != nil {
+		thresholds, ok = cfg.ThresholdsClassifier(table, files)
+	}
+	if !ok && cfg.HugeTableSizeBytes > 0 {
+		thresholds, ok = cfg.HugeTableThresholds, filesTotalBytes(files) >= cfg.HugeTableSizeBytes
+	}
+	if !ok {
+		return cfg
+	}
+	if thresholds.SplitSizeBytes != 0 {
+		cfg.SplitSizeBytes = thresholds.SplitSizeBytes
+	}
+	if thresholds.SplitKeyCount != 0 {
+		cfg.SplitKeyCount = thresholds.SplitKeyCount
+	}
+	return cfg
+}
+
+// filesTotalBytes returns the sum of the total bytes of the files.
+func filesTotalBytes(files []*backuppb.File) uint64 {
+	size := uint64(0)
+	for _, file := range files {
+		size += file.TotalBytes
+	}
+	return size
+}
+
+// smallTablesMergeStat sums up the merge statistics of the tables smaller than
+// MergeConfig.LogMinTableSizeBytes, so they are logged once instead of per table.
+type smallTablesMergeStat struct {
+	tables        int
+	files         int
+	bytes         uint64
+	regions       int
+	mergedRegions int
+}
+
+func (s *smallTablesMergeStat) add(stat *MergeRangesStat, bytes uint64) {
+	s.tables++
+	s.files += stat.TotalFiles
+	s.bytes += bytes
+	s.regions += stat.TotalRegions
+	s.mergedRegions += stat.MergedRegions
+}
+
+func (s *smallTablesMergeStat) log() {
+	if s.tables == 0 {
+		return
+	}
+	log.Info("merge and validate file of small tables",
+		zap.Int("tables", s.tables),
+		zap.Int("Files(total)", s.files),
+		zap.Uint64("Bytes(total)", s.bytes),
+		zap.Int("Region(total)", s.regions),
+		zap.Int("Merged(regions)", s.mergedRegions))
+}
+
+// adjust fills the zero thresholds with the default values.
+func (cfg *MergeConfig) adjust() {
+	if cfg.SplitSizeBytes == 0 {
+		cfg.SplitSizeBytes = DefaultMergeRegionSizeBytes
+	}
+	if cfg.SplitKeyCount == 0 {
+		cfg.SplitKeyCount = DefaultMergeRegionKeyCount
+	}
+	if cfg.OrphanFilesPolicy == "" {
+		cfg.OrphanFilesPolicy = OrphanFilesStrict
+	}
+}
+
+// adjustAndLog adjusts the config and logs the effective thresholds, along with
+// the requested ones if they differ, so the split behavior of restores is comparable.
+func (cfg *MergeConfig) adjustAndLog() {
+	requested := *cfg
+	cfg.adjust()
+	fields := []zap.Field{
+		zap.Uint64("split size bytes", cfg.SplitSizeBytes),
+		zap.Uint64("split key count", cfg.SplitKeyCount),
+		zap.Uint64("min file size bytes", cfg.MinFileSizeBytes),
+		zap.Int("max files per group", cfg.MaxFilesPerGroup),
+		zap.Int("table overrides", len(cfg.TableThresholds)),
+		zap.Bool("classified thresholds", cfg.ThresholdsClassifier != nil),
+	}
+	if requested.SplitSizeBytes != cfg.SplitSizeBytes || requested.SplitKeyCount != cfg.SplitKeyCount {
+		fields = append(fields,
+			zap.Uint64("requested split size bytes", requested.SplitSizeBytes),
+			zap.Uint64("requested split key count", requested.SplitKeyCount))
+	}
+	log.Info("effective thresholds of merging ranges", fields...)
+}
+
+// rangesMemSize estimates the memory the ranges take, i.e. the size of the keys
+// and the references to the files.
+func rangesMemSize(ranges []rtree.Range) uint64 {
+	size := uint64(0)
+	for _, rg := range ranges {
+		size += uint64(len(rg.StartKey) + len(rg.EndKey) + len(rg.Files)*8)
+	}
+	return size
+}
+
+// fileCF returns the CF of the file, by its name for the files missing the CF.
+func fileCF(file *backuppb.File) string {
+	if file.Cf != "" {
+		return file.Cf
+	}
+	if strings.Contains(file.GetName(), writeCFName) {
+		return writeCFName
+	}
+	if strings.Contains(file.GetName(), defaultCFName) {
+		return defaultCFName
+	}
+	return ""
+}
+
+// ValidateCFNames checks the names are the CFs of the backup files, i.e. default and write,
+// without duplicates, for ordering the files by CF.
+func ValidateCFNames(cfs []string) error {
+	seen := make(map[string]struct{}, len(cfs))
+	for _, cf := range cfs {
+		if cf != defaultCFName && cf != writeCFName {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"unknown CF %q, should be %s or %s", cf, defaultCFName, writeCFName)
+		}
+		if _, ok := seen[cf]; ok {
+			return errors.Annotatef(berrors.ErrInvalidArgument, "duplicate CF %q", cf)
+		}
+		seen[cf] = struct{}{}
+	}
+	return nil
+}
+
+// cfGroupOf returns the index of the CF of the file in cfs, len(cfs) for the unlisted CFs.
+func cfGroupOf(file *backuppb.File, cfs []string) int {
+	cf := fileCF(file)
+	for i, name := range cfs {
+		if cf == name {
+			return i
+		}
+	}
+	return len(cfs)
+}
+
+// groupFilesByCF splits the files into a group per CF in the order of cfs, the files
+// of the unlisted CFs are grouped last, and the empty groups are omitted.
+func groupFilesByCF(files []*backuppb.File, cfs []string) [][]*backuppb.File {
+	groups := make([][]*backuppb.File, len(cfs)+1)
+	for _, file := range files {
+		i := cfGroupOf(file, cfs)
+		groups[i] = append(groups[i], file)
+	}
+	result := make([][]*backuppb.File, 0, len(groups))
+	for _, files := range groups {
+		if len(files) > 0 {
+			result = append(result, files)
+		}
+	}
+	return result
+}
+
+// splitRangesByCF splits the ranges of the table into a group per CF in the
+// order of cfs, the ranges without files of a CF are omitted in its group.
+func splitRangesByCF(t TableWithRange, cfs []string) []TableWithRange {
+	groups := make([][]rtree.Range, len(cfs)+1)
+	for _, rg := range t.Range {
+		filesOfGroup := make([][]*backuppb.File, len(groups))
+		for _, file := range rg.Files {
+			i := cfGroupOf(file, cfs)
+			filesOfGroup[i] = append(filesOfGroup[i], file)
+		}
+		for i, files := range filesOfGroup {
+			if len(files) > 0 {
+				groups[i] = append(groups[i], rtree.Range{StartKey: rg.StartKey, EndKey: rg.EndKey, Files: files})
+			}
+		}
+	}
+	result := make([]TableWithRange, 0, len(groups))
+	for _, ranges := range groups {
+		if len(ranges) > 0 {
+			result = append(result, TableWithRange{CreatedTable: t.CreatedTable, Range: ranges})
+		}
+	}
+	return result
+}
+
+// backupRegionTemplate rewrites the boundaries in the keyspace of the restored table back into
+// the keyspace of the backup by the rewrite rules, the boundaries of other tables are dropped.
+func backupRegionTemplate(template [][]byte, rewriteRules *RewriteRules) [][]byte {
+	if rewriteRules == nil || len(template) == 0 {
+		return template
+	}
+	result := make([][]byte, 0)
+	for _, key := range template {
+		for _, rule := range rewriteRules.Data {
+			if bytes.HasPrefix(key, rule.GetNewKeyPrefix()) {
+				result = append(result, append(append([]byte{}, rule.GetOldKeyPrefix()...), key[len(rule.GetNewKeyPrefix()):]...))
+				break
+			}
+		}
+	}
+	// The partitions may be rewritten in a different order.
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i], result[j]) < 0
+	})
+	return result
+}
+
+// indexBoundariesOf returns the sorted prefixes of the indexes and the records of the physical tables
+// of the table in the keyspace of the backup, which the rewrite rules of the table can rewrite.
+func indexBoundariesOf(t CreatedTable) [][]byte {
+	boundaries := make([][]byte, 0)
+	for oldID := range newPhysicalIDsOf(t) {
+		prefixes := [][]byte{tablecodec.GenTableRecordPrefix(oldID)}
+		for _, index := range t.OldTable.Info.Indices {
+			prefixes = append(prefixes, tablecodec.EncodeTableIndexPrefix(oldID, index.ID))
+		}
+		for _, prefix := range prefixes {
+			if t.RewriteRule == nil || matchOldPrefix(prefix, t.RewriteRule) != nil {
+				boundaries = append(boundaries, prefix)
+			}
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		return bytes.Compare(boundaries[i], boundaries[j]) < 0
+	})
+	return boundaries
+}
+
+// alignRangesToBoundaries extends the end key of every sorted range to the first boundary of its table
+// after it, unless the next range starts before the boundary, so the split keys are at the boundaries.
+// The keys in between belong to no range, so no file is moved across a boundary.
+func alignRangesToBoundaries(ranges []rtree.Range, boundaries [][]byte) []rtree.Range {
+	for i := range ranges {
+		rg := &ranges[i]
+		j := sort.Search(len(boundaries), func(j int) bool {
+			return bytes.Compare(boundaries[j], rg.StartKey) > 0
+		})
+		if j == len(boundaries) || len(rg.EndKey) == 0 || bytes.Compare(rg.EndKey, boundaries[j]) >= 0 {
+			continue
+		}
+		if tablecodec.DecodeTableID(boundaries[j]) != tablecodec.DecodeTableID(rg.StartKey) {
+			continue
+		}
+		if i+1 < len(ranges) && bytes.Compare(ranges[i+1].StartKey, boundaries[j]) < 0 {
+			continue
+		}
+		rg.EndKey = boundaries[j]
+	}
+	return ranges
+}
+
+// crossRegionTemplate checks whether any sorted boundary is inside the range [startKey, endKey).
+func crossRegionTemplate(template [][]byte, startKey, endKey []byte) bool {
+	i := sort.Search(len(template), func(i int) bool {
+		return bytes.Compare(template[i], startKey) > 0
+	})
+	return i < len(template) && beforeEnd(template[i], endKey)
+}
+
+// cutToKeyRanges returns the parts of the range of the files sharing the start key inside the ranges,
+// an empty end key means unbounded. The files of a part cut from the range are copied with the keys of
+// the part, the files of a part covering the whole range are kept as they are.
+func cutToKeyRanges(ranges []rtree.Range, files []*backuppb.File) []rtree.Range {
+	startKey, endKey := files[0].GetStartKey(), files[0].GetEndKey()
+	parts := make([]rtree.Range, 0, 1)
+	for _, rg := range ranges {
+		if !beforeEnd(startKey, rg.EndKey) || !beforeEnd(rg.StartKey, endKey) {
+			continue
+		}
+		part := rtree.Range{StartKey: startKey, EndKey: endKey, Files: files}
+		if bytes.Compare(rg.StartKey, startKey) > 0 {
+			part.StartKey = rg.StartKey
+		}
+		if len(rg.EndKey) > 0 && (len(endKey) == 0 || bytes.Compare(rg.EndKey, endKey) < 0) {
+			part.EndKey = rg.EndKey
+		}
+		if !bytes.Equal(part.StartKey, startKey) || !bytes.Equal(part.EndKey, endKey) {
+			part.Files = make([]*backuppb.File, 0, len(files))
+			for _, file := range files {
+				cut := *file
+				cut.StartKey, cut.EndKey = part.StartKey, part.EndKey
+				part.Files = append(part.Files, &cut)
+			}
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// sortedKeyRanges returns the key ranges sorted with the overlapped and the adjacent ones merged,
+// an empty end key means unbounded.
+func sortedKeyRanges(ranges []rtree.Range) []rtree.Range {
+	sorted := append([]rtree.Range{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].StartKey, sorted[j].StartKey) < 0
+	})
+	merged := make([]rtree.Range, 0, len(sorted))
+	for _, rg := range sorted {
+		n := len(merged)
+		if n == 0 || (len(merged[n-1].EndKey) > 0 && bytes.Compare(merged[n-1].EndKey, rg.StartKey) < 0) {
+			merged = append(merged, rtree.Range{StartKey: rg.StartKey, EndKey: rg.EndKey})
+			continue
+		}
+		last := &merged[n-1]
+		if len(last.EndKey) > 0 && (len(rg.EndKey) == 0 || bytes.Compare(rg.EndKey, last.EndKey) > 0) {
+			last.EndKey = rg.EndKey
+		}
+	}
+	return merged
+}
+
+// isTombstoneFile checks whether the file is known to contain only tombstones.
+// It is conservative: only the write CF files of incremental backups may contain
+// tombstones, and the checksum and the stats of a file only cover the puts, so
+// an empty checksum means there are no rows in the file.
+func isTombstoneFile(file *backuppb.File) bool {
+	isWriteCF := file.Cf == writeCFName || (file.Cf == "" && strings.Contains(file.GetName(), writeCFName))
+	return isWriteCF && file.StartVersion > 0 &&
+		file.Crc64Xor == 0 && file.TotalKvs == 0 && file.TotalBytes == 0
+}
+
+// isTombstoneRange checks whether all files of the range contain only tombstones.
+// A range with a default CF file always contains puts.
+func isTombstoneRange(files []*backuppb.File) bool {
+	for _, file := range files {
+		if !isTombstoneFile(file) {
+			return false
+		}
+	}
+	return true
+}
+
+// isEmptyFile checks whether the file of a full backup contains no kvs at all.
+// The empty files of incremental backups may be tombstones, see isTombstoneFile.
+func isEmptyFile(file *backuppb.File) bool {
+	return file.StartVersion == 0 && file.Crc64Xor == 0 && file.TotalKvs == 0 && file.TotalBytes == 0
+}
+
+// isEmptyRange checks whether all files of the range are empty. The write CF file of a range
+// whose values are in the default CF file has no statistics, so a single file isn't enough.
+func isEmptyRange(files []*backuppb.File) bool {
+	for _, file := range files {
+		if !isEmptyFile(file) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRangeGaps checks the gaps between the consecutive sorted ranges of the
+// same table. It's a heuristic, only the record keys of int handles are checked.
+func checkRangeGaps(ranges []rtree.Range, maxGap uint64, strict bool) error {
+	for i := 1; i < len(ranges); i++ {
+		prevTableID, prevHandle, err1 := tablecodec.DecodeRecordKey(ranges[i-1].EndKey)
+		tableID, handle, err2 := tablecodec.DecodeRecordKey(ranges[i].StartKey)
+		if err1 != nil || err2 != nil || prevTableID != tableID || !prevHandle.IsInt() || !handle.IsInt() {
+			continue
+		}
+		if handle.IntValue() <= prevHandle.IntValue() {
+			continue
+		}
+		gap := uint64(handle.IntValue()) - uint64(prevHandle.IntValue())
+		if gap <= maxGap {
+			continue
+		}
+		if strict {
+			return errors.Annotatef(berrors.ErrRestoreInvalidRange,
+				"the gap between %s and %s of table %d is %d handles, exceeding %d, files may be missing",
+				redact.Key(ranges[i-1].EndKey), redact.Key(ranges[i].StartKey), tableID, gap, maxGap)
+		}
+		log.Warn("the gap between ranges is too large, files may be missing",
+			zap.Int64("table id", tableID),
+			logutil.Key("gap start", ranges[i-1].EndKey),
+			logutil.Key("gap end", ranges[i].StartKey),
+			zap.Uint64("gap", gap),
+			zap.Uint64("max gap", maxGap))
+	}
+	return nil
+}
+
+// checkOversizedRanges checks the sizes of the sorted ranges of files before merging against the max size
+// of a region, the oversized ranges fail by OversizedFilesFail, and are logged otherwise.
+func checkOversizedRanges(sortedRanges []rtree.Range, maxSize uint64, policy OversizedFilesPolicy) error {
+	oversized := 0
+	for i := range sortedRanges {
+		rg := &sortedRanges[i]
+		size, _ := rg.BytesAndKeys()
+		if size <= maxSize {
+			continue
+		}
+		if policy == OversizedFilesFail {
+			return errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+				"files of range [%X, %X) take %d bytes, larger than the region max size %d bytes, "+
+					"split the regions of them by the policy %s, or ingest them by the policy %s",
+				rg.StartKey, rg.EndKey, size, maxSize, OversizedFilesSplit, OversizedFilesIgnore)
+		}
+		oversized++
+		log.Debug("oversized files", logutil.Files(rg.Files), zap.Uint64("size", size))
+	}
+	if oversized > 0 {
+		log.Info("found oversized files",
+			zap.Int("ranges", oversized),
+			zap.Uint64("region max size", maxSize),
+			zap.String("policy", string(policy)))
+	}
+	return nil
 }
 
 // MergeFileRanges returns ranges of the files are merged based on
@@ -46,6 +786,32 @@ type MergeRangesStat struct {
 // small ranges (regions) as it reduces split region and scatter region.
 func MergeFileRanges(
 	files []*backuppb.File, splitSizeBytes, splitKeyCount uint64,
+) ([]rtree.Range, *MergeRangesStat, error) {
+	return MergeFileRangesWithConfig(files, MergeConfig{
+		SplitSizeBytes: splitSizeBytes,
+		SplitKeyCount:  splitKeyCount,
+	})
+}
+
+func traceMergeDecision(trace MergeTraceFunc, group, rg *rtree.Range, merged bool, reason MergeReason) {
+	groupBytes, groupKeys := group.BytesAndKeys()
+	rangeBytes, rangeKeys := rg.BytesAndKeys()
+	trace(MergeDecision{
+		GroupStartKey: group.StartKey,
+		GroupEndKey:   group.EndKey,
+		GroupBytes:    groupBytes,
+		GroupKeys:     groupKeys,
+		RangeStartKey: rg.StartKey,
+		RangeBytes:    rangeBytes,
+		RangeKeys:     rangeKeys,
+		Merged:        merged,
+		Reason:        reason,
+	})
+}
+
+// MergeFileRangesWithConfig is like MergeFileRanges, but merges the ranges by the config.
+func MergeFileRangesWithConfig(
+	files []*backuppb.File, cfg MergeConfig,
 ) ([]rtree.Range, *MergeRangesStat, error) {
 	if len(files) == 0 {
 		return []rtree.Range{}, &MergeRangesStat{}, nil
@@ -82,33 +848,66 @@ func MergeFileRanges(
 
 	// Check if files are overlapped
 	rangeTree := rtree.NewRangeTree()
+	tombstoneFiles := 0
+	emptyFiles := 0
+	filteredFiles := 0
+	allowlist := sortedKeyRanges(cfg.KeyRangeAllowlist)
 	for key := range filesMap {
 		files := filesMap[key]
-		if out := rangeTree.InsertRange(rtree.Range{
-			StartKey: files[0].GetStartKey(),
-			EndKey:   files[0].GetEndKey(),
-			Files:    files,
-		}); out != nil {
-			return nil, nil, errors.Annotatef(berrors.ErrRestoreInvalidRange,
-				"duplicate range %s files %+v", out, files)
+		if cfg.DropTombstoneFiles && isTombstoneRange(files) {
+			log.Debug("drop tombstone files", logutil.Files(files))
+			tombstoneFiles += len(files)
+			continue
+		}
+		parts := []rtree.Range{{StartKey: files[0].GetStartKey(), EndKey: files[0].GetEndKey(), Files: files}}
+		if len(allowlist) > 0 {
+			if parts = cutToKeyRanges(allowlist, files); len(parts) == 0 {
+				log.Debug("filter files out of the key range allowlist", logutil.Files(files))
+				filteredFiles += len(files)
+				continue
+			}
+		}
+		if cfg.SkipEmptyFiles && isEmptyRange(files) {
+			log.Debug("skip empty files", logutil.Files(files))
+			emptyFiles += len(files)
+			continue
+		}
+		for _, part := range parts {
+			if out := rangeTree.InsertRange(part); out != nil {
+				return nil, nil, errors.Annotatef(berrors.ErrRestoreInvalidRange,
+					"duplicate range %s files %+v", out, files)
+			}
 		}
 	}
 
-	needMerge := func(left, right *rtree.Range) bool {
+	needMerge := func(left, right *rtree.Range) (bool, MergeReason) {
+		if cfg.NoMerge {
+			return false, MergeReasonNoMerge
+		}
+		// Keep the merged ranges aligned to the region template.
+		if crossRegionTemplate(cfg.RegionTemplate, left.StartKey, right.EndKey) {
+			return false, MergeReasonRegionTemplate
+		}
+		if cfg.MaxFilesPerGroup > 0 && len(left.Files)+len(right.Files) > cfg.MaxFilesPerGroup {
+			return false, MergeReasonMaxFiles
+		}
 		leftBytes, leftKeys := left.BytesAndKeys()
 		rightBytes, rightKeys := right.BytesAndKeys()
 		if rightBytes == 0 {
-			return true
+			return true, MergeReasonEmptyRange
 		}
-		if leftBytes+rightBytes > splitSizeBytes {
-			return false
+		// Tiny ranges are always merged, as long as they are in the same table or index,
+		// up to MaxFilesPerGroup.
+		tiny := leftBytes < cfg.MinFileSizeBytes || rightBytes < cfg.MinFileSizeBytes
+		if !tiny && leftBytes+rightBytes > cfg.SplitSizeBytes {
+			return false, MergeReasonSplitSize
 		}
-		if leftKeys+rightKeys > splitKeyCount {
-			return false
+		if !tiny && leftKeys+rightKeys > cfg.SplitKeyCount {
+			return false, MergeReasonSplitKeyCount
 		}
 		// Do not merge ranges in different tables.
 		if tablecodec.DecodeTableID(kv.Key(left.StartKey)) != tablecodec.DecodeTableID(kv.Key(right.StartKey)) {
-			return false
+			return false, MergeReasonCrossTable
 		}
 		// Do not merge ranges in different indexes even if they are in the same
 		// table, as rewrite rule only supports rewriting one pattern.
@@ -118,14 +917,30 @@ func MergeFileRanges(
 		// If both of them are index keys, ...
 		if err1 == nil && err2 == nil {
 			// Merge left and right if they are in the same index.
-			return indexID1 == indexID2
+			if indexID1 == indexID2 {
+				return true, MergeReasonSameIndex
+			}
+			return false, MergeReasonCrossIndex
 		}
 		// Otherwise, merge if they are both record keys
-		return err1 != nil && err2 != nil
+		if err1 != nil && err2 != nil {
+			return true, MergeReasonSameIndex
+		}
+		return false, MergeReasonCrossIndex
 	}
 	sortedRanges := rangeTree.GetSortedRanges()
+	if cfg.RegionMaxSizeBytes > 0 {
+		if err := checkOversizedRanges(sortedRanges, cfg.RegionMaxSizeBytes, cfg.OversizedFilesPolicy); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	hint := hintMergedRangeCount(sortedRanges, totalBytes, totalKvs, cfg)
 	for i := 1; i < len(sortedRanges); {
-		if !needMerge(&sortedRanges[i-1], &sortedRanges[i]) {
+		merge, reason := needMerge(&sortedRanges[i-1], &sortedRanges[i])
+		if cfg.Trace != nil {
+			traceMergeDecision(cfg.Trace, &sortedRanges[i-1], &sortedRanges[i], merge, reason)
+		}
+		if !merge {
 			i++
 			continue
 		}
@@ -135,10 +950,23 @@ func MergeFileRanges(
 		sortedRanges = append(sortedRanges[:i], sortedRanges[i+1:]...)
 	}
 
+	if cfg.MaxRangeGapHandles > 0 {
+		if err := checkRangeGaps(sortedRanges, cfg.MaxRangeGapHandles, cfg.StrictRangeGap); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	if !cfg.NoMerge {
+		checkMergedRangeCount(hint, len(sortedRanges))
+	}
+
 	regionBytesAvg := totalBytes / uint64(totalRegions)
 	regionKeysAvg := totalKvs / uint64(totalRegions)
-	mergedRegionBytesAvg := totalBytes / uint64(len(sortedRanges))
-	mergedRegionKeysAvg := totalKvs / uint64(len(sortedRanges))
+	mergedRegionBytesAvg, mergedRegionKeysAvg := uint64(0), uint64(0)
+	if len(sortedRanges) > 0 {
+		mergedRegionBytesAvg = totalBytes / uint64(len(sortedRanges))
+		mergedRegionKeysAvg = totalKvs / uint64(len(sortedRanges))
+	}
 
 	return sortedRanges, &MergeRangesStat{
 		TotalFiles:           totalFiles,
@@ -150,5 +978,60 @@ func MergeFileRanges(
 		MergedRegions:        len(sortedRanges),
 		MergedRegionKeysAvg:  int(mergedRegionKeysAvg),
 		MergedRegionBytesAvg: int(mergedRegionBytesAvg),
+		TombstoneFiles:       tombstoneFiles,
+		EmptyFiles:           emptyFiles,
+		FilteredFiles:        filteredFiles,
 	}, nil
 }
+
+// mergedRangeCountTolerance is the difference between the count of the merged ranges
+// and its hint below which checkMergedRangeCount never warns, as the hint is
+// only an estimation and a few ranges more or less mean nothing.
+const mergedRangeCountTolerance = 8
+
+// hintMergedRangeCount estimates the count of the ranges merged from sortedRanges
+// by the thresholds alone: the ranges are never merged across the tables and indexes,
+// and each table or index takes as many ranges as its bytes and kvs exceed the thresholds.
+func hintMergedRangeCount(sortedRanges []rtree.Range, totalBytes, totalKvs uint64, cfg MergeConfig) int {
+	groups := 0
+	var lastTableID, lastIndexID int64
+	for i := range sortedRanges {
+		key := kv.Key(sortedRanges[i].StartKey)
+		tableID := tablecodec.DecodeTableID(key)
+		indexID := int64(0)
+		if _, id, _, err := tablecodec.DecodeIndexKey(key); err == nil {
+			indexID = id
+		}
+		if i == 0 || tableID != lastTableID || indexID != lastIndexID {
+			groups++
+		}
+		lastTableID, lastIndexID = tableID, indexID
+	}
+	hint := 0
+	if cfg.SplitSizeBytes > 0 {
+		hint = int((totalBytes + cfg.SplitSizeBytes - 1) / cfg.SplitSizeBytes)
+	}
+	if cfg.SplitKeyCount > 0 {
+		if n := int((totalKvs + cfg.SplitKeyCount - 1) / cfg.SplitKeyCount); n > hint {
+			hint = n
+		}
+	}
+	return hint + groups
+}
+
+// checkMergedRangeCount reports when the count of the merged ranges is far from
+// the hint, which usually means the merge thresholds don't fit the data,
+// e.g. the files are much larger than the thresholds, or most of them are kept
+// unmerged by the region template or the minimum file size.
+// It only logs and never changes the ranges.
+func checkMergedRangeCount(hint, merged int) {
+	log.Debug("merged range count", zap.Int("hint", hint), zap.Int("merged", merged))
+	diff := merged - hint
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > mergedRangeCountTolerance && (merged > 2*hint || 2*merged < hint) {
+		log.Warn("merged range count is far from the hint of the merge thresholds",
+			zap.Int("hint", hint), zap.Int("merged", merged))
+	}
+}
@@ -13,12 +13,16 @@ import (
 	. "github.com/pingcap/check"
 	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/log"
 	berrors "github.com/pingcap/tidb/br/pkg/errors"
 	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/pingcap/tidb/br/pkg/rtree"
 	"github.com/pingcap/tidb/sessionctx/stmtctx"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var _ = Suite(&testMergeRangesSuite{})
@@ -88,6 +92,294 @@ func (fb *fileBulder) build(tableID, indexID, num, bytes, kv int) (files []*back
 	return files
 }
 
+// SyntheticFilesConfig is the configuration of generating synthetic backup files.
+type SyntheticFilesConfig struct {
+	// Tables is the count of tables, whose IDs start from 1.
+	Tables        int
+	FilesPerTable int
+	// DefaultCFRatio is the ratio of the ranges having a default CF file besides the write CF file.
+	DefaultCFRatio float64
+	// MinFileBytes and MaxFileBytes are the bounds of the uniformly distributed file sizes.
+	MinFileBytes int
+	MaxFileBytes int
+	// BytesPerKV is the average size of a KV, so the KV count of a file is its size divided by it.
+	BytesPerKV int
+	// Seed makes the generated files reproducible.
+	Seed int64
+}
+
+// GenerateSyntheticFiles generates the files of a backup by the config, the files are sorted by keys
+// and the keys of them decode to the right table IDs.
+func GenerateSyntheticFiles(cfg SyntheticFilesConfig) []*backuppb.File {
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	files := make([]*backuppb.File, 0, cfg.Tables*cfg.FilesPerTable)
+	fb := fileBulder{}
+	for tableID := 1; tableID <= cfg.Tables; tableID++ {
+		for i := 0; i < cfg.FilesPerTable; i++ {
+			num := 1
+			if rnd.Float64() < cfg.DefaultCFRatio {
+				num = 2
+			}
+			bytes := cfg.MinFileBytes
+			if cfg.MaxFileBytes > cfg.MinFileBytes {
+				bytes += rnd.Intn(cfg.MaxFileBytes - cfg.MinFileBytes)
+			}
+			kv := 1
+			if cfg.BytesPerKV > 0 && bytes/cfg.BytesPerKV > 1 {
+				kv = bytes / cfg.BytesPerKV
+			}
+			files = append(files, fb.build(tableID, 0, num, bytes, kv)...)
+		}
+	}
+	return files
+}
+
+func (s *testMergeRangesSuite) TestGenerateSyntheticFiles(c *C) {
+	cfg := SyntheticFilesConfig{
+		Tables:         3,
+		FilesPerTable:  10,
+		DefaultCFRatio: 0.5,
+		MinFileBytes:   1024,
+		MaxFileBytes:   4096,
+		BytesPerKV:     64,
+		Seed:           1,
+	}
+	files := GenerateSyntheticFiles(cfg)
+	c.Assert(len(files) >= 30 && len(files) <= 60, IsTrue, Commentf("%d files", len(files)))
+	for _, f := range files {
+		tableID := tablecodec.DecodeTableID(f.StartKey)
+		c.Assert(tableID >= 1 && tableID <= 3, IsTrue)
+		c.Assert(tablecodec.DecodeTableID(f.EndKey), Equals, tableID)
+	}
+	ranges, stat, err := restore.MergeFileRangesWithConfig(files, restore.MergeConfig{
+		SplitSizeBytes: restore.DefaultMergeRegionSizeBytes,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(stat.TotalRegions, Equals, 30)
+	// the merged ranges never cross tables.
+	c.Assert(ranges, HasLen, 3)
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesDropTombstoneFiles(c *C) {
+	fb := fileBulder{}
+	// A range of tombstones only.
+	tombstone := fb.build(1, 0, 1, 0, 0)
+	// A range with the puts in the default CF file.
+	mixed := fb.build(1, 0, 2, 100, 10)
+	// A range with the puts in the write CF file.
+	shortValue := fb.build(1, 0, 1, 100, 10)
+	files := append(append(append([]*backuppb.File{}, tombstone...), mixed...), shortValue...)
+	for _, f := range files {
+		f.StartVersion = 10
+		f.EndVersion = 20
+	}
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: 1,
+		SplitKeyCount:  1,
+	}
+
+	rngs, stat, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 3)
+	c.Assert(stat.TombstoneFiles, Equals, 0)
+
+	cfg.DropTombstoneFiles = true
+	rngs, stat, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 2)
+	c.Assert(stat.TombstoneFiles, Equals, 1)
+	c.Assert(rngs[0].Files, DeepEquals, mixed)
+	c.Assert(rngs[1].Files, DeepEquals, shortValue)
+
+	// All ranges are dropped.
+	rngs, stat, err = restore.MergeFileRangesWithConfig(tombstone, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 0)
+	c.Assert(stat.TombstoneFiles, Equals, 1)
+
+	// A full backup never contains tombstones.
+	for _, f := range tombstone {
+		f.StartVersion = 0
+	}
+	rngs, stat, err = restore.MergeFileRangesWithConfig(tombstone, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 1)
+	c.Assert(stat.TombstoneFiles, Equals, 0)
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesAlignedToRegionTemplate(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// 6 ranges of 10 handles each: [0, 10), [10, 20), ..., [50, 60).
+	for i := 0; i < 6; i++ {
+		files = append(files, fb.build(1, 0, 1, 1, 1)...)
+	}
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: restore.DefaultMergeRegionSizeBytes,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	}
+	rngs, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 1)
+
+	handleKey := func(handle int64) []byte {
+		return tablecodec.EncodeRowKey(1, codec.EncodeInt(nil, handle))
+	}
+	// handle 25 is inside the range [20, 30), handle 40 is between ranges.
+	cfg.RegionTemplate = [][]byte{handleKey(25), handleKey(40)}
+	rngs, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 4)
+	// the range of a single file crossing a boundary is kept alone.
+	for i, expected := range [][2]int64{{0, 20}, {20, 30}, {30, 40}, {40, 60}} {
+		c.Assert(rngs[i].StartKey, DeepEquals, handleKey(expected[0]), Commentf("range %d", i))
+		c.Assert(rngs[i].EndKey, DeepEquals, handleKey(expected[1]), Commentf("range %d", i))
+	}
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesSkipEmptyFiles(c *C) {
+	fb := fileBulder{}
+	data := fb.build(1, 0, 1, 100, 10)
+	empty := fb.build(1, 0, 1, 0, 0)
+	// the write CF file has no statistics, but the default CF file has.
+	paired := fb.build(1, 0, 2, 100, 10)
+	// the empty file of an incremental backup may be a tombstone.
+	incremental := fb.build(1, 0, 1, 0, 0)
+	incremental[0].StartVersion = 10
+	files := append(append(append(append([]*backuppb.File{}, data...), empty...), paired...), incremental...)
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: 1,
+		SplitKeyCount:  1,
+	}
+
+	rngs, stat, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	// the ranges without bytes are merged into their neighbours like before.
+	c.Assert(rngs, HasLen, 2)
+	c.Assert(rngs[0].Files, DeepEquals, append(append([]*backuppb.File{}, data...), empty...))
+	c.Assert(rngs[0].EndKey, DeepEquals, empty[0].EndKey)
+	c.Assert(rngs[1].Files, DeepEquals, append(append([]*backuppb.File{}, paired...), incremental...))
+	c.Assert(stat.EmptyFiles, Equals, 0)
+
+	cfg.SkipEmptyFiles = true
+	rngs, stat, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 2)
+	c.Assert(stat.EmptyFiles, Equals, 1)
+	c.Assert(rngs[0].Files, DeepEquals, data)
+	c.Assert(rngs[0].EndKey, DeepEquals, data[0].EndKey)
+	c.Assert(rngs[1].Files, DeepEquals, append(append([]*backuppb.File{}, paired...), incremental...))
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesNoMerge(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// tiny write and default CF pairs, which would be merged into one range.
+	for i := 0; i < 3; i++ {
+		files = append(files, fb.build(1, 0, 2, 1, 1)...)
+	}
+	// a range of an index.
+	files = append(files, fb.build(1, 1, 1, 1, 1)...)
+	cfg := restore.MergeConfig{
+		SplitSizeBytes:   restore.DefaultMergeRegionSizeBytes,
+		SplitKeyCount:    restore.DefaultMergeRegionKeyCount,
+		MinFileSizeBytes: 100,
+	}
+	rngs, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 2)
+
+	cfg.NoMerge = true
+	rngs, stat, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 4)
+	c.Assert(stat.MergedRegions, Equals, 4)
+	// the range of the index sorts first.
+	c.Assert(rngs[0].Files, HasLen, 1)
+	for i, rg := range rngs {
+		// every range is the range of a file, with the files of both CFs.
+		if i > 0 {
+			c.Assert(rg.Files, HasLen, 2)
+		}
+		c.Assert(rg.StartKey, DeepEquals, rg.Files[0].StartKey)
+		c.Assert(rg.EndKey, DeepEquals, rg.Files[0].EndKey)
+		for _, file := range rg.Files {
+			c.Assert(file.StartKey, DeepEquals, rg.StartKey)
+		}
+	}
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesCheckGaps(c *C) {
+	fb := fileBulder{}
+	files := fb.build(1, 0, 1, 100, 10)
+	files = append(files, fb.build(1, 0, 1, 100, 10)...)
+	// leave a gap of 1000 handles, like some files are missing.
+	fb.startKeyOffset += 1000
+	files = append(files, fb.build(1, 0, 1, 100, 10)...)
+	// the ranges of another table never make a gap.
+	files = append(files, fb.build(2, 0, 1, 100, 10)...)
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: 1,
+		SplitKeyCount:  1,
+	}
+
+	rngs, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 4)
+
+	// only warns by default.
+	cfg.MaxRangeGapHandles = 100
+	rngs, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 4)
+
+	cfg.StrictRangeGap = true
+	_, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, ErrorMatches, ".*of table 1 is 1000 handles, exceeding 100, files may be missing.*")
+
+	cfg.MaxRangeGapHandles = 1000
+	_, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+}
+
+func (s *testMergeRangesSuite) TestSumMergeRangesStats(c *C) {
+	fb := fileBulder{}
+	var stats []*restore.MergeRangesStat
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: restore.DefaultMergeRegionSizeBytes,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	}
+	// table 1 has 4 ranges of 10 bytes, table 2 has 2 ranges of 40 bytes.
+	var files []*backuppb.File
+	for i := 0; i < 4; i++ {
+		files = append(files, fb.build(1, 0, 1, 10, 1)...)
+	}
+	_, stat, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	stats = append(stats, stat)
+	files = files[:0]
+	for i := 0; i < 2; i++ {
+		files = append(files, fb.build(2, 0, 2, 40, 4)...)
+	}
+	_, stat, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	stats = append(stats, stat, nil)
+
+	c.Assert(restore.SumMergeRangesStats(stats), DeepEquals, restore.MergeRangesStat{
+		TotalFiles:           8,
+		TotalWriteCFFile:     6,
+		TotalDefaultCFFile:   2,
+		TotalRegions:         6,
+		RegionKeysAvg:        2,
+		RegionBytesAvg:       20,
+		MergedRegions:        2,
+		MergedRegionKeysAvg:  6,
+		MergedRegionBytesAvg: 60,
+	})
+	c.Assert(restore.SumMergeRangesStats(nil), DeepEquals, restore.MergeRangesStat{})
+}
+
 func (s *testMergeRangesSuite) TestMergeRanges(c *C) {
 	type Case struct {
 		files  [][5]int // tableID, indexID num, bytes, kv
@@ -227,6 +519,63 @@ func (s *testMergeRangesSuite) TestMergeRanges(c *C) {
 	}
 }
 
+func (s *testMergeRangesSuite) TestMergeTinyFiles(c *C) {
+	files := make([]*backuppb.File, 0)
+	fb := fileBulder{}
+	for i := 0; i < 100; i++ {
+		files = append(files, fb.build(1, 0, 2, 10, 1)...)
+	}
+	for i := 0; i < 50; i++ {
+		files = append(files, fb.build(2, 0, 1, 10, 1)...)
+	}
+	files = append(files, fb.build(2, 0, 1, 1000, 1)...)
+	for i := 0; i < 50; i++ {
+		files = append(files, fb.build(2, 0, 1, 10, 1)...)
+	}
+
+	// Without the minimum file size, ranges are merged up to the threshold.
+	rngs, _, err := restore.MergeFileRangesWithConfig(files, restore.MergeConfig{
+		SplitSizeBytes: 100,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(rngs), Greater, 2)
+
+	cfg := restore.MergeConfig{
+		SplitSizeBytes:   100,
+		SplitKeyCount:    restore.DefaultMergeRegionKeyCount,
+		MinFileSizeBytes: 20,
+	}
+	rngs, stat, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	// Tiny files coalesce regardless of the threshold, but never across tables,
+	// and the big file only absorbs the tiny files after it.
+	c.Assert(rngs, HasLen, 3)
+	c.Assert(stat.MergedRegions, Equals, 3)
+	c.Assert(rngs[0].Files, HasLen, 200)
+	c.Assert(rngs[1].Files, HasLen, 50)
+	c.Assert(rngs[2].Files, HasLen, 51)
+
+	// The merged ranges are deterministic.
+	again, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(again, HasLen, len(rngs))
+	for i := range rngs {
+		c.Assert(again[i].StartKey, DeepEquals, rngs[i].StartKey)
+		c.Assert(again[i].EndKey, DeepEquals, rngs[i].EndKey)
+	}
+
+	// Tiny files coalesce up to the cap of files, the write and default CF files of a range stay together.
+	cfg.MaxFilesPerGroup = 64
+	rngs, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	var fileCounts []int
+	for _, rg := range rngs {
+		fileCounts = append(fileCounts, len(rg.Files))
+	}
+	c.Assert(fileCounts, DeepEquals, []int{64, 64, 64, 8, 50, 51})
+}
+
 func (s *testMergeRangesSuite) TestMergeRawKVRanges(c *C) {
 	files := make([]*backuppb.File, 0)
 	fb := fileBulder{}
@@ -294,3 +643,183 @@ func BenchmarkMergeRanges50k(b *testing.B) {
 func BenchmarkMergeRanges100k(b *testing.B) {
 	benchmarkMergeRanges(b, 100000)
 }
+
+// BenchmarkMergeSyntheticFiles benchmarks merging a backup of 100 tables of 1000 ranges,
+// with the files of 1 ~ 8 MB and half of the ranges having default CF files.
+func BenchmarkMergeSyntheticFiles(b *testing.B) {
+	files := GenerateSyntheticFiles(SyntheticFilesConfig{
+		Tables:         100,
+		FilesPerTable:  1000,
+		DefaultCFRatio: 0.5,
+		MinFileBytes:   1 << 20,
+		MaxFileBytes:   8 << 20,
+		BytesPerKV:     128,
+		Seed:           1,
+	})
+	fileOfTable := restore.MapTableToFiles(files)
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: restore.DefaultMergeRegionSizeBytes,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tableFiles := range fileOfTable {
+			if _, _, err := restore.MergeFileRangesWithConfig(tableFiles, cfg); err != nil {
+				b.Error(err)
+			}
+		}
+	}
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesTrace(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	// 4 ranges of the records of table 1, split by size after every 2 ranges.
+	for i := 0; i < 4; i++ {
+		files = append(files, fb.build(1, 0, 1, 40, 1)...)
+	}
+	// a range of an index of table 1, and 2 ranges of table 2.
+	files = append(files, fb.build(1, 1, 1, 1, 1)...)
+	files = append(files, fb.build(2, 0, 1, 1, 1)...)
+	files = append(files, fb.build(2, 0, 1, 1, 1)...)
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: 100,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	}
+	untraced, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+
+	var decisions []restore.MergeDecision
+	cfg.Trace = func(d restore.MergeDecision) {
+		decisions = append(decisions, d)
+	}
+	rngs, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	// tracing never changes the decisions.
+	c.Assert(rngs, DeepEquals, untraced)
+	c.Assert(rngs, HasLen, 4)
+	// every range except the first is decided once.
+	c.Assert(decisions, HasLen, len(files)-1)
+
+	var splitKeys [][]byte
+	reasons := make(map[restore.MergeReason]int)
+	for _, d := range decisions {
+		reasons[d.Reason]++
+		if !d.Merged {
+			splitKeys = append(splitKeys, d.GroupEndKey)
+		}
+	}
+	c.Assert(splitKeys, HasLen, len(rngs)-1)
+	for i, key := range splitKeys {
+		c.Assert(key, DeepEquals, rngs[i].EndKey, Commentf("split key %d", i))
+	}
+	c.Assert(reasons, DeepEquals, map[restore.MergeReason]int{
+		restore.MergeReasonSameIndex:  3,
+		restore.MergeReasonSplitSize:  1,
+		restore.MergeReasonCrossIndex: 1,
+		restore.MergeReasonCrossTable: 1,
+	})
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesOversizedFiles(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	files = append(files, fb.build(1, 0, 1, 40, 1)...)
+	// an oversized file of 250 bytes.
+	files = append(files, fb.build(1, 0, 1, 250, 1)...)
+	files = append(files, fb.build(1, 0, 1, 40, 1)...)
+	cfg := restore.MergeConfig{
+		SplitSizeBytes:     100,
+		SplitKeyCount:      restore.DefaultMergeRegionKeyCount,
+		RegionMaxSizeBytes: 100,
+	}
+
+	_, err := restore.ParseOversizedFilesPolicy("truncate")
+	c.Assert(err, ErrorMatches, ".*unknown oversized files policy truncate.*")
+	for _, policy := range []restore.OversizedFilesPolicy{"", restore.OversizedFilesIgnore, restore.OversizedFilesSplit} {
+		cfg.OversizedFilesPolicy = policy
+		rngs, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+		c.Assert(err, IsNil, Commentf("policy %s", policy))
+		c.Assert(rngs, HasLen, 3, Commentf("policy %s", policy))
+	}
+
+	cfg.OversizedFilesPolicy = restore.OversizedFilesFail
+	_, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, ErrorMatches, ".*take 250 bytes, larger than the region max size 100 bytes.*")
+	// the files of the range fit in a region.
+	cfg.RegionMaxSizeBytes = 250
+	_, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesKeyRangeAllowlist(c *C) {
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for i := 0; i < 4; i++ {
+		files = append(files, fb.build(1, 0, 2, 40, 1)...)
+	}
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: 100,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+		// intersects the second range only, and the start of the fourth range.
+		KeyRangeAllowlist: []rtree.Range{
+			{StartKey: files[2].StartKey, EndKey: files[4].StartKey},
+			{StartKey: files[6].StartKey, EndKey: append(append([]byte{}, files[6].StartKey...), 0)},
+		},
+	}
+	rngs, stat, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(stat.FilteredFiles, Equals, 4)
+	c.Assert(rngs, HasLen, 1)
+	c.Assert(rngs[0].StartKey, DeepEquals, files[2].StartKey)
+	// the fourth range is cut to the allowed keys, so are its files.
+	cutEndKey := append(append([]byte{}, files[6].StartKey...), 0)
+	c.Assert(rngs[0].EndKey, DeepEquals, cutEndKey)
+	c.Assert(rngs[0].Files, HasLen, 4)
+	c.Assert(rngs[0].Files[:2], DeepEquals, files[2:4])
+	for _, f := range rngs[0].Files[2:] {
+		c.Assert(f.StartKey, DeepEquals, files[6].StartKey)
+		c.Assert(f.EndKey, DeepEquals, cutEndKey)
+	}
+	// the backup files are left untouched.
+	c.Assert(files[6].EndKey, Not(DeepEquals), cutEndKey)
+
+	// nothing is filtered without the allowlist.
+	cfg.KeyRangeAllowlist = nil
+	rngs, stat, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(stat.FilteredFiles, Equals, 0)
+	c.Assert(rngs, HasLen, 2)
+}
+
+func (s *testMergeRangesSuite) TestMergeRangesCountHint(c *C) {
+	core, logs := observer.New(zap.WarnLevel)
+	defer log.ReplaceGlobals(zap.New(core), nil)()
+	cfg := restore.MergeConfig{
+		SplitSizeBytes: 100,
+		SplitKeyCount:  restore.DefaultMergeRegionKeyCount,
+	}
+
+	fb := fileBulder{}
+	var files []*backuppb.File
+	for i := 0; i < 20; i++ {
+		files = append(files, fb.build(1, 0, 1, 40, 1)...)
+	}
+	rngs, _, err := restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 10)
+	c.Assert(logs.FilterMessage("merged range count is far from the hint of the merge thresholds").Len(), Equals, 0)
+
+	// the files are much larger than the thresholds.
+	files = files[:0]
+	for i := 0; i < 20; i++ {
+		files = append(files, fb.build(2, 0, 1, 250, 1)...)
+	}
+	rngs, _, err = restore.MergeFileRangesWithConfig(files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(rngs, HasLen, 20)
+	entries := logs.FilterMessage("merged range count is far from the hint of the merge thresholds").All()
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].ContextMap()["hint"], Equals, int64(51))
+	c.Assert(entries[0].ContextMap()["merged"], Equals, int64(20))
+}
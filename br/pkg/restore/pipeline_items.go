@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/br/pkg/glue"
 	"github.com/pingcap/tidb/br/pkg/metautil"
@@ -85,7 +86,10 @@ func (manager *brContextManager) Close(ctx context.Context) {
 	for _, tbl := range manager.hasTable {
 		tbls = append(tbls, tbl.Table)
 	}
-	splitPostWork(ctx, manager.client, tbls)
+	// The tables never left are failed to restore, so their placement rules are never kept.
+	if err := manager.client.DiscardPlacementRules(ctx, tbls); err != nil {
+		log.Warn("reset placement rules failed", zap.Error(err))
+	}
 }
 
 func (manager *brContextManager) Enter(ctx context.Context, tables []CreatedTable) error {
@@ -143,6 +147,139 @@ func splitPrepareWork(ctx context.Context, client *Client, tables []*model.Table
 	return nil
 }
 
+// PrepareAheadContextManager wraps a ContextManager to prepare the tables
+// (e.g. set placement rules for online restore) in the background as soon as
+// they are created, so the preparing overlaps with validating and merging the
+// files of the tables, instead of blocking the batch before splitting.
+// Enter joins the preparing of the tables, and surfaces its error.
+type PrepareAheadContextManager struct {
+	inner ContextManager
+
+	mu       sync.Mutex
+	prepared map[int64]*prepareResult
+	// cancel stops the background preparing on closing.
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type prepareResult struct {
+	table CreatedTable
+	done  chan struct{}
+	err   error
+}
+
+// NewPrepareAheadContextManager makes a context manager preparing the tables ahead by the inner manager.
+func NewPrepareAheadContextManager(inner ContextManager) *PrepareAheadContextManager {
+	return &PrepareAheadContextManager{
+		inner:    inner,
+		prepared: make(map[int64]*prepareResult),
+		cancel:   func() {},
+	}
+}
+
+// GoPrepare passes the tables through, and prepares them one by one in the background.
+// It must be called at most once.
+func (manager *PrepareAheadContextManager) GoPrepare(
+	ctx context.Context, inCh <-chan CreatedTable,
+) <-chan CreatedTable {
+	ctx, manager.cancel = context.WithCancel(ctx)
+	outCh := make(chan CreatedTable, defaultChannelSize)
+	toPrepare := make(chan *prepareResult, defaultChannelSize)
+	manager.wg.Add(2)
+	go func() {
+		defer manager.wg.Done()
+		defer close(outCh)
+		defer close(toPrepare)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t, ok := <-inCh:
+				if !ok {
+					return
+				}
+				result := &prepareResult{table: t, done: make(chan struct{})}
+				manager.mu.Lock()
+				manager.prepared[t.Table.ID] = result
+				manager.mu.Unlock()
+				select {
+				case <-ctx.Done():
+					result.err = ctx.Err()
+					close(result.done)
+					return
+				case toPrepare <- result:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case outCh <- t:
+				}
+			}
+		}
+	}()
+	go func() {
+		defer manager.wg.Done()
+		for result := range toPrepare {
+			if result.err = ctx.Err(); result.err == nil {
+				result.err = manager.inner.Enter(ctx, []CreatedTable{result.table})
+			}
+			close(result.done)
+		}
+	}()
+	return outCh
+}
+
+// Enter waits the tables prepared ahead, and prepares the others by the inner manager.
+func (manager *PrepareAheadContextManager) Enter(ctx context.Context, tables []CreatedTable) error {
+	var results []*prepareResult
+	others := make([]CreatedTable, 0, len(tables))
+	manager.mu.Lock()
+	for _, t := range tables {
+		if result, ok := manager.prepared[t.Table.ID]; ok {
+			results = append(results, result)
+		} else {
+			others = append(others, t)
+		}
+	}
+	manager.mu.Unlock()
+
+	for _, result := range results {
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-result.done:
+		}
+		if result.err != nil {
+			return errors.Trace(result.err)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	return manager.inner.Enter(ctx, others)
+}
+
+// Leave makes the tables leave the inner manager.
+func (manager *PrepareAheadContextManager) Leave(ctx context.Context, tables []CreatedTable) error {
+	manager.mu.Lock()
+	for _, t := range tables {
+		delete(manager.prepared, t.Table.ID)
+	}
+	manager.mu.Unlock()
+	return manager.inner.Leave(ctx, tables)
+}
+
+// Close stops the background preparing and closes the inner manager,
+// so the tables prepared ahead are cleaned up too. It's safe to call more than once.
+func (manager *PrepareAheadContextManager) Close(ctx context.Context) {
+	manager.closeOnce.Do(func() {
+		manager.cancel()
+		manager.wg.Wait()
+		manager.inner.Close(ctx)
+	})
+}
+
 // CreatedTable is a table created on restore process,
 // but not yet filled with data.
 type CreatedTable struct {
@@ -158,6 +295,15 @@ type TableWithRange struct {
 	Range []rtree.Range
 }
 
+// Files returns all files of this table with range.
+func (t TableWithRange) Files() []*backuppb.File {
+	files := make([]*backuppb.File, 0, len(t.Range)*2)
+	for _, rg := range t.Range {
+		files = append(files, rg.Files...)
+	}
+	return files
+}
+
 // Exhaust drains all remaining errors in the channel, into a slice of errors.
 func Exhaust(ec <-chan error) []error {
 	out := make([]error, 0, len(ec))
@@ -183,9 +329,22 @@ type BatchSender interface {
 	Close()
 }
 
+// StageProgress is the progresses of the stages of restoring the batches, so they can be shown separately.
+type StageProgress struct {
+	// Split is increased once a range is split and scattered.
+	Split glue.Progress
+	// Ingest is increased once the files of a range are downloaded and ingested.
+	Ingest glue.Progress
+}
+
+// MergedStageProgress returns the StageProgress reporting both stages to the same progress.
+func MergedStageProgress(updateCh glue.Progress) StageProgress {
+	return StageProgress{Split: updateCh, Ingest: updateCh}
+}
+
 type tikvSender struct {
 	client   *Client
-	updateCh glue.Progress
+	progress StageProgress
 
 	sink TableSink
 	inCh chan<- DrainResult
@@ -212,13 +371,24 @@ func NewTiKVSender(
 	cli *Client,
 	updateCh glue.Progress,
 	splitConcurrency uint,
+) (BatchSender, error) {
+	return NewTiKVSenderWithStageProgress(ctx, cli, MergedStageProgress(updateCh), splitConcurrency)
+}
+
+// NewTiKVSenderWithStageProgress is like NewTiKVSender, but reports the progresses of splitting
+// and ingesting separately, e.g. to show them by two progress bars.
+func NewTiKVSenderWithStageProgress(
+	ctx context.Context,
+	cli *Client,
+	progress StageProgress,
+	splitConcurrency uint,
 ) (BatchSender, error) {
 	inCh := make(chan DrainResult, defaultChannelSize)
 	midCh := make(chan drainResultAndDone, defaultChannelSize)
 
 	sender := &tikvSender{
 		client:       cli,
-		updateCh:     updateCh,
+		progress:     progress,
 		inCh:         inCh,
 		wg:           new(sync.WaitGroup),
 		tableWaiters: new(sync.Map),
@@ -289,10 +459,14 @@ func (b *tikvSender) splitWorker(ctx context.Context,
 			// hence the checksum would fail.
 			done := b.registerTableIsRestoring(result.TablesToSend)
 			pool.ApplyOnErrorGroup(eg, func() error {
-				err := SplitRanges(ectx, b.client, result.Ranges, result.RewriteRules, b.updateCh)
-				if err != nil {
-					log.Error("failed on split range", rtree.ZapRanges(result.Ranges), zap.Error(err))
-					return err
+				// the ranges won't be restored once the time budget is exhausted, so don't split them either.
+				if !b.client.timeBudget.exceeded() {
+					err := splitRangesOfTables(ectx, b.client, result.BlankTablesAfterSend,
+						result.Ranges, result.RewriteRules, b.progress.Split)
+					if err != nil {
+						log.Error("failed on split range", rtree.ZapRanges(result.Ranges), zap.Error(err))
+						return err
+					}
 				}
 				next <- drainResultAndDone{
 					result: result,
@@ -358,14 +532,14 @@ func (b *tikvSender) restoreWorker(ctx context.Context, ranges <-chan drainResul
 			// There has been a worker in the `RestoreFiles` procedure.
 			// Spawning a raw goroutine won't make too many requests to TiKV.
 			eg.Go(func() error {
-				e := b.client.RestoreFiles(ectx, files, r.result.RewriteRules, b.updateCh)
+				e := b.client.RestoreFiles(ectx, files, r.result.RewriteRules, b.progress.Ingest)
 				if e != nil {
 					return e
 				}
 				log.Info("restore batch done", rtree.ZapRanges(r.result.Ranges))
 				r.done()
 				b.waitTablesDone(r.result.BlankTablesAfterSend)
-				b.sink.EmitTables(r.result.BlankTablesAfterSend...)
+				b.sink.EmitTables(b.client.fullyRestoredTables(r.result.BlankTablesAfterSend)...)
 				return nil
 			})
 		}
@@ -0,0 +1,174 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/br/pkg/logutil"
+	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/tablecodec"
+	"go.uber.org/zap"
+)
+
+// RangeWarmer reads the keys of the ranges, so the blocks of them get cached by the stores.
+type RangeWarmer interface {
+	// Warm reads at most limit keys from the start of the raw key range [startKey, endKey),
+	// and returns the count of the keys read.
+	Warm(ctx context.Context, startKey, endKey []byte, limit int) (int, error)
+}
+
+type storageRangeWarmer struct {
+	storage kv.Storage
+}
+
+// NewStorageRangeWarmer returns a RangeWarmer reading the keys by the snapshots of the storage.
+func NewStorageRangeWarmer(storage kv.Storage) RangeWarmer {
+	return storageRangeWarmer{storage: storage}
+}
+
+func (w storageRangeWarmer) Warm(ctx context.Context, startKey, endKey []byte, limit int) (int, error) {
+	ver, err := w.storage.CurrentVersion(kv.GlobalTxnScope)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	iter, err := w.storage.GetSnapshot(ver).Iter(startKey, endKey)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer iter.Close()
+	read := 0
+	for ; read < limit && iter.Valid(); read++ {
+		if err := ctx.Err(); err != nil {
+			return read, errors.Trace(err)
+		}
+		if err := iter.Next(); err != nil {
+			return read, errors.Trace(err)
+		}
+	}
+	return read, nil
+}
+
+// PreWarmConfig is how much of the restored tables is read by PreWarmRestoredTables.
+type PreWarmConfig struct {
+	// SamplesPerTable is the count of the ranges of the files restored into every restored
+	// physical table, picked evenly by the order of the ranges, the start of every range is read.
+	SamplesPerTable int
+	// KeysPerSample is the count of the keys read from the start of every part at most.
+	KeysPerSample int
+}
+
+// PreWarmStat is the coverage of PreWarmRestoredTables.
+type PreWarmStat struct {
+	// Samples is the count of the ranges of the restored tables to read.
+	Samples int
+	// WarmedSamples is the count of the ranges with any key read, the others are empty.
+	WarmedSamples int
+	// Keys is the count of the keys read.
+	Keys int
+}
+
+// Coverage returns the ratio of the ranges with any key read, 0 if there is no range.
+func (s PreWarmStat) Coverage() float64 {
+	if s.Samples == 0 {
+		return 0
+	}
+	return float64(s.WarmedSamples) / float64(s.Samples)
+}
+
+// preWarmRanges returns the ranges of the files restored into the physical tables to read, sorted by keys.
+// The data only takes the record and index prefixes of a table, a tiny part of the keyspace of the table,
+// so the ranges are picked from the ranges of the files of every physical table, and rewritten into the
+// keyspace of the restored table.
+func preWarmRanges(tables []CreatedTable, fileOfTable map[int64][]*backuppb.File, samplesPerTable int) []rtree.Range {
+	ranges := make([]rtree.Range, 0)
+	for _, t := range tables {
+		for oldID, newID := range newPhysicalIDsOf(t) {
+			fileRanges := make([]rtree.Range, 0)
+			seen := make(map[string]struct{})
+			for _, file := range fileOfTable[oldID] {
+				// the files of the CFs share the range.
+				if _, ok := seen[string(file.GetStartKey())]; ok {
+					continue
+				}
+				seen[string(file.GetStartKey())] = struct{}{}
+				fileRanges = append(fileRanges, rtree.Range{StartKey: file.GetStartKey(), EndKey: file.GetEndKey()})
+			}
+			sort.Slice(fileRanges, func(i, j int) bool {
+				return bytes.Compare(fileRanges[i].StartKey, fileRanges[j].StartKey) < 0
+			})
+			samples := samplesPerTable
+			if len(fileRanges) < samples {
+				samples = len(fileRanges)
+			}
+			for i := 0; i < samples; i++ {
+				rg := fileRanges[i*len(fileRanges)/samples]
+				startKey, _ := replacePrefix(rg.StartKey, t.RewriteRule)
+				endKey, rule := replacePrefix(rg.EndKey, t.RewriteRule)
+				if rule == nil {
+					// the range ends at the prefix of the next table or unbounded.
+					endKey = tablecodec.EncodeTablePrefix(newID + 1)
+				}
+				ranges = append(ranges, rtree.Range{StartKey: startKey, EndKey: endKey})
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0
+	})
+	return ranges
+}
+
+// SetPreWarm makes PreWarmRestoredTables read the samples of the restored tables by the warmer.
+// nil warmer (the default) means no pre-warming.
+func (rc *Client) SetPreWarm(warmer RangeWarmer, cfg PreWarmConfig) {
+	rc.rangeWarmer = warmer
+	rc.preWarmCfg = cfg
+}
+
+// PreWarmRestoredTables reads the keys of the samples of the restored tables, i.e. the ranges
+// of the files of the physical tables in the backup mapped by their old IDs, so the blocks of the
+// ingested files are cached by the stores, and the first queries after restore don't suffer from
+// the cold cache, e.g. on failover. It's a no-op unless SetPreWarm.
+func (rc *Client) PreWarmRestoredTables(
+	ctx context.Context,
+	tables []CreatedTable,
+	fileOfTable map[int64][]*backuppb.File,
+) (PreWarmStat, error) {
+	stat := PreWarmStat{}
+	if rc.rangeWarmer == nil || rc.preWarmCfg.SamplesPerTable <= 0 || rc.preWarmCfg.KeysPerSample <= 0 {
+		return stat, nil
+	}
+	start := time.Now()
+	ranges := preWarmRanges(tables, fileOfTable, rc.preWarmCfg.SamplesPerTable)
+	stat.Samples = len(ranges)
+	for _, rg := range ranges {
+		read, err := rc.rangeWarmer.Warm(ctx, rg.StartKey, rg.EndKey, rc.preWarmCfg.KeysPerSample)
+		if err != nil {
+			return stat, errors.Annotatef(err, "failed to pre-warm range [%X, %X)", rg.StartKey, rg.EndKey)
+		}
+		if read > 0 {
+			stat.WarmedSamples++
+		}
+		stat.Keys += read
+		log.Debug("pre-warm restored range done",
+			logutil.Key("startKey", rg.StartKey),
+			logutil.Key("endKey", rg.EndKey),
+			zap.Int("keys", read))
+	}
+	log.Info("pre-warm restored tables done",
+		zap.Int("tables", len(tables)),
+		zap.Int("samples", stat.Samples),
+		zap.Int("warmed samples", stat.WarmedSamples),
+		zap.Int("keys", stat.Keys),
+		zap.Float64("coverage", stat.Coverage()),
+		zap.Duration("take", time.Since(start)))
+	return stat, nil
+}
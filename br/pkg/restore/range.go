@@ -105,6 +105,21 @@ func SortRanges(ranges []rtree.Range, rewriteRules *RewriteRules) ([]rtree.Range
 	return sortedRanges, nil
 }
 
+// SortRangesWithComparator is like SortRanges, but sorts the ranges by the start keys compared by
+// the comparator, nil means bytewise. The ranges are still checked overlapped bytewise, like the regions.
+func SortRangesWithComparator(
+	ranges []rtree.Range, rewriteRules *RewriteRules, cmp KeyComparator,
+) ([]rtree.Range, error) {
+	sortedRanges, err := SortRanges(ranges, rewriteRules)
+	if err != nil || cmp == nil {
+		return sortedRanges, errors.Trace(err)
+	}
+	sort.SliceStable(sortedRanges, func(i, j int) bool {
+		return cmp(sortedRanges[i].StartKey, sortedRanges[j].StartKey) < 0
+	})
+	return sortedRanges, nil
+}
+
 // RegionInfo includes a region and the leader of the region.
 type RegionInfo struct {
 	Region *metapb.Region
@@ -6,12 +6,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/btree"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
 	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
@@ -21,7 +29,13 @@ import (
 	"github.com/pingcap/tidb/br/pkg/redact"
 	"github.com/pingcap/tidb/br/pkg/rtree"
 	"github.com/pingcap/tidb/br/pkg/utils"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/parser/model"
+	"github.com/pingcap/tidb/parser/mysql"
+	"github.com/pingcap/tidb/tablecodec"
 	"github.com/tikv/pd/pkg/codec"
+	"github.com/tikv/pd/server/schedule/labeler"
+	"go.uber.org/atomic"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
@@ -51,15 +65,312 @@ const (
 // RegionSplitter is a executor of region split by rules.
 type RegionSplitter struct {
 	client SplitClient
+	// scatterWaitTimeout is how long to wait for scattering the new regions at most.
+	scatterWaitTimeout time.Duration
+	// validateSplitKeys checks the split keys are in the keyspace of the restored tables before splitting.
+	validateSplitKeys bool
+	// splitOnTableBoundary splits at the start of every table following another table.
+	splitOnTableBoundary bool
+	// splitOnTableStart splits at the start key of the first range of every table.
+	splitOnTableStart bool
+	// skipTailSplitKey skips splitting at the end of the last range.
+	skipTailSplitKey bool
+	// splitBatchDelay and splitBatchJitter pace the split requests of the regions.
+	splitBatchDelay  time.Duration
+	splitBatchJitter time.Duration
+	// sleep waits between the split requests.
+	sleep func(ctx context.Context, d time.Duration) error
+	// regionTemplate replaces the split keys derived from the ranges, if set.
+	regionTemplate [][]byte
+	// keyComparator sorts and validates the split keys.
+	keyComparator KeyComparator
+	// minRegions is the count of regions the split keys of every table must produce at least.
+	minRegions int
+	// tableSplitKeys counts the split keys of every table across the calls, for minRegions.
+	tableSplitKeys *tableSplitKeyCounter
+	// regionMaxSize is the size of files above which a range is split inside, 0 means disabled.
+	regionMaxSize uint64
+	// minSplitKeyDistance is the distance to the previous split key below which a split key is skipped.
+	minSplitKeyDistance uint64
+	// keptSplitKeys are the split keys kept by minSplitKeyDistance across the calls.
+	keptSplitKeys *keptSplitKeys
+	// tailSplit and tailSplitTables split the tails of the restored physical tables of the IDs finer.
+	tailSplit       TailSplitConfig
+	tailSplitTables map[int64]struct{}
+	// injectedSplitKeys is the count of the split keys injected for minRegions, regionMaxSize and tailSplit.
+	injectedSplitKeys atomic.Int64
+	// onPlanned is called with the split keys planned by Split or given to SplitKeys before splitting, if set.
+	onPlanned func(keys [][]byte)
+	// splitOrder is the order of submitting the batches of split keys.
+	splitOrder SplitOrder
+	// regionLabel labels the new regions, if the key is set.
+	regionLabel labeler.RegionLabel
+	// labeledRanges are the key ranges of the regions labeled across the calls.
+	labeledRanges *labeledRanges
+	// pacer adapts the delay between the split requests to the latency of them, if set.
+	pacer *SplitPacer
+	// now measures the latency of the split requests.
+	now func() time.Time
 }
 
+// SplitOrder is the order of submitting the batches of split keys to split the regions,
+// there is a batch per region, the keys in a batch are always ascending.
+// The split keys are the same whatever the order is.
+type SplitOrder string
+
+const (
+	// SplitOrderAscending submits the batches in the ascending order of the keys.
+	SplitOrderAscending SplitOrder = "ascending"
+	// SplitOrderDescending submits the batches in the descending order of the keys.
+	SplitOrderDescending SplitOrder = "descending"
+	// SplitOrderLargestGapFirst submits the middle batch first, then the middles of the halves
+	// breadth first, so every batch splits the largest gap left by the batches submitted,
+	// counted by the batches. Some versions of PD balance the regions faster in this order.
+	SplitOrderLargestGapFirst SplitOrder = "largest-gap-first"
+)
+
+// ParseSplitOrder parses the order of submitting the split keys from its name.
+func ParseSplitOrder(name string) (SplitOrder, error) {
+	switch order := SplitOrder(name); order {
+	case SplitOrderAscending, SplitOrderDescending, SplitOrderLargestGapFirst:
+		return order, nil
+	}
+	return "", errors.Annotatef(berrors.ErrInvalidArgument,
+		"unknown split order %s, should be one of %s, %s and %s",
+		name, SplitOrderAscending, SplitOrderDescending, SplitOrderLargestGapFirst)
+}
+
+// KeyComparator compares two keys like bytes.Compare, for the key encodings whose
+// logical order differs from the bytewise order.
+type KeyComparator func(a, b []byte) int
+
 // NewRegionSplitter returns a new RegionSplitter.
 func NewRegionSplitter(client SplitClient) *RegionSplitter {
 	return &RegionSplitter{
-		client: client,
+		client:             client,
+		scatterWaitTimeout: ScatterWaitUpperInterval,
+		sleep:              sleepWithContext,
+		now:                time.Now,
+		keyComparator:      bytes.Compare,
+		splitOrder:         SplitOrderAscending,
+	}
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case <-timer.C:
+		return nil
 	}
 }
 
+// SetScatterWaitTimeout sets how long Split waits for scattering the new regions at most.
+// 0 means Split doesn't wait.
+func (rs *RegionSplitter) SetScatterWaitTimeout(timeout time.Duration) {
+	rs.scatterWaitTimeout = timeout
+}
+
+// EnableSplitKeyValidation makes Split check that every split key is in the
+// keyspace of one of the tables which the rewrite rules rewrite to.
+func (rs *RegionSplitter) EnableSplitKeyValidation() {
+	rs.validateSplitKeys = true
+}
+
+// EnableSplitOnTableBoundary makes Split also split at the start of every table
+// following another table in the ranges, besides the end keys of the ranges.
+func (rs *RegionSplitter) EnableSplitOnTableBoundary() {
+	rs.splitOnTableBoundary = true
+}
+
+// EnableSplitOnTableStart makes Split also split at the start key of the first range
+// of every table in the ranges, including the first table, so a table never shares
+// a region with whatever is before it in the keyspace.
+func (rs *RegionSplitter) EnableSplitOnTableStart() {
+	rs.splitOnTableStart = true
+}
+
+// SkipTailSplitKey makes Split not split at the end of the last range of every call,
+// when it's the prefix of the next table, which is split at on creating the table.
+// Other end keys are kept, as the ranges of a table may span several calls, e.g. batches,
+// and the keys following them belong to the same table.
+func (rs *RegionSplitter) SkipTailSplitKey() {
+	rs.skipTailSplitKey = true
+}
+
+// SetKeyComparator makes Split sort and validate the split keys by the comparator
+// instead of bytewise, nil means bytewise. The regions to split are still scanned bytewise.
+func (rs *RegionSplitter) SetKeyComparator(cmp KeyComparator) {
+	if cmp == nil {
+		cmp = bytes.Compare
+	}
+	rs.keyComparator = cmp
+}
+
+// SetRegionTemplate makes Split split exactly at the sorted keys of the template
+// which are inside the ranges, ignoring the end keys of the ranges, so the layout
+// of the regions could be managed externally.
+func (rs *RegionSplitter) SetRegionTemplate(keys [][]byte) {
+	rs.regionTemplate = keys
+}
+
+// SetMinRegions makes Split produce at least the count of regions for every table, by injecting
+// evenly spaced keys into the ranges of a table if the split keys of the table are too few,
+// e.g. so ingesting a small table spreads across all stores. The split keys of a table are counted
+// across the calls of the splitter, so a table split by several calls, i.e. restore batches, gets the
+// injected keys in the ranges of the call where it falls short, not in every call. 0 means no injecting.
+// It doesn't work with the region template.
+func (rs *RegionSplitter) SetMinRegions(minRegions int) {
+	rs.minRegions = minRegions
+	if rs.tableSplitKeys == nil {
+		rs.tableSplitKeys = newTableSplitKeyCounter()
+	}
+}
+
+// tableSplitKeyCounter counts the split keys inside every table, by the ID decoded from the keys.
+type tableSplitKeyCounter struct {
+	mu   sync.Mutex
+	keys map[int64]int
+}
+
+func newTableSplitKeyCounter() *tableSplitKeyCounter {
+	return &tableSplitKeyCounter{keys: make(map[int64]int)}
+}
+
+// add adds the count of split keys to the table, and returns the total count of the table.
+func (c *tableSplitKeyCounter) add(tableID int64, count int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[tableID] += count
+	return c.keys[tableID]
+}
+
+// SetRegionMaxSize makes Split inject evenly spaced keys into every range of files taking more than
+// the size, so ingesting an oversized file doesn't leave a region larger than the max size behind.
+// The ranges of files are the ones before merging, which MergeConfig.RegionMaxSizeBytes checks.
+// The keys inside the files aren't known, so the keys are assumed evenly distributed in the range,
+// and Split fails if they can't be. 0 means no injecting. It doesn't work with the region template.
+func (rs *RegionSplitter) SetRegionMaxSize(size uint64) {
+	rs.regionMaxSize = size
+}
+
+// SetMinSplitKeyDistance makes Split skip the split keys derived from the ranges closer than the
+// distance to the split keys kept, merging the tiny regions between them, e.g. of the ranges of a table
+// ending close together. The keys are kept across the calls of the splitter, i.e. restore batches,
+// and the keys injected, e.g. for the min regions, are never skipped. The distance is measured within
+// a table, see keyDistance, so the split keys of different tables or indexes are never skipped.
+// 0 means no skipping. It doesn't work with the region template.
+func (rs *RegionSplitter) SetMinSplitKeyDistance(distance uint64) {
+	rs.minSplitKeyDistance = distance
+	if rs.keptSplitKeys == nil {
+		rs.keptSplitKeys = newKeptSplitKeys()
+	}
+}
+
+// TailSplitConfig is how the tail of a table with a sequential int handle is split finer.
+type TailSplitConfig struct {
+	// Keys is the count of the split keys injected into the tail of every table, 0 means disabled.
+	Keys int
+	// HandleStep is the difference of the int handles between two adjacent split keys of a tail.
+	HandleStep uint64
+}
+
+// SetTailSplit makes Split inject the split keys into the tails of the tables with sequential int
+// handles, detected by the table infos, e.g. of the auto-increment int primary keys. The inserts
+// after restore all go to the region after the max handle, the end of the last record range of the
+// table, so the keys of the handles spaced by the step upward from the max handle split the keyspace
+// beyond the data ahead. The tables should be the ones whose last ranges are split, e.g. the tables
+// restored fully by a batch. The keys are derived from the ranges only, so they are the same for every
+// run. It doesn't work with the region template.
+func (rs *RegionSplitter) SetTailSplit(cfg TailSplitConfig, tables []CreatedTable) {
+	rs.tailSplit = cfg
+	rs.tailSplitTables = make(map[int64]struct{})
+	for _, t := range tables {
+		if !hasSequentialIntHandle(t.Table) {
+			continue
+		}
+		for _, newID := range newPhysicalIDsOf(t) {
+			rs.tailSplitTables[newID] = struct{}{}
+		}
+	}
+}
+
+// SetSplitOrder sets the order of submitting the batches of split keys, empty means ascending.
+func (rs *RegionSplitter) SetSplitOrder(order SplitOrder) {
+	if order == "" {
+		order = SplitOrderAscending
+	}
+	rs.splitOrder = order
+}
+
+// RestoreJobLabelKey is the key of the region label of the ID of the restore job creating the region.
+const RestoreJobLabelKey = "br-restore-job"
+
+// SetRegionLabel makes Split label the regions created by splitting with the label, e.g. the ID of
+// the restore job, so the regions could be correlated with the restore later. All regions labeled
+// across the calls of the splitter are labeled by a single key range rule of PD named after the label,
+// so the rules don't pile up with the split requests. Failing to label is only logged.
+// Empty key means no labeling.
+func (rs *RegionSplitter) SetRegionLabel(key, value string) {
+	rs.regionLabel = labeler.RegionLabel{Key: key, Value: value}
+	if rs.labeledRanges == nil {
+		rs.labeledRanges = newLabeledRanges()
+	}
+}
+
+// InjectedSplitKeyCount returns the count of the split keys injected for the min regions, the oversized ranges
+// and the tails of the tables.
+func (rs *RegionSplitter) InjectedSplitKeyCount() int64 {
+	return rs.injectedSplitKeys.Load()
+}
+
+// SetSplitBatchDelay makes Split wait the delay plus a random jitter less than
+// the jitter between the split requests of the regions, so the split requests
+// don't overload PD on constrained clusters. Both 0 means no waiting.
+func (rs *RegionSplitter) SetSplitBatchDelay(delay, jitter time.Duration) {
+	rs.splitBatchDelay = delay
+	rs.splitBatchJitter = jitter
+}
+
+// SetSleepFunc replaces how Split waits between the split requests, e.g. by a fake clock in tests.
+func (rs *RegionSplitter) SetSleepFunc(sleep func(ctx context.Context, d time.Duration) error) {
+	rs.sleep = sleep
+}
+
+// SetNowFunc replaces how Split measures the latency of the split requests, e.g. by a fake clock in tests.
+func (rs *RegionSplitter) SetNowFunc(now func() time.Time) {
+	rs.now = now
+}
+
+// SetSplitPacer makes Split wait at least the delay of the pacer before every split request,
+// including the first one, and feeds the latency of the split requests back to the pacer.
+func (rs *RegionSplitter) SetSplitPacer(pacer *SplitPacer) {
+	rs.pacer = pacer
+}
+
+// waitSplitBatch waits between the split requests by the delay and the jitter,
+// and before the first split request by the pacer only.
+func (rs *RegionSplitter) waitSplitBatch(ctx context.Context, first bool) error {
+	d := time.Duration(0)
+	if !first {
+		d = rs.splitBatchDelay
+		if rs.splitBatchJitter > 0 {
+			d += time.Duration(rand.Int63n(int64(rs.splitBatchJitter)))
+		}
+	}
+	if rs.pacer != nil {
+		if paced := rs.pacer.Delay(); paced > d {
+			d = paced
+		}
+	}
+	if d <= 0 {
+		return nil
+	}
+	return rs.sleep(ctx, d)
+}
+
 // OnSplitFunc is called before split a range.
 type OnSplitFunc func(key [][]byte)
 
@@ -86,15 +397,504 @@ func (rs *RegionSplitter) Split(
 	}
 
 	startTime := time.Now()
-	// Sort the range for getting the min and max key of the ranges
-	sortedRanges, errSplit := SortRanges(ranges, rewriteRules)
-	if errSplit != nil {
-		return errors.Trace(errSplit)
+	sortedRanges, checkKeys, err := rs.planSplitKeys(ranges, rewriteRules)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rs.onPlanned != nil {
+		rs.onPlanned(checkKeys)
+	}
+	// The ranges are sorted by the key comparator, the regions are scanned bytewise.
+	minKey, maxKey := bytewiseSpan(sortedRanges)
+	// The keys of the tails are beyond the ranges, scan the regions containing them as well.
+	for _, key := range checkKeys {
+		if len(maxKey) > 0 && bytes.Compare(key, maxKey) >= 0 {
+			maxKey = append(append([]byte{}, key...), 0)
+		}
+	}
+	minKey = codec.EncodeBytes(minKey)
+	// An empty end key means unbounded, which scans to the last region.
+	if len(maxKey) > 0 {
+		maxKey = codec.EncodeBytes(maxKey)
+	}
+	return rs.splitAtKeys(ctx, startTime, minKey, maxKey, checkKeys, ranges, onSplit)
+}
+
+// SplitKeys splits the regions at the sorted keys computed ahead, e.g. by the
+// restore plan, without the ranges. Like Split, the keys must be raw keys.
+func (rs *RegionSplitter) SplitKeys(ctx context.Context, sortedKeys [][]byte, onSplit OnSplitFunc) error {
+	if len(sortedKeys) == 0 {
+		log.Info("skip split regions, no split key")
+		return nil
+	}
+	startTime := time.Now()
+	if rs.onPlanned != nil {
+		rs.onPlanned(sortedKeys)
+	}
+	// The keys are sorted by the key comparator, which may not be bytewise.
+	minKey, maxKey := sortedKeys[0], sortedKeys[0]
+	for _, key := range sortedKeys[1:] {
+		if bytes.Compare(key, minKey) < 0 {
+			minKey = key
+		}
+		if bytes.Compare(key, maxKey) > 0 {
+			maxKey = key
+		}
+	}
+	// Scan the region containing the max key as well.
+	maxKey = append(append([]byte{}, maxKey...), 0)
+	return rs.splitAtKeys(ctx, startTime, codec.EncodeBytes(minKey), codec.EncodeBytes(maxKey), sortedKeys, nil, onSplit)
+}
+
+// planSplitKeys sorts the ranges by the key comparator and returns them with the keys to split at.
+// The keys of the ranges are produced in the order of the ranges, so they are validated as they are,
+// which fails on the rewritten keys out of the order.
+func (rs *RegionSplitter) planSplitKeys(
+	ranges []rtree.Range, rewriteRules *RewriteRules,
+) ([]rtree.Range, [][]byte, error) {
+	sortedRanges, err := SortRangesWithComparator(ranges, rewriteRules, rs.keyComparator)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if rs.validateSplitKeys {
+		if err := validateSplitKeys(sortedRanges, rewriteRules); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	var checkKeys [][]byte
+	if rs.regionTemplate != nil {
+		checkKeys, err = ValidateSplitKeysOrderWithComparator(
+			dropEmptyKeys(rs.templateSplitKeys(sortedRanges)), rs.keyComparator)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	} else {
+		checkKeys, err = ValidateSplitKeysOrderWithComparator(
+			dropEmptyKeys(rs.rangeSplitKeys(sortedRanges)), rs.keyComparator)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if rs.minSplitKeyDistance > 0 {
+			kept := rs.keptSplitKeys.dedup(checkKeys, rs.minSplitKeyDistance)
+			if len(kept) < len(checkKeys) {
+				log.Info("skip the split keys close to the previous ones",
+					zap.Int("split keys", len(checkKeys)),
+					zap.Int("skipped", len(checkKeys)-len(kept)),
+					zap.Uint64("min distance", rs.minSplitKeyDistance))
+			}
+			checkKeys = kept
+		}
+		injected, err := oversizedSplitKeys(sortedRanges, rewriteRules, rs.regionMaxSize)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if len(injected) > 0 {
+			log.Info("inject split keys for the oversized ranges",
+				zap.Int("split keys", len(checkKeys)),
+				zap.Int("injected", len(injected)),
+				zap.Uint64("region max size", rs.regionMaxSize))
+			checkKeys = rs.injectKeys(checkKeys, injected)
+		}
+		if injected := tailSplitKeys(sortedRanges, rs.tailSplitTables, rs.tailSplit); len(injected) > 0 {
+			log.Info("inject split keys for the tails of the tables",
+				zap.Int("split keys", len(checkKeys)),
+				zap.Int("injected", len(injected)),
+				zap.Int("tail split keys", rs.tailSplit.Keys),
+				zap.Uint64("handle step", rs.tailSplit.HandleStep))
+			checkKeys = rs.injectKeys(checkKeys, injected)
+		}
+		if injected := rs.minRegionsSplitKeys(sortedRanges, checkKeys); len(injected) > 0 {
+			log.Info("inject split keys for the min regions of the tables",
+				zap.Int("split keys", len(checkKeys)),
+				zap.Int("injected", len(injected)),
+				zap.Int("min regions", rs.minRegions))
+			checkKeys = rs.injectKeys(checkKeys, injected)
+		}
+	}
+	return sortedRanges, checkKeys, nil
+}
+
+// minRegionsSplitKeys counts the split keys of every table of the ranges, and returns the keys evenly
+// spaced inside the ranges of the tables whose split keys so far produce less than the min regions.
+// The prefix of a table is the boundary rather than a split key inside the table, so it's not counted.
+func (rs *RegionSplitter) minRegionsSplitKeys(sortedRanges []rtree.Range, keys [][]byte) [][]byte {
+	if rs.minRegions <= 0 {
+		return nil
+	}
+	keysOfTable := make(map[int64]int)
+	for _, key := range keys {
+		tableID := tablecodec.DecodeTableID(key)
+		if !bytes.Equal(key, tablecodec.EncodeTablePrefix(tableID)) {
+			keysOfTable[tableID]++
+		}
+	}
+	var tableIDs []int64
+	rangesOfTable := make(map[int64][]rtree.Range)
+	for _, rg := range sortedRanges {
+		tableID := tablecodec.DecodeTableID(rg.StartKey)
+		if _, ok := rangesOfTable[tableID]; !ok {
+			tableIDs = append(tableIDs, tableID)
+		}
+		rangesOfTable[tableID] = append(rangesOfTable[tableID], rg)
+	}
+	var injected [][]byte
+	for _, tableID := range tableIDs {
+		count := rs.tableSplitKeys.add(tableID, keysOfTable[tableID])
+		keys := injectSplitKeys(rangesOfTable[tableID], rs.minRegions-count-1)
+		rs.tableSplitKeys.add(tableID, len(keys))
+		injected = append(injected, keys...)
+	}
+	return injected
+}
+
+// keptSplitKeys keeps the split keys kept by the min distance, shared by the splitters of a restore.
+type keptSplitKeys struct {
+	mu   sync.Mutex
+	keys *btree.BTree
+}
+
+// splitKeyItem is a split key kept, ordered bytewise.
+type splitKeyItem []byte
+
+// Less implements btree.Item.
+func (k splitKeyItem) Less(than btree.Item) bool {
+	return bytes.Compare(k, than.(splitKeyItem)) < 0
+}
+
+func newKeptSplitKeys() *keptSplitKeys {
+	return &keptSplitKeys{keys: btree.New(32)}
+}
+
+// dedup returns the keys without the keys closer than the min distance to the nearest keys kept so
+// far, and keeps the rest. The keys are checked in their order, so of the sorted keys, the first key
+// is kept unless it's close to the keys kept before.
+func (k *keptSplitKeys) dedup(keys [][]byte, minDistance uint64) [][]byte {
+	min := new(big.Int).SetUint64(minDistance)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kept := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if k.closeTo(key, min) {
+			continue
+		}
+		k.keys.ReplaceOrInsert(splitKeyItem(key))
+		kept = append(kept, key)
+	}
+	return kept
+}
+
+// closeTo checks whether the nearest keys kept below and above the key are closer than the min distance.
+func (k *keptSplitKeys) closeTo(key []byte, min *big.Int) bool {
+	near := false
+	check := func(item btree.Item) bool {
+		distance := keyDistance(item.(splitKeyItem), key)
+		near = distance != nil && distance.Cmp(min) < 0
+		return false
+	}
+	k.keys.DescendLessOrEqual(splitKeyItem(key), check)
+	if !near {
+		k.keys.AscendGreaterOrEqual(splitKeyItem(key), check)
+	}
+	return near
+}
+
+var (
+	recordKeyPrefixLen = len(tablecodec.GenTableRecordPrefix(0))
+	indexKeyPrefixLen  = len(tablecodec.EncodeTableIndexPrefix(0, 0))
+)
+
+// tableKeyPrefixLen returns the length of the record prefix of a row key or of the index prefix of
+// an index key, 0 for the other keys.
+func tableKeyPrefixLen(key []byte) int {
+	switch {
+	case tablecodec.IsRecordKey(key):
+		return recordKeyPrefixLen
+	case tablecodec.IsIndexKey(key) && len(key) >= indexKeyPrefixLen:
+		return indexKeyPrefixLen
+	default:
+		return 0
+	}
+}
+
+// keyDistance returns the difference of the keys after their record or index prefix taken as
+// big-endian numbers of the same length, the shorter one padded with zeros, e.g. the difference of
+// the int handles of two row keys of a table. It returns nil for the keys of different tables or
+// indexes, which are never close. The keys out of the tables, e.g. of the raw kv, are taken as a whole.
+func keyDistance(a, b []byte) *big.Int {
+	prefixLen := tableKeyPrefixLen(a)
+	if prefixLen != tableKeyPrefixLen(b) || !bytes.Equal(a[:prefixLen], b[:prefixLen]) {
+		return nil
+	}
+	a, b = a[prefixLen:], b[prefixLen:]
+	length := len(a)
+	if len(b) > length {
+		length = len(b)
+	}
+	pad := func(key []byte) *big.Int {
+		padded := make([]byte, length)
+		copy(padded, key)
+		return new(big.Int).SetBytes(padded)
+	}
+	distance := new(big.Int).Sub(pad(b), pad(a))
+	return distance.Abs(distance)
+}
+
+// injectKeys merges the injected keys into the sorted split keys without the duplicated ones,
+// and counts them. The injected keys are spaced bytewise, so they are sorted by the key comparator first.
+func (rs *RegionSplitter) injectKeys(keys, injected [][]byte) [][]byte {
+	rs.injectedSplitKeys.Add(int64(len(injected)))
+	injected = rs.sortKeys(injected)
+	merged := make([][]byte, 0, len(keys)+len(injected))
+	for len(keys) > 0 || len(injected) > 0 {
+		var key []byte
+		if len(injected) == 0 || (len(keys) > 0 && rs.keyComparator(keys[0], injected[0]) <= 0) {
+			key, keys = keys[0], keys[1:]
+		} else {
+			key, injected = injected[0], injected[1:]
+		}
+		if len(merged) == 0 || rs.keyComparator(merged[len(merged)-1], key) < 0 {
+			merged = append(merged, key)
+		}
+	}
+	return merged
+}
+
+// sortKeys sorts the keys by the key comparator.
+func (rs *RegionSplitter) sortKeys(keys [][]byte) [][]byte {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return rs.keyComparator(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// oversizedSplitKeys returns the keys evenly spaced inside every range of files taking more than the
+// max size, so every part of the range takes at most the max size if the keys are evenly distributed.
+// The ranges of files are the ones checkOversizedRanges checks, i.e. the files sharing a start key in
+// the merged ranges, rewritten by the rules. It fails on an oversized range whose keys can't be spaced,
+// e.g. without an end key, since the distribution of the keys of the files is unknown then.
+func oversizedSplitKeys(sortedRanges []rtree.Range, rewriteRules *RewriteRules, maxSize uint64) ([][]byte, error) {
+	if maxSize == 0 {
+		return nil, nil
 	}
-	minKey := codec.EncodeBytes(sortedRanges[0].StartKey)
-	maxKey := codec.EncodeBytes(sortedRanges[len(sortedRanges)-1].EndKey)
+	var keys [][]byte
+	for i := range sortedRanges {
+		filesByStartKey := make(map[string][]*backuppb.File)
+		startKeys := make([]string, 0)
+		for _, file := range sortedRanges[i].Files {
+			startKey := string(file.GetStartKey())
+			if _, ok := filesByStartKey[startKey]; !ok {
+				startKeys = append(startKeys, startKey)
+			}
+			filesByStartKey[startKey] = append(filesByStartKey[startKey], file)
+		}
+		sort.Strings(startKeys)
+		for _, startKey := range startKeys {
+			files := filesByStartKey[startKey]
+			rg := rtree.Range{StartKey: files[0].GetStartKey(), EndKey: files[0].GetEndKey(), Files: files}
+			size, _ := rg.BytesAndKeys()
+			if size <= maxSize {
+				continue
+			}
+			parts := (size + maxSize - 1) / maxSize
+			var injected [][]byte
+			startKey, endKey, ok := rewriteFileRange(rg.StartKey, rg.EndKey, rewriteRules)
+			if ok && len(endKey) > 0 && bytes.Compare(startKey, endKey) < 0 {
+				injected = evenKeysBetween(startKey, endKey, int(parts-1))
+			}
+			if len(injected) == 0 {
+				return nil, errors.Annotatef(berrors.ErrRestoreInvalidRange,
+					"files of range [%X, %X) take %d bytes, larger than the region max size %d bytes, "+
+						"but the distribution of the keys of them is unknown for splitting the regions, "+
+						"ingest them by the policy %s",
+					rg.StartKey, rg.EndKey, size, maxSize, OversizedFilesIgnore)
+			}
+			keys = append(keys, injected...)
+		}
+	}
+	return keys, nil
+}
+
+// rewriteFileRange rewrites the keys of the range of files by the rules, nil rules mean no rewriting.
+// It fails if any key matches no rule.
+func rewriteFileRange(startKey, endKey []byte, rewriteRules *RewriteRules) ([]byte, []byte, bool) {
+	if rewriteRules == nil {
+		return startKey, endKey, true
+	}
+	startKey, startRule := replacePrefix(startKey, rewriteRules)
+	endKey, endRule := replacePrefix(endKey, rewriteRules)
+	return startKey, endKey, startRule != nil && endRule != nil
+}
+
+// hasSequentialIntHandle checks whether the rows of the table are inserted in the ascending order of
+// their int handles, i.e. the handle is the auto-increment int primary key, or the implicit row ID
+// without sharding. The auto random primary keys are sharded, so they aren't.
+func hasSequentialIntHandle(info *model.TableInfo) bool {
+	if info == nil || info.IsCommonHandle {
+		return false
+	}
+	if info.PKIsHandle {
+		pk := info.GetPkColInfo()
+		return pk != nil && mysql.HasAutoIncrementFlag(pk.Flag) && info.AutoRandomBits == 0
+	}
+	return info.ShardRowIDBits == 0
+}
+
+// tailSplitKeys returns the row keys of the handles spaced by the step upward from the max handle of
+// the last record range of every table of the IDs, i.e. beyond the data restored. The max handle is of
+// the end of the range if it's an int row key of the table, or else of the ends of its files, or else
+// of its start, 0 if none of them is an int row key, e.g. of the prefix of the records or an index.
+// The sorted ranges are in the keyspace of the restored tables.
+func tailSplitKeys(sortedRanges []rtree.Range, tableIDs map[int64]struct{}, cfg TailSplitConfig) [][]byte {
+	if cfg.Keys <= 0 || cfg.HandleStep == 0 || len(tableIDs) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(tableIDs))
+	for id := range tableIDs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var keys [][]byte
+	for _, id := range ids {
+		recordPrefix := tablecodec.GenTableRecordPrefix(id)
+		recordEnd := recordPrefix.PrefixNext()
+		last := -1
+		for i := range sortedRanges {
+			rg := &sortedRanges[i]
+			if bytes.Compare(rg.StartKey, recordEnd) < 0 &&
+				(len(rg.EndKey) == 0 || bytes.Compare(rg.EndKey, recordPrefix) > 0) &&
+				(last < 0 || bytes.Compare(rg.StartKey, sortedRanges[last].StartKey) > 0) {
+				last = i
+			}
+		}
+		if last < 0 {
+			continue
+		}
+		rg := &sortedRanges[last]
+		start := tailMaxHandle(rg, recordPrefix)
+		for i := 1; i <= cfg.Keys; i++ {
+			if uint64(math.MaxInt64-start)/uint64(i) < cfg.HandleStep {
+				break
+			}
+			key := tablecodec.EncodeRowKeyWithHandle(id, kv.IntHandle(start+int64(uint64(i)*cfg.HandleStep)))
+			if bytes.Compare(key, rg.StartKey) <= 0 {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// tailMaxHandle returns the max handle of the record range of the prefix, see tailSplitKeys.
+// The files of the range are in the keyspace of the backup, so only their handles are taken.
+func tailMaxHandle(rg *rtree.Range, recordPrefix kv.Key) int64 {
+	intHandle := func(key []byte) (int64, bool) {
+		if !tablecodec.IsRecordKey(key) || len(key) != tablecodec.RecordRowKeyLen {
+			return 0, false
+		}
+		handle, err := tablecodec.DecodeRowKey(key)
+		if err != nil || handle.IntValue() < 0 {
+			return 0, false
+		}
+		return handle.IntValue(), true
+	}
+	if bytes.HasPrefix(rg.EndKey, recordPrefix) {
+		if handle, ok := intHandle(rg.EndKey); ok {
+			return handle
+		}
+	}
+	max, found := int64(0), false
+	for _, file := range rg.Files {
+		if handle, ok := intHandle(file.GetEndKey()); ok && (!found || handle > max) {
+			max, found = handle, true
+		}
+	}
+	if found {
+		return max
+	}
+	if bytes.HasPrefix(rg.StartKey, recordPrefix) {
+		if handle, ok := intHandle(rg.StartKey); ok {
+			return handle
+		}
+	}
+	return 0
+}
+
+// injectSplitKeys returns the count of keys evenly spaced inside the ranges, which are
+// distributed to the ranges as evenly as possible, in the order of the ranges.
+// The ranges without an end key are skipped.
+func injectSplitKeys(sortedRanges []rtree.Range, count int) [][]byte {
+	if count <= 0 {
+		return nil
+	}
+	candidates := make([]rtree.Range, 0, len(sortedRanges))
+	for _, rg := range sortedRanges {
+		if len(rg.EndKey) > 0 && bytes.Compare(rg.StartKey, rg.EndKey) < 0 {
+			candidates = append(candidates, rg)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, count)
+	for i, rg := range candidates {
+		n := count / len(candidates)
+		if i < count%len(candidates) {
+			n++
+		}
+		keys = append(keys, evenKeysBetween(rg.StartKey, rg.EndKey, n)...)
+	}
+	return keys
+}
+
+// evenKeysBetween returns n keys evenly spaced strictly between the start and the end keys,
+// by taking the keys as big-endian numbers of the same length.
+func evenKeysBetween(start, end []byte, n int) [][]byte {
+	if n <= 0 {
+		return nil
+	}
+	// One more byte than the longer key, so there is room between two adjacent keys.
+	length := len(start)
+	if len(end) > length {
+		length = len(end)
+	}
+	length++
+	pad := func(key []byte) *big.Int {
+		padded := make([]byte, length)
+		copy(padded, key)
+		return new(big.Int).SetBytes(padded)
+	}
+	lower, upper := pad(start), pad(end)
+	step := new(big.Int).Sub(upper, lower)
+	step.Div(step, big.NewInt(int64(n+1)))
+	if step.Sign() == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, n)
+	current := lower
+	for i := 0; i < n; i++ {
+		current = new(big.Int).Add(current, step)
+		key := make([]byte, length)
+		current.FillBytes(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// splitAtKeys splits the regions in [minKey, maxKey) at the check keys, the min and max
+// keys are encoded. The ranges are only for logging.
+func (rs *RegionSplitter) splitAtKeys(
+	ctx context.Context,
+	startTime time.Time,
+	minKey, maxKey []byte,
+	checkKeys [][]byte,
+	ranges []rtree.Range,
+	onSplit OnSplitFunc,
+) error {
+	var errSplit error
 	interval := SplitRetryInterval
 	scatterRegions := make([]*RegionInfo, 0)
+	splitBatches := 0
 SplitRegions:
 	for i := 0; i < SplitRetryTimes; i++ {
 		regions, errScan := PaginateScanRegion(ctx, rs.client, minKey, maxKey, ScanRegionPaginationLimit)
@@ -106,12 +906,28 @@ SplitRegions:
 			}
 			return errors.Trace(errScan)
 		}
-		splitKeyMap := getSplitKeys(rewriteRules, sortedRanges, regions)
+		splitKeyMap := getSplitKeys(checkKeys, regions)
+		if i == 0 {
+			// The keys already at the region boundaries, e.g. split by an interrupted restore, are skipped.
+			missing := 0
+			for _, keys := range splitKeyMap {
+				missing += len(keys)
+			}
+			if missing < len(checkKeys) {
+				log.Info("skip the split keys already splitted",
+					zap.Int("split keys", len(checkKeys)), zap.Int("missing", missing))
+			}
+		}
 		regionMap := make(map[uint64]*RegionInfo)
 		for _, region := range regions {
 			regionMap[region.Region.GetId()] = region
 		}
-		for regionID, keys := range splitKeyMap {
+		for _, regionID := range rs.orderSplitBatches(splitKeyMap) {
+			keys := splitKeyMap[regionID]
+			if err := rs.waitSplitBatch(ctx, splitBatches == 0); err != nil {
+				return errors.Trace(err)
+			}
+			splitBatches++
 			var newRegions []*RegionInfo
 			region := regionMap[regionID]
 			log.Info("split regions",
@@ -148,6 +964,9 @@ SplitRegions:
 					zap.Int("split key count", len(keys)))
 			}
 			scatterRegions = append(scatterRegions, newRegions...)
+			if rs.regionLabel.Key != "" {
+				rs.labelRegions(ctx, newRegions)
+			}
 			onSplit(keys)
 		}
 		break
@@ -155,27 +974,45 @@ SplitRegions:
 	if errSplit != nil {
 		return errors.Trace(errSplit)
 	}
+	if rs.scatterWaitTimeout <= 0 {
+		log.Info("skip waiting for scattering regions",
+			zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
+		return nil
+	}
 	log.Info("start to wait for scattering regions",
 		zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
-	startTime = time.Now()
+	_, err := rs.WaitForScatterRegions(ctx, scatterRegions, rs.scatterWaitTimeout)
+	return errors.Trace(err)
+}
+
+// WaitForScatterRegions waits until the scatter operators of the regions are finished one by one,
+// or the timeout is reached. It returns the count of the leading regions which are known to be scattered,
+// so the caller could wait for the rest regions again later.
+// Reaching the timeout isn't an error, but canceling the context is.
+func (rs *RegionSplitter) WaitForScatterRegions(
+	ctx context.Context, regions []*RegionInfo, timeout time.Duration,
+) (int, error) {
+	startTime := time.Now()
 	scatterCount := 0
-	for _, region := range scatterRegions {
-		rs.waitForScatterRegion(ctx, region)
-		if time.Since(startTime) > ScatterWaitUpperInterval {
+	for _, region := range regions {
+		if err := rs.waitForScatterRegion(ctx, region); err != nil {
+			return scatterCount, errors.Trace(err)
+		}
+		if time.Since(startTime) > timeout {
 			break
 		}
 		scatterCount++
 	}
-	if scatterCount == len(scatterRegions) {
+	if scatterCount == len(regions) {
 		log.Info("waiting for scattering regions done",
-			zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
+			zap.Int("regions", len(regions)), zap.Duration("take", time.Since(startTime)))
 	} else {
 		log.Warn("waiting for scattering regions timeout",
 			zap.Int("scatterCount", scatterCount),
-			zap.Int("regions", len(scatterRegions)),
+			zap.Int("regions", len(regions)),
 			zap.Duration("take", time.Since(startTime)))
 	}
-	return nil
+	return scatterCount, nil
 }
 
 func (rs *RegionSplitter) hasRegion(ctx context.Context, regionID uint64) (bool, error) {
@@ -231,7 +1068,8 @@ type retryTimeKey struct{}
 
 var retryTimes = new(retryTimeKey)
 
-func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *RegionInfo) {
+// waitForScatterRegion waits for the scatter operator of the region, only returns error when the context is done.
+func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *RegionInfo) error {
 	interval := ScatterWaitInterval
 	regionID := regionInfo.Region.GetId()
 	for i := 0; i < ScatterWaitMaxRetryTimes; i++ {
@@ -240,7 +1078,7 @@ func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *
 		if err != nil {
 			log.Warn("scatter region failed: do not have the region",
 				logutil.Region(regionInfo.Region))
-			return
+			return nil
 		}
 		if ok {
 			break
@@ -249,8 +1087,13 @@ func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *
 		if interval > ScatterMaxWaitInterval {
 			interval = ScatterMaxWaitInterval
 		}
-		time.Sleep(interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
 	}
+	return nil
 }
 
 func (rs *RegionSplitter) splitAndScatterRegions(
@@ -260,7 +1103,11 @@ func (rs *RegionSplitter) splitAndScatterRegions(
 		return []*RegionInfo{regionInfo}, nil
 	}
 
+	start := rs.now()
 	newRegions, err := rs.client.BatchSplitRegions(ctx, regionInfo, keys)
+	if rs.pacer != nil {
+		rs.pacer.Observe(rs.now().Sub(start))
+	}
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -281,6 +1128,77 @@ func (rs *RegionSplitter) splitAndScatterRegions(
 	return newRegions, nil
 }
 
+// labelRegions adds the regions to the labeled ranges, and updates the key range rule named after
+// the label with all of them.
+func (rs *RegionSplitter) labelRegions(ctx context.Context, regions []*RegionInfo) {
+	if len(regions) == 0 {
+		return
+	}
+	rs.labeledRanges.mu.Lock()
+	defer rs.labeledRanges.mu.Unlock()
+	rule := &labeler.LabelRule{
+		ID:       fmt.Sprintf("%s-%s", rs.regionLabel.Key, rs.regionLabel.Value),
+		Labels:   []labeler.RegionLabel{rs.regionLabel},
+		RuleType: labeler.KeyRange,
+		Data:     rs.labeledRanges.add(regions),
+	}
+	// the rule replaces the one of the same ID, so it's updated under the lock to keep the latest ranges.
+	if err := rs.client.SetRegionLabelRule(ctx, rule); err != nil {
+		log.Warn("failed to label the new regions",
+			zap.String("rule", rule.ID), zap.Int("regions", len(regions)), logutil.ShortError(err))
+	}
+}
+
+// labeledRanges are the sorted key ranges of the regions labeled, with the adjacent ones merged,
+// shared by the splitters of a restore.
+type labeledRanges struct {
+	mu     sync.Mutex
+	ranges []labeledRange
+}
+
+// labeledRange is the range of the encoded keys of labeled regions, an empty end key means unbounded.
+type labeledRange struct {
+	startKey, endKey []byte
+}
+
+func newLabeledRanges() *labeledRanges {
+	return &labeledRanges{}
+}
+
+// add merges the ranges of the regions into the labeled ranges, and returns all of them as the key
+// ranges of a label rule. The caller must hold the lock.
+func (l *labeledRanges) add(regions []*RegionInfo) []*labeler.KeyRangeRule {
+	for _, region := range regions {
+		l.ranges = append(l.ranges, labeledRange{
+			startKey: region.Region.GetStartKey(),
+			endKey:   region.Region.GetEndKey(),
+		})
+	}
+	sort.Slice(l.ranges, func(i, j int) bool {
+		return bytes.Compare(l.ranges[i].startKey, l.ranges[j].startKey) < 0
+	})
+	merged := l.ranges[:1]
+	for _, rg := range l.ranges[1:] {
+		last := &merged[len(merged)-1]
+		if len(last.endKey) > 0 && bytes.Compare(rg.startKey, last.endKey) > 0 {
+			merged = append(merged, rg)
+			continue
+		}
+		if len(last.endKey) > 0 && (len(rg.endKey) == 0 || bytes.Compare(rg.endKey, last.endKey) > 0) {
+			last.endKey = rg.endKey
+		}
+	}
+	l.ranges = merged
+	keyRanges := make([]*labeler.KeyRangeRule, 0, len(l.ranges))
+	for _, rg := range l.ranges {
+		keyRanges = append(keyRanges, &labeler.KeyRangeRule{
+			StartKeyHex: hex.EncodeToString(rg.startKey),
+			EndKeyHex:   hex.EncodeToString(rg.endKey),
+		})
+	}
+	return keyRanges
+}
+
 // ScatterRegionsWithBackoffer scatter the region with some backoffer.
 // This function is for testing the retry mechanism.
 // For a real cluster, directly use ScatterRegions would be fine.
@@ -434,14 +1352,164 @@ func (b *scanRegionBackoffer) Attempt() int {
 	return b.attempt
 }
 
-// getSplitKeys checks if the regions should be split by the end key of
-// the ranges, groups the split keys by region id.
-func getSplitKeys(rewriteRules *RewriteRules, ranges []rtree.Range, regions []*RegionInfo) map[uint64][][]byte {
-	splitKeyMap := make(map[uint64][][]byte)
-	checkKeys := make([][]byte, 0)
-	for _, rg := range ranges {
-		checkKeys = append(checkKeys, rg.EndKey)
+// validateSplitKeys checks whether the split keys, i.e. the end keys of the sorted ranges,
+// are all in the keyspace of the tables which the rewrite rules rewrite to.
+// There is nothing to check against if there aren't any rewrite rules.
+func validateSplitKeys(sortedRanges []rtree.Range, rewriteRules *RewriteRules) error {
+	if rewriteRules == nil || len(rewriteRules.Data) == 0 {
+		return nil
+	}
+	tableIDs := make(map[int64]struct{}, len(rewriteRules.Data))
+	for _, rule := range rewriteRules.Data {
+		tableIDs[tablecodec.DecodeTableID(rule.GetNewKeyPrefix())] = struct{}{}
+	}
+	for _, rg := range sortedRanges {
+		tableID := tablecodec.DecodeTableID(rg.EndKey)
+		if _, ok := tableIDs[tableID]; !ok {
+			return errors.Annotatef(berrors.ErrRestoreInvalidRange,
+				"split key %s of table %d isn't in the keyspace of the restored tables",
+				redact.Key(rg.EndKey), tableID)
+		}
 	}
+	return nil
+}
+
+// rangeSplitKeys returns the keys to split the sorted ranges by, i.e. the end keys of the ranges.
+// If splitOnTableBoundary is set, the prefix of every table following another table is added too,
+// so the data of different tables would never be in the same region.
+// If splitOnTableStart is set, the start key of the first range of every table is added too,
+// unless it's the same as the key before it.
+// If skipTailSplitKey is set, the end key of the last range is skipped if it's the prefix of the next table.
+func (rs *RegionSplitter) rangeSplitKeys(sortedRanges []rtree.Range) [][]byte {
+	keys := make([][]byte, 0, len(sortedRanges))
+	for i, rg := range sortedRanges {
+		tableID := tablecodec.DecodeTableID(rg.StartKey)
+		newTable := i == 0 || tableID != tablecodec.DecodeTableID(sortedRanges[i-1].EndKey)
+		if rs.splitOnTableBoundary && i > 0 && newTable {
+			keys = append(keys, tablecodec.EncodeTablePrefix(tableID))
+		}
+		if rs.splitOnTableStart && newTable && (len(keys) == 0 || !bytes.Equal(keys[len(keys)-1], rg.StartKey)) {
+			keys = append(keys, rg.StartKey)
+		}
+		keys = append(keys, rg.EndKey)
+	}
+	if rs.skipTailSplitKey && len(keys) > 0 {
+		last := sortedRanges[len(sortedRanges)-1]
+		nextTable := tablecodec.EncodeTablePrefix(tablecodec.DecodeTableID(last.StartKey) + 1)
+		if bytes.Equal(keys[len(keys)-1], nextTable) {
+			keys = keys[:len(keys)-1]
+		}
+	}
+	return keys
+}
+
+// dropEmptyKeys returns the keys without the empty ones, i.e. the unbounded end keys
+// of the ranges, e.g. of the raw restore without an end key, which are never split at.
+func dropEmptyKeys(keys [][]byte) [][]byte {
+	result := keys[:0]
+	for _, key := range keys {
+		if len(key) > 0 {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// templateSplitKeys returns the keys of the template between the min start key of the sorted
+// ranges and the max end key of them, which are split by a batch of ranges. The template is
+// sorted bytewise, so the keys are sorted by the key comparator.
+func (rs *RegionSplitter) templateSplitKeys(sortedRanges []rtree.Range) [][]byte {
+	startKey, endKey := bytewiseSpan(sortedRanges)
+	keys := make([][]byte, 0)
+	for _, key := range rs.regionTemplate {
+		if bytes.Compare(key, startKey) >= 0 && (len(endKey) == 0 || bytes.Compare(key, endKey) <= 0) {
+			keys = append(keys, key)
+		}
+	}
+	return rs.sortKeys(keys)
+}
+
+// bytewiseSpan returns the min start key and the max end key of the ranges compared bytewise,
+// an empty end key means unbounded.
+func bytewiseSpan(ranges []rtree.Range) ([]byte, []byte) {
+	startKey, endKey := ranges[0].StartKey, ranges[0].EndKey
+	for _, rg := range ranges[1:] {
+		if bytes.Compare(rg.StartKey, startKey) < 0 {
+			startKey = rg.StartKey
+		}
+		if len(endKey) > 0 && (len(rg.EndKey) == 0 || bytes.Compare(rg.EndKey, endKey) > 0) {
+			endKey = rg.EndKey
+		}
+	}
+	return startKey, endKey
+}
+
+// ValidateSplitKeysOrder checks the split keys are sorted in the increasing order.
+// The duplicated keys are removed with a warning, and an out-of-order key fails
+// the check, which usually means the rewrite rules are broken.
+func ValidateSplitKeysOrder(keys [][]byte) ([][]byte, error) {
+	return ValidateSplitKeysOrderWithComparator(keys, bytes.Compare)
+}
+
+// ValidateSplitKeysOrderWithComparator is like ValidateSplitKeysOrder, but compares the keys by the comparator.
+func ValidateSplitKeysOrderWithComparator(keys [][]byte, cmp KeyComparator) ([][]byte, error) {
+	result := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		if i == 0 {
+			result = append(result, key)
+			continue
+		}
+		switch c := cmp(keys[i-1], key); {
+		case c == 0:
+			log.Warn("skip the duplicated split key", logutil.Key("key", key))
+		case c > 0:
+			return nil, errors.Annotatef(berrors.ErrRestoreInvalidRange,
+				"split key %s is less than the previous key %s",
+				redact.Key(key), redact.Key(keys[i-1]))
+		default:
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// orderSplitBatches returns the IDs of the regions to split in the order of submitting their split keys.
+func (rs *RegionSplitter) orderSplitBatches(splitKeyMap map[uint64][][]byte) []uint64 {
+	regionIDs := make([]uint64, 0, len(splitKeyMap))
+	for regionID := range splitKeyMap {
+		regionIDs = append(regionIDs, regionID)
+	}
+	sort.Slice(regionIDs, func(i, j int) bool {
+		return rs.keyComparator(splitKeyMap[regionIDs[i]][0], splitKeyMap[regionIDs[j]][0]) < 0
+	})
+	switch rs.splitOrder {
+	case SplitOrderDescending:
+		for i, j := 0, len(regionIDs)-1; i < j; i, j = i+1, j-1 {
+			regionIDs[i], regionIDs[j] = regionIDs[j], regionIDs[i]
+		}
+	case SplitOrderLargestGapFirst:
+		ordered := make([]uint64, 0, len(regionIDs))
+		// the gaps of [start, end) left, breadth first.
+		gaps := [][2]int{{0, len(regionIDs)}}
+		for len(gaps) > 0 {
+			gap := gaps[0]
+			gaps = gaps[1:]
+			if gap[0] >= gap[1] {
+				continue
+			}
+			mid := (gap[0] + gap[1]) / 2
+			ordered = append(ordered, regionIDs[mid])
+			gaps = append(gaps, [2]int{gap[0], mid}, [2]int{mid + 1, gap[1]})
+		}
+		regionIDs = ordered
+	}
+	return regionIDs
+}
+
+// getSplitKeys checks if the regions should be split by the keys,
+// groups the split keys by region id.
+func getSplitKeys(checkKeys [][]byte, regions []*RegionInfo) map[uint64][][]byte {
+	splitKeyMap := make(map[uint64][][]byte)
 	for _, key := range checkKeys {
 		if region := NeedSplit(key, regions); region != nil {
 			splitKeys, ok := splitKeyMap[region.Region.GetId()]
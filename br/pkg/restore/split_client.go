@@ -30,6 +30,7 @@ import (
 	"github.com/pingcap/tidb/br/pkg/logutil"
 	pd "github.com/tikv/pd/client"
 	"github.com/tikv/pd/server/config"
+	"github.com/tikv/pd/server/schedule/labeler"
 	"github.com/tikv/pd/server/schedule/placement"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
@@ -74,6 +75,8 @@ type SplitClient interface {
 	// SetStoreLabel add or update specified label of stores. If labelValue
 	// is empty, it clears the label.
 	SetStoresLabel(ctx context.Context, stores []uint64, labelKey, labelValue string) error
+	// SetRegionLabelRule inserts or updates a region label rule to PD.
+	SetRegionLabelRule(ctx context.Context, rule *labeler.LabelRule) error
 }
 
 // pdClient is a wrapper of pd client, can be used by RegionSplitter.
@@ -82,6 +85,9 @@ type pdClient struct {
 	client     pd.Client
 	tlsConf    *tls.Config
 	storeCache map[uint64]*metapb.Store
+	// httpCli is used for the requests to the PD HTTP API,
+	// when it is nil, the client works in gRPC-only mode.
+	httpCli *http.Client
 
 	// FIXME when config changed during the lifetime of pdClient,
 	// 	this may mislead the scatter.
@@ -91,10 +97,24 @@ type pdClient struct {
 
 // NewSplitClient returns a client used by RegionSplitter.
 func NewSplitClient(client pd.Client, tlsConf *tls.Config) SplitClient {
+	return NewSplitClientWithHTTPClient(client, tlsConf, httputil.NewClient(tlsConf))
+}
+
+// NewSplitClientWithHTTPClient returns a client used by RegionSplitter,
+// which sends the PD HTTP API requests by the httpCli.
+// If the httpCli is nil, the client degrades to gRPC-only mode, in which the
+// features depending on the PD HTTP API (checking whether scatter is needed,
+// placement rules and store labels) are disabled.
+func NewSplitClientWithHTTPClient(client pd.Client, tlsConf *tls.Config, httpCli *http.Client) SplitClient {
+	if httpCli == nil {
+		log.Warn("PD HTTP client is unavailable, split client works in gRPC-only mode, " +
+			"scatter check, placement rules and store labels are disabled")
+	}
 	cli := &pdClient{
 		client:     client,
 		tlsConf:    tlsConf,
 		storeCache: make(map[uint64]*metapb.Store),
+		httpCli:    httpCli,
 	}
 	return cli
 }
@@ -406,13 +426,16 @@ func (c *pdClient) getStoreCount(ctx context.Context) (int, error) {
 }
 
 func (c *pdClient) getMaxReplica(ctx context.Context) (int, error) {
+	if c.httpCli == nil {
+		return 0, errors.Annotate(berrors.ErrUnsupportedOperation, "failed to get max replica: gRPC-only mode")
+	}
 	api := c.getPDAPIAddr()
 	configAPI := api + "/pd/api/v1/config"
 	req, err := http.NewRequestWithContext(ctx, "GET", configAPI, nil)
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := c.httpCli.Do(req)
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
@@ -470,6 +493,9 @@ func (c *pdClient) ScanRegions(ctx context.Context, key, endKey []byte, limit in
 
 func (c *pdClient) GetPlacementRule(ctx context.Context, groupID, ruleID string) (placement.Rule, error) {
 	var rule placement.Rule
+	if c.httpCli == nil {
+		return rule, errors.Annotate(berrors.ErrUnsupportedOperation, "failed to get placement rule: gRPC-only mode")
+	}
 	addr := c.getPDAPIAddr()
 	if addr == "" {
 		return rule, errors.Annotate(berrors.ErrRestoreSplitFailed, "failed to add stores labels: no leader")
@@ -478,7 +504,7 @@ func (c *pdClient) GetPlacementRule(ctx context.Context, groupID, ruleID string)
 	if err != nil {
 		return rule, errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := c.httpCli.Do(req)
 	if err != nil {
 		return rule, errors.Trace(err)
 	}
@@ -495,6 +521,9 @@ func (c *pdClient) GetPlacementRule(ctx context.Context, groupID, ruleID string)
 }
 
 func (c *pdClient) SetPlacementRule(ctx context.Context, rule placement.Rule) error {
+	if c.httpCli == nil {
+		return errors.Annotate(berrors.ErrUnsupportedOperation, "failed to set placement rule: gRPC-only mode")
+	}
 	addr := c.getPDAPIAddr()
 	if addr == "" {
 		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to add stores labels")
@@ -504,7 +533,7 @@ func (c *pdClient) SetPlacementRule(ctx context.Context, rule placement.Rule) er
 	if err != nil {
 		return errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := c.httpCli.Do(req)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -512,6 +541,9 @@ func (c *pdClient) SetPlacementRule(ctx context.Context, rule placement.Rule) er
 }
 
 func (c *pdClient) DeletePlacementRule(ctx context.Context, groupID, ruleID string) error {
+	if c.httpCli == nil {
+		return errors.Annotate(berrors.ErrUnsupportedOperation, "failed to delete placement rule: gRPC-only mode")
+	}
 	addr := c.getPDAPIAddr()
 	if addr == "" {
 		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to add stores labels")
@@ -520,7 +552,7 @@ func (c *pdClient) DeletePlacementRule(ctx context.Context, groupID, ruleID stri
 	if err != nil {
 		return errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := c.httpCli.Do(req)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -530,12 +562,14 @@ func (c *pdClient) DeletePlacementRule(ctx context.Context, groupID, ruleID stri
 func (c *pdClient) SetStoresLabel(
 	ctx context.Context, stores []uint64, labelKey, labelValue string,
 ) error {
+	if c.httpCli == nil {
+		return errors.Annotate(berrors.ErrUnsupportedOperation, "failed to add stores labels: gRPC-only mode")
+	}
 	b := []byte(fmt.Sprintf(`{"%s": "%s"}`, labelKey, labelValue))
 	addr := c.getPDAPIAddr()
 	if addr == "" {
 		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to add stores labels")
 	}
-	httpCli := httputil.NewClient(c.tlsConf)
 	for _, id := range stores {
 		req, err := http.NewRequestWithContext(
 			ctx, "POST",
@@ -545,7 +579,7 @@ func (c *pdClient) SetStoresLabel(
 		if err != nil {
 			return errors.Trace(err)
 		}
-		res, err := httpCli.Do(req)
+		res, err := c.httpCli.Do(req)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -557,6 +591,35 @@ func (c *pdClient) SetStoresLabel(
 	return nil
 }
 
+func (c *pdClient) SetRegionLabelRule(ctx context.Context, rule *labeler.LabelRule) error {
+	if c.httpCli == nil {
+		return errors.Annotate(berrors.ErrUnsupportedOperation, "failed to set region label rule: gRPC-only mode")
+	}
+	addr := c.getPDAPIAddr()
+	if addr == "" {
+		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to set region label rule")
+	}
+	m, err := json.Marshal(rule)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", addr+"/pd/api/v1/config/region-label/rule", bytes.NewReader(m))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res, err := c.httpCli.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return errors.Annotatef(berrors.ErrPDInvalidResponse,
+			"failed to set region label rule %s: %s", rule.ID, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
 func (c *pdClient) getPDAPIAddr() string {
 	addr := c.client.GetLeaderAddr()
 	if addr != "" && !strings.HasPrefix(addr, "http") {
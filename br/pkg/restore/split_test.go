@@ -5,21 +5,30 @@ package restore_test
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"sort"
 	"sync"
 	"testing"
 	"time"
 
 	. "github.com/pingcap/check"
 	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
+	berrors "github.com/pingcap/tidb/br/pkg/errors"
 	"github.com/pingcap/tidb/br/pkg/restore"
 	"github.com/pingcap/tidb/br/pkg/rtree"
 	"github.com/pingcap/tidb/br/pkg/utils"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/parser/mysql"
+	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
 	"github.com/stretchr/testify/require"
+	pd "github.com/tikv/pd/client"
 	"github.com/tikv/pd/server/core"
+	"github.com/tikv/pd/server/schedule/labeler"
 	"github.com/tikv/pd/server/schedule/placement"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -203,6 +212,10 @@ func (c *TestClient) DeletePlacementRule(ctx context.Context, groupID, ruleID st
 	return nil
 }
 
+func (c *TestClient) SetRegionLabelRule(ctx context.Context, rule *labeler.LabelRule) error {
+	return nil
+}
+
 func (c *TestClient) SetStoresLabel(ctx context.Context, stores []uint64, labelKey, labelValue string) error {
 	return nil
 }
@@ -447,3 +460,753 @@ func (s *testRangeSuite) TestNeedSplit(c *C) {
 	// Out of region
 	c.Assert(restore.NeedSplit([]byte("e"), regions), IsNil)
 }
+
+type scatterRecordPDClient struct {
+	pd.Client
+	regions   map[uint64]*metapb.Region
+	scattered []uint64
+}
+
+func (c *scatterRecordPDClient) GetAllStores(context.Context, ...pd.GetStoreOption) ([]*metapb.Store, error) {
+	return []*metapb.Store{{Id: 1}, {Id: 2}, {Id: 3}}, nil
+}
+
+func (c *scatterRecordPDClient) GetRegionByID(_ context.Context, regionID uint64) (*pd.Region, error) {
+	region, ok := c.regions[regionID]
+	if !ok {
+		return nil, nil
+	}
+	return &pd.Region{Meta: region, Leader: region.Peers[0]}, nil
+}
+
+func (c *scatterRecordPDClient) ScatterRegion(_ context.Context, regionID uint64) error {
+	c.scattered = append(c.scattered, regionID)
+	return nil
+}
+
+func TestSplitClientWithoutHTTPClient(t *testing.T) {
+	t.Parallel()
+	pdCli := &scatterRecordPDClient{regions: map[uint64]*metapb.Region{}}
+	regionInfos := make([]*restore.RegionInfo, 0, 3)
+	for i := uint64(1); i <= 3; i++ {
+		region := &metapb.Region{Id: i, Peers: []*metapb.Peer{{Id: i, StoreId: 1}}}
+		pdCli.regions[i] = region
+		regionInfos = append(regionInfos, &restore.RegionInfo{Region: region})
+	}
+	client := restore.NewSplitClientWithHTTPClient(pdCli, nil, nil)
+
+	// scatter still works by gRPC only.
+	ctx := context.Background()
+	restore.NewRegionSplitter(client).ScatterRegions(ctx, regionInfos)
+	require.ElementsMatch(t, []uint64{1, 2, 3}, pdCli.scattered)
+
+	// features depending on the PD HTTP API are disabled.
+	_, err := client.GetPlacementRule(ctx, "pd", "default")
+	require.True(t, berrors.ErrUnsupportedOperation.Equal(err))
+	err = client.SetPlacementRule(ctx, placement.Rule{})
+	require.True(t, berrors.ErrUnsupportedOperation.Equal(err))
+	err = client.DeletePlacementRule(ctx, "pd", "restore-t1")
+	require.True(t, berrors.ErrUnsupportedOperation.Equal(err))
+	err = client.SetStoresLabel(ctx, []uint64{1}, "exclusive", "restore")
+	require.True(t, berrors.ErrUnsupportedOperation.Equal(err))
+}
+
+// scatterProgressClient reports the scatter operators of regions are running
+// until they have been queried enough times.
+type scatterProgressClient struct {
+	*TestClient
+	mu      sync.Mutex
+	running map[uint64]int
+}
+
+func (c *scatterProgressClient) GetOperator(_ context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &pdpb.GetOperatorResponse{
+		Header:   new(pdpb.ResponseHeader),
+		RegionId: regionID,
+		Desc:     []byte("scatter-region"),
+		Status:   pdpb.OperatorStatus_SUCCESS,
+	}
+	if c.running[regionID] > 0 {
+		c.running[regionID]--
+		resp.Status = pdpb.OperatorStatus_RUNNING
+	}
+	return resp, nil
+}
+
+func TestWaitForScatterRegions(t *testing.T) {
+	t.Parallel()
+	regions := []*restore.RegionInfo{
+		{Region: &metapb.Region{Id: 1}},
+		{Region: &metapb.Region{Id: 2}},
+	}
+	ctx := context.Background()
+
+	client := &scatterProgressClient{TestClient: initTestClient(), running: map[uint64]int{1: 1, 2: 2}}
+	splitter := restore.NewRegionSplitter(client)
+	count, err := splitter.WaitForScatterRegions(ctx, regions, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, map[uint64]int{1: 0, 2: 0}, client.running)
+
+	// timeout isn't an error, and the rest regions can be waited again.
+	client.running = map[uint64]int{1: 1, 2: 1}
+	count, err = splitter.WaitForScatterRegions(ctx, regions, time.Nanosecond)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	count, err = splitter.WaitForScatterRegions(ctx, regions[count:], time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// waiting is canceled by the context.
+	client.running = map[uint64]int{1: 1000}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	count, err = splitter.WaitForScatterRegions(cctx, regions, time.Minute)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	require.Equal(t, 0, count)
+}
+
+func TestSplitWithSplitKeyValidation(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	rules := newImportTestRewriteRules(1, 2)
+	ranges := []rtree.Range{
+		{StartKey: rowKey(1, 1), EndKey: rowKey(1, 10)},
+		{StartKey: rowKey(1, 10), EndKey: rowKey(1, 20)},
+	}
+
+	client := initTestClient()
+	splitter := restore.NewRegionSplitter(client)
+	splitter.EnableSplitKeyValidation()
+	err := splitter.Split(context.Background(), ranges, rules, func([][]byte) {})
+	require.NoError(t, err)
+
+	// table 3 has no rewrite rule, so its split key stays in the keyspace of the backup table.
+	ranges = append(ranges, rtree.Range{StartKey: rowKey(3, 1), EndKey: rowKey(3, 10)})
+	err = splitter.Split(context.Background(), ranges, rules, func([][]byte) {})
+	require.Error(t, err)
+	require.True(t, berrors.ErrRestoreInvalidRange.Equal(err))
+}
+
+func TestValidateSplitKeysOrder(t *testing.T) {
+	t.Parallel()
+	keys, err := restore.ValidateSplitKeysOrder([][]byte{[]byte("a"), []byte("b"), []byte("b"), []byte("c")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, keys)
+
+	_, err = restore.ValidateSplitKeysOrder([][]byte{[]byte("a"), []byte("c"), []byte("b")})
+	require.Error(t, err)
+	require.Regexp(t, "split key .* is less than the previous key", err.Error())
+}
+
+func TestValidateSplitKeysOrderWithComparator(t *testing.T) {
+	t.Parallel()
+	// the keys of an experimental encoding are ordered descending.
+	descending := func(a, b []byte) int { return bytes.Compare(b, a) }
+	keys, err := restore.ValidateSplitKeysOrderWithComparator(
+		[][]byte{[]byte("c"), []byte("b"), []byte("b"), []byte("a")}, descending)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("c"), []byte("b"), []byte("a")}, keys)
+
+	_, err = restore.ValidateSplitKeysOrderWithComparator([][]byte{[]byte("a"), []byte("b")}, descending)
+	require.Error(t, err)
+	require.Regexp(t, "split key .* is less than the previous key", err.Error())
+
+	// the splitter sorts the ranges by the comparator too, and splits the regions in the order.
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aae")},
+		{StartKey: []byte("aae"), EndKey: []byte("aaz")},
+	}
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetKeyComparator(descending)
+	err = splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("aaz"), []byte("aae")}, client.splitKeys)
+
+	// the prefixes are ordered descending, the keys of a prefix ascending, so the end key of
+	// a range crossing the prefixes is out of the order of the split keys.
+	prefixDescending := func(a, b []byte) int {
+		if c := bytes.Compare(b[:1], a[:1]); c != 0 {
+			return c
+		}
+		return bytes.Compare(a[1:], b[1:])
+	}
+	sorted, err := restore.SortRangesWithComparator([]rtree.Range{
+		{StartKey: []byte("a1"), EndKey: []byte("a5")},
+		{StartKey: []byte("b1"), EndKey: []byte("b2")},
+		{StartKey: []byte("b2"), EndKey: []byte("b5")},
+	}, nil, prefixDescending)
+	require.NoError(t, err)
+	require.Equal(t, []rtree.Range{
+		{StartKey: []byte("b1"), EndKey: []byte("b2")},
+		{StartKey: []byte("b2"), EndKey: []byte("b5")},
+		{StartKey: []byte("a1"), EndKey: []byte("a5")},
+	}, sorted)
+	splitter.SetKeyComparator(prefixDescending)
+	err = splitter.Split(context.Background(), []rtree.Range{
+		{StartKey: []byte("a1"), EndKey: []byte("b0")},
+		{StartKey: []byte("b1"), EndKey: []byte("b2")},
+	}, nil, func([][]byte) {})
+	require.Error(t, err)
+	require.Regexp(t, "split key .* is less than the previous key", err.Error())
+}
+
+func TestSplitSkipTailSplitKey(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	// the ranges of table 1 are split by two batches, the last range ends at the prefix of table 2.
+	batches := [][]rtree.Range{
+		{
+			{StartKey: rowKey(1, 0), EndKey: rowKey(1, 10)},
+			{StartKey: rowKey(1, 10), EndKey: rowKey(1, 20)},
+		},
+		{
+			{StartKey: rowKey(1, 20), EndKey: rowKey(1, 30)},
+			{StartKey: rowKey(1, 30), EndKey: tablecodec.EncodeTablePrefix(2)},
+		},
+	}
+	for _, skip := range []bool{false, true} {
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		if skip {
+			splitter.SkipTailSplitKey()
+		}
+		for _, ranges := range batches {
+			err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+			require.NoError(t, err)
+		}
+		expected := [][]byte{rowKey(1, 10), rowKey(1, 20), rowKey(1, 30)}
+		if !skip {
+			expected = append(expected, tablecodec.EncodeTablePrefix(2))
+		}
+		require.Equal(t, expected, client.splitKeys)
+	}
+}
+
+// region: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+func TestSplitBatchDelay(t *testing.T) {
+	t.Parallel()
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aab")},
+		{StartKey: []byte("bba"), EndKey: []byte("bbb")},
+		{StartKey: []byte("cca"), EndKey: []byte("ccb")},
+	}
+	const (
+		delay  = time.Second
+		jitter = 100 * time.Millisecond
+	)
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetSplitBatchDelay(delay, jitter)
+	// the fake clock only records the waiting.
+	var slept []time.Duration
+	splitter.SetSleepFunc(func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	})
+	err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][]byte{[]byte("aab"), []byte("bbb"), []byte("ccb")}, client.splitKeys)
+	// the keys are in 3 regions, so it waits between the 3 split batches.
+	require.Len(t, slept, 2)
+	for _, d := range slept {
+		require.GreaterOrEqual(t, d, delay)
+		require.Less(t, d, delay+jitter)
+	}
+
+	// it doesn't wait by default.
+	client = &recordSplitClient{TestClient: initTestClient()}
+	splitter = restore.NewRegionSplitter(client)
+	splitter.SetSleepFunc(func(ctx context.Context, d time.Duration) error {
+		t.Fatalf("unexpected waiting for %s", d)
+		return nil
+	})
+	err = splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+	require.NoError(t, err)
+	require.Len(t, client.splitKeys, 3)
+}
+
+func TestSplitPartiallySplitKeyspace(t *testing.T) {
+	t.Parallel()
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aab")},
+		{StartKey: []byte("aab"), EndKey: []byte("aac")},
+		{StartKey: []byte("aac"), EndKey: []byte("aad")},
+		{StartKey: []byte("aad"), EndKey: []byte("aae")},
+	}
+	// an interrupted restore has split at aab and aad.
+	keys := []string{"", "aab", "aad", ""}
+	regions := make(map[uint64]*restore.RegionInfo)
+	for i := uint64(1); i < uint64(len(keys)); i++ {
+		var startKey, endKey []byte
+		if len(keys[i-1]) != 0 {
+			startKey = codec.EncodeBytes([]byte{}, []byte(keys[i-1]))
+		}
+		if len(keys[i]) != 0 {
+			endKey = codec.EncodeBytes([]byte{}, []byte(keys[i]))
+		}
+		regions[i] = &restore.RegionInfo{
+			Region: &metapb.Region{
+				Id:       i,
+				Peers:    []*metapb.Peer{{Id: 1, StoreId: 1}},
+				StartKey: startKey,
+				EndKey:   endKey,
+			},
+		}
+	}
+	stores := map[uint64]*metapb.Store{1: {Id: 1}}
+	client := &recordSplitClient{TestClient: NewTestClient(stores, regions, uint64(len(keys)))}
+	splitter := restore.NewRegionSplitter(client)
+	var splitted [][]byte
+	err := splitter.Split(context.Background(), ranges, nil, func(keys [][]byte) {
+		splitted = append(splitted, keys...)
+	})
+	require.NoError(t, err)
+	// only the missing keys are split at.
+	require.Equal(t, [][]byte{[]byte("aac"), []byte("aae")}, client.splitKeys)
+	require.Equal(t, client.splitKeys, splitted)
+}
+
+// labelRecordClient records the region label rules.
+type labelRecordClient struct {
+	*TestClient
+	rules []*labeler.LabelRule
+}
+
+func (c *labelRecordClient) SetRegionLabelRule(ctx context.Context, rule *labeler.LabelRule) error {
+	c.rules = append(c.rules, rule)
+	return nil
+}
+
+func TestSplitWithRegionLabel(t *testing.T) {
+	t.Parallel()
+	client := &labelRecordClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	err := splitter.Split(context.Background(), initRanges(), nil, func([][]byte) {})
+	require.NoError(t, err)
+	// no labeling by default.
+	require.Empty(t, client.rules)
+
+	client = &labelRecordClient{TestClient: initTestClient()}
+	splitter = restore.NewRegionSplitter(client)
+	splitter.SetRegionLabel(restore.RestoreJobLabelKey, "job-1")
+	err = splitter.Split(context.Background(), initRanges(), nil, func([][]byte) {})
+	require.NoError(t, err)
+	require.NotEmpty(t, client.rules)
+	// a single rule is updated with the regions of every split request.
+	for _, rule := range client.rules {
+		require.Equal(t, restore.RestoreJobLabelKey+"-job-1", rule.ID)
+		require.Equal(t, labeler.KeyRange, rule.RuleType)
+		require.Equal(t, []labeler.RegionLabel{{Key: restore.RestoreJobLabelKey, Value: "job-1"}}, rule.Labels)
+	}
+	labeled := client.rules[len(client.rules)-1].Data.([]*labeler.KeyRangeRule)
+	covered := func(region *restore.RegionInfo) bool {
+		startKey, endKey := hex.EncodeToString(region.Region.StartKey), hex.EncodeToString(region.Region.EndKey)
+		for _, rg := range labeled {
+			if rg.StartKeyHex <= startKey && (rg.EndKeyHex == "" || (endKey != "" && endKey <= rg.EndKeyHex)) {
+				return true
+			}
+		}
+		return false
+	}
+	// every region created by splitting is labeled, the regions before splitting are not.
+	created := 0
+	for id, region := range client.GetAllRegions() {
+		require.Equal(t, id > 5, covered(region), "region %d", id)
+		if id > 5 {
+			created++
+		}
+	}
+	require.Equal(t, 4, created)
+	// the adjacent regions are merged into a key range.
+	require.Less(t, len(labeled), created)
+}
+
+// slowSplitClient takes the latencies in turn to split, by advancing the fake clock.
+type slowSplitClient struct {
+	*TestClient
+	clock     time.Time
+	latencies []time.Duration
+}
+
+func (c *slowSplitClient) BatchSplitRegions(
+	ctx context.Context, regionInfo *restore.RegionInfo, keys [][]byte,
+) ([]*restore.RegionInfo, error) {
+	c.clock = c.clock.Add(c.latencies[0])
+	c.latencies = c.latencies[1:]
+	return c.TestClient.BatchSplitRegions(ctx, regionInfo, keys)
+}
+
+func TestSplitWithPacer(t *testing.T) {
+	t.Parallel()
+	// a split key per region.
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aab")},
+		{StartKey: []byte("baa"), EndKey: []byte("bab")},
+		{StartKey: []byte("bba"), EndKey: []byte("bbb")},
+		{StartKey: []byte("bbx"), EndKey: []byte("bbz")},
+		{StartKey: []byte("cca"), EndKey: []byte("ccb")},
+	}
+	client := &slowSplitClient{
+		TestClient: initTestClient(),
+		latencies: []time.Duration{
+			50 * time.Millisecond, 50 * time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond,
+		},
+	}
+	splitter := restore.NewRegionSplitter(client)
+	var delays []time.Duration
+	splitter.SetSleepFunc(func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	})
+	splitter.SetNowFunc(func() time.Time { return client.clock })
+	pacer := restore.NewSplitPacer(10*time.Millisecond, time.Second)
+	splitter.SetSplitPacer(pacer)
+	err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+	require.NoError(t, err)
+	require.Empty(t, client.latencies)
+	// backs off while slow, and speeds up once recovered.
+	require.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond}, delays)
+	require.Equal(t, time.Duration(0), pacer.Delay())
+}
+
+// region: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+func TestSplitOrder(t *testing.T) {
+	t.Parallel()
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aab")},
+		{StartKey: []byte("aab"), EndKey: []byte("aac")},
+		{StartKey: []byte("baa"), EndKey: []byte("bab")},
+		{StartKey: []byte("bba"), EndKey: []byte("bbb")},
+		{StartKey: []byte("bbx"), EndKey: []byte("bbz")},
+		{StartKey: []byte("cca"), EndKey: []byte("ccb")},
+	}
+	keys := func(ks ...string) [][]byte {
+		res := make([][]byte, 0, len(ks))
+		for _, k := range ks {
+			res = append(res, []byte(k))
+		}
+		return res
+	}
+	cases := []struct {
+		order    restore.SplitOrder
+		expected [][]byte
+	}{
+		// ascending by default.
+		{"", keys("aab", "aac", "bab", "bbb", "bbz", "ccb")},
+		{restore.SplitOrderAscending, keys("aab", "aac", "bab", "bbb", "bbz", "ccb")},
+		// the keys in the same region are always ascending.
+		{restore.SplitOrderDescending, keys("ccb", "bbz", "bbb", "bab", "aab", "aac")},
+		{restore.SplitOrderLargestGapFirst, keys("bbb", "bab", "ccb", "aab", "aac", "bbz")},
+	}
+	for _, ca := range cases {
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		splitter.SetSplitOrder(ca.order)
+		err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+		require.NoError(t, err)
+		require.Equal(t, ca.expected, client.splitKeys, "order %s", ca.order)
+	}
+
+	order, err := restore.ParseSplitOrder("largest-gap-first")
+	require.NoError(t, err)
+	require.Equal(t, restore.SplitOrderLargestGapFirst, order)
+	_, err = restore.ParseSplitOrder("random")
+	require.Error(t, err)
+}
+
+// region: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+func TestSplitByRegionTemplate(t *testing.T) {
+	t.Parallel()
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aae")},
+		{StartKey: []byte("aae"), EndKey: []byte("bbb")},
+	}
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	// "aay" is a region boundary already, "ccc" is out of the ranges.
+	splitter.SetRegionTemplate([][]byte{[]byte("aac"), []byte("aay"), []byte("bbb"), []byte("ccc")})
+	err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+	require.NoError(t, err)
+	// the end keys of the ranges are ignored, except the ones in the template.
+	require.ElementsMatch(t, [][]byte{[]byte("aac"), []byte("bbb")}, client.splitKeys)
+}
+
+func TestSplitOnTableStart(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	ranges := []rtree.Range{
+		{StartKey: rowKey(1, 0), EndKey: rowKey(1, 10)},
+		{StartKey: rowKey(1, 10), EndKey: rowKey(1, 20)},
+		{StartKey: rowKey(2, 5), EndKey: rowKey(2, 10)},
+		// the start key is the same as the boundary of the table.
+		{StartKey: tablecodec.EncodeTablePrefix(3), EndKey: rowKey(3, 10)},
+	}
+	endKeys := [][]byte{rowKey(1, 10), rowKey(1, 20), rowKey(2, 10), rowKey(3, 10)}
+	cases := []struct {
+		onTableStart    bool
+		onTableBoundary bool
+		expected        [][]byte
+	}{
+		{false, false, endKeys},
+		{true, false, [][]byte{
+			rowKey(1, 0), rowKey(1, 10), rowKey(1, 20), rowKey(2, 5), rowKey(2, 10),
+			tablecodec.EncodeTablePrefix(3), rowKey(3, 10),
+		}},
+		{true, true, [][]byte{
+			rowKey(1, 0), rowKey(1, 10), rowKey(1, 20), tablecodec.EncodeTablePrefix(2), rowKey(2, 5), rowKey(2, 10),
+			tablecodec.EncodeTablePrefix(3), rowKey(3, 10),
+		}},
+	}
+	for _, cs := range cases {
+		// region: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, ), the keys are all in the last one.
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		if cs.onTableStart {
+			splitter.EnableSplitOnTableStart()
+		}
+		if cs.onTableBoundary {
+			splitter.EnableSplitOnTableBoundary()
+		}
+		err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+		require.NoError(t, err)
+		require.Equal(t, cs.expected, client.splitKeys, "case %+v", cs)
+	}
+}
+
+func TestSplitMinRegions(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	// a small table of 3 regions, restored into a cluster of 8 stores.
+	ranges := []rtree.Range{
+		{StartKey: rowKey(1, 0), EndKey: rowKey(1, 10)},
+		{StartKey: rowKey(1, 10), EndKey: rowKey(1, 20)},
+	}
+	split := func(minRegions int) ([][]byte, int64) {
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		splitter.SetMinRegions(minRegions)
+		err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+		require.NoError(t, err)
+		return client.splitKeys, splitter.InjectedSplitKeyCount()
+	}
+
+	keys, injected := split(8 * 2)
+	require.Len(t, keys, 15)
+	require.Equal(t, int64(13), injected)
+	for i, key := range keys {
+		require.True(t, bytes.Compare(key, rowKey(1, 0)) > 0, "key %x", key)
+		require.True(t, bytes.Compare(key, rowKey(1, 20)) <= 0, "key %x", key)
+		if i > 0 {
+			require.True(t, bytes.Compare(keys[i-1], key) < 0, "keys %x and %x", keys[i-1], key)
+		}
+	}
+	// the end keys of the ranges are kept, the first range takes the extra key.
+	require.Equal(t, rowKey(1, 10), keys[7])
+	require.Equal(t, rowKey(1, 20), keys[14])
+	// the injected keys are deterministic.
+	again, _ := split(8 * 2)
+	require.Equal(t, keys, again)
+
+	// no injecting if the ranges produce enough regions.
+	keys, injected = split(3)
+	require.Equal(t, [][]byte{rowKey(1, 10), rowKey(1, 20)}, keys)
+	require.Equal(t, int64(0), injected)
+
+	// the split keys of a table are counted across the calls, i.e. the restore batches,
+	// so the keys are only injected into the batch where the table falls short.
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetMinRegions(4)
+	require.NoError(t, splitter.Split(context.Background(), ranges[:1], nil, func([][]byte) {}))
+	require.Len(t, client.splitKeys, 3)
+	require.Equal(t, int64(2), splitter.InjectedSplitKeyCount())
+	require.NoError(t, splitter.Split(context.Background(), ranges[1:], nil, func([][]byte) {}))
+	require.Len(t, client.splitKeys, 4)
+	require.Equal(t, rowKey(1, 20), client.splitKeys[3])
+	require.Equal(t, int64(2), splitter.InjectedSplitKeyCount())
+
+	// every table of a batch gets the min regions on its own.
+	client = &recordSplitClient{TestClient: initTestClient()}
+	splitter = restore.NewRegionSplitter(client)
+	splitter.SetMinRegions(3)
+	err := splitter.Split(context.Background(), []rtree.Range{
+		{StartKey: rowKey(1, 0), EndKey: rowKey(1, 10)},
+		{StartKey: rowKey(2, 0), EndKey: rowKey(2, 10)},
+	}, nil, func([][]byte) {})
+	require.NoError(t, err)
+	require.Len(t, client.splitKeys, 4)
+	require.Equal(t, int64(2), splitter.InjectedSplitKeyCount())
+	for i, key := range client.splitKeys {
+		require.Equal(t, int64(1+i/2), tablecodec.DecodeTableID(key), "key %x", key)
+	}
+}
+
+func TestSplitOversizedFiles(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	file := func(start, end int64, size uint64) *backuppb.File {
+		return &backuppb.File{Name: "1.sst", StartKey: rowKey(1, start), EndKey: rowKey(1, end), TotalBytes: size, TotalKvs: 1}
+	}
+	// the file of the second range takes 3.5 times the max size of a region.
+	ranges := []rtree.Range{
+		{StartKey: rowKey(1, 0), EndKey: rowKey(1, 10), Files: []*backuppb.File{file(0, 10, 100)}},
+		{StartKey: rowKey(1, 10), EndKey: rowKey(1, 20), Files: []*backuppb.File{file(10, 20, 350)}},
+	}
+	split := func(ranges []rtree.Range, regionMaxSize uint64) ([][]byte, int64, error) {
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		splitter.SetRegionMaxSize(regionMaxSize)
+		err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+		return client.splitKeys, splitter.InjectedSplitKeyCount(), err
+	}
+
+	keys, injected, err := split(ranges, 100)
+	require.NoError(t, err)
+	require.Len(t, keys, 5)
+	require.Equal(t, int64(3), injected)
+	require.Equal(t, rowKey(1, 10), keys[0])
+	require.Equal(t, rowKey(1, 20), keys[4])
+	for i := 1; i < 4; i++ {
+		require.True(t, bytes.Compare(keys[i-1], keys[i]) < 0, "keys %x and %x", keys[i-1], keys[i])
+		require.True(t, bytes.Compare(keys[i], rowKey(1, 20)) < 0, "key %x", keys[i])
+	}
+
+	// no injecting without the max size, or if the files fit in a region.
+	for _, size := range []uint64{0, 350} {
+		keys, injected, err = split(ranges, size)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{rowKey(1, 10), rowKey(1, 20)}, keys)
+		require.Equal(t, int64(0), injected)
+	}
+
+	// the merged range of small files isn't oversized, like before merging.
+	merged := []rtree.Range{{StartKey: rowKey(1, 0), EndKey: rowKey(1, 20), Files: []*backuppb.File{
+		file(0, 10, 100), file(10, 20, 100),
+	}}}
+	keys, injected, err = split(merged, 100)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{rowKey(1, 20)}, keys)
+	require.Equal(t, int64(0), injected)
+
+	// the keys of an oversized file without the end key can't be spaced.
+	unbounded := file(10, 20, 350)
+	unbounded.EndKey = nil
+	_, _, err = split([]rtree.Range{{StartKey: rowKey(1, 10), EndKey: rowKey(1, 20), Files: []*backuppb.File{unbounded}}}, 100)
+	require.Error(t, err)
+	require.Regexp(t, "distribution of the keys of them is unknown", err.Error())
+}
+
+func TestSplitMinKeyDistance(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	// the ranges end at the handles 10, 11, 20, 22, 23 and 40.
+	var ranges []rtree.Range
+	start := int64(0)
+	for _, end := range []int64{10, 11, 20, 22, 23, 40} {
+		ranges = append(ranges, rtree.Range{StartKey: rowKey(1, start), EndKey: rowKey(1, end)})
+		start = end
+	}
+	split := func(distance uint64) [][]byte {
+		client := &recordSplitClient{TestClient: initTestClient()}
+		splitter := restore.NewRegionSplitter(client)
+		splitter.SetMinSplitKeyDistance(distance)
+		err := splitter.Split(context.Background(), ranges, nil, func([][]byte) {})
+		require.NoError(t, err)
+		return client.splitKeys
+	}
+
+	// the distance is to the previous key kept, so 23 is skipped as close to 20, not to 22.
+	expected := [][]byte{rowKey(1, 10), rowKey(1, 20), rowKey(1, 40)}
+	require.Equal(t, expected, split(5))
+	// the skipping is deterministic.
+	require.Equal(t, expected, split(5))
+	require.Equal(t, [][]byte{rowKey(1, 10), rowKey(1, 20), rowKey(1, 22), rowKey(1, 40)}, split(2))
+	// every key is kept without the min distance.
+	require.Len(t, split(0), len(ranges))
+
+	// the keys are kept across the calls, i.e. the batches of a restore.
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetMinSplitKeyDistance(5)
+	require.NoError(t, splitter.Split(context.Background(), ranges[:3], nil, func([][]byte) {}))
+	require.NoError(t, splitter.Split(context.Background(), ranges[3:], nil, func([][]byte) {}))
+	require.Equal(t, expected, client.splitKeys)
+
+	// the keys injected aren't skipped, only the keys of the ranges are.
+	client = &recordSplitClient{TestClient: initTestClient()}
+	splitter = restore.NewRegionSplitter(client)
+	splitter.SetMinSplitKeyDistance(1000)
+	splitter.SetMinRegions(4)
+	require.NoError(t, splitter.Split(context.Background(), ranges, nil, func([][]byte) {}))
+	require.Equal(t, int64(2), splitter.InjectedSplitKeyCount())
+	require.Len(t, client.splitKeys, 3)
+	require.Contains(t, client.splitKeys, rowKey(1, 10))
+
+	// the distance is measured within a table or an index, the keys of the others are never close.
+	indexKey := func(tableID, indexID int64, value byte) []byte {
+		return append(tablecodec.EncodeTableIndexPrefix(tableID, indexID), value)
+	}
+	keys := [][]byte{
+		rowKey(1, 10), rowKey(1, 12), indexKey(2, 1, 1), indexKey(2, 1, 2), indexKey(2, 2, 2), rowKey(2, 10),
+	}
+	ranges = ranges[:0]
+	for i := range keys[1:] {
+		ranges = append(ranges, rtree.Range{StartKey: keys[i], EndKey: keys[i+1]})
+	}
+	ranges = append([]rtree.Range{{StartKey: rowKey(1, 0), EndKey: keys[0]}}, ranges...)
+	require.Equal(t, [][]byte{rowKey(1, 10), indexKey(2, 1, 1), indexKey(2, 2, 2), rowKey(2, 10)}, split(5))
+}
+
+func TestSplitTailBeyondRanges(t *testing.T) {
+	t.Parallel()
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	// a region starts beyond the range, at the handle 21 of the table.
+	peers := []*metapb.Peer{{Id: 1, StoreId: 1}}
+	boundary := codec.EncodeBytes([]byte{}, rowKey(101, 21))
+	regions := map[uint64]*restore.RegionInfo{
+		1: {Region: &metapb.Region{Id: 1, Peers: peers, EndKey: boundary}},
+		2: {Region: &metapb.Region{Id: 2, Peers: peers, StartKey: boundary}},
+	}
+	stores := map[uint64]*metapb.Store{1: {Id: 1}}
+	client := &recordSplitClient{TestClient: NewTestClient(stores, regions, 3)}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetTailSplit(restore.TailSplitConfig{Keys: 2, HandleStep: 3},
+		[]restore.CreatedTable{newTestIntPKCreatedTable(1, 101, mysql.AutoIncrementFlag)})
+	ranges := []rtree.Range{{StartKey: rowKey(101, 10), EndKey: rowKey(101, 20)}}
+	require.NoError(t, splitter.Split(context.Background(), ranges, nil, func([][]byte) {}))
+	// the keys of the tail are split in the region beyond the range as well.
+	sort.Slice(client.splitKeys, func(i, j int) bool { return bytes.Compare(client.splitKeys[i], client.splitKeys[j]) < 0 })
+	require.Equal(t, [][]byte{rowKey(101, 20), rowKey(101, 23), rowKey(101, 26)}, client.splitKeys)
+}
+
+func TestSplitRawRangesWithUnboundedEndKey(t *testing.T) {
+	t.Parallel()
+	// the raw restore of [aaa, ) passes an empty end key.
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aae")},
+		{StartKey: []byte("aae"), EndKey: []byte{}},
+	}
+	client := &recordSplitClient{TestClient: initTestClient()}
+	splitter := restore.NewRegionSplitter(client)
+	err := splitter.Split(context.Background(), ranges, &restore.RewriteRules{}, func([][]byte) {})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("aae")}, client.splitKeys)
+}
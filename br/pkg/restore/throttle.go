@@ -0,0 +1,441 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/br/pkg/conn"
+	"github.com/pingcap/tidb/br/pkg/pdutil"
+	"go.uber.org/zap"
+)
+
+// DiskUsageSource reports the disk usage of the stores.
+type DiskUsageSource interface {
+	// MaxDiskUsage returns the largest ratio of the used disk to the capacity among the stores.
+	MaxDiskUsage(ctx context.Context) (float64, error)
+}
+
+type pdDiskUsageSource struct {
+	pd *pdutil.PdController
+}
+
+// NewPDDiskUsageSource returns a DiskUsageSource reading the capacity of the TiKV stores from PD.
+func NewPDDiskUsageSource(pd *pdutil.PdController) DiskUsageSource {
+	return pdDiskUsageSource{pd: pd}
+}
+
+func (s pdDiskUsageSource) MaxDiskUsage(ctx context.Context) (float64, error) {
+	stores, err := conn.GetAllTiKVStores(ctx, s.pd.GetPDClient(), conn.SkipTiFlash)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	maxUsage := 0.0
+	for _, store := range stores {
+		info, err := s.pd.GetStoreInfo(ctx, store.GetId())
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		capacity := float64(info.Status.Capacity)
+		if capacity == 0 {
+			continue
+		}
+		if usage := 1 - float64(info.Status.Available)/capacity; usage > maxUsage {
+			maxUsage = usage
+		}
+	}
+	return maxUsage, nil
+}
+
+// ClusterCapacitySource reports the disk capacity of the cluster.
+type ClusterCapacitySource interface {
+	// ClusterCapacity returns the total capacity and the available bytes of the stores.
+	ClusterCapacity(ctx context.Context) (capacity, available uint64, err error)
+	// MaxReplicas returns the count of the replicas of every region, each taking the disk.
+	MaxReplicas(ctx context.Context) (int, error)
+}
+
+// NewPDClusterCapacitySource returns a ClusterCapacitySource reading the capacity of the TiKV stores from PD.
+func NewPDClusterCapacitySource(pd *pdutil.PdController) ClusterCapacitySource {
+	return pdDiskUsageSource{pd: pd}
+}
+
+func (s pdDiskUsageSource) ClusterCapacity(ctx context.Context) (capacity, available uint64, err error) {
+	stores, err := conn.GetAllTiKVStores(ctx, s.pd.GetPDClient(), conn.SkipTiFlash)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	for _, store := range stores {
+		info, err := s.pd.GetStoreInfo(ctx, store.GetId())
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		capacity += uint64(info.Status.Capacity)
+		available += uint64(info.Status.Available)
+	}
+	return capacity, available, nil
+}
+
+func (s pdDiskUsageSource) MaxReplicas(ctx context.Context) (int, error) {
+	replicas, err := s.pd.GetMaxReplicas(ctx)
+	return replicas, errors.Trace(err)
+}
+
+// RegionCountSource reports the count of the regions of the cluster and its limit.
+type RegionCountSource interface {
+	// RegionCount returns the count of the regions in the cluster now.
+	RegionCount(ctx context.Context) (int, error)
+	// MaxRegionCount returns the count of the regions the cluster allows at most, 0 means unlimited.
+	MaxRegionCount(ctx context.Context) (int, error)
+}
+
+type pdRegionCountSource struct {
+	pd             *pdutil.PdController
+	maxRegionCount int
+}
+
+// NewPDRegionCountSource returns a RegionCountSource reading the count of the regions from PD.
+// PD has no config of the max count of regions, so the max count is given.
+func NewPDRegionCountSource(pd *pdutil.PdController, maxRegionCount int) RegionCountSource {
+	return pdRegionCountSource{pd: pd, maxRegionCount: maxRegionCount}
+}
+
+func (s pdRegionCountSource) RegionCount(ctx context.Context) (int, error) {
+	count, err := s.pd.GetRegionCount(ctx, []byte{}, []byte{})
+	return count, errors.Trace(err)
+}
+
+func (s pdRegionCountSource) MaxRegionCount(context.Context) (int, error) {
+	return s.maxRegionCount, nil
+}
+
+// IngestThrottleConfig is the configuration of IngestThrottle.
+type IngestThrottleConfig struct {
+	// HighDiskUsage is the disk usage at or above which the concurrency is halved.
+	HighDiskUsage float64
+	// LowDiskUsage is the disk usage at or below which the concurrency grows by one.
+	LowDiskUsage float64
+	// MinConcurrency and MaxConcurrency are the bounds of the concurrency, 0 means 1.
+	MinConcurrency int
+	MaxConcurrency int
+	// CheckInterval is how often the disk usage is checked, 0 means on every acquiring.
+	CheckInterval time.Duration
+}
+
+// IngestThrottle limits the count of in-flight ingests by the disk usage of the stores,
+// so restoring doesn't fill the disks up and cause write stalls.
+type IngestThrottle struct {
+	source DiskUsageSource
+	cfg    IngestThrottleConfig
+
+	mu        sync.Mutex
+	limit     int
+	inFlight  int
+	checking  bool
+	lastCheck time.Time
+	// released is closed and replaced once an ingest is released or the limit changes.
+	released chan struct{}
+}
+
+// NewIngestThrottle returns a throttle starting at the max concurrency.
+func NewIngestThrottle(source DiskUsageSource, cfg IngestThrottleConfig) *IngestThrottle {
+	if cfg.MinConcurrency <= 0 {
+		cfg.MinConcurrency = 1
+	}
+	if cfg.MaxConcurrency < cfg.MinConcurrency {
+		cfg.MaxConcurrency = cfg.MinConcurrency
+	}
+	return &IngestThrottle{
+		source:   source,
+		cfg:      cfg,
+		limit:    cfg.MaxConcurrency,
+		released: make(chan struct{}),
+	}
+}
+
+// Limit returns the current concurrency of ingesting.
+func (th *IngestThrottle) Limit() int {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.limit
+}
+
+// Acquire blocks until an ingest is allowed, each successful Acquire must be paired with a Release.
+func (th *IngestThrottle) Acquire(ctx context.Context) error {
+	th.check(ctx)
+	for {
+		th.mu.Lock()
+		if th.inFlight < th.limit {
+			th.inFlight++
+			th.mu.Unlock()
+			return nil
+		}
+		released := th.released
+		th.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-released:
+		}
+	}
+}
+
+// Release releases an ingest allowed by Acquire.
+func (th *IngestThrottle) Release() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.inFlight--
+	th.notifyLocked()
+}
+
+func (th *IngestThrottle) notifyLocked() {
+	close(th.released)
+	th.released = make(chan struct{})
+}
+
+// check adjusts the limit by the disk usage if the check interval is elapsed.
+func (th *IngestThrottle) check(ctx context.Context) {
+	th.mu.Lock()
+	if th.checking || time.Since(th.lastCheck) < th.cfg.CheckInterval {
+		th.mu.Unlock()
+		return
+	}
+	th.checking = true
+	th.mu.Unlock()
+
+	usage, err := th.source.MaxDiskUsage(ctx)
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.checking = false
+	th.lastCheck = time.Now()
+	if err != nil {
+		log.Warn("failed to get disk usage of stores, keep the ingest concurrency",
+			zap.Int("concurrency", th.limit), zap.Error(err))
+		return
+	}
+	limit := th.limit
+	switch {
+	case usage >= th.cfg.HighDiskUsage:
+		limit /= 2
+		if limit < th.cfg.MinConcurrency {
+			limit = th.cfg.MinConcurrency
+		}
+	case usage <= th.cfg.LowDiskUsage:
+		if limit < th.cfg.MaxConcurrency {
+			limit++
+		}
+	}
+	if limit != th.limit {
+		log.Info("adjust ingest concurrency by disk usage",
+			zap.Float64("disk usage", usage),
+			zap.Int("from", th.limit),
+			zap.Int("to", limit))
+		th.limit = limit
+		th.notifyLocked()
+	}
+}
+
+// SplitPacer adapts the delay between the split requests to the latency of them, so splitting
+// backs off while PD and TiKV are struggling, and speeds up again once they recover. The split
+// keys are the same whatever the delay is. It's shared by the splitters of a restore.
+type SplitPacer struct {
+	// latencyThreshold is the latency of a split request above which the delay is doubled.
+	latencyThreshold time.Duration
+	// maxDelay caps the delay.
+	maxDelay time.Duration
+
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+// NewSplitPacer returns a SplitPacer, whose delay starts from the latency threshold once a split
+// request takes longer than the threshold, doubles on every slow request up to the max delay,
+// and halves on every fast request, down to no delay.
+func NewSplitPacer(latencyThreshold, maxDelay time.Duration) *SplitPacer {
+	if maxDelay < latencyThreshold {
+		maxDelay = latencyThreshold
+	}
+	return &SplitPacer{latencyThreshold: latencyThreshold, maxDelay: maxDelay}
+}
+
+// Delay returns the current delay before a split request.
+func (p *SplitPacer) Delay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.delay
+}
+
+// Observe adjusts the delay by the latency of a split request.
+func (p *SplitPacer) Observe(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delay := p.delay
+	switch {
+	case latency > p.latencyThreshold:
+		delay *= 2
+		if delay < p.latencyThreshold {
+			delay = p.latencyThreshold
+		}
+		if delay > p.maxDelay {
+			delay = p.maxDelay
+		}
+	case delay > 0:
+		delay /= 2
+		if delay < p.latencyThreshold {
+			delay = 0
+		}
+	}
+	if delay != p.delay {
+		log.Info("adjust split delay by latency",
+			zap.Duration("latency", latency),
+			zap.Duration("from", p.delay),
+			zap.Duration("to", delay))
+		p.delay = delay
+	}
+}
+
+// BandwidthLimiter is a token bucket of bytes shared by all the in-flight ingests,
+// so the total bandwidth of restoring stays under the budget however many groups
+// of files are restored concurrently. The bucket holds at most one second of budget.
+type BandwidthLimiter struct {
+	bytesPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter of the bytes per second, the bucket starts full.
+func NewBandwidthLimiter(bytesPerSecond uint64) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		tokens:         float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// Wait blocks until the bytes are allowed by the budget. The bytes larger than the
+// bucket are allowed by borrowing from the future, so the later waiters wait longer.
+func (l *BandwidthLimiter) Wait(ctx context.Context, bytes uint64) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	if l.tokens > l.bytesPerSecond {
+		l.tokens = l.bytesPerSecond
+	}
+	l.last = now
+	l.tokens -= float64(bytes)
+	wait := time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	return errors.Trace(sleepWithContext(ctx, wait))
+}
+
+// tableLimiter limits the count of the tables whose files are restored concurrently,
+// the files of a table already in flight are always allowed.
+type tableLimiter struct {
+	maxTables int
+
+	mu sync.Mutex
+	// inFlight is the count of the groups in flight by the table.
+	inFlight map[int64]int
+	// released is closed and replaced once a table has no groups in flight.
+	released chan struct{}
+}
+
+func newTableLimiter(maxTables int) *tableLimiter {
+	return &tableLimiter{
+		maxTables: maxTables,
+		inFlight:  make(map[int64]int),
+		released:  make(chan struct{}),
+	}
+}
+
+// acquire blocks until a group of the table is allowed, each successful acquire must be paired with a release.
+func (l *tableLimiter) acquire(ctx context.Context, tableID int64) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight[tableID] > 0 || len(l.inFlight) < l.maxTables {
+			l.inFlight[tableID]++
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-released:
+		}
+	}
+}
+
+// release releases a group of the table allowed by acquire.
+func (l *tableLimiter) release(tableID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight[tableID]--
+	if l.inFlight[tableID] == 0 {
+		delete(l.inFlight, tableID)
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+}
+
+// bytesLimiter limits the total bytes of the groups of files in flight, a group exceeding
+// the limit alone is allowed once no group is in flight, so it doesn't block forever.
+type bytesLimiter struct {
+	maxBytes uint64
+
+	mu sync.Mutex
+	// inFlight is the total bytes of the groups in flight.
+	inFlight uint64
+	// released is closed and replaced once the bytes of any group are released.
+	released chan struct{}
+}
+
+func newBytesLimiter(maxBytes uint64) *bytesLimiter {
+	return &bytesLimiter{
+		maxBytes: maxBytes,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire blocks until a group of the bytes is allowed, each successful acquire must be paired with a release.
+func (l *bytesLimiter) acquire(ctx context.Context, bytes uint64) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight == 0 || l.inFlight+bytes <= l.maxBytes {
+			l.inFlight += bytes
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-released:
+		}
+	}
+}
+
+// release releases a group of the bytes allowed by acquire.
+func (l *bytesLimiter) release(bytes uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight -= bytes
+	close(l.released)
+	l.released = make(chan struct{})
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDiskUsageSource reports the disk usages in order, and keeps reporting the last one.
+type fakeDiskUsageSource struct {
+	mu     sync.Mutex
+	usages []float64
+	err    error
+}
+
+func (s *fakeDiskUsageSource) MaxDiskUsage(context.Context) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	usage := s.usages[0]
+	if len(s.usages) > 1 {
+		s.usages = s.usages[1:]
+	}
+	return usage, nil
+}
+
+func TestIngestThrottle(t *testing.T) {
+	source := &fakeDiskUsageSource{usages: []float64{0.9, 0.85, 0.5, 0.2, 0.2, 0.9, 0.1}}
+	throttle := restore.NewIngestThrottle(source, restore.IngestThrottleConfig{
+		HighDiskUsage:  0.8,
+		LowDiskUsage:   0.3,
+		MinConcurrency: 2,
+		MaxConcurrency: 8,
+	})
+	require.Equal(t, 8, throttle.Limit())
+
+	ctx := context.Background()
+	limits := []int{}
+	for i := 0; i < 7; i++ {
+		require.NoError(t, throttle.Acquire(ctx))
+		throttle.Release()
+		limits = append(limits, throttle.Limit())
+	}
+	// halved at high usage but never below the min, grows by one at low usage.
+	require.Equal(t, []int{4, 2, 2, 3, 4, 2, 3}, limits)
+
+	// the limit is kept on error.
+	source.err = errors.New("pd is unavailable")
+	require.NoError(t, throttle.Acquire(ctx))
+	throttle.Release()
+	require.Equal(t, 3, throttle.Limit())
+}
+
+func TestIngestThrottleBlocks(t *testing.T) {
+	source := &fakeDiskUsageSource{usages: []float64{0.9}}
+	throttle := restore.NewIngestThrottle(source, restore.IngestThrottleConfig{
+		HighDiskUsage:  0.8,
+		LowDiskUsage:   0.3,
+		MaxConcurrency: 1,
+	})
+
+	ctx := context.Background()
+	require.NoError(t, throttle.Acquire(ctx))
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, context.Canceled, errors.Cause(throttle.Acquire(canceledCtx)))
+
+	acquired := make(chan struct{})
+	go func() {
+		require.NoError(t, throttle.Acquire(ctx))
+		close(acquired)
+	}()
+	throttle.Release()
+	<-acquired
+	throttle.Release()
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := restore.NewBandwidthLimiter(1000)
+	ctx := context.Background()
+	start := time.Now()
+	// the bucket starts full.
+	require.NoError(t, limiter.Wait(ctx, 1000))
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	// then the bytes are allowed by the rate.
+	require.NoError(t, limiter.Wait(ctx, 500))
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	// the waiting is cancelled with the context.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, limiter.Wait(cctx, 1000))
+}
+
+type fakeClusterCapacitySource struct {
+	capacity, available uint64
+	replicas            int
+}
+
+func (s fakeClusterCapacitySource) ClusterCapacity(context.Context) (uint64, uint64, error) {
+	return s.capacity, s.available, nil
+}
+
+func (s fakeClusterCapacitySource) MaxReplicas(context.Context) (int, error) {
+	return s.replicas, nil
+}
+
+type fakeRegionCountSource struct {
+	count, maxCount int
+}
+
+func (s fakeRegionCountSource) RegionCount(context.Context) (int, error) {
+	return s.count, nil
+}
+
+func (s fakeRegionCountSource) MaxRegionCount(context.Context) (int, error) {
+	return s.maxCount, nil
+}
+
+func TestSplitPacer(t *testing.T) {
+	t.Parallel()
+	pacer := restore.NewSplitPacer(10*time.Millisecond, 30*time.Millisecond)
+	require.Equal(t, time.Duration(0), pacer.Delay())
+	pacer.Observe(5 * time.Millisecond)
+	require.Equal(t, time.Duration(0), pacer.Delay())
+
+	// doubles from the threshold up to the max delay while slow.
+	for _, expected := range []time.Duration{10, 20, 30, 30} {
+		pacer.Observe(time.Second)
+		require.Equal(t, expected*time.Millisecond, pacer.Delay())
+	}
+	// halves down to no delay once recovered.
+	for _, expected := range []time.Duration{15, 0, 0} {
+		pacer.Observe(time.Millisecond)
+		require.Equal(t, expected*time.Millisecond, pacer.Delay())
+	}
+}
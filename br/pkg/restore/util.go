@@ -7,9 +7,11 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql" // mysql driver
+	"github.com/google/btree"
 	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/brpb"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
@@ -18,11 +20,13 @@ import (
 	berrors "github.com/pingcap/tidb/br/pkg/errors"
 	"github.com/pingcap/tidb/br/pkg/glue"
 	"github.com/pingcap/tidb/br/pkg/logutil"
+	"github.com/pingcap/tidb/br/pkg/metautil"
 	"github.com/pingcap/tidb/br/pkg/rtree"
 	"github.com/pingcap/tidb/br/pkg/utils"
 	"github.com/pingcap/tidb/parser/model"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -186,19 +190,55 @@ func MapTableToFiles(files []*backuppb.File) map[int64][]*backuppb.File {
 }
 
 // GoValidateFileRanges validate files by a stream of tables and yields
-// tables with range.
+// tables with range. The zero thresholds of mergeCfg fall back to the default values.
+// With mergeCfg.MemoryBudgetBytes, the ranges merged but not taken from the returned
+// channel yet are bounded by the budget, merging waits for the consumer once it's exceeded.
+// With mergeCfg.GroupSkewRatio, it warns once all tables are merged if the sizes of
+// the tables are skewed.
 func GoValidateFileRanges(
 	ctx context.Context,
 	tableStream <-chan CreatedTable,
 	fileOfTable map[int64][]*backuppb.File,
-	splitSizeBytes, splitKeyCount uint64,
+	mergeCfg MergeConfig,
 	errCh chan<- error,
 ) <-chan TableWithRange {
+	mergeCfg.adjustAndLog()
 	// Could we have a smaller outCh size?
 	outCh := make(chan TableWithRange, len(fileOfTable))
+	send := func(t TableWithRange) bool {
+		outCh <- t
+		return true
+	}
+	var mergedCh chan TableWithRange
+	if mergeCfg.MemoryBudgetBytes > 0 {
+		mergedCh, outCh = outCh, make(chan TableWithRange)
+		limiter := newBytesLimiter(mergeCfg.MemoryBudgetBytes)
+		send = func(t TableWithRange) bool {
+			if err := limiter.acquire(ctx, rangesMemSize(t.Range)); err != nil {
+				errCh <- err
+				return false
+			}
+			mergedCh <- t
+			return true
+		}
+		go forwardRangesInBudget(ctx, mergedCh, outCh, limiter, errCh)
+	}
 	go func() {
-		defer close(outCh)
+		if mergedCh != nil {
+			defer close(mergedCh)
+		} else {
+			defer close(outCh)
+		}
 		defer log.Info("all range generated")
+		small := &smallTablesMergeStat{}
+		defer small.log()
+		keyspaces := newRewriteKeyspaces()
+		// the errors and the tables held back until the end on CollectAllErrors.
+		var errs error
+		var pending []TableWithRange
+		pendingMemSize := uint64(0)
+		// the sizes of the tables yielded, for checking the skew.
+		var sizes []uint64
 		for {
 			select {
 			case <-ctx.Done():
@@ -206,62 +246,242 @@ func GoValidateFileRanges(
 				return
 			case t, ok := <-tableStream:
 				if !ok {
+					if errs != nil {
+						logCollectedErrors(errs, mergeCfg)
+						errCh <- errs
+						return
+					}
+					for _, tableWithRange := range pending {
+						if !send(tableWithRange) {
+							return
+						}
+					}
+					if mergeCfg.GroupSkewRatio > 0 {
+						logSkewedFileGroups(fileGroupsSizeStatOf(sizes), mergeCfg.GroupSkewRatio)
+					}
 					return
 				}
-				files := fileOfTable[t.OldTable.Info.ID]
-				if partitions := t.OldTable.Info.Partition; partitions != nil {
-					log.Debug("table partition",
-						zap.Stringer("database", t.OldTable.DB.Name),
-						zap.Stringer("table", t.Table.Name),
-						zap.Any("partition info", partitions),
-					)
-					for _, partition := range partitions.Definitions {
-						files = append(files, fileOfTable[partition.ID]...)
-					}
+				tableWithRange, err := validateAndMergeTableFiles(t, fileOfTable, mergeCfg, small)
+				if err == nil {
+					err = keyspaces.add(tableWithRange.CreatedTable)
 				}
-				for _, file := range files {
-					err := ValidateFileRewriteRule(file, t.RewriteRule)
-					if err != nil {
+				if err != nil {
+					if !mergeCfg.CollectAllErrors {
 						errCh <- err
 						return
 					}
+					errs = multierr.Append(errs, err)
+					continue
 				}
-				// Merge small ranges to reduce split and scatter regions.
-				ranges, stat, err := MergeFileRanges(
-					files, splitSizeBytes, splitKeyCount)
-				if err != nil {
-					errCh <- err
-					return
+				if mergeCfg.GroupSkewRatio > 0 {
+					sizes = append(sizes, filesTotalBytes(tableWithRange.Files()))
 				}
-				log.Info("merge and validate file",
-					zap.Stringer("database", t.OldTable.DB.Name),
-					zap.Stringer("table", t.Table.Name),
-					zap.Int("Files(total)", stat.TotalFiles),
-					zap.Int("File(write)", stat.TotalWriteCFFile),
-					zap.Int("File(default)", stat.TotalDefaultCFFile),
-					zap.Int("Region(total)", stat.TotalRegions),
-					zap.Int("Regoin(keys avg)", stat.RegionKeysAvg),
-					zap.Int("Region(bytes avg)", stat.RegionBytesAvg),
-					zap.Int("Merged(regions)", stat.MergedRegions),
-					zap.Int("Merged(keys avg)", stat.MergedRegionKeysAvg),
-					zap.Int("Merged(bytes avg)", stat.MergedRegionBytesAvg))
-
-				tableWithRange := TableWithRange{
-					CreatedTable: t,
-					Range:        ranges,
+				if mergeCfg.CollectAllErrors {
+					// the tables held back can't wait for the consumer, so they fail on exceeding the budget.
+					pendingMemSize += rangesMemSize(tableWithRange.Range)
+					if mergeCfg.MemoryBudgetBytes > 0 && pendingMemSize > mergeCfg.MemoryBudgetBytes {
+						errCh <- errors.Annotatef(berrors.ErrInvalidArgument,
+							"ranges of the first %d tables take %d bytes, exceeding the memory budget %d bytes, "+
+								"please raise the budget or the merge thresholds",
+							len(pending)+1, pendingMemSize, mergeCfg.MemoryBudgetBytes)
+						return
+					}
+					pending = append(pending, tableWithRange)
+					continue
 				}
 				log.Debug("sending range info",
 					zap.Stringer("table", t.Table.Name),
-					zap.Int("files", len(files)),
-					zap.Int("range size", len(ranges)),
+					zap.Int("files", len(tableWithRange.Files())),
+					zap.Int("range size", len(tableWithRange.Range)),
 					zap.Int("output channel size", len(outCh)))
-				outCh <- tableWithRange
+				if !send(tableWithRange) {
+					return
+				}
 			}
 		}
 	}()
 	return outCh
 }
 
+// forwardRangesInBudget forwards the tables with ranges one by one, and releases the memory
+// of the ranges of a table from the limiter once the table is taken from outCh.
+func forwardRangesInBudget(
+	ctx context.Context,
+	mergedCh <-chan TableWithRange,
+	outCh chan<- TableWithRange,
+	limiter *bytesLimiter,
+	errCh chan<- error,
+) {
+	defer close(outCh)
+	for t := range mergedCh {
+		select {
+		case <-ctx.Done():
+			errCh <- ctx.Err()
+			return
+		case outCh <- t:
+		}
+		limiter.release(rangesMemSize(t.Range))
+	}
+}
+
+// logCollectedErrors logs the count of the errors collected on CollectAllErrors.
+func logCollectedErrors(errs error, mergeCfg MergeConfig) {
+	if mergeCfg.CollectAllErrors {
+		log.Error("validate and merge files failed", zap.Int("errors", len(multierr.Errors(errs))), zap.Error(errs))
+	}
+}
+
+// CheckOrphanFiles handles the files of the tables in the backup but not in the tables to restore
+// by the policy, comparing the physical IDs of the tables and their partitions with the IDs decoded
+// from the files. It's for the restore streaming the tables by GoValidateFileRanges, which should
+// check ahead before creating any table, rather than once all the tables are restored.
+func CheckOrphanFiles(tables []*metautil.Table, fileOfTable map[int64][]*backuppb.File, policy OrphanFilesPolicy) error {
+	restored := make(map[int64]struct{}, len(fileOfTable))
+	for _, table := range tables {
+		restored[table.Info.ID] = struct{}{}
+		if partitions := table.Info.Partition; partitions != nil {
+			for _, def := range partitions.Definitions {
+				restored[def.ID] = struct{}{}
+			}
+		}
+	}
+	if policy == "" {
+		policy = OrphanFilesStrict
+	}
+	return checkOrphanFiles(fileOfTable, restored, policy)
+}
+
+// checkOrphanFiles handles the files of the tables which aren't restored by the policy,
+// the old physical IDs of the restored tables are in restored.
+func checkOrphanFiles(
+	fileOfTable map[int64][]*backuppb.File, restored map[int64]struct{}, policy OrphanFilesPolicy,
+) error {
+	if policy == OrphanFilesIgnore {
+		return nil
+	}
+	orphans := make([]int64, 0)
+	orphanFiles := 0
+	for tableID, files := range fileOfTable {
+		if _, ok := restored[tableID]; !ok {
+			orphans = append(orphans, tableID)
+			orphanFiles += len(files)
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+	if policy == OrphanFilesWarn {
+		log.Warn("skip the files of the tables not to restore, the backup files and the metadata may mismatch",
+			zap.Int64s("table ids", orphans), zap.Int("files", orphanFiles))
+		return nil
+	}
+	return errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+		"%d files of the tables %v are not in the tables to restore, the backup files and the metadata may mismatch",
+		orphanFiles, orphans)
+}
+
+// validateAndMergeTableFiles validates the files of the table by its rewrite
+// rules, then merges the small ranges of the files. The statistics of a table
+// smaller than mergeCfg.LogMinTableSizeBytes are summed up into small.
+func validateAndMergeTableFiles(
+	t CreatedTable,
+	fileOfTable map[int64][]*backuppb.File,
+	mergeCfg MergeConfig,
+	small *smallTablesMergeStat,
+) (TableWithRange, error) {
+	files := fileOfTable[t.OldTable.Info.ID]
+	if partitions := t.OldTable.Info.Partition; partitions != nil {
+		log.Debug("table partition",
+			zap.Stringer("database", t.OldTable.DB.Name),
+			zap.Stringer("table", t.Table.Name),
+			zap.Any("partition info", partitions),
+		)
+		for _, partition := range partitions.Definitions {
+			files = append(files, fileOfTable[partition.ID]...)
+		}
+	}
+	if mergeCfg.PhysicalTablesTransformer != nil {
+		var err error
+		files, t.RewriteRule, err = transformPhysicalTables(
+			t, fileOfTable, mergeCfg.PhysicalTablesTransformer, mergeCfg.keyComparator())
+		if err != nil {
+			return TableWithRange{}, errors.Trace(err)
+		}
+	} else if t.RewriteRule != nil {
+		// Refuse the partitions rewritten into the same physical table, and the physical tables
+		// restored in place, i.e. with the identical IDs, but rewritten into the other tables.
+		if _, err := getSortedPhysicalTables(t, mergeCfg.keyComparator()); err != nil {
+			return TableWithRange{}, errors.Trace(err)
+		}
+	}
+	// A table without files needs no rules, e.g. a table created but never written.
+	if len(files) > 0 && t.RewriteRule == nil {
+		return TableWithRange{}, errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+			"table %s has %d files to restore but no rewrite rules", t.Table.Name, len(files))
+	}
+	for _, file := range files {
+		err := ValidateFileRewriteRule(file, t.RewriteRule)
+		if err != nil {
+			return TableWithRange{}, err
+		}
+	}
+	if mergeCfg.ValidateRewriteTableID {
+		newPhysicalIDs := newPhysicalIDsOf(t)
+		for _, file := range files {
+			if err := validateFileRewriteTableID(file, t.RewriteRule, newPhysicalIDs); err != nil {
+				return TableWithRange{}, errors.Trace(err)
+			}
+		}
+	}
+	// Merge small ranges to reduce split and scatter regions.
+	tableCfg := mergeCfg.forTable(t, files)
+	tableCfg.RegionTemplate = backupRegionTemplate(mergeCfg.RegionTemplate, t.RewriteRule)
+	var indexBoundaries [][]byte
+	if mergeCfg.SplitAtIndexBoundaries {
+		// Never merge across the boundaries, including the empty ranges.
+		indexBoundaries = indexBoundariesOf(t)
+		tableCfg.RegionTemplate = append(append([][]byte{}, tableCfg.RegionTemplate...), indexBoundaries...)
+		sort.Slice(tableCfg.RegionTemplate, func(i, j int) bool {
+			return bytes.Compare(tableCfg.RegionTemplate[i], tableCfg.RegionTemplate[j]) < 0
+		})
+	}
+	ranges, stat, err := MergeFileRangesWithConfig(files, tableCfg)
+	if err != nil {
+		return TableWithRange{}, err
+	}
+	if len(indexBoundaries) > 0 {
+		ranges = alignRangesToBoundaries(ranges, indexBoundaries)
+	}
+	if err := checkReservedKeyRanges(mergeCfg.ReservedKeyRanges, t, ranges); err != nil {
+		return TableWithRange{}, errors.Trace(err)
+	}
+	if tableBytes := filesTotalBytes(files); tableBytes < mergeCfg.LogMinTableSizeBytes {
+		small.add(stat, tableBytes)
+	} else {
+		log.Info("merge and validate file",
+			zap.Stringer("database", t.OldTable.DB.Name),
+			zap.Stringer("table", t.Table.Name),
+			zap.Int("Files(total)", stat.TotalFiles),
+			zap.Int("File(write)", stat.TotalWriteCFFile),
+			zap.Int("File(default)", stat.TotalDefaultCFFile),
+			zap.Int("Region(total)", stat.TotalRegions),
+			zap.Int("Regoin(keys avg)", stat.RegionKeysAvg),
+			zap.Int("Region(bytes avg)", stat.RegionBytesAvg),
+			zap.Int("Merged(regions)", stat.MergedRegions),
+			zap.Int("Merged(keys avg)", stat.MergedRegionKeysAvg),
+			zap.Int("Merged(bytes avg)", stat.MergedRegionBytesAvg),
+			zap.Int("Dropped(tombstone files)", stat.TombstoneFiles),
+			zap.Int("Skipped(empty files)", stat.EmptyFiles),
+			zap.Int("Filtered(files)", stat.FilteredFiles))
+	}
+
+	return TableWithRange{
+		CreatedTable: t,
+		Range:        ranges,
+	}, nil
+}
+
 // ValidateFileRewriteRule uses rewrite rules to validate the ranges of a file.
 func ValidateFileRewriteRule(file *backuppb.File, rewriteRules *RewriteRules) error {
 	// Check if the start key has a matched rewrite key
@@ -307,6 +527,252 @@ func ValidateFileRewriteRule(file *backuppb.File, rewriteRules *RewriteRules) er
 	return nil
 }
 
+// PhysicalTable is a physical table, i.e. a partition or a non-partitioned table, to restore.
+type PhysicalTable struct {
+	OldPhysicalID int64
+	NewPhysicalID int64
+	// RewriteRules is the rules rewriting the keys of the physical table only.
+	RewriteRules *RewriteRules
+}
+
+// PhysicalTablesTransformer returns the physical tables to restore of the table, given the
+// physical tables of it sorted by the new physical IDs, see getSortedPhysicalTables.
+// The returned ones must be sorted too.
+type PhysicalTablesTransformer func(table CreatedTable, physicalTables []PhysicalTable) ([]PhysicalTable, error)
+
+// comparePhysicalTables compares the physical tables by the prefixes of the new physical IDs.
+func comparePhysicalTables(cmp KeyComparator, a, b PhysicalTable) int {
+	return cmp(tablecodec.EncodeTablePrefix(a.NewPhysicalID), tablecodec.EncodeTablePrefix(b.NewPhysicalID))
+}
+
+// getSortedPhysicalTables returns the physical tables of the table sorted by the prefixes of
+// the new physical IDs, i.e. by the new physical IDs for the bytewise comparator,
+// with the rewrite rules of the table split by the physical tables.
+// The ties are broken by the old physical IDs, but two physical tables rewritten into
+// the same new physical ID are refused.
+// The new physical ID may equal the old one, e.g. restoring in place, then the rules
+// of the records are no-ops, and the split keys are the same as in the backup. But such
+// a physical table with a rule rewriting into another table is refused, as its keys would
+// be half rewritten, e.g. by the rules generated for the table restored elsewhere.
+func getSortedPhysicalTables(t CreatedTable, cmp KeyComparator) ([]PhysicalTable, error) {
+	physicalTables := make([]PhysicalTable, 0)
+	for oldID, newID := range newPhysicalIDsOf(t) {
+		var rules *RewriteRules
+		if t.RewriteRule != nil {
+			rules = &RewriteRules{}
+			for _, rule := range t.RewriteRule.Data {
+				if tablecodec.DecodeTableID(rule.GetOldKeyPrefix()) != oldID {
+					continue
+				}
+				if rewrittenID := tablecodec.DecodeTableID(rule.GetNewKeyPrefix()); oldID == newID && rewrittenID != newID {
+					return nil, errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+						"physical table %d of table %s is restored in place, but rewrite rule %X => %X rewrites it into table %d",
+						oldID, t.Table.Name, rule.GetOldKeyPrefix(), rule.GetNewKeyPrefix(), rewrittenID)
+				}
+				rules.Data = append(rules.Data, rule)
+			}
+		}
+		physicalTables = append(physicalTables, PhysicalTable{
+			OldPhysicalID: oldID,
+			NewPhysicalID: newID,
+			RewriteRules:  rules,
+		})
+	}
+	sort.Slice(physicalTables, func(i, j int) bool {
+		if c := comparePhysicalTables(cmp, physicalTables[i], physicalTables[j]); c != 0 {
+			return c < 0
+		}
+		return physicalTables[i].OldPhysicalID < physicalTables[j].OldPhysicalID
+	})
+	for i := 1; i < len(physicalTables); i++ {
+		prev, cur := physicalTables[i-1], physicalTables[i]
+		if prev.NewPhysicalID == cur.NewPhysicalID {
+			return nil, errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+				"physical tables %d and %d of table %s are both rewritten into %d",
+				prev.OldPhysicalID, cur.OldPhysicalID, t.Table.Name, cur.NewPhysicalID)
+		}
+	}
+	return physicalTables, nil
+}
+
+// transformPhysicalTables transforms the physical tables of the table, returns
+// the files and the rewrite rules of the transformed physical tables.
+func transformPhysicalTables(
+	t CreatedTable,
+	fileOfTable map[int64][]*backuppb.File,
+	transformer PhysicalTablesTransformer,
+	cmp KeyComparator,
+) ([]*backuppb.File, *RewriteRules, error) {
+	physicalTables, err := getSortedPhysicalTables(t, cmp)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	physicalTables, err = transformer(t, physicalTables)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var files []*backuppb.File
+	var rewriteRules *RewriteRules
+	for i, p := range physicalTables {
+		if i > 0 && comparePhysicalTables(cmp, physicalTables[i-1], p) >= 0 {
+			return nil, nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"physical tables of table %s aren't sorted by the new physical ID after transforming, %d follows %d",
+				t.Table.Name, p.NewPhysicalID, physicalTables[i-1].NewPhysicalID)
+		}
+		files = append(files, fileOfTable[p.OldPhysicalID]...)
+		if p.RewriteRules != nil {
+			if rewriteRules == nil {
+				rewriteRules = &RewriteRules{}
+			}
+			rewriteRules.Data = append(rewriteRules.Data, p.RewriteRules.Data...)
+		}
+	}
+	return files, rewriteRules, nil
+}
+
+// newPhysicalIDsOf maps the old physical IDs of the table to the new ones,
+// the partitions are matched by their names like GetRewriteRules.
+func newPhysicalIDsOf(t CreatedTable) map[int64]int64 {
+	ids := map[int64]int64{t.OldTable.Info.ID: t.Table.ID}
+	if t.OldTable.Info.Partition != nil && t.Table.Partition != nil {
+		for _, srcPart := range t.OldTable.Info.Partition.Definitions {
+			for _, destPart := range t.Table.Partition.Definitions {
+				if srcPart.Name == destPart.Name {
+					ids[srcPart.ID] = destPart.ID
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// rewriteKeyspace is the keyspace a rewrite rule rewrites into, i.e. the keys prefixed by the new key prefix.
+type rewriteKeyspace struct {
+	prefix []byte
+	table  string
+}
+
+// Less implements btree.Item.
+func (k *rewriteKeyspace) Less(than btree.Item) bool {
+	return bytes.Compare(k.prefix, than.(*rewriteKeyspace).prefix) < 0
+}
+
+// rewriteKeyspaces checks the keyspaces rewritten into by the rules of different tables don't overlap,
+// which means the tables would overwrite each other, e.g. by a bug of generating the rewrite rules.
+// The keyspaces are prefixes, so two of them overlap only if one is a prefix of the other.
+type rewriteKeyspaces struct {
+	tree *btree.BTree
+}
+
+func newRewriteKeyspaces() *rewriteKeyspaces {
+	return &rewriteKeyspaces{tree: btree.New(32)}
+}
+
+// add adds the keyspaces of the table, or returns the error naming the table colliding with it.
+func (ks *rewriteKeyspaces) add(t CreatedTable) error {
+	if t.RewriteRule == nil {
+		return nil
+	}
+	table := fmt.Sprintf("%s.%s", t.OldTable.DB.Name, t.Table.Name)
+	for _, rule := range t.RewriteRule.Data {
+		prefix := rule.GetNewKeyPrefix()
+		// the keyspaces containing the new one.
+		for l := 0; l <= len(prefix); l++ {
+			if item := ks.tree.Get(&rewriteKeyspace{prefix: prefix[:l]}); item != nil {
+				if err := checkRewriteCollision(item.(*rewriteKeyspace), table, prefix); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+		// the keyspaces contained by the new one, the first one following the prefix is one if there's any.
+		var err error
+		ks.tree.AscendGreaterOrEqual(&rewriteKeyspace{prefix: prefix}, func(item btree.Item) bool {
+			if k := item.(*rewriteKeyspace); bytes.HasPrefix(k.prefix, prefix) {
+				err = checkRewriteCollision(k, table, prefix)
+			}
+			return false
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ks.tree.ReplaceOrInsert(&rewriteKeyspace{prefix: prefix, table: table})
+	}
+	return nil
+}
+
+func checkRewriteCollision(k *rewriteKeyspace, table string, prefix []byte) error {
+	if k.table == table {
+		return nil
+	}
+	return errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+		"tables %s and %s are rewritten into the overlapping keyspaces %X and %X",
+		k.table, table, k.prefix, prefix)
+}
+
+// validateFileRewriteTableID checks the start key of the file decodes to the
+// expected new physical ID after rewriting.
+func validateFileRewriteTableID(
+	file *backuppb.File, rewriteRules *RewriteRules, newPhysicalIDs map[int64]int64,
+) error {
+	if rewriteRules == nil {
+		return nil
+	}
+	oldID := tablecodec.DecodeTableID(file.GetStartKey())
+	expectedID, ok := newPhysicalIDs[oldID]
+	if !ok {
+		return errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+			"file %s belongs to table %d, which isn't a physical table of the restored table", file.GetName(), oldID)
+	}
+	rule := matchOldPrefix(file.GetStartKey(), rewriteRules)
+	if rule == nil {
+		return errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+			"cannot find rewrite rule for file %s", file.GetName())
+	}
+	newKey := bytes.Replace(file.GetStartKey(), rule.GetOldKeyPrefix(), rule.GetNewKeyPrefix(), 1)
+	if newID := tablecodec.DecodeTableID(newKey); newID != expectedID {
+		return errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+			"file %s is rewritten into table %d, but expected table %d, the rewrite rule is %X => %X",
+			file.GetName(), newID, expectedID, rule.GetOldKeyPrefix(), rule.GetNewKeyPrefix())
+	}
+	return nil
+}
+
+// checkReservedKeyRanges refuses the files of the merged ranges of the table rewritten into
+// the reserved key ranges, and the split keys, i.e. the end keys of the ranges, inside them.
+func checkReservedKeyRanges(reserved []rtree.Range, t CreatedTable, ranges []rtree.Range) error {
+	if len(reserved) == 0 {
+		return nil
+	}
+	rewrite := func(key []byte) []byte {
+		if t.RewriteRule == nil || len(key) == 0 {
+			return key
+		}
+		newKey, _ := replacePrefix(key, t.RewriteRule)
+		return newKey
+	}
+	for _, rg := range ranges {
+		for _, file := range rg.Files {
+			startKey, endKey := rewrite(file.GetStartKey()), rewrite(file.GetEndKey())
+			for _, r := range reserved {
+				if beforeEnd(startKey, r.EndKey) && beforeEnd(r.StartKey, endKey) {
+					return errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+						"file %s of table %s is rewritten into [%X, %X), which overlaps the reserved key range [%X, %X)",
+						file.GetName(), t.Table.Name, startKey, endKey, r.StartKey, r.EndKey)
+				}
+			}
+		}
+		splitKey := rewrite(rg.EndKey)
+		for _, r := range reserved {
+			if len(splitKey) > 0 && bytes.Compare(r.StartKey, splitKey) < 0 && beforeEnd(splitKey, r.EndKey) {
+				return errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+					"split key %X of table %s is inside the reserved key range [%X, %X)",
+					splitKey, t.Table.Name, r.StartKey, r.EndKey)
+			}
+		}
+	}
+	return nil
+}
+
 // Rewrites a raw key and returns a encoded key.
 func rewriteRawKey(key []byte, rewriteRules *RewriteRules) ([]byte, *import_sstpb.RewriteRule) {
 	if rewriteRules == nil {
@@ -346,15 +812,75 @@ func SplitRanges(
 	rewriteRules *RewriteRules,
 	updateCh glue.Progress,
 ) error {
-	splitter := NewRegionSplitter(NewSplitClient(client.GetPDClient(), client.GetTLSConfig()))
+	return splitRangesOfTables(ctx, client, nil, ranges, rewriteRules, updateCh)
+}
 
+// splitRangesOfTables is like SplitRanges, but also splits the tails of the tables by the client,
+// see Client.SetTailSplit. The tables are the ones whose last ranges are among the ranges.
+func splitRangesOfTables(
+	ctx context.Context,
+	client *Client,
+	tables []CreatedTable,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	updateCh glue.Progress,
+) error {
+	splitter := client.newRegionSplitter()
+	splitter.SetTailSplit(client.tailSplit, tables)
+	defer func() {
+		client.injectedSplitKeys.Add(splitter.InjectedSplitKeyCount())
+	}()
 	return splitter.Split(ctx, ranges, rewriteRules, func(keys [][]byte) {
+		client.splitKeys.Add(int64(len(keys)))
 		for range keys {
 			updateCh.Inc()
 		}
 	})
 }
 
+// newRegionSplitter returns a region splitter configured by the client.
+func (rc *Client) newRegionSplitter() *RegionSplitter {
+	splitter := NewRegionSplitter(rc.toolClient)
+	splitter.SetScatterWaitTimeout(rc.scatterWaitTimeout)
+	if rc.validateSplitKeys {
+		splitter.EnableSplitKeyValidation()
+	}
+	if rc.splitOnTable {
+		splitter.EnableSplitOnTableBoundary()
+	}
+	if rc.splitOnTableStart {
+		splitter.EnableSplitOnTableStart()
+	}
+	if rc.skipTailSplitKey {
+		splitter.SkipTailSplitKey()
+	}
+	splitter.SetSplitBatchDelay(rc.splitBatchDelay, rc.splitBatchJitter)
+	splitter.SetSplitOrder(rc.splitOrder)
+	splitter.SetSplitPacer(rc.splitPacer)
+	if rc.restoreJobID != "" {
+		// a splitter per batch, the regions of all batches are labeled by a single rule.
+		splitter.labeledRanges = rc.labeledRanges
+		splitter.SetRegionLabel(RestoreJobLabelKey, rc.restoreJobID)
+	}
+	if rc.regionTemplate != nil {
+		splitter.SetRegionTemplate(rc.regionTemplate)
+	}
+	splitter.SetKeyComparator(rc.keyComparator)
+	splitter.SetMinRegions(rc.minRegions)
+	if rc.tableSplitKeys != nil {
+		// a splitter per batch, the split keys of the tables are counted across the batches.
+		splitter.tableSplitKeys = rc.tableSplitKeys
+	}
+	splitter.SetRegionMaxSize(rc.regionMaxSize)
+	splitter.SetMinSplitKeyDistance(rc.minSplitKeyDistance)
+	if rc.keptSplitKeys != nil {
+		// a splitter per batch, the split keys are kept by the min distance across the batches.
+		splitter.keptSplitKeys = rc.keptSplitKeys
+	}
+	splitter.onPlanned = rc.splitKeysCallback
+	return splitter
+}
+
 func findMatchedRewriteRule(file *backuppb.File, rules *RewriteRules) *import_sstpb.RewriteRule {
 	startID := tablecodec.DecodeTableID(file.GetStartKey())
 	endID := tablecodec.DecodeTableID(file.GetEndKey())
@@ -430,6 +956,14 @@ func ParseQuoteName(name string) (db, table string) {
 	return db, table
 }
 
+// summaryUnit returns the name of the summary unit in the namespace of prefix.
+func summaryUnit(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
 func unQuoteName(name string) string {
 	name = strings.TrimPrefix(name, "`")
 	return strings.TrimSuffix(name, "`")
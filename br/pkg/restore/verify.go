@@ -0,0 +1,168 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"hash/fnv"
+	"io"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	"github.com/pingcap/kvproto/pkg/encryptionpb"
+	"github.com/pingcap/log"
+	berrors "github.com/pingcap/tidb/br/pkg/errors"
+	"github.com/pingcap/tidb/br/pkg/logutil"
+	"github.com/pingcap/tidb/br/pkg/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// verifySampleScale is the resolution of the sample rate of verifying files.
+	verifySampleScale = 1000000
+	// DefaultVerifyConcurrency is the count of the sampled files verified concurrently by default.
+	DefaultVerifyConcurrency = 4
+)
+
+// FileVerifier verifies the content of a backup file by its checksum.
+type FileVerifier interface {
+	// Verify returns an error wrapping ErrRestoreChecksumMismatch if the content mismatches the checksum.
+	Verify(ctx context.Context, file *backuppb.File) error
+}
+
+type storageFileVerifier struct {
+	storage storage.ExternalStorage
+	cipher  *backuppb.CipherInfo
+}
+
+// NewStorageFileVerifier returns a FileVerifier reading the files from the storage, the checksum
+// of a file is of its content decrypted by the cipher, as computed on backup.
+func NewStorageFileVerifier(storage storage.ExternalStorage, cipher *backuppb.CipherInfo) FileVerifier {
+	return storageFileVerifier{storage: storage, cipher: cipher}
+}
+
+// Verify streams the content of the file into the checksum, so the file is never read into memory whole.
+func (v storageFileVerifier) Verify(ctx context.Context, file *backuppb.File) error {
+	reader, err := v.storage.Open(ctx, file.GetName())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer reader.Close()
+	var content io.Reader = reader
+	if v.cipher != nil {
+		if content, err = decryptReader(reader, v.cipher, file.GetCipherIv()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return errors.Trace(err)
+	}
+	if checksum := h.Sum(nil); !bytes.Equal(checksum, file.GetSha256()) {
+		return errors.Annotatef(berrors.ErrRestoreChecksumMismatch,
+			"file %s has sha256 %x, but expected %x", file.GetName(), checksum, file.GetSha256())
+	}
+	return nil
+}
+
+// decryptReader returns the reader of the content decrypted by the cipher, like metautil.Decrypt
+// but streaming.
+func decryptReader(reader io.Reader, info *backuppb.CipherInfo, iv []byte) (io.Reader, error) {
+	switch info.CipherType {
+	case encryptionpb.EncryptionMethod_PLAINTEXT:
+		return reader, nil
+	case encryptionpb.EncryptionMethod_AES128_CTR,
+		encryptionpb.EncryptionMethod_AES192_CTR,
+		encryptionpb.EncryptionMethod_AES256_CTR:
+		block, err := aes.NewCipher(info.CipherKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: reader}, nil
+	default:
+		return nil, errors.Annotate(berrors.ErrInvalidArgument, "cipher type invalid")
+	}
+}
+
+// sampledForVerify checks whether the file is in the sample of the rate, by the hash of its name,
+// so the same files are sampled by every run, e.g. the resumed ones.
+func sampledForVerify(file *backuppb.File, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(file.GetName()))
+	return h.Sum64()%verifySampleScale < uint64(rate*verifySampleScale)
+}
+
+// SetFileVerifier makes RestoreFiles verify the sample of the rate of the files by the verifier
+// before importing them, a statistical check of the integrity of the backup cheaper than verifying
+// all files. The sample is by the names of the files, so it's the same for every run. A mismatch
+// fails the restore. The rate is in [0, 1], 0 (the default) means no verifying. The files are
+// verified by DefaultVerifyConcurrency concurrently at most, see SetVerifyConcurrency.
+func (rc *Client) SetFileVerifier(verifier FileVerifier, sampleRate float64) {
+	rc.fileVerifier = verifier
+	rc.verifySampleRate = sampleRate
+	if rc.verifyTokens == nil {
+		rc.SetVerifyConcurrency(DefaultVerifyConcurrency)
+	}
+}
+
+// SetVerifyConcurrency sets the count of the sampled files verified concurrently at most, apart
+// from the concurrency of restoring, since verifying reads the whole files from the storage.
+// note this function isn't goroutine safe yet, just call it before anything starts, please.
+func (rc *Client) SetVerifyConcurrency(concurrency uint) {
+	if concurrency == 0 {
+		concurrency = DefaultVerifyConcurrency
+	}
+	rc.verifyTokens = make(chan struct{}, concurrency)
+}
+
+// VerifiedFileCount returns the count of the sampled files verified, and the count of those mismatched.
+func (rc *Client) VerifiedFileCount() (verified, mismatched int64) {
+	return rc.verifiedFiles.Load(), rc.mismatchedFiles.Load()
+}
+
+// verifySampledFiles verifies the sampled files of the group, the files without checksums are skipped.
+// A file is verified once only, e.g. the files of the groups retried, or of the ranges cut from a file,
+// are skipped unless verifying them failed.
+func (rc *Client) verifySampledFiles(ctx context.Context, files []*backuppb.File) error {
+	if rc.fileVerifier == nil {
+		return nil
+	}
+	for _, file := range files {
+		if len(file.GetSha256()) == 0 || !sampledForVerify(file, rc.verifySampleRate) {
+			continue
+		}
+		if _, verified := rc.verifiedFileNames.LoadOrStore(file.GetName(), struct{}{}); verified {
+			continue
+		}
+		err := rc.verifyFile(ctx, file)
+		if err != nil && errors.Cause(err) != berrors.ErrRestoreChecksumMismatch { // nolint:errorlint
+			rc.verifiedFileNames.Delete(file.GetName())
+			return errors.Trace(err)
+		}
+		rc.verifiedFiles.Inc()
+		if err != nil {
+			rc.mismatchedFiles.Inc()
+			log.Error("sampled file mismatches its checksum", logutil.File(file), zap.Error(err))
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// verifyFile verifies the file by the verifier, waiting for a token of the verify concurrency.
+func (rc *Client) verifyFile(ctx context.Context, file *backuppb.File) error {
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case rc.verifyTokens <- struct{}{}:
+	}
+	defer func() { <-rc.verifyTokens }()
+	return rc.fileVerifier.Verify(ctx, file)
+}
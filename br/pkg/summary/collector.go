@@ -22,6 +22,9 @@ const (
 	TotalKV = "total kv"
 	// TotalBytes is a field we collect during backup/restore
 	TotalBytes = "total bytes"
+	// FileIngestRetries is a field we collect during restore, it's the count
+	// of files retried to download and ingest.
+	FileIngestRetries = "file ingest retries"
 	// BackupDataSize is a field we collect after backup finish
 	BackupDataSize = "backup data size(after compressed)"
 	// RestoreDataSize is a field we collection after restore finish
@@ -3,20 +3,31 @@
 package task
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	backuppb "github.com/pingcap/kvproto/pkg/brpb"
 	"github.com/pingcap/log"
+	filter "github.com/pingcap/tidb-tools/pkg/table-filter"
 	"github.com/pingcap/tidb/br/pkg/conn"
 	berrors "github.com/pingcap/tidb/br/pkg/errors"
 	"github.com/pingcap/tidb/br/pkg/glue"
+	"github.com/pingcap/tidb/br/pkg/logutil"
 	"github.com/pingcap/tidb/br/pkg/metautil"
 	"github.com/pingcap/tidb/br/pkg/pdutil"
 	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/pingcap/tidb/br/pkg/rtree"
 	"github.com/pingcap/tidb/br/pkg/storage"
 	"github.com/pingcap/tidb/br/pkg/summary"
 	"github.com/pingcap/tidb/br/pkg/utils"
@@ -31,20 +42,175 @@ const (
 	flagOnline   = "online"
 	flagNoSchema = "no-schema"
 
+	// flagRecoverTiFlashReplica controls whether to set the TiFlash replica of restored tables as the backup cluster.
+	flagRecoverTiFlashReplica = "recover-tiflash-replica"
+	// flagTiFlashReplicaWaitTimeout controls how long to wait for the recovered TiFlash replicas being available.
+	flagTiFlashReplicaWaitTimeout = "tiflash-replica-wait-timeout"
+	// flagCompactAfterRestore controls whether and how to compact the keyspaces of restored tables after restore.
+	flagCompactAfterRestore = "compact-after-restore"
+	// flagPreWarmSamplesPerTable controls how many parts of every restored table are read after restore.
+	flagPreWarmSamplesPerTable = "pre-warm-samples-per-table"
+	// flagPreWarmKeysPerSample controls how many keys of every part of the restored tables are read after restore.
+	flagPreWarmKeysPerSample = "pre-warm-keys-per-sample"
+	// flagVerifySampleRate controls the ratio of the files sampled to verify their checksums before importing.
+	flagVerifySampleRate = "verify-sample-rate"
+	// flagVerifyConcurrency controls how many sampled files are verified concurrently.
+	flagVerifyConcurrency = "verify-concurrency"
+	// flagTailSplitKeys controls how many split keys are added to the tails of the tables with sequential int handles.
+	flagTailSplitKeys = "tail-split-keys"
+	// flagTailSplitHandleStep controls the difference of the int handles between the split keys of the tails.
+	flagTailSplitHandleStep = "tail-split-handle-step"
+	// flagDisablePDHTTP controls whether to restore without the PD HTTP API, by gRPC only.
+	flagDisablePDHTTP = "disable-pd-http"
+
 	// FlagMergeRegionSizeBytes is the flag name of merge small regions by size
 	FlagMergeRegionSizeBytes = "merge-region-size-bytes"
 	// FlagMergeRegionKeyCount is the flag name of merge small regions by key count
 	FlagMergeRegionKeyCount = "merge-region-key-count"
+	// FlagMergeMinFileSizeBytes is the flag name of always merging files smaller than it
+	FlagMergeMinFileSizeBytes = "merge-min-file-size-bytes"
+	// FlagMergeMaxFilesPerGroup is the flag name of the count of the files of a merged range at most.
+	FlagMergeMaxFilesPerGroup = "merge-max-files-per-group"
+	// FlagDropTombstoneFiles is the flag name of dropping the files containing only tombstones,
+	// it's only safe when restoring into empty tables.
+	FlagDropTombstoneFiles = "drop-tombstone-files"
+	// FlagOrphanFilesPolicy is the flag name of the policy on the files of the tables not to restore.
+	FlagOrphanFilesPolicy = "orphan-files-policy"
+	// FlagNoMerge is the flag name of restoring the range of every file into a region of its own, for diagnosing.
+	FlagNoMerge = "no-merge"
+	// FlagSkipEmptyFiles is the flag name of skipping the files of full backups containing no kvs.
+	FlagSkipEmptyFiles = "skip-empty-files"
+	// FlagMergeLogMinTableSizeBytes is the flag name of only logging the merge statistics of tables
+	// of at least the size one by one, the smaller tables are logged together.
+	FlagMergeLogMinTableSizeBytes = "merge-log-min-table-size-bytes"
+	// FlagMergeMaxRangeGapHandles is the flag name of the max gap of handles between the ranges of a table,
+	// above which files are suspected to be missing.
+	FlagMergeMaxRangeGapHandles = "merge-max-range-gap-handles"
+	// FlagStrictRangeGap is the flag name of failing on the gaps above the max gap, instead of warning.
+	FlagStrictRangeGap = "strict-range-gap"
+	// FlagValidateRewriteTableID is the flag name of checking the files are rewritten into the right tables.
+	FlagValidateRewriteTableID = "validate-rewrite-table-id"
+	// FlagTraceMergeDecisions is the flag name of logging every decision of merging ranges.
+	FlagTraceMergeDecisions = "trace-merge-decisions"
+	// FlagRegionMaxSizeBytes is the flag name of the max size of a region, above which the files are oversized.
+	FlagRegionMaxSizeBytes = "region-max-size-bytes"
+	// FlagOversizedFilesPolicy is the flag name of the policy on the files larger than the max size of a region.
+	FlagOversizedFilesPolicy = "oversized-files-policy"
+	// FlagCollectAllErrors is the flag name of reporting all the errors of validating the files at once.
+	FlagCollectAllErrors = "collect-all-errors"
+	// FlagSplitAtIndexBoundaries is the flag name of splitting the ranges of tables exactly at the prefixes of indexes.
+	FlagSplitAtIndexBoundaries = "split-at-index-boundaries"
+	// FlagMergeMemoryBudgetBytes is the flag name of the memory budget of the merged ranges not restored yet.
+	FlagMergeMemoryBudgetBytes = "merge-memory-budget-bytes"
+	// FlagCFGroupOrder is the flag name of the order of the CFs in which the files of every batch are restored.
+	FlagCFGroupOrder = "cf-group-order"
+	// FlagGroupSkewRatio is the flag name of the ratio of the largest table to the median one,
+	// above which the sizes of the tables are warned as skewed.
+	FlagGroupSkewRatio = "group-skew-ratio"
 	// FlagPDConcurrency controls concurrency pd-relative operations like split & scatter.
 	FlagPDConcurrency = "pd-concurrency"
 	// FlagBatchFlushInterval controls after how long the restore batch would be auto sended.
 	FlagBatchFlushInterval = "batch-flush-interval"
+	// FlagScatterWaitTimeout controls how long to wait for scattering the new regions at most after splitting.
+	FlagScatterWaitTimeout = "scatter-wait-timeout"
+	// FlagSplitBatchDelay controls how long to wait between the split requests of the regions.
+	FlagSplitBatchDelay = "split-batch-delay"
+	// FlagSplitOrder is the order of submitting the split keys of the regions.
+	FlagSplitOrder = "split-order"
+	// FlagRestoreJobID is the ID of the restore job to label the regions created by splitting with.
+	FlagRestoreJobID = "restore-job-id"
+	// FlagDescendingTables is the filter of the tables whose files are restored in descending key order.
+	FlagDescendingTables = "descending-tables"
+	// FlagSplitBatchJitter controls the upper bound of the random time added to the split batch delay.
+	FlagSplitBatchJitter = "split-batch-jitter"
+	// FlagSplitLatencyThreshold is the latency of a split request above which the split requests are slowed down.
+	FlagSplitLatencyThreshold = "split-latency-threshold"
+	// FlagSplitMaxDelay caps the delay between the split requests slowed down by the latency.
+	FlagSplitMaxDelay = "split-max-delay"
+	// FlagValidateSplitKeys controls whether to check the split keys are in the keyspace of the restored tables.
+	FlagValidateSplitKeys = "validate-split-keys"
+	// FlagNoCrossTableBatch controls whether a restore batch could contain the ranges of more than one table.
+	FlagNoCrossTableBatch = "no-cross-table-batch"
+	// FlagSplitOnTableBoundary controls whether to split at the start of every table following another table in a batch.
+	FlagSplitOnTableBoundary = "split-on-table-boundary"
+	// FlagSplitOnTableStart controls whether to split at the start of the first range of every table in a batch.
+	FlagSplitOnTableStart = "split-on-table-start"
+	// FlagNoTailSplitKey controls whether to skip splitting at the end of the last range of every batch,
+	// when it's the prefix of the next table.
+	FlagNoTailSplitKey = "no-tail-split-key"
+	// FlagMinRegionsPerStore is the count of regions per TiKV store every restored table is split into at least.
+	FlagMinRegionsPerStore = "min-regions-per-store"
+	// FlagMinSplitKeyDistance is the distance to the previous split key below which a split key is skipped.
+	FlagMinSplitKeyDistance = "min-split-key-distance"
+	// FlagRestoreFilesRetryTimes controls how many times to retry the unfinished files on a transient error.
+	FlagRestoreFilesRetryTimes = "restore-files-retry-times"
+	// FlagDownloadRetryTimes is how many times to try downloading a file into a region at most.
+	FlagDownloadRetryTimes = "download-retry-times"
+	// FlagIngestRetryTimes is how many times to try ingesting the files of a range at most.
+	FlagIngestRetryTimes = "ingest-retry-times"
+	// FlagCFIngestOrder is the order of ingesting the files of the CFs into a region by a request per CF.
+	FlagCFIngestOrder = "cf-ingest-order"
+	// FlagMaxCapacityFill is the ratio of the cluster capacity the restore may fill the disks up to at most.
+	FlagMaxCapacityFill = "max-capacity-fill"
+	// FlagMaxRegionCount is the count of the regions of the cluster the restore may split up to at most.
+	FlagMaxRegionCount = "max-region-count"
+	// FlagMaxConcurrentTables is the count of the distinct tables whose files are restored concurrently at most.
+	FlagMaxConcurrentTables = "max-concurrent-tables"
+	// FlagGlobalRateLimit is the total rate limit of restoring files across all stores, MB/s.
+	FlagGlobalRateLimit = "global-ratelimit"
+	// FlagMaxInFlightSize is the total size of the files being downloaded and ingested at once at most, MB.
+	FlagMaxInFlightSize = "max-in-flight-size"
+	// FlagTimeBudget is the time budget of the restore, the restore stops cleanly once it's exhausted.
+	FlagTimeBudget = "time-budget"
+	// FlagIngestHighDiskUsage is the disk usage of stores at or above which the ingest concurrency is halved.
+	FlagIngestHighDiskUsage = "ingest-high-disk-usage"
+	// FlagIngestLowDiskUsage is the disk usage of stores at or below which the ingest concurrency grows back.
+	FlagIngestLowDiskUsage = "ingest-low-disk-usage"
+	// FlagKeepPlacementRules controls whether to keep the placement rules of online restore after restore, for debugging.
+	FlagKeepPlacementRules = "keep-placement-rules"
+	// FlagPlacementRulesAhead controls whether to set the placement rules of online restore as soon as the tables
+	// are created, overlapping with merging the ranges of the files.
+	FlagPlacementRulesAhead = "placement-rules-ahead"
+	// FlagSkipMatchedPlacementRules controls whether to skip setting the placement rules of online restore
+	// of the tables whose rules already match, e.g. set by a previous run interrupted.
+	FlagSkipMatchedPlacementRules = "skip-matched-placement-rules"
+	// FlagPauseSchedulersOnline controls whether to pause the PD schedulers slowing down restoring in online
+	// restore too, like the offline restore always does.
+	FlagPauseSchedulersOnline = "pause-schedulers-online"
+	// FlagRegionTemplate is the path of a file of the externally managed boundaries of regions,
+	// one hex encoded key in the keyspace of the restored tables per line, to split exactly at.
+	FlagRegionTemplate = "region-template"
+	// FlagReservedKeyRanges is the key ranges of the restored cluster reserved for others, no file is restored
+	// into, each is a pair of hex encoded keys joined by "-", an empty end key means unbounded.
+	FlagReservedKeyRanges = "reserved-key-ranges"
+	// FlagKeyRangeAllowlist is the path of a file of the key ranges of the backup to restore selectively,
+	// one pair of hex encoded keys joined by "-" per line, only the files intersecting them are restored.
+	FlagKeyRangeAllowlist = "key-range-allowlist"
+	// FlagAnalyzeFileEpochs is the count of region epochs, the tables whose files span at least it are reported,
+	// for diagnosing the backups taken during heavy region splits.
+	FlagAnalyzeFileEpochs = "analyze-file-epochs"
+	// FlagAuditOutput is the path to write the audit of which backup files are restored into which ranges.
+	FlagAuditOutput = "audit-output"
+	// FlagPlanHash controls whether to hash the restored ranges, files and split keys, for reproducibility audits.
+	FlagPlanHash = "plan-hash"
+	// FlagDropLastTableFiles controls whether to drop the files of the last table of every batch, for fault injection.
+	FlagDropLastTableFiles = "drop-last-table-files"
+	// FlagUnsafeFaultInjection must be set to enable the fault injection which makes the restored data incomplete.
+	FlagUnsafeFaultInjection = "unsafe-fault-injection"
 
 	defaultRestoreConcurrency = 128
 	maxRestoreBatchSizeLimit  = 10240
 	defaultPDConcurrency      = 1
 	defaultBatchFlushInterval = 16 * time.Second
 	defaultDDLConcurrency     = 16
+	defaultSplitMaxDelay      = 10 * time.Second
+
+	defaultPreWarmKeysPerSample = 1024
+	defaultTailSplitHandleStep  = 65536
+	noScatterWait               = time.Duration(-1)
+
+	ingestDiskUsageCheckInterval = 10 * time.Second
+	restoreFilesRetryInterval    = time.Second
 )
 
 // RestoreCommonConfig is the common configuration for all BR restore tasks.
@@ -56,6 +222,84 @@ type RestoreCommonConfig struct {
 	// See https://github.com/tikv/tikv/blob/v4.0.8/components/raftstore/src/coprocessor/config.rs#L35-L38
 	MergeSmallRegionSizeBytes uint64 `json:"merge-region-size-bytes" toml:"merge-region-size-bytes"`
 	MergeSmallRegionKeyCount  uint64 `json:"merge-region-key-count" toml:"merge-region-key-count"`
+	// MergeMinFileSizeBytes is the size below which files are always merged into their neighbours (Default 0, disabled).
+	MergeMinFileSizeBytes uint64 `json:"merge-min-file-size-bytes" toml:"merge-min-file-size-bytes"`
+	// MergeMaxFilesPerGroup is the count of the files of a merged range at most (Default 0, unlimited).
+	MergeMaxFilesPerGroup int `json:"merge-max-files-per-group" toml:"merge-max-files-per-group"`
+	// DropTombstoneFiles drops the files containing only tombstones, only safe when restoring into empty tables,
+	// which is checked before restoring an incremental backup.
+	DropTombstoneFiles bool `json:"drop-tombstone-files" toml:"drop-tombstone-files"`
+	// OrphanFilesPolicy is the policy on the files of the tables not to restore (Default strict).
+	OrphanFilesPolicy restore.OrphanFilesPolicy `json:"orphan-files-policy" toml:"orphan-files-policy"`
+	// NoMerge restores the range of every file into a region of its own, for diagnosing only.
+	NoMerge bool `json:"no-merge" toml:"no-merge"`
+	// SkipEmptyFiles skips the files of full backups containing no kvs, e.g. placeholders of empty ranges.
+	SkipEmptyFiles bool `json:"skip-empty-files" toml:"skip-empty-files"`
+	// MergeLogMinTableSizeBytes is the size below which tables are logged together on merging (Default 0, disabled).
+	MergeLogMinTableSizeBytes uint64 `json:"merge-log-min-table-size-bytes" toml:"merge-log-min-table-size-bytes"`
+	// MergeMaxRangeGapHandles is the max gap of handles between the ranges of a table (Default 0, disabled).
+	MergeMaxRangeGapHandles uint64 `json:"merge-max-range-gap-handles" toml:"merge-max-range-gap-handles"`
+	StrictRangeGap          bool   `json:"strict-range-gap" toml:"strict-range-gap"`
+	// ValidateRewriteTableID checks the files are rewritten into the right tables (Default false).
+	ValidateRewriteTableID bool `json:"validate-rewrite-table-id" toml:"validate-rewrite-table-id"`
+	// TraceMergeDecisions logs every decision of merging ranges, for debugging the split keys only.
+	TraceMergeDecisions bool `json:"trace-merge-decisions" toml:"trace-merge-decisions"`
+	// RegionMaxSizeBytes is the max size of a region, above which files are oversized (Default 0, disabled).
+	RegionMaxSizeBytes uint64 `json:"region-max-size-bytes" toml:"region-max-size-bytes"`
+	// OversizedFilesPolicy is the policy on the oversized files (Default ignore).
+	OversizedFilesPolicy restore.OversizedFilesPolicy `json:"oversized-files-policy" toml:"oversized-files-policy"`
+	// CollectAllErrors reports all the errors of validating the files at once (Default false, fail fast).
+	CollectAllErrors bool `json:"collect-all-errors" toml:"collect-all-errors"`
+	// SplitAtIndexBoundaries splits the ranges at the prefixes of the indexes and records (Default false).
+	SplitAtIndexBoundaries bool `json:"split-at-index-boundaries" toml:"split-at-index-boundaries"`
+	// MergeMemoryBudgetBytes bounds the merged ranges not restored yet (Default 0, unlimited).
+	MergeMemoryBudgetBytes uint64 `json:"merge-memory-budget-bytes" toml:"merge-memory-budget-bytes"`
+	// CFGroupOrder is the order of the CFs in which the files of every batch are restored (Default empty, at once).
+	CFGroupOrder []string `json:"cf-group-order" toml:"cf-group-order"`
+	// GroupSkewRatio warns about the tables larger than the ratio times the median one (Default 0, disabled).
+	GroupSkewRatio float64 `json:"group-skew-ratio" toml:"group-skew-ratio"`
+}
+
+// mergeConfig returns the config of merging the ranges of files.
+func (cfg *RestoreCommonConfig) mergeConfig() restore.MergeConfig {
+	mergeCfg := restore.MergeConfig{
+		SplitSizeBytes:         cfg.MergeSmallRegionSizeBytes,
+		SplitKeyCount:          cfg.MergeSmallRegionKeyCount,
+		MinFileSizeBytes:       cfg.MergeMinFileSizeBytes,
+		MaxFilesPerGroup:       cfg.MergeMaxFilesPerGroup,
+		DropTombstoneFiles:     cfg.DropTombstoneFiles,
+		SkipEmptyFiles:         cfg.SkipEmptyFiles,
+		NoMerge:                cfg.NoMerge,
+		OrphanFilesPolicy:      cfg.OrphanFilesPolicy,
+		LogMinTableSizeBytes:   cfg.MergeLogMinTableSizeBytes,
+		MaxRangeGapHandles:     cfg.MergeMaxRangeGapHandles,
+		StrictRangeGap:         cfg.StrictRangeGap,
+		ValidateRewriteTableID: cfg.ValidateRewriteTableID,
+		RegionMaxSizeBytes:     cfg.RegionMaxSizeBytes,
+		OversizedFilesPolicy:   cfg.OversizedFilesPolicy,
+		CollectAllErrors:       cfg.CollectAllErrors,
+		SplitAtIndexBoundaries: cfg.SplitAtIndexBoundaries,
+		MemoryBudgetBytes:      cfg.MergeMemoryBudgetBytes,
+		CFGroupOrder:           cfg.CFGroupOrder,
+		GroupSkewRatio:         cfg.GroupSkewRatio,
+	}
+	if cfg.TraceMergeDecisions {
+		mergeCfg.Trace = logMergeDecision
+	}
+	return mergeCfg
+}
+
+func logMergeDecision(d restore.MergeDecision) {
+	log.Info("merge decision",
+		logutil.Key("groupStartKey", d.GroupStartKey),
+		logutil.Key("groupEndKey", d.GroupEndKey),
+		zap.Uint64("group bytes", d.GroupBytes),
+		zap.Uint64("group keys", d.GroupKeys),
+		logutil.Key("startKey", d.RangeStartKey),
+		zap.Uint64("bytes", d.RangeBytes),
+		zap.Uint64("keys", d.RangeKeys),
+		zap.Bool("merged", d.Merged),
+		zap.String("reason", string(d.Reason)))
 }
 
 // adjust adjusts the abnormal config value in the current config.
@@ -78,14 +322,223 @@ func DefineRestoreCommonFlags(flags *pflag.FlagSet) {
 		"the threshold of merging small regions (Default 96MB, region split size)")
 	flags.Uint64(FlagMergeRegionKeyCount, restore.DefaultMergeRegionKeyCount,
 		"the threshold of merging small regions (Default 960_000, region split key count)")
+	flags.Uint64(FlagMergeMinFileSizeBytes, 0,
+		"the size below which files are always merged into their neighbours (Default 0, disabled)")
+	flags.Int(FlagMergeMaxFilesPerGroup, 0,
+		"the count of the files of a merged range at most, even if they are below the min file size (Default 0, unlimited)")
+	flags.Bool(FlagDropTombstoneFiles, false,
+		"drop the files containing only tombstones of incremental backups, only safe when restoring into empty tables")
+	flags.String(FlagOrphanFilesPolicy, string(restore.OrphanFilesStrict),
+		"the policy on the files of the tables not to restore, which usually means the backup files and "+
+			"the metadata mismatch: strict fails, warn logs and skips them, ignore skips them silently")
+	flags.Bool(FlagNoMerge, false,
+		"don't merge the ranges of files, restore the range of every file into a region of its own, "+
+			"for diagnosing ingest issues and small restores only")
+	flags.Bool(FlagSkipEmptyFiles, false,
+		"skip the files of full backups containing no kvs, e.g. the placeholders of empty ranges")
+	flags.Uint64(FlagMergeLogMinTableSizeBytes, 0,
+		"the size below which tables are logged together instead of one by one on merging ranges (Default 0, disabled)")
+	flags.Uint64(FlagMergeMaxRangeGapHandles, 0,
+		"the max gap of handles between the ranges of a table, above which files may be missing (Default 0, disabled)")
+	flags.Bool(FlagStrictRangeGap, false,
+		"fail restoring on the gaps between ranges above --"+FlagMergeMaxRangeGapHandles+", instead of warning")
+	flags.Bool(FlagValidateRewriteTableID, false,
+		"check the start key of every file is rewritten into the right table before restoring")
+	flags.Bool(FlagTraceMergeDecisions, false,
+		"log every decision of merging the ranges of files, for debugging the split keys, expensive for large restores")
+	flags.Uint64(FlagRegionMaxSizeBytes, 0,
+		"the max size of a region of the cluster, the files above it are oversized (Default 0, disabled)")
+	flags.String(FlagOversizedFilesPolicy, string(restore.OversizedFilesIgnore),
+		"the policy on the files larger than --"+FlagRegionMaxSizeBytes+": ignore ingests them as they are, "+
+			"split splits their regions evenly before ingesting, fail refuses to restore")
+	flags.Bool(FlagCollectAllErrors, false,
+		"continue validating the files of the other tables on an error, and report all the errors at once")
+	flags.Bool(FlagSplitAtIndexBoundaries, false,
+		"split the regions of the restored tables exactly at the prefixes of every index and the records")
+	flags.Uint64(FlagMergeMemoryBudgetBytes, 0,
+		"the memory budget of the merged ranges not restored yet, merging waits for restoring "+
+			"once it's exceeded (Default 0, unlimited)")
+	flags.StringSlice(FlagCFGroupOrder, nil,
+		"the order of the CFs in which the files of every restore batch are restored, e.g. write,default "+
+			"restores the write CF files before the default CF files. Empty means restoring them at once.")
+	flags.Float64(FlagGroupSkewRatio, 0,
+		"warn if the size of the largest restored table is above the ratio times the median one, "+
+			"as some stores may be hot on restoring (Default 0, disabled)")
 	flags.Uint(FlagPDConcurrency, defaultPDConcurrency,
 		"concurrency pd-relative operations like split & scatter.")
 	flags.Duration(FlagBatchFlushInterval, defaultBatchFlushInterval,
 		"after how long a restore batch would be auto sended.")
 	_ = flags.MarkHidden(FlagMergeRegionSizeBytes)
 	_ = flags.MarkHidden(FlagMergeRegionKeyCount)
+	_ = flags.MarkHidden(FlagMergeMinFileSizeBytes)
+	_ = flags.MarkHidden(FlagMergeMaxFilesPerGroup)
+	_ = flags.MarkHidden(FlagDropTombstoneFiles)
+	_ = flags.MarkHidden(FlagOrphanFilesPolicy)
+	_ = flags.MarkHidden(FlagNoMerge)
+	_ = flags.MarkHidden(FlagSkipEmptyFiles)
+	_ = flags.MarkHidden(FlagMergeLogMinTableSizeBytes)
+	_ = flags.MarkHidden(FlagMergeMaxRangeGapHandles)
+	_ = flags.MarkHidden(FlagStrictRangeGap)
+	_ = flags.MarkHidden(FlagValidateRewriteTableID)
+	_ = flags.MarkHidden(FlagTraceMergeDecisions)
+	_ = flags.MarkHidden(FlagRegionMaxSizeBytes)
+	_ = flags.MarkHidden(FlagOversizedFilesPolicy)
+	_ = flags.MarkHidden(FlagCollectAllErrors)
+	_ = flags.MarkHidden(FlagSplitAtIndexBoundaries)
+	_ = flags.MarkHidden(FlagMergeMemoryBudgetBytes)
+	_ = flags.MarkHidden(FlagCFGroupOrder)
+	_ = flags.MarkHidden(FlagGroupSkewRatio)
 	_ = flags.MarkHidden(FlagPDConcurrency)
+	flags.Duration(FlagScatterWaitTimeout, restore.ScatterWaitUpperInterval,
+		"how long to wait for scattering the new regions at most after splitting, 0 means not waiting.")
+	flags.Duration(FlagSplitBatchDelay, 0,
+		"how long to wait between the split requests of the regions, to avoid overloading PD.")
+	flags.Duration(FlagSplitBatchJitter, 0,
+		"the upper bound of the random time added to the split batch delay.")
+	flags.Duration(FlagSplitLatencyThreshold, 0,
+		"the latency of a split request above which the delay between the split requests doubles, "+
+			"and halves once the latency recovers. 0 means the delay is static.")
+	flags.Duration(FlagSplitMaxDelay, defaultSplitMaxDelay,
+		"the max delay between the split requests slowed down by --"+FlagSplitLatencyThreshold+".")
+	flags.String(FlagSplitOrder, string(restore.SplitOrderAscending),
+		"the order of submitting the split keys of the regions, one of ascending, descending and "+
+			"largest-gap-first, which splits the middle first. The split keys are the same whatever the order is.")
+	flags.String(FlagRestoreJobID, "",
+		"label the regions created by splitting with the ID of the restore job, by the region label "+
+			restore.RestoreJobLabelKey+", so they could be correlated with the restore later. Empty means no labeling.")
+	flags.StringSlice(FlagDescendingTables, nil,
+		"the filter of the tables whose files are restored from the high end, for the tables queried mostly "+
+			"by reverse scans, in the syntax of --filter. The split keys are unaffected. Empty means none.")
+	flags.Bool(FlagValidateSplitKeys, false,
+		"check the split keys are in the keyspace of the restored tables before splitting.")
+	flags.Bool(FlagNoCrossTableBatch, false,
+		"never put the ranges of different tables into the same restore batch.")
+	flags.Bool(FlagSplitOnTableBoundary, false,
+		"split at the start of every table following another table in a restore batch.")
+	flags.Bool(FlagSplitOnTableStart, false,
+		"split at the start of the first range of every table in a restore batch, including the first table.")
 	_ = flags.MarkHidden(FlagBatchFlushInterval)
+	_ = flags.MarkHidden(FlagScatterWaitTimeout)
+	_ = flags.MarkHidden(FlagSplitBatchDelay)
+	_ = flags.MarkHidden(FlagSplitBatchJitter)
+	_ = flags.MarkHidden(FlagSplitLatencyThreshold)
+	_ = flags.MarkHidden(FlagSplitMaxDelay)
+	_ = flags.MarkHidden(FlagSplitOrder)
+	_ = flags.MarkHidden(FlagRestoreJobID)
+	_ = flags.MarkHidden(FlagDescendingTables)
+	_ = flags.MarkHidden(FlagValidateSplitKeys)
+	_ = flags.MarkHidden(FlagNoCrossTableBatch)
+	_ = flags.MarkHidden(FlagSplitOnTableBoundary)
+	_ = flags.MarkHidden(FlagSplitOnTableStart)
+	flags.Bool(FlagNoTailSplitKey, false,
+		"don't split at the end of the last range of every restore batch, when it's the prefix of the next table.")
+	_ = flags.MarkHidden(FlagNoTailSplitKey)
+	flags.Int(FlagMinRegionsPerStore, 0,
+		"split every restored table into at least the count of regions per TiKV store, by injecting evenly spaced "+
+			"split keys if the data is too small, so ingesting spreads across all stores. The regions of a table are "+
+			"counted across the restore batches. 0 means by the data only.")
+	_ = flags.MarkHidden(FlagMinRegionsPerStore)
+	flags.Uint64(FlagMinSplitKeyDistance, 0,
+		"skip the split keys closer than the distance to the previous split key of the same table or index, "+
+			"e.g. the difference of the int handles of two row keys, so the ranges ending close together don't "+
+			"make tiny regions. 0 means no skipping.")
+	_ = flags.MarkHidden(FlagMinSplitKeyDistance)
+	flags.Int(FlagRestoreFilesRetryTimes, 0,
+		"how many times to retry the unfinished files of a restore batch on a transient error, e.g. a store is unavailable.")
+	_ = flags.MarkHidden(FlagRestoreFilesRetryTimes)
+	flags.Int(FlagDownloadRetryTimes, 0,
+		"how many times to try downloading a file into a region at most, for the flakiness of the external storage. "+
+			"0 means the default.")
+	flags.Int(FlagIngestRetryTimes, 0,
+		"how many times to try ingesting the files of a range at most, for the flakiness of the cluster. "+
+			"0 means the default.")
+	_ = flags.MarkHidden(FlagDownloadRetryTimes)
+	_ = flags.MarkHidden(FlagIngestRetryTimes)
+	flags.StringSlice(FlagCFIngestOrder, nil,
+		"the order of ingesting the files of the CFs into a region by a request per CF, like default,write, "+
+			"so a write CF record never becomes visible before its value. Empty means ingesting all CFs at once.")
+	_ = flags.MarkHidden(FlagCFIngestOrder)
+	flags.Float64(FlagMaxCapacityFill, 0,
+		"check the cluster has the capacity for the restore before restoring, and refuse the restore if "+
+			"the used disk plus the size of the backup times the max replicas exceeds the ratio of the capacity. "+
+			"0 means unchecked.")
+	_ = flags.MarkHidden(FlagMaxCapacityFill)
+	flags.Int(FlagMaxRegionCount, 0,
+		"check the count of regions before splitting, and refuse the restore if the regions of the cluster "+
+			"plus the regions split by the planned keys exceed the count, e.g. the count PD and the stores can handle. 0 means unchecked.")
+	_ = flags.MarkHidden(FlagMaxRegionCount)
+	flags.Int(FlagMaxConcurrentTables, 0,
+		"the count of the distinct tables whose files are restored concurrently at most, regardless of "+
+			"the concurrency of files, e.g. to keep the regions of related tables from scattering all at once. "+
+			"0 means unlimited.")
+	_ = flags.MarkHidden(FlagMaxConcurrentTables)
+	flags.Uint64(FlagGlobalRateLimit, 0,
+		"the total rate limit of restoring files shared by all tables and stores, MB/s, 0 means unlimited. "+
+			"unlike --"+flagRateLimit+", it isn't per store.")
+	_ = flags.MarkHidden(FlagGlobalRateLimit)
+	flags.Uint64(FlagMaxInFlightSize, 0,
+		"the total size of the files being downloaded and ingested at once at most, MB, e.g. to bound "+
+			"the buffers of downloading of the stores. 0 means unlimited.")
+	_ = flags.MarkHidden(FlagMaxInFlightSize)
+	flags.Duration(FlagTimeBudget, 0,
+		"the time budget of the restore, e.g. a maintenance window. Once it's exhausted, no more files are "+
+			"restored, the files in flight are waited for, and the restore stops without an error, reporting "+
+			"the tables left unrestored for the next run. 0 means unlimited.")
+	_ = flags.MarkHidden(FlagTimeBudget)
+	flags.Float64(FlagIngestHighDiskUsage, 0,
+		"the disk usage of stores at or above which the ingest concurrency is halved, 0 means unlimited.")
+	flags.Float64(FlagIngestLowDiskUsage, 0.5,
+		"the disk usage of stores at or below which the ingest concurrency grows back.")
+	_ = flags.MarkHidden(FlagIngestHighDiskUsage)
+	_ = flags.MarkHidden(FlagIngestLowDiskUsage)
+	flags.Bool(FlagKeepPlacementRules, false,
+		"unsafe, keep the placement rules of online restore after restore, they must be removed manually. "+
+			"The rules of the tables failed to restore are removed anyway.")
+	flags.Bool(FlagPlacementRulesAhead, false,
+		"set the placement rules of online restore as soon as the tables are created, instead of before splitting.")
+	flags.Bool(FlagSkipMatchedPlacementRules, false,
+		"skip setting the placement rules of online restore of the tables whose rules already match, "+
+			"e.g. set by a previous run interrupted.")
+	_ = flags.MarkHidden(FlagKeepPlacementRules)
+	_ = flags.MarkHidden(FlagPlacementRulesAhead)
+	_ = flags.MarkHidden(FlagSkipMatchedPlacementRules)
+	flags.Bool(FlagPauseSchedulersOnline, false,
+		"pause the PD schedulers slowing down restoring in online restore too, e.g. the balance schedulers. "+
+			"They are resumed after restore, or by PD once the pausing expires if BR exits unexpectedly.")
+	_ = flags.MarkHidden(FlagPauseSchedulersOnline)
+	flags.String(FlagRegionTemplate, "",
+		"the path of a file of the region boundaries to split exactly at, one hex encoded key per line, "+
+			"instead of splitting by the data. The ranges of files are merged aligned to the boundaries too.")
+	_ = flags.MarkHidden(FlagRegionTemplate)
+	flags.StringSlice(FlagReservedKeyRanges, nil,
+		"the key ranges reserved for others, e.g. the system tables or another tenant, each is a pair of "+
+			"hex encoded keys joined by '-', like 7480-7481. Restoring fails if any file would be restored into them.")
+	_ = flags.MarkHidden(FlagReservedKeyRanges)
+	flags.String(FlagKeyRangeAllowlist, "",
+		"the path of a file of the key ranges of the backup to restore, one pair of hex encoded keys joined by '-' "+
+			"per line, like 7480-7481. Only the files intersecting them are restored, and the checksum is skipped. "+
+			"Empty means restoring all.")
+	_ = flags.MarkHidden(FlagKeyRangeAllowlist)
+	flags.Int(FlagAnalyzeFileEpochs, 0,
+		"report the region epochs parsed from the names of files per table, and warn for the tables "+
+			"whose files span at least the count of epochs, 0 means disabled. It doesn't change restoring.")
+	_ = flags.MarkHidden(FlagAnalyzeFileEpochs)
+	flags.String(FlagAuditOutput, "",
+		"the path to write the audit of which backup files are restored into which ranges of every table "+
+			"in JSON, after the restore succeeds. Empty means no audit.")
+	_ = flags.MarkHidden(FlagAuditOutput)
+	flags.Bool(FlagPlanHash, false,
+		"compute the SHA-256 of the ranges, the files restored into them and the split keys in the keyspace "+
+			"of the backup, log it and record it in the report, so two restores with identical inputs can be "+
+			"proven to have planned identically, whatever IDs the tables are created with.")
+	_ = flags.MarkHidden(FlagPlanHash)
+	flags.Bool(FlagDropLastTableFiles, false,
+		"drop the files of the last table of every restore batch and fail, for fault injection. "+
+			"it requires --"+FlagUnsafeFaultInjection)
+	flags.Bool(FlagUnsafeFaultInjection, false,
+		"allow the fault injection which makes the restored data incomplete.")
+	_ = flags.MarkHidden(FlagDropLastTableFiles)
+	_ = flags.MarkHidden(FlagUnsafeFaultInjection)
 }
 
 // ParseFromFlags parses the config from the flag set.
@@ -103,6 +556,93 @@ func (cfg *RestoreCommonConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.MergeMinFileSizeBytes, err = flags.GetUint64(FlagMergeMinFileSizeBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MergeMaxFilesPerGroup, err = flags.GetInt(FlagMergeMaxFilesPerGroup)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.MergeMaxFilesPerGroup < 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must not be negative, got %d", FlagMergeMaxFilesPerGroup, cfg.MergeMaxFilesPerGroup)
+	}
+	cfg.DropTombstoneFiles, err = flags.GetBool(FlagDropTombstoneFiles)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	orphanFilesPolicy, err := flags.GetString(FlagOrphanFilesPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.OrphanFilesPolicy, err = restore.ParseOrphanFilesPolicy(orphanFilesPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.NoMerge, err = flags.GetBool(FlagNoMerge)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SkipEmptyFiles, err = flags.GetBool(FlagSkipEmptyFiles)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MergeLogMinTableSizeBytes, err = flags.GetUint64(FlagMergeLogMinTableSizeBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MergeMaxRangeGapHandles, err = flags.GetUint64(FlagMergeMaxRangeGapHandles)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.StrictRangeGap, err = flags.GetBool(FlagStrictRangeGap)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.ValidateRewriteTableID, err = flags.GetBool(FlagValidateRewriteTableID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.TraceMergeDecisions, err = flags.GetBool(FlagTraceMergeDecisions)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RegionMaxSizeBytes, err = flags.GetUint64(FlagRegionMaxSizeBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	oversizedFilesPolicy, err := flags.GetString(FlagOversizedFilesPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.OversizedFilesPolicy, err = restore.ParseOversizedFilesPolicy(oversizedFilesPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.CollectAllErrors, err = flags.GetBool(FlagCollectAllErrors)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitAtIndexBoundaries, err = flags.GetBool(FlagSplitAtIndexBoundaries)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MergeMemoryBudgetBytes, err = flags.GetUint64(FlagMergeMemoryBudgetBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.CFGroupOrder, err = flags.GetStringSlice(FlagCFGroupOrder)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = restore.ValidateCFNames(cfg.CFGroupOrder); err != nil {
+		return errors.Annotatef(err, "invalid --%s", FlagCFGroupOrder)
+	}
+	cfg.GroupSkewRatio, err = flags.GetFloat64(FlagGroupSkewRatio)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	return errors.Trace(err)
 }
 
@@ -114,6 +654,96 @@ type RestoreConfig struct {
 	NoSchema           bool          `json:"no-schema" toml:"no-schema"`
 	PDConcurrency      uint          `json:"pd-concurrency" toml:"pd-concurrency"`
 	BatchFlushInterval time.Duration `json:"batch-flush-interval" toml:"batch-flush-interval"`
+	// ScatterWaitTimeout is how long to wait for scattering, 0 means the default, negative means not waiting.
+	ScatterWaitTimeout time.Duration `json:"scatter-wait-timeout" toml:"scatter-wait-timeout"`
+	ValidateSplitKeys  bool          `json:"validate-split-keys" toml:"validate-split-keys"`
+	// SplitBatchDelay and SplitBatchJitter pace the split requests, 0 means no waiting.
+	SplitBatchDelay  time.Duration `json:"split-batch-delay" toml:"split-batch-delay"`
+	SplitBatchJitter time.Duration `json:"split-batch-jitter" toml:"split-batch-jitter"`
+	// SplitLatencyThreshold adapts the delay between the split requests to their latency, 0 means disabled.
+	SplitLatencyThreshold time.Duration `json:"split-latency-threshold" toml:"split-latency-threshold"`
+	SplitMaxDelay         time.Duration `json:"split-max-delay" toml:"split-max-delay"`
+	// SplitOrder is the order of submitting the split keys of the regions (Default ascending).
+	SplitOrder restore.SplitOrder `json:"split-order" toml:"split-order"`
+	// RestoreJobID labels the regions created by splitting, empty means no labeling.
+	RestoreJobID string `json:"restore-job-id" toml:"restore-job-id"`
+	// DescendingTables is the filter of the tables whose files are restored in descending key order.
+	DescendingTables []string `json:"descending-tables" toml:"descending-tables"`
+	// NoCrossTableBatch and SplitOnTableBoundary work independently:
+	// the former keeps every batch in one table, the latter adds split keys between tables in a batch.
+	NoCrossTableBatch    bool `json:"no-cross-table-batch" toml:"no-cross-table-batch"`
+	SplitOnTableBoundary bool `json:"split-on-table-boundary" toml:"split-on-table-boundary"`
+	SplitOnTableStart    bool `json:"split-on-table-start" toml:"split-on-table-start"`
+	NoTailSplitKey       bool `json:"no-tail-split-key" toml:"no-tail-split-key"`
+	// MinRegionsPerStore injects split keys until every table has the count of regions per store, 0 means disabled.
+	MinRegionsPerStore int `json:"min-regions-per-store" toml:"min-regions-per-store"`
+	// MinSplitKeyDistance skips the split keys close to the previous ones, 0 means disabled.
+	MinSplitKeyDistance uint64 `json:"min-split-key-distance" toml:"min-split-key-distance"`
+	// RestoreFilesRetryTimes retries the unfinished files on a transient error, 0 means no retry.
+	RestoreFilesRetryTimes int `json:"restore-files-retry-times" toml:"restore-files-retry-times"`
+	// DownloadRetryTimes and IngestRetryTimes are the retry budgets of downloading and ingesting, 0 means the default.
+	DownloadRetryTimes int `json:"download-retry-times" toml:"download-retry-times"`
+	IngestRetryTimes   int `json:"ingest-retry-times" toml:"ingest-retry-times"`
+	// CFIngestOrder is the order of ingesting the files of the CFs into a region, empty means at once.
+	CFIngestOrder []string `json:"cf-ingest-order" toml:"cf-ingest-order"`
+	// MaxCapacityFill refuses the restores filling the disks of the cluster over the ratio, 0 means unchecked.
+	MaxCapacityFill float64 `json:"max-capacity-fill" toml:"max-capacity-fill"`
+	// MaxRegionCount refuses the restores splitting the regions of the cluster over the count, 0 means unchecked.
+	MaxRegionCount int `json:"max-region-count" toml:"max-region-count"`
+	// MaxConcurrentTables limits the tables whose files are restored concurrently, 0 means unlimited.
+	MaxConcurrentTables int `json:"max-concurrent-tables" toml:"max-concurrent-tables"`
+	// GlobalRateLimit is the total bytes of the files restored per second across all stores, 0 means unlimited.
+	GlobalRateLimit uint64 `json:"global-rate-limit" toml:"global-rate-limit"`
+	// MaxInFlightBytes is the total bytes of the files being restored at once at most, 0 means unlimited.
+	MaxInFlightBytes uint64 `json:"max-in-flight-bytes" toml:"max-in-flight-bytes"`
+	// TimeBudget stops the restore cleanly once it's exhausted, 0 means unlimited.
+	TimeBudget time.Duration `json:"time-budget" toml:"time-budget"`
+	// IngestHighDiskUsage and IngestLowDiskUsage throttle ingesting by the disk usage of stores.
+	// 0 IngestHighDiskUsage means the ingest is never throttled.
+	IngestHighDiskUsage float64 `json:"ingest-high-disk-usage" toml:"ingest-high-disk-usage"`
+	IngestLowDiskUsage  float64 `json:"ingest-low-disk-usage" toml:"ingest-low-disk-usage"`
+	// KeepPlacementRules is for debugging only, the kept rules must be removed manually.
+	KeepPlacementRules bool `json:"keep-placement-rules" toml:"keep-placement-rules"`
+	// PlacementRulesAhead overlaps setting the placement rules with merging the ranges of the files.
+	PlacementRulesAhead bool `json:"placement-rules-ahead" toml:"placement-rules-ahead"`
+	// SkipMatchedPlacementRules skips setting the placement rules of the tables whose rules already match.
+	SkipMatchedPlacementRules bool `json:"skip-matched-placement-rules" toml:"skip-matched-placement-rules"`
+	// PauseSchedulersOnline pauses the PD schedulers in online restore, offline restore always pauses them.
+	PauseSchedulersOnline bool `json:"pause-schedulers-online" toml:"pause-schedulers-online"`
+	// RegionTemplate is the path of the region boundaries managed externally, empty means splitting by the data.
+	RegionTemplate string `json:"region-template" toml:"region-template"`
+	// ReservedKeyRanges are the hex encoded key ranges no file is restored into, like 7480-7481.
+	ReservedKeyRanges []string `json:"reserved-key-ranges" toml:"reserved-key-ranges"`
+	// KeyRangeAllowlist is the path of the key ranges of the backup to restore, empty means restoring all.
+	KeyRangeAllowlist string `json:"key-range-allowlist" toml:"key-range-allowlist"`
+	// AnalyzeFileEpochs reports the tables whose files span at least the count of region epochs, 0 means disabled.
+	AnalyzeFileEpochs int `json:"analyze-file-epochs" toml:"analyze-file-epochs"`
+	// AuditOutput is the path of the audit of the restored ranges, empty means no audit.
+	AuditOutput string `json:"audit-output" toml:"audit-output"`
+	// PlanHash computes the hash of the restored ranges, files and split keys, and records it in the report.
+	PlanHash bool `json:"plan-hash" toml:"plan-hash"`
+	// DropLastTableFiles is for fault injection only, it is refused unless UnsafeFaultInjection is set.
+	DropLastTableFiles   bool `json:"drop-last-table-files" toml:"drop-last-table-files"`
+	UnsafeFaultInjection bool `json:"unsafe-fault-injection" toml:"unsafe-fault-injection"`
+
+	RecoverTiFlashReplica     bool          `json:"recover-tiflash-replica" toml:"recover-tiflash-replica"`
+	TiFlashReplicaWaitTimeout time.Duration `json:"tiflash-replica-wait-timeout" toml:"tiflash-replica-wait-timeout"`
+	// CompactAfterRestore is the scope of compacting the restored tables after restore, empty means no compaction.
+	CompactAfterRestore restore.CompactionScope `json:"compact-after-restore" toml:"compact-after-restore"`
+	// PreWarm reads the samples of the restored tables after restore, 0 samples per table means no pre-warming.
+	PreWarm restore.PreWarmConfig `json:"pre-warm" toml:"pre-warm"`
+	// VerifySampleRate is the ratio of the files to verify the checksums, 0 means no verifying.
+	VerifySampleRate float64 `json:"verify-sample-rate" toml:"verify-sample-rate"`
+	// VerifyConcurrency is the count of the sampled files verified concurrently at most.
+	VerifyConcurrency uint `json:"verify-concurrency" toml:"verify-concurrency"`
+	// TailSplit splits the tails of the tables with sequential int handles finer, 0 keys means disabled.
+	TailSplit restore.TailSplitConfig `json:"tail-split" toml:"tail-split"`
+	// DisablePDHTTP restores without the PD HTTP API, the features depending on it are disabled.
+	DisablePDHTTP bool `json:"disable-pd-http" toml:"disable-pd-http"`
+	// PrevalidatePlan inspects the restore plan before anything is split or ingested, nil means no inspection.
+	// It's for the callers embedding BR, e.g. a policy engine rejecting a restore touching certain tables.
+	// The tables are already created then, and left behind on rejecting, see restore.Client.GoPrevalidatePlan.
+	PrevalidatePlan restore.PrevalidatePlanFunc `json:"-" toml:"-"`
 }
 
 // DefineRestoreFlags defines common flags for the restore tidb command.
@@ -121,6 +751,41 @@ func DefineRestoreFlags(flags *pflag.FlagSet) {
 	flags.Bool(flagNoSchema, false, "skip creating schemas and tables, reuse existing empty ones")
 	// Do not expose this flag
 	_ = flags.MarkHidden(flagNoSchema)
+	flags.Bool(flagRecoverTiFlashReplica, false,
+		"set the tiflash replica of restored tables as the backup cluster after restore")
+	flags.Duration(flagTiFlashReplicaWaitTimeout, 0,
+		"how long to wait for the recovered tiflash replicas being available, 0 means don't wait")
+	flags.String(flagCompactAfterRestore, "",
+		"compact the keyspaces of the restored tables on all stores after restore, so the tables are ready for "+
+			"querying sooner. \"table\" compacts every table separately, \"global\" compacts the span of all tables "+
+			"at once, empty means no compaction.")
+	_ = flags.MarkHidden(flagCompactAfterRestore)
+	flags.Int(flagPreWarmSamplesPerTable, 0,
+		"read the keys of the count of the ranges of the files restored into every restored table, picked evenly, "+
+			"after restore, so the cache of the stores is warm for the first queries. 0 means no pre-warming.")
+	flags.Int(flagPreWarmKeysPerSample, defaultPreWarmKeysPerSample,
+		"how many keys to read from every part of the restored tables at most on pre-warming.")
+	_ = flags.MarkHidden(flagPreWarmSamplesPerTable)
+	_ = flags.MarkHidden(flagPreWarmKeysPerSample)
+	flags.Float64(flagVerifySampleRate, 0,
+		"verify the checksums of the ratio of the files, in [0, 1], before importing them. The sample is "+
+			"by the names of the files, so every run verifies the same files. 0 means no verifying.")
+	flags.Uint(flagVerifyConcurrency, restore.DefaultVerifyConcurrency,
+		"the count of the sampled files verified concurrently at most, apart from the concurrency of restoring, "+
+			"since verifying reads the whole files from the external storage.")
+	_ = flags.MarkHidden(flagVerifySampleRate)
+	_ = flags.MarkHidden(flagVerifyConcurrency)
+	flags.Int(flagTailSplitKeys, 0,
+		"add the count of split keys to the tail of every table with a sequential int handle, e.g. an auto-increment "+
+			"int primary key, so the region taking the inserts after restore is split ahead. 0 means disabled.")
+	flags.Uint64(flagTailSplitHandleStep, defaultTailSplitHandleStep,
+		"the difference of the int handles between two adjacent split keys of the tail of a table.")
+	_ = flags.MarkHidden(flagTailSplitKeys)
+	_ = flags.MarkHidden(flagTailSplitHandleStep)
+	flags.Bool(flagDisablePDHTTP, false,
+		"restore without the PD HTTP API, e.g. where it's unreachable by TLS or ACL restrictions. The features "+
+			"depending on it, e.g. checking whether to scatter, placement rules and store labels, are disabled.")
+	_ = flags.MarkHidden(flagDisablePDHTTP)
 
 	DefineRestoreCommonFlags(flags)
 }
@@ -152,6 +817,254 @@ func (cfg *RestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Annotatef(err, "failed to get flag %s", FlagBatchFlushInterval)
 	}
+	cfg.ScatterWaitTimeout, err = flags.GetDuration(FlagScatterWaitTimeout)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagScatterWaitTimeout)
+	}
+	if cfg.ScatterWaitTimeout == 0 {
+		// 0 of the flag means not waiting, while 0 of the config means the default.
+		cfg.ScatterWaitTimeout = noScatterWait
+	}
+	cfg.SplitBatchDelay, err = flags.GetDuration(FlagSplitBatchDelay)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitBatchDelay)
+	}
+	cfg.SplitBatchJitter, err = flags.GetDuration(FlagSplitBatchJitter)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitBatchJitter)
+	}
+	cfg.SplitLatencyThreshold, err = flags.GetDuration(FlagSplitLatencyThreshold)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitLatencyThreshold)
+	}
+	cfg.SplitMaxDelay, err = flags.GetDuration(FlagSplitMaxDelay)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitMaxDelay)
+	}
+	splitOrder, err := flags.GetString(FlagSplitOrder)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitOrder)
+	}
+	cfg.SplitOrder, err = restore.ParseSplitOrder(splitOrder)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RestoreJobID, err = flags.GetString(FlagRestoreJobID)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagRestoreJobID)
+	}
+	cfg.DescendingTables, err = flags.GetStringSlice(FlagDescendingTables)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagDescendingTables)
+	}
+	if len(cfg.DescendingTables) > 0 {
+		if _, err := filter.Parse(cfg.DescendingTables); err != nil {
+			return errors.Annotatef(berrors.ErrInvalidArgument, "invalid --%s: %s", FlagDescendingTables, err)
+		}
+	}
+	cfg.ValidateSplitKeys, err = flags.GetBool(FlagValidateSplitKeys)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagValidateSplitKeys)
+	}
+	cfg.NoCrossTableBatch, err = flags.GetBool(FlagNoCrossTableBatch)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagNoCrossTableBatch)
+	}
+	cfg.SplitOnTableBoundary, err = flags.GetBool(FlagSplitOnTableBoundary)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitOnTableBoundary)
+	}
+	cfg.SplitOnTableStart, err = flags.GetBool(FlagSplitOnTableStart)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSplitOnTableStart)
+	}
+	cfg.NoTailSplitKey, err = flags.GetBool(FlagNoTailSplitKey)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagNoTailSplitKey)
+	}
+	cfg.MinRegionsPerStore, err = flags.GetInt(FlagMinRegionsPerStore)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagMinRegionsPerStore)
+	}
+	cfg.MinSplitKeyDistance, err = flags.GetUint64(FlagMinSplitKeyDistance)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagMinSplitKeyDistance)
+	}
+	cfg.RestoreFilesRetryTimes, err = flags.GetInt(FlagRestoreFilesRetryTimes)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagRestoreFilesRetryTimes)
+	}
+	cfg.DownloadRetryTimes, err = flags.GetInt(FlagDownloadRetryTimes)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagDownloadRetryTimes)
+	}
+	cfg.IngestRetryTimes, err = flags.GetInt(FlagIngestRetryTimes)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagIngestRetryTimes)
+	}
+	cfg.CFIngestOrder, err = flags.GetStringSlice(FlagCFIngestOrder)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagCFIngestOrder)
+	}
+	if err = restore.ValidateCFNames(cfg.CFIngestOrder); err != nil {
+		return errors.Annotatef(err, "invalid --%s", FlagCFIngestOrder)
+	}
+	cfg.MaxCapacityFill, err = flags.GetFloat64(FlagMaxCapacityFill)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagMaxCapacityFill)
+	}
+	cfg.MaxRegionCount, err = flags.GetInt(FlagMaxRegionCount)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagMaxRegionCount)
+	}
+	cfg.MaxConcurrentTables, err = flags.GetInt(FlagMaxConcurrentTables)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagMaxConcurrentTables)
+	}
+	globalRateLimit, err := flags.GetUint64(FlagGlobalRateLimit)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagGlobalRateLimit)
+	}
+	cfg.GlobalRateLimit = globalRateLimit * units.MiB
+	maxInFlightSize, err := flags.GetUint64(FlagMaxInFlightSize)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagMaxInFlightSize)
+	}
+	cfg.MaxInFlightBytes = maxInFlightSize * units.MiB
+	cfg.TimeBudget, err = flags.GetDuration(FlagTimeBudget)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagTimeBudget)
+	}
+	cfg.IngestHighDiskUsage, err = flags.GetFloat64(FlagIngestHighDiskUsage)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagIngestHighDiskUsage)
+	}
+	cfg.IngestLowDiskUsage, err = flags.GetFloat64(FlagIngestLowDiskUsage)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagIngestLowDiskUsage)
+	}
+	if cfg.IngestHighDiskUsage < 0 || cfg.IngestHighDiskUsage > 1 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must be in [0, 1], got %v", FlagIngestHighDiskUsage, cfg.IngestHighDiskUsage)
+	}
+	if cfg.IngestLowDiskUsage < 0 || cfg.IngestLowDiskUsage > 1 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must be in [0, 1], got %v", FlagIngestLowDiskUsage, cfg.IngestLowDiskUsage)
+	}
+	// the concurrency would be halved and grown back on the same disk usage.
+	if cfg.IngestHighDiskUsage > 0 && cfg.IngestLowDiskUsage >= cfg.IngestHighDiskUsage {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must be less than --%s, got %v and %v", FlagIngestLowDiskUsage, FlagIngestHighDiskUsage,
+			cfg.IngestLowDiskUsage, cfg.IngestHighDiskUsage)
+	}
+	cfg.KeepPlacementRules, err = flags.GetBool(FlagKeepPlacementRules)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagKeepPlacementRules)
+	}
+	cfg.PlacementRulesAhead, err = flags.GetBool(FlagPlacementRulesAhead)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagPlacementRulesAhead)
+	}
+	cfg.SkipMatchedPlacementRules, err = flags.GetBool(FlagSkipMatchedPlacementRules)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagSkipMatchedPlacementRules)
+	}
+	cfg.PauseSchedulersOnline, err = flags.GetBool(FlagPauseSchedulersOnline)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagPauseSchedulersOnline)
+	}
+	cfg.RegionTemplate, err = flags.GetString(FlagRegionTemplate)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagRegionTemplate)
+	}
+	cfg.ReservedKeyRanges, err = flags.GetStringSlice(FlagReservedKeyRanges)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagReservedKeyRanges)
+	}
+	cfg.KeyRangeAllowlist, err = flags.GetString(FlagKeyRangeAllowlist)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagKeyRangeAllowlist)
+	}
+	// the tables restored partially never match the checksums of the whole tables in the backup.
+	if cfg.KeyRangeAllowlist != "" && cfg.Checksum {
+		if flags.Changed(flagChecksum) {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"--%s can't be used with --%s, the tables are restored partially",
+				flagChecksum, FlagKeyRangeAllowlist)
+		}
+		log.Info("skip the checksum of the tables restored partially by the key range allowlist")
+		cfg.Checksum = false
+	}
+	cfg.AnalyzeFileEpochs, err = flags.GetInt(FlagAnalyzeFileEpochs)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagAnalyzeFileEpochs)
+	}
+	cfg.AuditOutput, err = flags.GetString(FlagAuditOutput)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagAuditOutput)
+	}
+	cfg.PlanHash, err = flags.GetBool(FlagPlanHash)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagPlanHash)
+	}
+	cfg.DropLastTableFiles, err = flags.GetBool(FlagDropLastTableFiles)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagDropLastTableFiles)
+	}
+	cfg.UnsafeFaultInjection, err = flags.GetBool(FlagUnsafeFaultInjection)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", FlagUnsafeFaultInjection)
+	}
+	cfg.RecoverTiFlashReplica, err = flags.GetBool(flagRecoverTiFlashReplica)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagRecoverTiFlashReplica)
+	}
+	cfg.TiFlashReplicaWaitTimeout, err = flags.GetDuration(flagTiFlashReplicaWaitTimeout)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagTiFlashReplicaWaitTimeout)
+	}
+	compactAfterRestore, err := flags.GetString(flagCompactAfterRestore)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagCompactAfterRestore)
+	}
+	if compactAfterRestore != "" {
+		cfg.CompactAfterRestore, err = restore.ParseCompactionScope(compactAfterRestore)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	cfg.PreWarm.SamplesPerTable, err = flags.GetInt(flagPreWarmSamplesPerTable)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagPreWarmSamplesPerTable)
+	}
+	cfg.PreWarm.KeysPerSample, err = flags.GetInt(flagPreWarmKeysPerSample)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagPreWarmKeysPerSample)
+	}
+	cfg.VerifySampleRate, err = flags.GetFloat64(flagVerifySampleRate)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagVerifySampleRate)
+	}
+	if cfg.VerifySampleRate < 0 || cfg.VerifySampleRate > 1 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must be in [0, 1], got %v", flagVerifySampleRate, cfg.VerifySampleRate)
+	}
+	cfg.VerifyConcurrency, err = flags.GetUint(flagVerifyConcurrency)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagVerifyConcurrency)
+	}
+	cfg.TailSplit.Keys, err = flags.GetInt(flagTailSplitKeys)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagTailSplitKeys)
+	}
+	cfg.TailSplit.HandleStep, err = flags.GetUint64(flagTailSplitHandleStep)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagTailSplitHandleStep)
+	}
+	cfg.DisablePDHTTP, err = flags.GetBool(flagDisablePDHTTP)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get flag %s", flagDisablePDHTTP)
+	}
 	return nil
 }
 
@@ -175,6 +1088,9 @@ func (cfg *RestoreConfig) adjustRestoreConfig() {
 	if cfg.BatchFlushInterval == 0 {
 		cfg.BatchFlushInterval = defaultBatchFlushInterval
 	}
+	if cfg.ScatterWaitTimeout == 0 {
+		cfg.ScatterWaitTimeout = restore.ScatterWaitUpperInterval
+	}
 }
 
 // CheckRestoreDBAndTable is used to check whether the restore dbs or tables have been backup
@@ -212,9 +1128,103 @@ func CheckRestoreDBAndTable(client *restore.Client, cfg *RestoreConfig) error {
 	return nil
 }
 
+// RestoreReport is the machine-readable result of a restore task.
+type RestoreReport struct {
+	Tables     int    `json:"tables"`
+	Files      int    `json:"files"`
+	TotalKVs   uint64 `json:"total-kvs"`
+	TotalBytes uint64 `json:"total-bytes"`
+	// RestoredFiles is the count of the files actually restored, excluding the skipped ones.
+	RestoredFiles int64 `json:"restored-files"`
+	// NoNewFiles is set if no file is restored by the run, e.g. all files are skipped,
+	// so the steps after restore on the data, e.g. analyzing and verifying, may be skipped.
+	NoNewFiles bool `json:"no-new-files"`
+	// BudgetExhausted is set if the restore stopped by the time budget with files left unrestored,
+	// it isn't a failure, the UnrestoredTables can be restored by the next run.
+	BudgetExhausted bool `json:"budget-exhausted"`
+	// UnrestoredTables are the IDs of the restored tables with files left unrestored by the time budget.
+	UnrestoredTables []int64 `json:"unrestored-tables,omitempty"`
+	// SplitKeys is the count of the keys used to split regions.
+	SplitKeys int64 `json:"split-keys"`
+	// PlanHash is the hash of the restored ranges, files and split keys, empty unless it's enabled.
+	PlanHash string `json:"plan-hash,omitempty"`
+	// InjectedSplitKeys is the count of the split keys injected for the min regions per store.
+	InjectedSplitKeys int64 `json:"injected-split-keys"`
+	// Sequences are the values set to the restored sequences, by "db.sequence".
+	Sequences map[string]int64 `json:"sequences"`
+	// VerifiedFiles and MismatchedFiles are the count of the files sampled to verify the checksums and mismatched.
+	VerifiedFiles   int64 `json:"verified-files"`
+	MismatchedFiles int64 `json:"mismatched-files"`
+	// PreWarmCoverage is the ratio of the parts of the restored tables with any key read by pre-warming.
+	PreWarmCoverage float64 `json:"pre-warm-coverage,omitempty"`
+	// StageDurations is the time taken by every stage of the restore,
+	// i.e. "prepare", "restore" and "post restore".
+	StageDurations map[string]time.Duration `json:"stage-durations"`
+	// Warnings are the failures which don't fail the restore.
+	Warnings []string `json:"warnings"`
+}
+
+func newRestoreReport() *RestoreReport {
+	return &RestoreReport{
+		Sequences:      make(map[string]int64),
+		StageDurations: make(map[string]time.Duration),
+	}
+}
+
+// collectSequences collects the values set to the sequences, which are set on creating them.
+func (report *RestoreReport) collectSequences(tables []*metautil.Table) {
+	for _, t := range tables {
+		if t.Info.IsSequence() {
+			report.Sequences[fmt.Sprintf("%s.%s", t.DB.Name, t.Info.Name)] = t.Info.AutoIncID
+		}
+	}
+}
+
+// collectFiles collects the count of the tables and the size of the files to restore.
+func (report *RestoreReport) collectFiles(tables []*metautil.Table, files []*backuppb.File) {
+	report.Tables = len(tables)
+	report.Files = len(files)
+	for _, file := range files {
+		report.TotalKVs += file.TotalKvs
+		report.TotalBytes += file.TotalBytes
+	}
+}
+
+// collectRestoredFiles collects the count of the files actually restored by the run.
+func (report *RestoreReport) collectRestoredFiles(restored int64) {
+	report.RestoredFiles = restored
+	report.NoNewFiles = restored == 0
+}
+
+// collectUnrestoredTables records the tables left unrestored by the time budget.
+func (report *RestoreReport) collectUnrestoredTables(tableIDs []int64) {
+	report.BudgetExhausted = len(tableIDs) > 0
+	if report.BudgetExhausted {
+		report.UnrestoredTables = tableIDs
+	}
+}
+
+// recordStage records the duration of the stage started at start, and returns the end of the stage.
+func (report *RestoreReport) recordStage(stage string, start time.Time) time.Time {
+	end := time.Now()
+	report.StageDurations[stage] = end.Sub(start)
+	return end
+}
+
 // RunRestore starts a restore task inside the current goroutine.
 func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConfig) error {
+	_, err := RunRestoreWithReport(c, g, cmdName, cfg)
+	return err
+}
+
+// RunRestoreWithReport starts a restore task inside the current goroutine,
+// and returns the report of the task, which is incomplete on error.
+func RunRestoreWithReport(
+	c context.Context, g glue.Glue, cmdName string, cfg *RestoreConfig,
+) (*RestoreReport, error) {
 	cfg.adjustRestoreConfig()
+	report := newRestoreReport()
+	stageStart := time.Now()
 
 	defer summary.Summary(cmdName)
 	ctx, cancel := context.WithCancel(c)
@@ -230,7 +1240,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	needDomain := true
 	mgr, err := NewMgr(ctx, g, cfg.PD, cfg.TLS, GetKeepalive(&cfg.Config), cfg.CheckRequirements, needDomain)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 	defer mgr.Close()
 
@@ -238,13 +1248,16 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	keepaliveCfg.PermitWithoutStream = true
 	client, err := restore.NewRestoreClient(g, mgr.GetPDClient(), mgr.GetStorage(), mgr.GetTLSConfig(), keepaliveCfg)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 	defer client.Close()
+	if cfg.DisablePDHTTP {
+		client.DisablePDHTTP()
+	}
 
 	u, err := storage.ParseBackend(cfg.Storage, &cfg.BackendOptions)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 	opts := storage.ExternalStorageOptions{
 		NoCredentials:   cfg.NoCreds,
@@ -252,7 +1265,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 		SkipCheckPath:   cfg.SkipCheckPath,
 	}
 	if err = client.SetStorage(ctx, u, &opts); err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 	client.SetRateLimit(cfg.RateLimit)
 	client.SetCrypter(&cfg.CipherInfo)
@@ -260,39 +1273,174 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if cfg.Online {
 		client.EnableOnline()
 	}
+	if cfg.KeepPlacementRules {
+		client.EnableKeepPlacementRules()
+	}
+	if cfg.SkipMatchedPlacementRules {
+		client.EnableSkipMatchedPlacementRules()
+	}
 	if cfg.NoSchema {
 		client.EnableSkipCreateSQL()
 	}
 	client.SetSwitchModeInterval(cfg.SwitchModeInterval)
+	client.SetScatterWaitTimeout(cfg.ScatterWaitTimeout)
+	client.SetSplitBatchDelay(cfg.SplitBatchDelay, cfg.SplitBatchJitter)
+	if cfg.SplitLatencyThreshold > 0 {
+		client.SetSplitPacer(restore.NewSplitPacer(cfg.SplitLatencyThreshold, cfg.SplitMaxDelay))
+	}
+	client.SetSplitOrder(cfg.SplitOrder)
+	client.SetRestoreJobLabel(cfg.RestoreJobID)
+	mergeCfg := cfg.mergeConfig()
+	// the ranges are streamed table by table, so the CFs are ordered on restoring every batch instead.
+	client.SetCFGroupOrder(mergeCfg.CFGroupOrder)
+	if cfg.RegionTemplate != "" {
+		regionTemplate, err := loadRegionTemplate(cfg.RegionTemplate)
+		if err != nil {
+			return report, errors.Trace(err)
+		}
+		log.Info("split regions by the region template",
+			zap.String("path", cfg.RegionTemplate), zap.Int("keys", len(regionTemplate)))
+		client.SetRegionTemplate(regionTemplate)
+		mergeCfg.RegionTemplate = regionTemplate
+	}
+	if len(cfg.ReservedKeyRanges) > 0 {
+		mergeCfg.ReservedKeyRanges, err = parseKeyRanges(cfg.ReservedKeyRanges, "reserved")
+		if err != nil {
+			return report, errors.Trace(err)
+		}
+	}
+	if cfg.KeyRangeAllowlist != "" {
+		mergeCfg.KeyRangeAllowlist, err = loadKeyRangeAllowlist(cfg.KeyRangeAllowlist)
+		if err != nil {
+			return report, errors.Trace(err)
+		}
+		log.Info("restore the files in the key range allowlist",
+			zap.String("path", cfg.KeyRangeAllowlist), zap.Int("ranges", len(mergeCfg.KeyRangeAllowlist)))
+		// the files are cut to the allowlist, so are the downloaded keys of them.
+		client.EnableFileRangeCut()
+	}
+	if cfg.ValidateSplitKeys {
+		client.EnableSplitKeyValidation()
+	}
+	if cfg.SplitOnTableBoundary {
+		client.EnableSplitOnTableBoundary()
+	}
+	if cfg.SplitOnTableStart {
+		client.EnableSplitOnTableStart()
+	}
+	if cfg.NoTailSplitKey {
+		client.SkipTailSplitKey()
+	}
+	if cfg.MinRegionsPerStore > 0 {
+		stores, err := conn.GetAllTiKVStores(ctx, mgr.GetPDClient(), conn.SkipTiFlash)
+		if err != nil {
+			return report, errors.Trace(err)
+		}
+		log.Info("split into the min regions per store",
+			zap.Int("stores", len(stores)), zap.Int("regions per store", cfg.MinRegionsPerStore))
+		client.SetMinRegions(len(stores) * cfg.MinRegionsPerStore)
+	}
+	client.SetMinSplitKeyDistance(cfg.MinSplitKeyDistance)
+	if cfg.OversizedFilesPolicy == restore.OversizedFilesSplit {
+		client.SetRegionMaxSize(cfg.RegionMaxSizeBytes)
+	}
+	client.SetRestoreFilesRetry(cfg.RestoreFilesRetryTimes, restoreFilesRetryInterval)
+	client.SetImportRetry(
+		restore.ImportRetryConfig{Attempts: cfg.DownloadRetryTimes},
+		restore.ImportRetryConfig{Attempts: cfg.IngestRetryTimes})
+	client.SetCFIngestOrder(cfg.CFIngestOrder)
+	client.SetMaxConcurrentTables(cfg.MaxConcurrentTables)
+	if cfg.MaxCapacityFill > 0 {
+		client.SetClusterCapacityCheck(restore.NewPDClusterCapacitySource(mgr.PdController), cfg.MaxCapacityFill)
+	}
+	if cfg.MaxRegionCount > 0 {
+		client.SetRegionCountCheck(restore.NewPDRegionCountSource(mgr.PdController, cfg.MaxRegionCount))
+	}
+	client.SetGlobalBandwidthLimit(cfg.GlobalRateLimit)
+	client.SetMaxInFlightBytes(cfg.MaxInFlightBytes)
+	client.SetTimeBudget(cfg.TimeBudget)
+	if cfg.CompactAfterRestore != "" {
+		metaClient := restore.NewSplitClient(mgr.GetPDClient(), mgr.GetTLSConfig())
+		client.SetPostRestoreCompaction(
+			restore.NewStoreCompactionTrigger(
+				mgr.GetPDClient(), restore.NewImportClient(metaClient, mgr.GetTLSConfig(), keepaliveCfg)),
+			cfg.CompactAfterRestore)
+	}
+	if cfg.PreWarm.SamplesPerTable > 0 {
+		client.SetPreWarm(restore.NewStorageRangeWarmer(mgr.GetStorage()), cfg.PreWarm)
+	}
+	client.SetTailSplit(cfg.TailSplit)
+	if cfg.IngestHighDiskUsage > 0 {
+		client.SetIngestThrottle(restore.NewIngestThrottle(
+			restore.NewPDDiskUsageSource(mgr.PdController),
+			restore.IngestThrottleConfig{
+				HighDiskUsage:  cfg.IngestHighDiskUsage,
+				LowDiskUsage:   cfg.IngestLowDiskUsage,
+				MaxConcurrency: int(cfg.Concurrency),
+				CheckInterval:  ingestDiskUsageCheckInterval,
+			}))
+	}
+	if cfg.DropLastTableFiles {
+		if err = client.EnableDropLastTableFiles(cfg.UnsafeFaultInjection); err != nil {
+			return report, errors.Trace(err)
+		}
+	}
 	err = client.LoadRestoreStores(ctx)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 
 	u, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, &cfg.Config)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 	backupVersion := version.NormalizeBackupVersion(backupMeta.ClusterVersion)
 	if cfg.CheckRequirements && backupVersion != nil {
 		if versionErr := version.CheckClusterVersion(ctx, mgr.GetPDClient(), version.CheckVersionForBackup(backupVersion)); versionErr != nil {
-			return errors.Trace(versionErr)
+			return report, errors.Trace(versionErr)
 		}
 	}
 	reader := metautil.NewMetaReader(backupMeta, s, &cfg.CipherInfo)
 	if err = client.InitBackupMeta(c, backupMeta, u, s, reader); err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
+	}
+	if cfg.VerifySampleRate > 0 {
+		client.SetFileVerifier(restore.NewStorageFileVerifier(s, &cfg.CipherInfo), cfg.VerifySampleRate)
+		client.SetVerifyConcurrency(cfg.VerifyConcurrency)
+		defer func() {
+			report.VerifiedFiles, report.MismatchedFiles = client.VerifiedFileCount()
+			log.Info("verified the checksums of the sampled files",
+				zap.Float64("sample rate", cfg.VerifySampleRate),
+				zap.Int64("verified", report.VerifiedFiles),
+				zap.Int64("mismatched", report.MismatchedFiles))
+		}()
 	}
 
 	if client.IsRawKvMode() {
-		return errors.Annotate(berrors.ErrRestoreModeMismatch, "cannot do transactional restore from raw kv data")
+		return report, errors.Annotate(berrors.ErrRestoreModeMismatch, "cannot do transactional restore from raw kv data")
 	}
 	if err = CheckRestoreDBAndTable(client, cfg); err != nil {
-		return err
+		return report, err
 	}
 	files, tables, dbs := filterRestoreFiles(client, cfg)
 	if len(dbs) == 0 && len(tables) != 0 {
-		return errors.Annotate(berrors.ErrRestoreInvalidBackup, "contain tables but no databases")
+		return report, errors.Annotate(berrors.ErrRestoreInvalidBackup, "contain tables but no databases")
+	}
+	report.collectFiles(tables, files)
+	var descending []int64
+	if len(cfg.DescendingTables) > 0 {
+		descending, err = descendingTableIDs(cfg.DescendingTables, tables)
+		if err != nil {
+			return report, errors.Trace(err)
+		}
+		log.Info("restore the files of tables in descending key order", zap.Int64s("table ids", descending))
+		client.SetDescendingTables(descending)
+	}
+	if err = client.CheckClusterCapacity(ctx, files); err != nil {
+		return report, errors.Trace(err)
+	}
+	if cfg.AnalyzeFileEpochs > 0 {
+		restore.LogFileEpochs(restore.AnalyzeFileEpochs(files), cfg.AnalyzeFileEpochs)
 	}
 	archiveSize := reader.ArchiveSize(ctx, files)
 	g.Record(summary.RestoreDataSize, archiveSize)
@@ -300,7 +1448,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	g.Record("Size", archiveSize)
 	restoreTS, err := client.GetTS(ctx)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 
 	sp := utils.BRServiceSafePoint{
@@ -315,7 +1463,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	// so, we should keep the safe point unchangeable. to avoid GC life time is shorter than transaction duration.
 	err = utils.StartServiceSafePointKeeper(ctx, mgr.GetPDClient(), sp)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 
 	var newTS uint64
@@ -326,12 +1474,20 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 
 	err = client.PreCheckTableTiFlashReplica(ctx, tables)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 
 	err = client.PreCheckTableClusterIndex(tables, ddlJobs, mgr.GetDomain())
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
+	}
+
+	// only incremental backups contain deletes, which must be restored into the tables with rows.
+	if cfg.DropTombstoneFiles && client.IsIncremental() {
+		err = client.PreCheckTablesEmpty(ctx, mgr.GetStorage(), tables, mgr.GetDomain())
+		if err != nil {
+			return report, errors.Annotatef(err, "--%s needs the tables to restore empty", FlagDropTombstoneFiles)
+		}
 	}
 
 	// pre-set TiDB config for restore
@@ -341,7 +1497,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	// execute DDL first
 	err = client.ExecDDLs(ctx, ddlJobs)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 
 	// nothing to restore, maybe only ddl changes in incremental restore
@@ -349,13 +1505,20 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 		log.Info("nothing to restore, all databases and tables are filtered out")
 		// even nothing to restore, we show a success message since there is no failure.
 		summary.SetSuccessStatus(true)
-		return nil
+		return report, nil
 	}
 
+	tableFileMap := restore.MapTableToFiles(files)
+	log.Debug("mapped table to files", zap.Any("result map", tableFileMap))
+	// check the files against the tables in the backup before creating any database or table,
+	// the files of the tables created are checked again by checkCreatedTablesAndFiles.
+	if err = restore.CheckOrphanFiles(tables, tableFileMap, cfg.OrphanFilesPolicy); err != nil {
+		return report, errors.Trace(err)
+	}
 	for _, db := range dbs {
 		err = client.CreateDatabase(ctx, db.Info)
 		if err != nil {
-			return errors.Trace(err)
+			return report, errors.Trace(err)
 		}
 	}
 
@@ -387,30 +1550,50 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 		// don't return immediately, wait all pipeline done.
 	}
 
-	tableFileMap := restore.MapTableToFiles(files)
-	log.Debug("mapped table to files", zap.Any("result map", tableFileMap))
+	var manager restore.ContextManager = restore.NewBRContextManager(client)
+	if cfg.PlacementRulesAhead {
+		aheadManager := restore.NewPrepareAheadContextManager(manager)
+		// the batcher closes the manager too, closing more than once is fine.
+		defer aheadManager.Close(context.Background())
+		tableStream = aheadManager.GoPrepare(ctx, tableStream)
+		manager = aheadManager
+	}
+
+	tableStream = checkCreatedTablesAndFiles(ctx, tableStream, tableFileMap, errCh)
 
 	rangeStream := restore.GoValidateFileRanges(
-		ctx, tableStream, tableFileMap, cfg.MergeSmallRegionSizeBytes, cfg.MergeSmallRegionKeyCount, errCh)
+		ctx, tableStream, tableFileMap, mergeCfg, errCh)
+	// the tables are streamed through the batcher rather than executed as a restore.RestorePlan,
+	// so the plan is only computed here for the inspection and the region count check.
+	client.SetPrevalidatePlan(cfg.PrevalidatePlan)
+	rangeStream = client.GoPrevalidatePlan(ctx, rangeStream, mergeCfg, errCh)
+	var audit *restore.RestoreAudit
+	if cfg.AuditOutput != "" || cfg.PlanHash {
+		audit = restore.NewRestoreAudit()
+		rangeStream = auditTableRanges(ctx, rangeStream, audit, errCh)
+		client.SetSplitKeysCallback(audit.RecordSplitKeys)
+	}
 
 	rangeSize := restore.EstimateRangeSize(files)
 	summary.CollectInt("restore ranges", rangeSize)
 	log.Info("range and file prepared", zap.Int("file count", len(files)), zap.Int("range count", rangeSize))
 
-	restoreSchedulers, err := restorePreWork(ctx, client, mgr)
+	restoreSchedulers, err := restorePreWork(ctx, client, mgr, cfg.PauseSchedulersOnline)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
 	// Always run the post-work even on error, so we don't stuck in the import
 	// mode or emptied schedulers
-	defer restorePostWork(ctx, client, restoreSchedulers)
+	defer func() {
+		report.Warnings = append(report.Warnings, restorePostWork(ctx, client, restoreSchedulers)...)
+	}()
 
 	// Do not reset timestamp if we are doing incremental restore, because
 	// we are not allowed to decrease timestamp.
 	if !client.IsIncremental() {
 		if err = client.ResetTS(ctx, cfg.PD); err != nil {
 			log.Error("reset pd TS failed", zap.Error(err))
-			return errors.Trace(err)
+			return report, errors.Trace(err)
 		}
 	}
 
@@ -431,14 +1614,25 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	defer updateCh.Close()
 	sender, err := restore.NewTiKVSender(ctx, client, updateCh, cfg.PDConcurrency)
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
 	}
-	manager := restore.NewBRContextManager(client)
 	batcher, afterRestoreStream := restore.NewBatcher(ctx, sender, manager, errCh)
 	batcher.SetThreshold(batchSize)
+	if cfg.NoCrossTableBatch {
+		batcher.DisableCrossTableBatch()
+	}
+	if len(descending) > 0 {
+		batcher.SetDescendingTables(descending)
+	}
 	batcher.EnableAutoCommit(ctx, cfg.BatchFlushInterval)
+	stageStart = report.recordStage("prepare", stageStart)
 	go restoreTableStream(ctx, rangeStream, batcher, errCh)
 
+	var restoredTables []restore.CreatedTable
+	if cfg.RecoverTiFlashReplica || cfg.CompactAfterRestore != "" || cfg.PreWarm.SamplesPerTable > 0 {
+		afterRestoreStream = collectCreatedTables(ctx, afterRestoreStream, &restoredTables, errCh)
+	}
+
 	var finish <-chan struct{}
 	// Checksum
 	if cfg.Checksum {
@@ -455,18 +1649,79 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	case <-finish:
 	}
 
+	report.collectRestoredFiles(client.RestoredFileCount())
+	report.collectUnrestoredTables(client.UnrestoredTableIDs())
+	for _, err := range client.PlacementRuleResetErrors() {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("failed to reset the placement rules: %v", err))
+	}
+	report.SplitKeys = client.SplitKeyCount()
+	report.InjectedSplitKeys = client.InjectedSplitKeyCount()
 	// If any error happened, return now.
 	if err != nil {
-		return errors.Trace(err)
+		return report, errors.Trace(err)
+	}
+	if report.BudgetExhausted {
+		log.Warn("restore stopped by the time budget, the tables left aren't restored or checksummed, "+
+			"restore them by the next run", zap.Int64s("unrestored tables", report.UnrestoredTables))
+	}
+	if report.NoNewFiles {
+		log.Info("no new files are restored, the data of the tables is unchanged by this restore")
+	}
+	report.collectSequences(tables)
+	stageStart = report.recordStage("restore", stageStart)
+	if cfg.PlanHash {
+		report.PlanHash = audit.Hash()
+		log.Info("restore plan hash", zap.String("hash", report.PlanHash))
+	}
+	if cfg.AuditOutput != "" {
+		if err := writeRestoreAudit(cfg.AuditOutput, audit); err != nil {
+			return report, errors.Trace(err)
+		}
+	}
+
+	if cfg.RecoverTiFlashReplica {
+		statuses, err := client.RecoverTiFlashReplica(ctx, restoredTables, cfg.TiFlashReplicaWaitTimeout)
+		if err != nil {
+			return report, errors.Trace(err)
+		}
+		summary.CollectInt("tiflash replica tables", len(statuses))
+		for _, status := range statuses {
+			if !status.Skipped && !status.Available {
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("tiflash replica of %s.%s isn't available yet", status.DB, status.Table))
+			}
+		}
+	}
+
+	if cfg.CompactAfterRestore != "" {
+		compactCh := g.StartProgress(ctx, "Compact",
+			int64(len(restore.CompactionRanges(restoredTables, cfg.CompactAfterRestore))), !cfg.LogProgress)
+		err := client.CompactRestoredTables(ctx, restoredTables, compactCh)
+		compactCh.Close()
+		// the data is restored anyway, the compaction only makes querying faster.
+		if err != nil {
+			log.Warn("failed to compact the restored tables", zap.Error(err))
+			report.Warnings = append(report.Warnings, fmt.Sprintf("failed to compact the restored tables: %v", err))
+		}
+	}
+	if cfg.PreWarm.SamplesPerTable > 0 {
+		// pre-warm after compaction, which would evict the cached blocks of the compacted files.
+		stat, err := client.PreWarmRestoredTables(ctx, restoredTables, tableFileMap)
+		report.PreWarmCoverage = stat.Coverage()
+		if err != nil {
+			log.Warn("failed to pre-warm the restored tables", zap.Error(err))
+			report.Warnings = append(report.Warnings, fmt.Sprintf("failed to pre-warm the restored tables: %v", err))
+		}
 	}
 
 	// The cost of rename user table / replace into system table wouldn't be so high.
 	// So leave it out of the pipeline for easier implementation.
 	client.RestoreSystemSchemas(ctx, cfg.TableFilter)
+	report.recordStage("post restore", stageStart)
 
 	// Set task summary to success status.
 	summary.SetSuccessStatus(true)
-	return nil
+	return report, nil
 }
 
 // dropToBlackhole drop all incoming tables into black hole,
@@ -498,6 +1753,87 @@ func dropToBlackhole(
 	return outCh
 }
 
+// auditTableRanges records the ranges of all incoming tables into the audit and passes them through.
+func auditTableRanges(
+	ctx context.Context,
+	rangeStream <-chan restore.TableWithRange,
+	audit *restore.RestoreAudit,
+	errCh chan<- error,
+) <-chan restore.TableWithRange {
+	outCh := make(chan restore.TableWithRange)
+	go func() {
+		defer close(outCh)
+		for {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case t, ok := <-rangeStream:
+				if !ok {
+					return
+				}
+				if err := audit.Record(t); err != nil {
+					errCh <- err
+					return
+				}
+				select {
+				case <-ctx.Done():
+					errCh <- ctx.Err()
+					return
+				case outCh <- t:
+				}
+			}
+		}
+	}()
+	return outCh
+}
+
+// writeRestoreAudit writes the audit into the file of the path in JSON.
+func writeRestoreAudit(path string, audit *restore.RestoreAudit) error {
+	data, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return errors.Annotatef(err, "failed to write the restore audit to %s", path)
+	}
+	log.Info("restore audit written", zap.String("path", path))
+	return nil
+}
+
+// collectCreatedTables records all incoming tables into the slice and passes them through.
+// the slice is complete once the returned channel is closed.
+func collectCreatedTables(
+	ctx context.Context,
+	tableStream <-chan restore.CreatedTable,
+	collected *[]restore.CreatedTable,
+	errCh chan<- error,
+) <-chan restore.CreatedTable {
+	outCh := make(chan restore.CreatedTable)
+	go func() {
+		defer close(outCh)
+		for {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case t, ok := <-tableStream:
+				if !ok {
+					return
+				}
+				*collected = append(*collected, t)
+				select {
+				case <-ctx.Done():
+					errCh <- ctx.Err()
+					return
+				case outCh <- t:
+				}
+			}
+		}
+	}()
+	return outCh
+}
+
 func filterRestoreFiles(
 	client *restore.Client,
 	cfg *RestoreConfig,
@@ -523,11 +1859,190 @@ func filterRestoreFiles(
 	return
 }
 
+// loadRegionTemplate reads the sorted region boundaries from the file of hex encoded keys,
+// one per line, the empty lines are ignored.
+func loadRegionTemplate(path string) ([][]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read region template %s", path)
+	}
+	keys := make([][]byte, 0)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid key at line %d of region template %s: %s", i+1, path, err)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// loadKeyRangeAllowlist reads the key ranges to restore from the file of pairs of hex encoded keys
+// joined by "-", one per line, the empty lines are ignored.
+func loadKeyRangeAllowlist(path string) ([]rtree.Range, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read key range allowlist %s", path)
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	ranges, err := parseKeyRanges(lines, "allowed")
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid key range allowlist %s", path)
+	}
+	return ranges, nil
+}
+
+// parseKeyRanges parses the key ranges of pairs of hex encoded keys joined by "-",
+// the kind of the ranges is for the error messages.
+func parseKeyRanges(ranges []string, kind string) ([]rtree.Range, error) {
+	result := make([]rtree.Range, 0, len(ranges))
+	for _, rg := range ranges {
+		keys := strings.Split(rg, "-")
+		if len(keys) != 2 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid %s key range %s, should be a pair of hex encoded keys joined by '-'", kind, rg)
+		}
+		startKey, err := hex.DecodeString(keys[0])
+		if err != nil {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid start key of %s key range %s: %s", kind, rg, err)
+		}
+		endKey, err := hex.DecodeString(keys[1])
+		if err != nil {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid end key of %s key range %s: %s", kind, rg, err)
+		}
+		if len(endKey) > 0 && bytes.Compare(startKey, endKey) >= 0 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid %s key range %s, the start key should be less than the end key", kind, rg)
+		}
+		result = append(result, rtree.Range{StartKey: startKey, EndKey: endKey})
+	}
+	return result, nil
+}
+
+// descendingTableIDs returns the physical IDs of the tables matched by the filter rules,
+// including the partitions.
+func descendingTableIDs(rules []string, tables []*metautil.Table) ([]int64, error) {
+	f, err := filter.Parse(rules)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "invalid --%s: %s", FlagDescendingTables, err)
+	}
+	f = filter.CaseInsensitive(f)
+	ids := make([]int64, 0)
+	for _, t := range tables {
+		if !f.MatchTable(t.DB.Name.O, t.Info.Name.O) {
+			continue
+		}
+		ids = append(ids, t.Info.ID)
+		if t.Info.Partition != nil {
+			for _, def := range t.Info.Partition.Definitions {
+				ids = append(ids, def.ID)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// checkCreatedTablesAndFiles checks the files really belong to the tables created,
+// so restoring doesn't succeed silently with the files orphaned, or with the data of tables missing.
+// A table with no files is fine only if it's empty, or its checksum is unknown.
+// The files left without any table created are checked when the table stream closes,
+// nothing is restored then.
+func checkCreatedTablesAndFiles(
+	ctx context.Context,
+	tableStream <-chan restore.CreatedTable,
+	tableFileMap map[int64][]*backuppb.File,
+	errCh chan<- error,
+) <-chan restore.CreatedTable {
+	outCh := make(chan restore.CreatedTable)
+	go func() {
+		defer close(outCh)
+		created := 0
+		for {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case t, ok := <-tableStream:
+				if !ok {
+					if created == 0 && len(tableFileMap) != 0 {
+						fileCount := 0
+						for _, files := range tableFileMap {
+							fileCount += len(files)
+						}
+						errCh <- errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+							"contain %d files but no tables created", fileCount)
+					}
+					return
+				}
+				created++
+				if err := checkTableFiles(t.OldTable, tableFileMap); err != nil {
+					errCh <- err
+					return
+				}
+				select {
+				case <-ctx.Done():
+					errCh <- ctx.Err()
+					return
+				case outCh <- t:
+				}
+			}
+		}
+	}()
+	return outCh
+}
+
+// checkTableFiles checks the table has files, in the table itself or its partitions,
+// unless it's empty.
+func checkTableFiles(table *metautil.Table, tableFileMap map[int64][]*backuppb.File) error {
+	if table.TotalKvs == 0 {
+		return nil
+	}
+	if len(tableFileMap[table.Info.ID]) != 0 {
+		return nil
+	}
+	if partitions := table.Info.GetPartitionInfo(); partitions != nil {
+		for _, def := range partitions.Definitions {
+			if len(tableFileMap[def.ID]) != 0 {
+				return nil
+			}
+		}
+	}
+	return errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+		"contain no files but table %s.%s has %d kvs", table.DB.Name, table.Info.Name, table.TotalKvs)
+}
+
+// schedulersRemover removes the PD schedulers slowing down restoring, e.g. *conn.Mgr.
+type schedulersRemover interface {
+	RemoveSchedulers(ctx context.Context) (pdutil.UndoFunc, error)
+}
+
 // restorePreWork executes some prepare work before restore.
+// The schedulers are paused in online restore only if pauseSchedulersOnline is set.
 // TODO make this function returns a restore post work.
-func restorePreWork(ctx context.Context, client *restore.Client, mgr *conn.Mgr) (pdutil.UndoFunc, error) {
+func restorePreWork(
+	ctx context.Context, client *restore.Client, mgr schedulersRemover, pauseSchedulersOnline bool,
+) (pdutil.UndoFunc, error) {
 	if client.IsOnline() {
-		return pdutil.Nop, nil
+		if !pauseSchedulersOnline {
+			return pdutil.Nop, nil
+		}
+		log.Info("pause the PD schedulers for online restore")
+		return mgr.RemoveSchedulers(ctx)
 	}
 
 	// Switch TiKV cluster to import mode (adjust rocksdb configuration).
@@ -540,20 +2055,23 @@ func restorePreWork(ctx context.Context, client *restore.Client, mgr *conn.Mgr)
 // TODO: aggregate all lifetime manage methods into batcher's context manager field.
 func restorePostWork(
 	ctx context.Context, client *restore.Client, restoreSchedulers pdutil.UndoFunc,
-) {
+) (warnings []string) {
 	if ctx.Err() != nil {
 		log.Warn("context canceled, try shutdown")
 		ctx = context.Background()
 	}
-	if client.IsOnline() {
-		return
-	}
-	if err := client.SwitchToNormalMode(ctx); err != nil {
-		log.Warn("fail to switch to normal mode", zap.Error(err))
+	// The online restore never switches to import mode, but may pause the schedulers.
+	if !client.IsOnline() {
+		if err := client.SwitchToNormalMode(ctx); err != nil {
+			log.Warn("fail to switch to normal mode", zap.Error(err))
+			warnings = append(warnings, fmt.Sprintf("fail to switch to normal mode: %v", err))
+		}
 	}
 	if err := restoreSchedulers(ctx); err != nil {
 		log.Warn("failed to restore PD schedulers", zap.Error(err))
+		warnings = append(warnings, fmt.Sprintf("failed to restore PD schedulers: %v", err))
 	}
+	return warnings
 }
 
 // enableTiDBConfig tweaks some of configs of TiDB to make the restore progress go well.
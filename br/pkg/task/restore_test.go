@@ -3,8 +3,21 @@
 package task
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/brpb"
+	berrors "github.com/pingcap/tidb/br/pkg/errors"
+	"github.com/pingcap/tidb/br/pkg/metautil"
+	"github.com/pingcap/tidb/br/pkg/pdutil"
 	"github.com/pingcap/tidb/br/pkg/restore"
+	"github.com/pingcap/tidb/br/pkg/rtree"
+	"github.com/pingcap/tidb/parser/model"
+	"github.com/spf13/pflag"
 )
 
 type testRestoreSuite struct{}
@@ -19,4 +32,347 @@ func (s *testRestoreSuite) TestRestoreConfigAdjust(c *C) {
 	c.Assert(cfg.Config.SwitchModeInterval, Equals, defaultSwitchInterval)
 	c.Assert(cfg.MergeSmallRegionKeyCount, Equals, restore.DefaultMergeRegionKeyCount)
 	c.Assert(cfg.MergeSmallRegionSizeBytes, Equals, restore.DefaultMergeRegionSizeBytes)
+	c.Assert(cfg.ScatterWaitTimeout, Equals, restore.ScatterWaitUpperInterval)
+
+	// not waiting isn't replaced by the default.
+	cfg = &RestoreConfig{}
+	cfg.ScatterWaitTimeout = noScatterWait
+	cfg.adjustRestoreConfig()
+	c.Assert(cfg.ScatterWaitTimeout, Equals, noScatterWait)
+}
+
+func (s *testRestoreSuite) TestParseKeyRangeAllowlistChecksum(c *C) {
+	parse := func(args ...string) (*RestoreConfig, error) {
+		flags := pflag.NewFlagSet("restore", pflag.ContinueOnError)
+		DefineCommonFlags(flags)
+		DefineRestoreFlags(flags)
+		c.Assert(flags.Parse(args), IsNil)
+		cfg := &RestoreConfig{}
+		return cfg, cfg.ParseFromFlags(flags)
+	}
+	cfg, err := parse()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Checksum, IsTrue)
+
+	// the checksum on by default is skipped for the tables restored partially.
+	cfg, err = parse("--key-range-allowlist=allowlist.txt")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Checksum, IsFalse)
+
+	_, err = parse("--key-range-allowlist=allowlist.txt", "--checksum")
+	c.Assert(err, ErrorMatches, ".*--checksum can't be used with --key-range-allowlist.*")
+	cfg, err = parse("--key-range-allowlist=allowlist.txt", "--checksum=false")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Checksum, IsFalse)
+}
+
+func (s *testRestoreSuite) TestParseIngestDiskUsage(c *C) {
+	parse := func(args ...string) (*RestoreConfig, error) {
+		flags := pflag.NewFlagSet("restore", pflag.ContinueOnError)
+		DefineCommonFlags(flags)
+		DefineRestoreFlags(flags)
+		c.Assert(flags.Parse(args), IsNil)
+		cfg := &RestoreConfig{}
+		return cfg, cfg.ParseFromFlags(flags)
+	}
+	// the ingest isn't throttled by default.
+	cfg, err := parse()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.IngestHighDiskUsage, Equals, float64(0))
+	cfg, err = parse("--ingest-high-disk-usage=0.9", "--ingest-low-disk-usage=0.7")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.IngestHighDiskUsage, Equals, 0.9)
+	c.Assert(cfg.IngestLowDiskUsage, Equals, 0.7)
+
+	_, err = parse("--ingest-high-disk-usage=0.9", "--ingest-low-disk-usage=0.9")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+	c.Assert(err, ErrorMatches, ".*--ingest-low-disk-usage must be less than --ingest-high-disk-usage.*")
+	_, err = parse("--ingest-high-disk-usage=0.5", "--ingest-low-disk-usage=0.7")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+	_, err = parse("--ingest-high-disk-usage=1.5")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+	c.Assert(err, ErrorMatches, ".*--ingest-high-disk-usage must be in \\[0, 1\\].*")
+	_, err = parse("--ingest-low-disk-usage=-0.1")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+}
+
+func (s *testRestoreSuite) TestParseScatterWaitTimeout(c *C) {
+	parse := func(args ...string) time.Duration {
+		flags := pflag.NewFlagSet("restore", pflag.ContinueOnError)
+		DefineCommonFlags(flags)
+		DefineRestoreFlags(flags)
+		c.Assert(flags.Parse(args), IsNil)
+		cfg := &RestoreConfig{}
+		c.Assert(cfg.ParseFromFlags(flags), IsNil)
+		cfg.adjustRestoreConfig()
+		return cfg.ScatterWaitTimeout
+	}
+	c.Assert(parse(), Equals, restore.ScatterWaitUpperInterval)
+	c.Assert(parse("--scatter-wait-timeout=1m"), Equals, time.Minute)
+	// 0 turns waiting off.
+	c.Assert(parse("--scatter-wait-timeout=0") < 0, IsTrue)
+}
+
+func (s *testRestoreSuite) TestParseStreamingMergeFlags(c *C) {
+	parse := func(args ...string) (*RestoreConfig, error) {
+		flags := pflag.NewFlagSet("restore", pflag.ContinueOnError)
+		DefineCommonFlags(flags)
+		DefineRestoreFlags(flags)
+		c.Assert(flags.Parse(args), IsNil)
+		cfg := &RestoreConfig{}
+		return cfg, cfg.ParseFromFlags(flags)
+	}
+	cfg, err := parse("--merge-memory-budget-bytes=1048576", "--cf-group-order=write,default", "--group-skew-ratio=10")
+	c.Assert(err, IsNil)
+	mergeCfg := cfg.mergeConfig()
+	c.Assert(mergeCfg.MemoryBudgetBytes, Equals, uint64(1<<20))
+	c.Assert(mergeCfg.CFGroupOrder, DeepEquals, []string{"write", "default"})
+	c.Assert(mergeCfg.GroupSkewRatio, Equals, float64(10))
+
+	_, err = parse("--cf-group-order=write,lock")
+	c.Assert(err, ErrorMatches, `invalid --cf-group-order: unknown CF "lock".*`)
+	_, err = parse("--cf-group-order=write,write")
+	c.Assert(err, ErrorMatches, `invalid --cf-group-order: duplicate CF "write".*`)
+
+	cfg, err = parse("--cf-ingest-order=default,write")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.CFIngestOrder, DeepEquals, []string{"default", "write"})
+	_, err = parse("--cf-ingest-order=default,lock")
+	c.Assert(err, ErrorMatches, `invalid --cf-ingest-order: unknown CF "lock".*`)
+	_, err = parse("--cf-ingest-order=default,default")
+	c.Assert(err, ErrorMatches, `invalid --cf-ingest-order: duplicate CF "default".*`)
+}
+
+func (s *testRestoreSuite) TestRestoreReport(c *C) {
+	report := newRestoreReport()
+	tables := []*metautil.Table{
+		{DB: &model.DBInfo{Name: model.NewCIStr("test")}, Info: &model.TableInfo{Name: model.NewCIStr("t")}},
+		{DB: &model.DBInfo{Name: model.NewCIStr("test")}, Info: &model.TableInfo{
+			Name: model.NewCIStr("seq"), AutoIncID: 100, Sequence: &model.SequenceInfo{Increment: 1},
+		}},
+	}
+	files := []*backuppb.File{
+		{Name: "1_write.sst", TotalKvs: 10, TotalBytes: 100},
+		{Name: "1_default.sst", TotalKvs: 10, TotalBytes: 200},
+		{Name: "2_write.sst", TotalKvs: 5, TotalBytes: 50},
+	}
+	report.collectFiles(tables, files)
+	c.Assert(report.Tables, Equals, 2)
+	c.Assert(report.Files, Equals, 3)
+	c.Assert(report.TotalKVs, Equals, uint64(25))
+	c.Assert(report.TotalBytes, Equals, uint64(350))
+	report.collectSequences(tables)
+	c.Assert(report.Sequences, DeepEquals, map[string]int64{"test.seq": 100})
+	report.collectRestoredFiles(3)
+	c.Assert(report.RestoredFiles, Equals, int64(3))
+	c.Assert(report.NoNewFiles, IsFalse)
+	// all files are skipped, nothing new is restored.
+	report.collectRestoredFiles(0)
+	c.Assert(report.NoNewFiles, IsTrue)
+	report.collectUnrestoredTables(nil)
+	c.Assert(report.BudgetExhausted, IsFalse)
+	c.Assert(report.UnrestoredTables, IsNil)
+	report.collectUnrestoredTables([]int64{2, 3})
+	c.Assert(report.BudgetExhausted, IsTrue)
+	c.Assert(report.UnrestoredTables, DeepEquals, []int64{2, 3})
+
+	start := time.Now().Add(-time.Second)
+	end := report.recordStage("prepare", start)
+	report.recordStage("restore", end)
+	c.Assert(report.StageDurations, HasLen, 2)
+	c.Assert(report.StageDurations["prepare"] >= time.Second, IsTrue)
+	c.Assert(report.StageDurations["restore"] < time.Second, IsTrue)
+}
+
+func (s *testRestoreSuite) TestCheckCreatedTablesAndFiles(c *C) {
+	tableFileMap := map[int64][]*backuppb.File{
+		1: {{Name: "1_write.sst", TotalKvs: 10, TotalBytes: 100}},
+		// the files of the partition 4 of the table 3.
+		4: {{Name: "4_write.sst", TotalKvs: 10, TotalBytes: 100}},
+	}
+	emptyTable := &metautil.Table{
+		DB:   &model.DBInfo{Name: model.NewCIStr("test")},
+		Info: &model.TableInfo{ID: 2, Name: model.NewCIStr("empty")},
+	}
+	newTable := func(id int64, name string) *metautil.Table {
+		return &metautil.Table{
+			DB:         &model.DBInfo{Name: model.NewCIStr("test")},
+			Info:       &model.TableInfo{ID: id, Name: model.NewCIStr(name)},
+			Crc64Xor:   1,
+			TotalKvs:   10,
+			TotalBytes: 100,
+		}
+	}
+	partitioned := newTable(3, "p")
+	partitioned.Info.Partition = &model.PartitionInfo{Enable: true, Definitions: []model.PartitionDefinition{{ID: 4}}}
+	check := func(tableFileMap map[int64][]*backuppb.File, tables ...*metautil.Table) (int, error) {
+		tableStream := make(chan restore.CreatedTable, len(tables))
+		for _, t := range tables {
+			tableStream <- restore.CreatedTable{Table: t.Info, OldTable: t}
+		}
+		close(tableStream)
+		errCh := make(chan error, 1)
+		created := 0
+		for range checkCreatedTablesAndFiles(context.Background(), tableStream, tableFileMap, errCh) {
+			created++
+		}
+		select {
+		case err := <-errCh:
+			return created, err
+		default:
+			return created, nil
+		}
+	}
+
+	created, err := check(nil)
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, 0)
+	created, err = check(tableFileMap, newTable(1, "t"), emptyTable, partitioned)
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, 3)
+	// Files but no tables created.
+	_, err = check(tableFileMap)
+	c.Assert(err, ErrorMatches, ".*contain 2 files but no tables created.*")
+	// Tables but no files.
+	created, err = check(nil, emptyTable, newTable(1, "t"))
+	c.Assert(err, ErrorMatches, ".*contain no files but table test.t has 10 kvs.*")
+	c.Assert(created, Equals, 1)
+}
+
+func (s *testRestoreSuite) TestLoadRegionTemplate(c *C) {
+	path := filepath.Join(c.MkDir(), "template")
+	c.Assert(os.WriteFile(path, []byte("7462\n\n  7461 \n"), 0o644), IsNil)
+	keys, err := loadRegionTemplate(path)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, [][]byte{[]byte("ta"), []byte("tb")})
+
+	c.Assert(os.WriteFile(path, []byte("7461\nnot-hex\n"), 0o644), IsNil)
+	_, err = loadRegionTemplate(path)
+	c.Assert(err, ErrorMatches, ".*invalid key at line 2 of region template.*")
+}
+
+func (s *testRestoreSuite) TestLoadKeyRangeAllowlist(c *C) {
+	path := filepath.Join(c.MkDir(), "allowlist")
+	// the ranges "tb" to "tc", and from "te" on.
+	c.Assert(os.WriteFile(path, []byte("7462-7463\n\n  7465- \n"), 0o644), IsNil)
+	allowlist, err := loadKeyRangeAllowlist(path)
+	c.Assert(err, IsNil)
+	c.Assert(allowlist, DeepEquals, []rtree.Range{
+		{StartKey: []byte("tb"), EndKey: []byte("tc")},
+		{StartKey: []byte("te"), EndKey: []byte{}},
+	})
+
+	file := func(name, startKey, endKey string) *backuppb.File {
+		return &backuppb.File{
+			Name: name, Cf: "write", StartKey: []byte(startKey), EndKey: []byte(endKey), TotalKvs: 1, TotalBytes: 1,
+		}
+	}
+	files := []*backuppb.File{
+		file("1_write.sst", "ta", "tb"),
+		file("2_write.sst", "tb1", "tb2"),
+		file("3_write.sst", "tc", "td"),
+		file("4_write.sst", "td", "tf"),
+	}
+	ranges, stat, err := restore.MergeFileRangesWithConfig(files, restore.MergeConfig{
+		SplitSizeBytes:    1,
+		SplitKeyCount:     1,
+		KeyRangeAllowlist: allowlist,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(stat.FilteredFiles, Equals, 2)
+	restored := make([]string, 0)
+	for _, rg := range ranges {
+		for _, f := range rg.Files {
+			restored = append(restored, f.Name)
+		}
+	}
+	c.Assert(restored, DeepEquals, []string{"2_write.sst", "4_write.sst"})
+	// the files are cut to the allowed ranges.
+	c.Assert(ranges[len(ranges)-1].StartKey, DeepEquals, []byte("te"))
+	c.Assert(ranges[len(ranges)-1].Files[0].StartKey, DeepEquals, []byte("te"))
+
+	c.Assert(os.WriteFile(path, []byte("7461-7462\n7461\n"), 0o644), IsNil)
+	_, err = loadKeyRangeAllowlist(path)
+	c.Assert(err, ErrorMatches, ".*invalid key range allowlist.*invalid allowed key range 7461,.*")
+}
+
+func (s *testRestoreSuite) TestParseReservedKeyRanges(c *C) {
+	ranges, err := parseKeyRanges([]string{"7461-7462", "74ff-"}, "reserved")
+	c.Assert(err, IsNil)
+	c.Assert(ranges, DeepEquals, []rtree.Range{
+		{StartKey: []byte("ta"), EndKey: []byte("tb")},
+		{StartKey: []byte("t\xff"), EndKey: []byte{}},
+	})
+
+	_, err = parseKeyRanges([]string{"7461"}, "reserved")
+	c.Assert(err, ErrorMatches, ".*invalid reserved key range 7461.*")
+	_, err = parseKeyRanges([]string{"7462-7461"}, "reserved")
+	c.Assert(err, ErrorMatches, ".*the start key should be less than the end key.*")
+	_, err = parseKeyRanges([]string{"7461-not-hex"}, "reserved")
+	c.Assert(err, ErrorMatches, ".*invalid reserved key range 7461-not-hex.*")
+}
+
+func (s *testRestoreSuite) TestDescendingTableIDs(c *C) {
+	db := &model.DBInfo{Name: model.NewCIStr("test")}
+	tables := []*metautil.Table{
+		{DB: db, Info: &model.TableInfo{ID: 1, Name: model.NewCIStr("t1")}},
+		{DB: db, Info: &model.TableInfo{ID: 2, Name: model.NewCIStr("T2"), Partition: &model.PartitionInfo{
+			Definitions: []model.PartitionDefinition{{ID: 3}, {ID: 4}},
+		}}},
+	}
+	ids, err := descendingTableIDs([]string{"test.t2"}, tables)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{2, 3, 4})
+	ids, err = descendingTableIDs([]string{"other.*"}, tables)
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 0)
+	_, err = descendingTableIDs([]string{"test"}, tables)
+	c.Assert(err, ErrorMatches, ".*invalid --descending-tables.*")
+}
+
+type fakeSchedulersRemover struct {
+	removed int
+	resumed int
+	// resumeErr fails resuming the schedulers.
+	resumeErr error
+}
+
+func (r *fakeSchedulersRemover) RemoveSchedulers(context.Context) (pdutil.UndoFunc, error) {
+	r.removed++
+	return func(context.Context) error {
+		r.resumed++
+		return r.resumeErr
+	}, nil
+}
+
+func (s *testRestoreSuite) TestPauseSchedulersOnline(c *C) {
+	client := &restore.Client{}
+	client.EnableOnline()
+
+	// the online restore doesn't pause the schedulers by default.
+	remover := &fakeSchedulersRemover{}
+	undo, err := restorePreWork(context.Background(), client, remover, false)
+	c.Assert(err, IsNil)
+	c.Assert(restorePostWork(context.Background(), client, undo), HasLen, 0)
+	c.Assert(remover.removed, Equals, 0)
+	c.Assert(remover.resumed, Equals, 0)
+
+	undo, err = restorePreWork(context.Background(), client, remover, true)
+	c.Assert(err, IsNil)
+	c.Assert(remover.removed, Equals, 1)
+	c.Assert(remover.resumed, Equals, 0)
+	// the schedulers are resumed even if the restore is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(restorePostWork(ctx, client, undo), HasLen, 0)
+	c.Assert(remover.resumed, Equals, 1)
+
+	// failing to resume is a warning.
+	remover.resumeErr = errors.New("pd is unavailable")
+	undo, err = restorePreWork(context.Background(), client, remover, true)
+	c.Assert(err, IsNil)
+	warnings := restorePostWork(context.Background(), client, undo)
+	c.Assert(warnings, HasLen, 1)
+	c.Assert(warnings[0], Matches, "failed to restore PD schedulers: pd is unavailable")
+	c.Assert(remover.resumed, Equals, 2)
 }
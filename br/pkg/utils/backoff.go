@@ -53,6 +53,33 @@ func NewDownloadSSTBackoffer() Backoffer {
 	return NewBackoffer(downloadSSTRetryTimes, downloadSSTWaitInterval, downloadSSTMaxWaitInterval)
 }
 
+// NewImportSSTBackofferWithRetry is like NewImportSSTBackoffer, but tries at most the attempts
+// and starts backing off from the interval. 0 attempts or interval means the default.
+func NewImportSSTBackofferWithRetry(attempts int, interval time.Duration) Backoffer {
+	return newBackofferOrDefault(attempts, interval, importSSTRetryTimes, importSSTWaitInterval, importSSTMaxWaitInterval)
+}
+
+// NewDownloadSSTBackofferWithRetry is like NewDownloadSSTBackoffer, but tries at most the attempts
+// and starts backing off from the interval. 0 attempts or interval means the default.
+func NewDownloadSSTBackofferWithRetry(attempts int, interval time.Duration) Backoffer {
+	return newBackofferOrDefault(attempts, interval, downloadSSTRetryTimes, downloadSSTWaitInterval, downloadSSTMaxWaitInterval)
+}
+
+func newBackofferOrDefault(
+	attempts int, interval time.Duration, defaultAttempts int, defaultInterval, maxInterval time.Duration,
+) Backoffer {
+	if attempts <= 0 {
+		attempts = defaultAttempts
+	}
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	return NewBackoffer(attempts, interval, maxInterval)
+}
+
 func (bo *importerBackoffer) NextBackoff(err error) time.Duration {
 	if MessageIsRetryableStorageError(err.Error()) {
 		bo.delayTime = 2 * bo.delayTime